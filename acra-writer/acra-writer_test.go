@@ -70,3 +70,30 @@ func TestCreateAcrastruct(t *testing.T) {
 		t.Fatal("Decrypted data not equal to original data")
 	}
 }
+
+func TestValidateAcraStruct(t *testing.T) {
+	keypair, err := keys.New(keys.KEYTYPE_EC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acrastruct, err := acrawriter.CreateAcrastruct([]byte("some data"), keypair.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := base.ValidateAcraStruct(acrastruct); err != nil {
+		t.Fatalf("Expected valid AcraStruct, took %v", err)
+	}
+
+	// plaintext with correct length fields but without TagBegin
+	data := make([]byte, len(acrastruct))
+	copy(data[len(base.TagBegin)+base.KeyBlockLength:], acrastruct[len(base.TagBegin)+base.KeyBlockLength:])
+	if err := base.ValidateAcraStruct(data); err != base.ErrIncorrectAcraStructTagBegin {
+		t.Fatalf("Expected ErrIncorrectAcraStructTagBegin, took %v", err)
+	}
+
+	// TagBegin followed by data which isn't public key
+	copy(data, base.TagBegin)
+	if err := base.ValidateAcraStruct(data); err != base.ErrIncorrectAcraStructPublicKey {
+		t.Fatalf("Expected ErrIncorrectAcraStructPublicKey, took %v", err)
+	}
+}
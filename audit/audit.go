@@ -0,0 +1,267 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit writes tamper-evident audit log of queries, decryptions and poison records. Every entry of log is
+// numbered and chained with HMAC of previous entry calculated with key from keystore, so deletion, reordering or
+// modification of entries is detected by Verify without storing anything except the key.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/acra-censor/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Events written to audit log
+const (
+	EventQuery        = "query"
+	EventDecryption   = "decryption"
+	EventPoisonRecord = "poison_record"
+)
+
+// Verdicts of AcraCensor about queries
+const (
+	VerdictAllowed = "allowed"
+	VerdictBlocked = "blocked"
+)
+
+// Errors returned by Verify
+var (
+	ErrInvalidEntry     = errors.New("entry isn't valid audit log entry")
+	ErrInvalidSequence  = errors.New("unexpected sequence number, entries were deleted or reordered")
+	ErrInvalidHMAC      = errors.New("HMAC doesn't match, entry or previous entries were modified")
+	ErrEmptyAuditLogKey = errors.New("audit log key is empty")
+)
+
+// Entry is one event of audit log
+type Entry struct {
+	Sequence         uint64    `json:"sequence"`
+	Timestamp        time.Time `json:"timestamp"`
+	Event            string    `json:"event"`
+	ClientID         string    `json:"client_id"`
+	QueryFingerprint string    `json:"query_fingerprint,omitempty"`
+	CensorVerdict    string    `json:"censor_verdict,omitempty"`
+	Decrypted        int       `json:"decrypted,omitempty"`
+}
+
+// record is one line of audit log. Entry is kept as raw json to verify HMAC of exactly written bytes
+type record struct {
+	Entry json.RawMessage `json:"entry"`
+	HMAC  []byte          `json:"hmac"`
+}
+
+// VerificationError describes line of audit log where chain of entries is broken
+type VerificationError struct {
+	Line int
+	Err  error
+}
+
+func (err *VerificationError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Err)
+}
+
+// chainState is sequence number and HMAC of last entry in chain
+type chainState struct {
+	sequence uint64
+	hmac     []byte
+}
+
+// next returns HMAC of entry which follows state
+func (state chainState) next(key, entry []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(state.hmac)
+	mac.Write(entry)
+	return mac.Sum(nil)
+}
+
+// Log writes entries chained with HMAC. Log is safe for concurrent use
+type Log struct {
+	lock   sync.Mutex
+	writer io.Writer
+	closer io.Closer
+	key    []byte
+	state  chainState
+}
+
+// NewLog returns Log which writes new chain of entries to writer
+func NewLog(writer io.Writer, key []byte) (*Log, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyAuditLogKey
+	}
+	return &Log{writer: writer, key: key}, nil
+}
+
+// OpenFile opens audit log file and verifies it, new entries continue chain of existing entries. File is created
+// if it doesn't exist. Last line without line break is entry partially written before crash, it's truncated so new
+// entries start from new line. Returns VerificationError if chain of existing entries is broken
+func OpenFile(path string, key []byte) (*Log, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyAuditLogKey
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	state, size, partial, err := verify(file, key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if partial {
+		logrus.WithFields(logrus.Fields{"audit_log_file": path, "sequence": state.sequence}).
+			Warningln("Audit log ends with partially written entry, truncate it")
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &Log{writer: file, closer: file, key: key, state: state}, nil
+}
+
+// Close closes file of log opened with OpenFile
+func (log *Log) Close() error {
+	if log.closer == nil {
+		return nil
+	}
+	return log.closer.Close()
+}
+
+// Write assigns next sequence number to entry, chains it with previous entry and writes it to log
+func (log *Log) Write(entry Entry) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	entry.Sequence = log.state.sequence + 1
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	rawEntry, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	mac := log.state.next(log.key, rawEntry)
+	line, err := json.Marshal(record{Entry: rawEntry, HMAC: mac})
+	if err != nil {
+		return err
+	}
+	if _, err := log.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	log.state = chainState{sequence: entry.Sequence, hmac: mac}
+	return nil
+}
+
+// LogQuery writes fingerprint of query sent by client and verdict of AcraCensor about it
+func (log *Log) LogQuery(clientID []byte, query, verdict string) error {
+	return log.Write(Entry{Event: EventQuery, ClientID: string(clientID), QueryFingerprint: QueryFingerprint(query), CensorVerdict: verdict})
+}
+
+// LogDecryption writes count of AcraStructs decrypted in response to client
+func (log *Log) LogDecryption(clientID []byte, count int) error {
+	return log.Write(Entry{Event: EventDecryption, ClientID: string(clientID), Decrypted: count})
+}
+
+// LogPoisonRecord writes event of poison record found in response to client
+func (log *Log) LogPoisonRecord(clientID []byte) error {
+	return log.Write(Entry{Event: EventPoisonRecord, ClientID: string(clientID)})
+}
+
+// QueryFingerprint returns hex encoded SHA-256 of query with redacted values, so queries which differ only by
+// values have equal fingerprints and values don't leak to log. Queries which can't be parsed are hashed as is
+func QueryFingerprint(query string) string {
+	if _, redactedQuery, _, err := common.HandleRawSQLQuery(query); err == nil {
+		query = redactedQuery
+	}
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:])
+}
+
+// Verify reads all entries of audit log and checks their sequence numbers and HMACs. Returns count of verified
+// entries and VerificationError on first broken entry. Deletion of last entries can't be detected by chain, so
+// count of entries should be compared with count known from previous verification. Last line without line break is
+// entry partially written before crash, it isn't counted and ends log
+func Verify(reader io.Reader, key []byte) (uint64, error) {
+	if len(key) == 0 {
+		return 0, ErrEmptyAuditLogKey
+	}
+	state, _, partial, err := verify(reader, key)
+	if partial {
+		logrus.WithField("sequence", state.sequence).Warningln("Audit log ends with partially written entry, ignore it")
+	}
+	return state.sequence, err
+}
+
+// verify checks chain of entries from reader and returns state of last valid entry and size of complete lines.
+// Returns true if last line has no line break, such line isn't verified
+func verify(reader io.Reader, key []byte) (chainState, int64, bool, error) {
+	state := chainState{}
+	bufReader := bufio.NewReader(reader)
+	var size int64
+	line := 0
+	for {
+		data, err := bufReader.ReadBytes('\n')
+		if err == io.EOF {
+			return state, size, len(data) > 0, nil
+		}
+		if err != nil {
+			return state, size, false, err
+		}
+		line++
+		var rec record
+		var entry Entry
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return state, size, false, &VerificationError{Line: line, Err: ErrInvalidEntry}
+		}
+		if err := json.Unmarshal(rec.Entry, &entry); err != nil {
+			return state, size, false, &VerificationError{Line: line, Err: ErrInvalidEntry}
+		}
+		if entry.Sequence != state.sequence+1 {
+			return state, size, false, &VerificationError{Line: line, Err: ErrInvalidSequence}
+		}
+		mac := state.next(key, rec.Entry)
+		if !hmac.Equal(mac, rec.HMAC) {
+			return state, size, false, &VerificationError{Line: line, Err: ErrInvalidHMAC}
+		}
+		state = chainState{sequence: entry.Sequence, hmac: mac}
+		size += int64(len(data))
+	}
+}
+
+// PoisonCallback writes event of detected poison record to audit log
+type PoisonCallback struct {
+	log      *Log
+	clientID []byte
+}
+
+// NewPoisonCallback returns callback which writes poison records found in responses to client with clientID
+func NewPoisonCallback(log *Log, clientID []byte) *PoisonCallback {
+	return &PoisonCallback{log: log, clientID: clientID}
+}
+
+// Call writes event of poison record to audit log
+func (callback *PoisonCallback) Call() error {
+	return callback.log.LogPoisonRecord(callback.clientID)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestEntries(t *testing.T, log *Log) {
+	clientID := []byte("client")
+	if err := log.LogQuery(clientID, "select data from test where id=1", VerdictAllowed); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.LogDecryption(clientID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPoisonCallback(log, clientID).Call(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key := []byte("audit log key")
+	output := &bytes.Buffer{}
+	log, err := NewLog(output, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestEntries(t, log)
+	lines := strings.SplitAfter(output.String(), "\n")[:3]
+
+	if count, err := Verify(strings.NewReader(strings.Join(lines, "")), key); err != nil || count != 3 {
+		t.Fatalf("Expected 3 verified entries, took %v, %v", count, err)
+	}
+	if count, err := Verify(strings.NewReader(lines[0]+lines[1]+lines[2][:10]), key); err != nil || count != 2 {
+		t.Fatalf("Expected 2 verified entries before partially written entry, took %v, %v", count, err)
+	}
+	_, err = Verify(strings.NewReader(strings.Join(lines, "")), []byte("other key"))
+	if verificationErr, ok := err.(*VerificationError); !ok || verificationErr.Err != ErrInvalidHMAC {
+		t.Fatalf("Expected ErrInvalidHMAC with other key, took %v", err)
+	}
+
+	testcases := []struct {
+		name  string
+		lines []string
+		line  int
+		err   error
+	}{
+		{"deleted first entry", lines[1:], 1, ErrInvalidSequence},
+		{"deleted middle entry", []string{lines[0], lines[2]}, 2, ErrInvalidSequence},
+		{"reordered entries", []string{lines[1], lines[0], lines[2]}, 1, ErrInvalidSequence},
+		{"edited entry", []string{lines[0], strings.Replace(lines[1], `"decrypted":3`, `"decrypted":1`, 1), lines[2]}, 2, ErrInvalidHMAC},
+		{"renumbered entry", []string{lines[0], strings.Replace(lines[2], `"sequence":3`, `"sequence":2`, 1)}, 2, ErrInvalidHMAC},
+		{"corrupted entry", []string{lines[0], "{not json\n"}, 2, ErrInvalidEntry},
+	}
+	for _, tcase := range testcases {
+		_, err := Verify(strings.NewReader(strings.Join(tcase.lines, "")), key)
+		verificationErr, ok := err.(*VerificationError)
+		if !ok || verificationErr.Line != tcase.line || verificationErr.Err != tcase.err {
+			t.Fatalf("[%s] Expected error %v on line %d, took %v", tcase.name, tcase.err, tcase.line, err)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	key := []byte("audit log key")
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		log, err := OpenFile(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestEntries(t, log)
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := Verify(bytes.NewReader(data), key); err != nil || count != 6 {
+		t.Fatalf("Expected 6 verified entries after reopening, took %v, %v", count, err)
+	}
+
+	// entry partially written before crash is truncated
+	if err := ioutil.WriteFile(path, append(append([]byte{}, data...), data[:10]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	log, err := OpenFile(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestEntries(t, log)
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := Verify(bytes.NewReader(data), key); err != nil || count != 9 {
+		t.Fatalf("Expected 9 verified entries after truncation of partial entry, took %v, %v", count, err)
+	}
+
+	if err := ioutil.WriteFile(path, data[bytes.IndexByte(data, '\n')+1:], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(path, key); err == nil {
+		t.Fatal("Expected error on opening log with broken chain")
+	}
+}
@@ -52,6 +52,8 @@ var (
 func main() {
 	outputDir := flag.String("keys_output_dir", keystore.DefaultKeyDirShort, "Folder where will be saved generated zone keys")
 	fsKeystore := flag.Bool("fs_keystore_enable", true, "Use filesystem key store")
+	cmd.RegisterKeyStoreCmdParameters()
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	logging.SetLogLevel(logging.LogVerbose)
 
@@ -63,24 +65,28 @@ func main() {
 	//LoadFromConfig(DEFAULT_CONFIG_PATH)
 	//iniflags.Parse()
 
-	output, err := filepath.Abs(*outputDir)
-	if err != nil {
-		log.WithError(err).Errorln("can't get absolute path for output dir")
-		os.Exit(1)
+	output := *outputDir
+	// paths of remote keystores are relative to their root
+	if cmd.IsFilesystemKeyStore() {
+		output, err = filepath.Abs(*outputDir)
+		if err != nil {
+			log.WithError(err).Errorln("can't get absolute path for output dir")
+			os.Exit(1)
+		}
 	}
 	var keyStore keystore.KeyStore
 	if *fsKeystore {
-		masterKey, err := keystore.GetMasterKeyFromEnvironment()
+		scellEncryptor, err := cmd.GetKeyEncryptor()
 		if err != nil {
-			log.WithError(err).Errorln("can't load master key")
+			log.WithError(err).Errorln("can't initialize key encryptor")
 			os.Exit(1)
 		}
-		scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
+		keyStorage, err := cmd.GetKeyStoreStorage()
 		if err != nil {
-			log.WithError(err).Errorln("can't init scell encryptor")
+			log.WithError(err).Errorln("can't initialize storage of keys")
 			os.Exit(1)
 		}
-		keyStore, err = filesystem.NewFilesystemKeyStore(output, scellEncryptor)
+		keyStore, err = filesystem.NewFilesystemKeyStoreWithStorage(output, output, keyStorage, scellEncryptor, keystore.InfiniteCacheSize)
 		if err != nil {
 			log.WithError(err).Errorln("can't create key store")
 			os.Exit(1)
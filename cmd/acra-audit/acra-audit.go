@@ -0,0 +1,108 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package main is entry point for acra-audit. Acra-audit provides console utility to verify integrity of audit log
+// written by AcraServer: `acra-audit verify --audit_log_file=<path>` checks that no entries were deleted, reordered
+// or modified.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cossacklabs/acra/audit"
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants used by AcraAudit
+var (
+	// DefaultConfigPath relative path to config which will be parsed as default
+	DefaultConfigPath = utils.GetConfigPathByName("acra-audit")
+	ServiceName       = "acra-audit"
+)
+
+// verifyCommand is the only command of acra-audit
+const verifyCommand = "verify"
+
+func main() {
+	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which the keys will be loaded")
+	auditLogFile := flag.String("audit_log_file", "", "Path to audit log written by AcraServer")
+	minEntries := flag.Uint64("min_entries", 0, "Minimal count of entries expected in audit log, detects deletion of last entries. 0 - don't check")
+	cmd.RegisterKeyEncryptorCmdParameters()
+
+	logging.SetLogLevel(logging.LogVerbose)
+
+	// command precedes flags, remove it to parse flags as usual
+	command := ""
+	if len(os.Args) > 1 && os.Args[1] == verifyCommand {
+		command = verifyCommand
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	err := cmd.Parse(DefaultConfigPath, ServiceName)
+	if err != nil {
+		log.WithError(err).Errorln("Can't parse args")
+		os.Exit(1)
+	}
+	if command != verifyCommand {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags]\n", filepath.Base(os.Args[0]), verifyCommand)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *auditLogFile == "" {
+		log.Errorln("audit_log_file is required")
+		os.Exit(1)
+	}
+
+	scellEncryptor, err := cmd.GetKeyEncryptor()
+	if err != nil {
+		log.WithError(err).Errorln("Can't initialize key encryptor")
+		os.Exit(1)
+	}
+	keyStore, err := filesystem.NewFilesystemKeyStore(*keysDir, scellEncryptor)
+	if err != nil {
+		log.WithError(err).Errorln("Can't initialize key store")
+		os.Exit(1)
+	}
+	key, err := keyStore.ReadAuditLogKey()
+	if err != nil {
+		log.WithError(err).Errorln("Can't load audit log key")
+		os.Exit(1)
+	}
+
+	file, err := os.Open(*auditLogFile)
+	if err != nil {
+		log.WithError(err).Errorln("Can't open audit log")
+		os.Exit(1)
+	}
+	defer file.Close()
+	count, err := audit.Verify(file, key)
+	if err != nil {
+		log.WithError(err).WithField("verified_entries", count).Errorln("Audit log is corrupted")
+		os.Exit(1)
+	}
+	if count < *minEntries {
+		log.WithFields(log.Fields{"verified_entries": count, "min_entries": *minEntries}).Errorln("Audit log has less entries than expected, last entries were deleted")
+		os.Exit(1)
+	}
+	log.WithField("verified_entries", count).Infoln("Audit log is valid")
+}
@@ -177,6 +177,7 @@ func main() {
 	filePath := flag.String("file", cmd.DEFAULT_ACRA_AUTH_PATH, "Auth file")
 	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which will be loaded keys")
 	debug := flag.Bool("d", false, "Turn on debug logging")
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	if err := cmd.Parse(DEFAULT_CONFIG_PATH, SERVICE_NAME); err != nil {
 		log.WithError(err).Errorln("can't parse cmd arguments")
@@ -191,14 +192,9 @@ func main() {
 		logging.SetLogLevel(logging.LogVerbose)
 	}
 
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	encryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("can't load master key")
-		os.Exit(1)
-	}
-	encryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("can't initialize scell encryptor")
+		log.WithError(err).Errorln("can't initialize key encryptor")
 		os.Exit(1)
 	}
 	keyStore, err := filesystem.NewFilesystemKeyStore(*keysDir, encryptor)
@@ -39,6 +39,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/cmd/acra-connector/connector-mode"
@@ -78,6 +79,22 @@ func handleApiConnection(config *Config, connection net.Conn) {
 	timer.ObserveDuration()
 }
 
+// checkUpstreamConnection connects to AcraServer or AcraTranslator and completes handshake of transport encryption
+func checkUpstreamConnection(config *Config) error {
+	connection, err := network.Dial(config.OutgoingConnectionString)
+	if err != nil {
+		return err
+	}
+	// wrappers may not limit time of handshake
+	connection.SetDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+	wrappedConnection, err := config.ConnectionWrapper.WrapClient(context.Background(), config.ClientID, connection)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	return wrappedConnection.Close()
+}
+
 func handleConnection(config *Config, connection net.Conn) {
 	options := []trace.StartOption{trace.WithSpanKind(trace.SpanKindClient)}
 	ctx := logging.SetTraceStatus(context.Background(), cmd.IsTraceToLogOn())
@@ -234,6 +251,7 @@ func main() {
 	acraServerConnectionString := flag.String("acraserver_connection_string", "", "Connection string to AcraServer like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	acraServerAPIConnectionString := flag.String("acraserver_api_connection_string", "", "Connection string to Acra's API like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	prometheusAddress := flag.String("incoming_connection_prometheus_metrics_string", "", "URL which will be used to expose Prometheus metrics (use <URL>/metrics address to pull metrics)")
+	healthAddress := flag.String("incoming_connection_health_string", "", "URL which will be used to expose health checks (use <URL>/health/live and <URL>/health/ready addresses for liveness and readiness probes)")
 
 	connectorModeString := flag.String("mode", "AcraServer", "Expected mode of connection. Possible values are: AcraServer or AcraTranslator. Corresponded connection host/port/string/session_id will be used.")
 	acraTranslatorHost := flag.String("acratranslator_connection_host", cmd.DEFAULT_ACRATRANSLATOR_GRPC_HOST, "IP or domain to AcraTranslator daemon")
@@ -243,6 +261,8 @@ func main() {
 
 	cmd.RegisterTracingCmdParameters()
 	cmd.RegisterJaegerCmdParameters()
+	cmd.RegisterKeyStoreCmdParameters()
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
 	debug := flag.Bool("d", false, "Log everything to stderr")
@@ -328,17 +348,18 @@ func main() {
 
 	// --------- keystore  -----------
 	log.Infof("Initializing keystore...")
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("can't load master key")
+		log.WithError(err).Errorln("can't initialize key encryptor")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
+	keyStorage, err := cmd.GetKeyStoreStorage()
 	if err != nil {
-		log.WithError(err).Errorln("can't init scell encryptor")
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+			Errorln("Can't initialize storage of keys")
 		os.Exit(1)
 	}
-	keyStore, err := filesystem.NewConnectorFileSystemKeyStore(*keysDir, []byte(*clientID), scellEncryptor, connectorMode)
+	keyStore, err := filesystem.NewConnectorKeyStoreWithStorage(*keysDir, []byte(*clientID), keyStorage, scellEncryptor, connectorMode)
 	if err != nil {
 		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
 			Errorln("Can't initialize keystore")
@@ -487,6 +508,27 @@ func main() {
 		})
 	}
 
+	if *healthAddress != "" {
+		healthHandler := cmd.NewHealthHandler()
+		healthHandler.AddReadinessCheck("keystore", func() error {
+			_, err := keyStore.GetPrivateKey(config.ClientID)
+			return err
+		})
+		healthHandler.AddReadinessCheck("upstream", func() error {
+			return checkUpstreamConnection(config)
+		})
+		_, healthHTTPServer, err := cmd.RunHealthHTTPHandler(*healthAddress, healthHandler)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartService).
+				Errorln("Can't run health check handler")
+			os.Exit(1)
+		}
+		sigHandler.AddCallback(func() {
+			log.Infoln("Stop health check http handler")
+			healthHTTPServer.Close()
+		})
+	}
+
 	cmd.SetupTracing(ServiceName)
 
 	for {
@@ -23,6 +23,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/cossacklabs/acra/cmd"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/keystore/filesystem"
@@ -31,6 +32,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 // Constants used by AcraKeymaker
@@ -50,6 +53,16 @@ func main() {
 	outputDir := flag.String("keys_output_dir", keystore.DefaultKeyDirShort, "Folder where will be saved keys")
 	outputPublicKey := flag.String("keys_public_output_dir", keystore.DefaultKeyDirShort, "Folder where will be saved public key")
 	masterKey := flag.String("generate_master_key", "", "Generate new random master key and save to file")
+	retirePreviousKeys := flag.Bool("retire_previous_keys", false, "Remove previous versions of storage private key of client_id or private key of zone_id, kept after key rotation to decrypt not re-encrypted AcraStructs")
+	hmacKey := flag.Bool("generate_hmac_key", false, "Create symmetric key of client_id or zone_id used to calculate HMAC of searchable encrypted data")
+	tokenizationKey := flag.Bool("generate_tokenization_key", false, "Create symmetric key of client_id or zone_id used to tokenize data")
+	zoneID := flag.String("zone_id", "", "Zone ID which previous versions of private key will be removed with retire_previous_keys or which key will be created with generate_hmac_key and generate_tokenization_key")
+	rotateMasterKey := flag.Bool("rotate_master_key", false, "Re-encrypt all keys of keys_output_dir from master key in "+keystore.AcraMasterKeyVarName+" to new master key in "+cmd.NewMasterKeyVarName)
+	masterKeyBackupDir := flag.String("master_key_backup_dir", "", "Folder where keys encrypted with old master key will be saved on rotation (default: keys_output_dir with timestamp suffix)")
+	exportKeys := flag.String("export_keys", "", "Export all keys of keys_output_dir and keys_public_output_dir to file as single archive encrypted with passphrase from "+cmd.KeysBackupPassphraseVarName)
+	importKeys := flag.String("import_keys", "", "Restore keys to keys_output_dir and keys_public_output_dir from file created with export_keys and encrypted with passphrase from "+cmd.KeysBackupPassphraseVarName)
+	cmd.RegisterKeyStoreCmdParameters()
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	logging.SetLogLevel(logging.LogVerbose)
 
@@ -66,36 +79,121 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		// store master key encrypted with KMS key if it's passed to services in that form
+		newKey, err = cmd.WrapMasterKey(newKey)
+		if err != nil {
+			log.WithError(err).Errorln("Can't encrypt master key")
+			os.Exit(1)
+		}
 		if err := ioutil.WriteFile(*masterKey, newKey, 0600); err != nil {
 			panic(err)
 		}
 		os.Exit(0)
 	}
 
-	symmetricKey, err := keystore.GetMasterKeyFromEnvironment()
+	if *exportKeys != "" || *importKeys != "" {
+		if !cmd.IsFilesystemKeyStore() {
+			log.Errorln("Configuration error: export and import of keys are supported only for filesystem keystore")
+			os.Exit(1)
+		}
+		passphrase, err := cmd.GetKeysBackupPassphrase()
+		if err != nil {
+			log.WithError(err).Errorln("Can't load passphrase of keys backup")
+			os.Exit(1)
+		}
+		if *exportKeys != "" {
+			archive, err := filesystem.ExportKeys(*outputDir, *outputPublicKey)
+			if err != nil {
+				log.WithError(err).Errorln("Can't export keys")
+				os.Exit(1)
+			}
+			encrypted, err := cmd.EncryptKeysBackup(archive, passphrase)
+			if err != nil {
+				log.WithError(err).Errorln("Can't encrypt keys backup")
+				os.Exit(1)
+			}
+			if err := ioutil.WriteFile(*exportKeys, encrypted, 0600); err != nil {
+				log.WithError(err).Errorln("Can't write keys backup")
+				os.Exit(1)
+			}
+			log.Infof("Keys exported to %s, private keys in it are still encrypted with current master key", *exportKeys)
+			os.Exit(0)
+		}
+		encrypted, err := ioutil.ReadFile(*importKeys)
+		if err != nil {
+			log.WithError(err).Errorln("Can't read keys backup")
+			os.Exit(1)
+		}
+		archive, err := cmd.DecryptKeysBackup(encrypted, passphrase)
+		if err != nil {
+			log.WithError(err).Errorln("Can't decrypt keys backup")
+			os.Exit(1)
+		}
+		restored, err := filesystem.ImportKeys(archive, *outputDir, *outputPublicKey)
+		if err != nil {
+			log.WithError(err).Errorln("Can't import keys, nothing was restored")
+			os.Exit(1)
+		}
+		log.Infof("Restored %v files of keys from %s", len(restored), *importKeys)
+		os.Exit(0)
+	}
+
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
 		if err == keystore.ErrEmptyMasterKey {
 			log.Infof("You must pass master key via %v environment variable", keystore.AcraMasterKeyVarName)
 			os.Exit(1)
 		}
-		log.WithError(err).Errorln("Can't load master key")
+		log.WithError(err).Errorln("Can't initialize key encryptor")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(symmetricKey)
+	if *rotateMasterKey {
+		if !cmd.IsFilesystemKeyStore() {
+			log.Errorln("Configuration error: master key rotation is supported only for filesystem keystore")
+			os.Exit(1)
+		}
+		newEncryptor, err := cmd.GetNewKeyEncryptor()
+		if err != nil {
+			log.WithError(err).Errorf("Can't load new master key from %v", cmd.NewMasterKeyVarName)
+			os.Exit(1)
+		}
+		backupDir := *masterKeyBackupDir
+		if backupDir == "" {
+			backupDir = fmt.Sprintf("%s.backup-%s", filepath.Clean(*outputDir), time.Now().Format("20060102150405"))
+		}
+		rotated, err := filesystem.RotateMasterKey(*outputDir, backupDir, scellEncryptor, newEncryptor)
+		if err != nil {
+			log.WithError(err).Errorln("Can't rotate master key")
+			os.Exit(1)
+		}
+		log.Infof("Re-encrypted %v keys with new master key, pass it via %v from now on", len(rotated), keystore.AcraMasterKeyVarName)
+		os.Exit(0)
+	}
+	keyStorage, err := cmd.GetKeyStoreStorage()
 	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
+		log.WithError(err).Errorln("Can't initialize storage of keys")
 		os.Exit(1)
 	}
-	var store keystore.KeyStore
-	if *outputPublicKey != *outputDir {
-		store, err = filesystem.NewFilesystemKeyStoreTwoPath(*outputDir, *outputPublicKey, scellEncryptor)
-	} else {
-		store, err = filesystem.NewFilesystemKeyStore(*outputDir, scellEncryptor)
-	}
+	store, err := filesystem.NewFilesystemKeyStoreWithStorage(*outputDir, *outputPublicKey, keyStorage, scellEncryptor, keystore.InfiniteCacheSize)
 	if err != nil {
 		panic(err)
 	}
 
+	if *retirePreviousKeys {
+		var retired int
+		if *zoneID != "" {
+			retired, err = store.RetireZoneKeyVersions([]byte(*zoneID))
+		} else {
+			retired, err = store.RetireServerDecryptionKeyVersions([]byte(*clientID))
+		}
+		if err != nil {
+			log.WithError(err).Errorln("Can't remove previous versions of private key")
+			os.Exit(1)
+		}
+		log.Infof("Removed %v previous versions of private key", retired)
+		os.Exit(0)
+	}
+
 	if *acraConnector {
 		err = store.GenerateConnectorKeys([]byte(*clientID))
 		if err != nil {
@@ -116,6 +214,24 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+	} else if *hmacKey {
+		id := *clientID
+		if *zoneID != "" {
+			id = *zoneID
+		}
+		err = store.GenerateHMACSecretKey([]byte(id))
+		if err != nil {
+			panic(err)
+		}
+	} else if *tokenizationKey {
+		id := *clientID
+		if *zoneID != "" {
+			id = *zoneID
+		}
+		err = store.GenerateTokenizationKey([]byte(id))
+		if err != nil {
+			panic(err)
+		}
 	} else if *basicauth {
 		_, err = store.GetAuthKey(true)
 		if err != nil {
@@ -141,5 +257,15 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+
+		err = store.GenerateHMACSecretKey([]byte(*clientID))
+		if err != nil {
+			panic(err)
+		}
+
+		err = store.GenerateTokenizationKey([]byte(*clientID))
+		if err != nil {
+			panic(err)
+		}
 	}
 }
@@ -48,6 +48,7 @@ var (
 func main() {
 	keysDir := flag.String("keys_dir", keystore.DefaultKeyDirShort, "Folder from which will be loaded keys")
 	dataLength := flag.Int("data_length", poison.UseDefaultDataLength, fmt.Sprintf("Length of random data for data block in acrastruct. -1 is random in range 1..%v", poison.DefaultDataLength))
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	logging.SetLogLevel(logging.LogDiscard)
 
@@ -57,14 +58,9 @@ func main() {
 		os.Exit(1)
 	}
 
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("can't load master key")
-		os.Exit(1)
-	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("can't init scell encryptor")
+		log.WithError(err).Errorln("can't initialize key encryptor")
 		os.Exit(1)
 	}
 	store, err := filesystem.NewFilesystemKeyStore(*keysDir, scellEncryptor)
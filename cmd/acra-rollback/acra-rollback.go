@@ -160,6 +160,7 @@ func main() {
 	escapeFormat := flag.Bool("escape", false, "Escape bytea format")
 	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
 	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	logging.SetLogLevel(logging.LogVerbose)
 
@@ -216,14 +217,9 @@ func main() {
 		log.Errorln("Output_file missing or execute flag")
 		os.Exit(1)
 	}
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("Can't load master key")
-		os.Exit(1)
-	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
+		log.WithError(err).Errorln("Can't initialize key encryptor")
 		os.Exit(1)
 	}
 	keystorage, err := filesystem.NewFilesystemKeyStore(absKeysDir, scellEncryptor)
@@ -271,6 +267,7 @@ func main() {
 
 	var data, zone []byte
 	var privateKey *keys.PrivateKey
+	var getPrivateKeys func() ([]*keys.PrivateKey, error)
 
 	for i := 0; rows.Next(); i++ {
 		if *withZone {
@@ -283,6 +280,9 @@ func main() {
 				log.WithError(err).Errorf("Can't get zone private key for row with number %v", i)
 				continue
 			}
+			getPrivateKeys = func() ([]*keys.PrivateKey, error) {
+				return keystorage.GetZonePrivateKeys(zone)
+			}
 		} else {
 			err = rows.Scan(&data)
 			if err != nil {
@@ -293,8 +293,11 @@ func main() {
 				log.WithError(err).Errorf("Can't get private key for row with number %v", i)
 				continue
 			}
+			getPrivateKeys = func() ([]*keys.PrivateKey, error) {
+				return keystorage.GetServerDecryptionPrivateKeys([]byte(*clientID))
+			}
 		}
-		decrypted, err := base.DecryptAcrastruct(data, privateKey, zone)
+		decrypted, err := base.DecryptAcrastructWithPreviousKeys(data, privateKey, getPrivateKeys, zone)
 		if err != nil {
 			log.WithError(err).Errorf("Can't decrypt acrastruct in row with number %v", i)
 			continue
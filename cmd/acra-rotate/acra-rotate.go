@@ -46,14 +46,9 @@ func initKeyStore(dirPath string) (keystore.KeyStore, error) {
 		log.WithError(err).Errorln("Can't get absolute path for keys_dir")
 		os.Exit(1)
 	}
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("Can't load master key")
-		return nil, err
-	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
-	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
+		log.WithError(err).Errorln("Can't initialize key encryptor")
 		return nil, err
 	}
 	keystorage, err := filesystem.NewFilesystemKeyStore(absKeysDir, scellEncryptor)
@@ -74,6 +69,7 @@ func main() {
 	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
 	_ = flag.Bool("postgresql_enable", false, "Handle Postgresql connections")
 	dryRun := flag.Bool("dry-run", false, "perform rotation without saving rotated AcraStructs and keys")
+	cmd.RegisterKeyEncryptorCmdParameters()
 	logging.SetLogLevel(logging.LogVerbose)
 
 	err := cmd.Parse(DefaultConfigPath, ServiceName)
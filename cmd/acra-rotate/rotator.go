@@ -58,7 +58,10 @@ func (rotator *keyRotator) rotateAcrastruct(zoneID, acrastruct []byte) ([]byte,
 		return nil, err
 	}
 	defer utils.FillSlice(0, privateKey.Value)
-	decrypted, err := base.DecryptAcrastruct(acrastruct, privateKey, zoneID)
+	getPrivateKeys := func() ([]*keys.PrivateKey, error) {
+		return rotator.keystore.GetZonePrivateKeys(zoneID)
+	}
+	decrypted, err := base.DecryptAcrastructWithPreviousKeys(acrastruct, privateKey, getPrivateKeys, zoneID)
 	if err != nil {
 		logger.WithField("acrastruct", hex.EncodeToString(acrastruct)).WithError(err).Errorln("Can't decrypt AcraStruct")
 		return nil, err
@@ -31,16 +31,23 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/decryptor/mysql"
+	pg "github.com/cossacklabs/acra/decryptor/postgresql"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/keystore/filesystem"
 	"github.com/cossacklabs/acra/logging"
@@ -68,6 +75,12 @@ const (
 	DESCRIPTOR_ACRA                 = 3
 	DESCRIPTOR_API                  = 4
 	ServiceName                     = "acra-server"
+	// PgPoolPasswordEnvName is environment variable with password of user used by pool of connections to PostgreSQL
+	PgPoolPasswordEnvName = "ACRA_PGSQL_POOL_PASSWORD"
+	// DBHealthCheckPasswordEnvName is environment variable with password of user used by health checks of databases
+	DBHealthCheckPasswordEnvName = "ACRA_DB_HEALTH_CHECK_PASSWORD"
+	// pgHealthCheckDatabase is database which exists in every PostgreSQL cluster and is used by health checks
+	pgHealthCheckDatabase = "postgres"
 )
 
 // DEFAULT_CONFIG_PATH relative path to config which will be parsed as default
@@ -83,8 +96,13 @@ func main() {
 
 	dbHost := flag.String("db_host", "", "Host to db")
 	dbPort := flag.Int("db_port", 5432, "Port to db")
+	dbFailoverBackends := flag.String("db_failover_backends", "", "Comma separated list of host:port of databases used in order when <db_host> and previous databases of list refuse connections")
+	dbReplicaBackends := flag.String("db_replica_backends", "", "Comma separated list of host:port of read replicas which execute autocommit SELECT queries without function calls of sessions that use pool of connections to Postgresql")
+	dbHealthCheckInterval := flag.Int("db_health_check_interval", 5, "Interval in seconds of checking availability of databases when failover or replica backends are used. 0 - turn off checks")
+	dbHealthCheckUser := flag.String("db_health_check_user", "", "User used by health checks to verify that failover databases aren't read-only replicas and replicas accept sessions. Password is taken from "+DBHealthCheckPasswordEnvName+" environment variable. <pgsql_pool_user> is used if empty")
 
 	prometheusAddress := flag.String("incoming_connection_prometheus_metrics_string", "", "URL (tcp://host:port) which will be used to expose Prometheus metrics (<URL>/metrics address to pull metrics)")
+	healthAddress := flag.String("incoming_connection_health_string", "", "URL (tcp://host:port) which will be used to expose health checks (<URL>/health/live and <URL>/health/ready addresses for liveness and readiness probes)")
 
 	host := flag.String("incoming_connection_host", cmd.DEFAULT_ACRA_HOST, "Host for AcraServer")
 	port := flag.Int("incoming_connection_port", cmd.DEFAULT_ACRASERVER_PORT, "Port for AcraServer")
@@ -95,6 +113,13 @@ func main() {
 
 	pgHexFormat := flag.Bool("pgsql_hex_bytea", false, "Hex format for Postgresql bytea data (default)")
 	pgEscapeFormat := flag.Bool("pgsql_escape_bytea", false, "Escape format for Postgresql bytea data")
+	pgCancelRewriteKeys := flag.Bool("pgsql_cancel_request_rewrite_keys", false, "Send to Postgresql clients keys of sessions generated by AcraServer instead of database's keys. Cancel requests with these keys are routed to database which started session")
+	pgPoolSize := flag.Int("pgsql_pool_size", 0, "Maximum count of connections to Postgresql shared by clients' sessions per transaction. 0 - every session opens own connection")
+	pgPoolUser := flag.String("pgsql_pool_user", "", "User used by pool to connect to Postgresql. Password is taken from "+PgPoolPasswordEnvName+" environment variable")
+	pgPoolDatabase := flag.String("pgsql_pool_database", "", "Database used by connections of pool (default is name of user)")
+	pgPoolWaitTimeout := flag.Int("pgsql_pool_wait_timeout", 30, "Time in seconds that session waits for free connection of pool")
+	pgPoolResetQuery := flag.String("pgsql_pool_reset_query", pg.DefaultPoolResetQuery, "Query executed on connection of pool before it's returned from session that changed session state")
+	pgPoolAuthFile := flag.String("pgsql_pool_auth_file", "", "Path to yaml file with '<user>: <password or md5 hash>' pairs of clients allowed to use pool of connections. Without it clients should be authenticated by Secure Session or TLS certificate (<tls_auth>=4)")
 
 	secureSessionID := flag.String("securesession_id", "acra_server", "Id that will be sent in secure session")
 
@@ -108,6 +133,8 @@ func main() {
 	stopOnPoison := flag.Bool("poison_shutdown_enable", false, "On detecting poison record: log about poison record detection, stop and shutdown")
 	scriptOnPoison := flag.String("poison_run_script_file", "", "On detecting poison record: log about poison record detection, execute script, return decrypted data")
 
+	auditLogFile := flag.String("audit_log_file", "", "Path to file where AcraServer appends tamper-evident audit log of queries, decryptions and poison records. Empty - audit log is turned off")
+
 	withZone := flag.Bool("zonemode_enable", false, "Turn on zone mode")
 	enableHTTPAPI := flag.Bool("http_api_enable", false, "Enable HTTP API")
 
@@ -117,8 +144,14 @@ func main() {
 	tlsCA := flag.String("tls_ca", "", "Path to root certificate which will be used with system root certificates to validate Postgresql's and AcraConnector's certificate")
 	tlsDbSNI := flag.String("tls_db_sni", "", "Expected Server Name (SNI) from Postgresql")
 	tlsAuthType := flag.Int("tls_auth", int(tls.RequireAndVerifyClientCert), "Set authentication mode that will be used in TLS connection with Postgresql. Values in range 0-4 that set auth type (https://golang.org/pkg/crypto/tls/#ClientAuthType). Default is tls.RequireAndVerifyClientCert")
+	tlsClientIDSource := flag.String("tls_client_id_source", "", "Take client ID from verified AcraConnector's/client's certificate instead of <client_id> in TLS mode: 'cn' - subject's common name, 'san' - first subject alternative name, 'fingerprint' - map certificate's SHA256 fingerprint to client ID with <tls_client_id_fingerprint_mapping_file>")
+	tlsClientIDMappingFile := flag.String("tls_client_id_fingerprint_mapping_file", "", "Path to yaml file with '<SHA256 fingerprint of certificate>: <client ID>' pairs used with <tls_client_id_source>=fingerprint")
 	noEncryptionTransport := flag.Bool("acraconnector_transport_encryption_disable", false, "Use raw transport (tcp/unix socket) between AcraServer and AcraConnector/client (don't use this flag if you not connect to database with ssl/tls")
 	clientID := flag.String("client_id", "", "Expected client ID of AcraConnector in mode without encryption")
+	clientMaxSessions := flag.Int("client_max_sessions", 0, "Maximum count of concurrent sessions of every client ID. 0 - no limits")
+	clientQueriesPerSecond := flag.Int("client_queries_per_second", 0, "Maximum count of queries per second sent by every client ID, excess queries are rejected with error. 0 - no limits")
+	clientDecryptedBytesPerMinute := flag.Int("client_decrypted_bytes_per_minute", 0, "Maximum count of bytes decrypted per minute for every client ID, responses with excess decrypted data are replaced with error. 0 - no limits")
+	loginMappingFile := flag.String("db_login_mapping_file", "", "Path to yaml file that maps database users (and optionally application names) to client IDs in mode without encryption. <client_id> is used for not mapped users if set, otherwise their connections are rejected")
 	acraConnectionString := flag.String("incoming_connection_string", network.BuildConnectionString(cmd.DEFAULT_ACRA_CONNECTION_PROTOCOL, cmd.DEFAULT_ACRA_HOST, cmd.DEFAULT_ACRASERVER_PORT, ""), "Connection string like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	acraAPIConnectionString := flag.String("incoming_connection_api_string", network.BuildConnectionString(cmd.DEFAULT_ACRA_CONNECTION_PROTOCOL, cmd.DEFAULT_ACRA_HOST, cmd.DEFAULT_ACRASERVER_API_PORT, ""), "Connection string for api like tcp://x.x.x.x:yyyy or unix:///path/to/socket")
 	authPath = flag.String("auth_keys", cmd.DEFAULT_ACRA_AUTH_PATH, "Path to basic auth passwords. To add user, use: `./acra-authmanager --set --user <user> --pwd <pwd>`")
@@ -126,9 +159,12 @@ func main() {
 	useMysql := flag.Bool("mysql_enable", false, "Handle MySQL connections")
 	usePostgresql := flag.Bool("postgresql_enable", false, "Handle Postgresql connections (default true)")
 	censorConfig := flag.String("acracensor_config_file", "", "Path to AcraCensor configuration file")
+	encryptorConfig := flag.String("encryptor_config_file", "", "Path to Encryptor configuration file with tables' columns that should be encrypted. Only these columns will be decrypted in responses. Queries with configured tables which can't be parsed (PostgreSQL type casts with ::, WITH, ON CONFLICT, escape and dollar-quoted strings) are rejected")
 
 	cmd.RegisterTracingCmdParameters()
 	cmd.RegisterJaegerCmdParameters()
+	cmd.RegisterKeyStoreCmdParameters()
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
 	debug := flag.Bool("d", false, "Log everything to stderr")
@@ -180,6 +216,37 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := config.SetTableSchema(*encryptorConfig); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't load encryptor configuration")
+		os.Exit(1)
+	}
+
+	if *loginMappingFile != "" && !*noEncryptionTransport {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: database logins may be mapped to client IDs only in mode without encryption, client ID is taken from transport in other modes")
+		os.Exit(1)
+	}
+	if err := config.SetLoginMapping(*loginMappingFile); err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't load mapping of database logins to client IDs")
+		os.Exit(1)
+	}
+
+	if *clientMaxSessions != 0 || *clientQueriesPerSecond != 0 || *clientDecryptedBytesPerMinute != 0 {
+		limiter, err := base.NewClientLimiter(base.ClientLimits{
+			MaxSessions:             *clientMaxSessions,
+			QueriesPerSecond:        *clientQueriesPerSecond,
+			DecryptedBytesPerMinute: *clientDecryptedBytesPerMinute,
+		})
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't configure limits of clients")
+			os.Exit(1)
+		}
+		config.SetClientLimiter(limiter)
+	}
+
 	// now it's stub as default values
 	config.SetDetectPoisonRecords(*detectPoisonRecords)
 	config.SetStopOnPoison(*stopOnPoison)
@@ -200,6 +267,7 @@ func main() {
 	config.SetEnableHTTPAPI(*enableHTTPAPI)
 	config.SetConfigPath(DEFAULT_CONFIG_PATH)
 	config.SetDebug(*debug)
+	config.SetPgCancelRequestRewriteKeys(*pgCancelRewriteKeys)
 
 	if *pgHexFormat || !*pgEscapeFormat {
 		config.SetByteaFormat(HEX_BYTEA_FORMAT)
@@ -207,18 +275,49 @@ func main() {
 		config.SetByteaFormat(ESCAPE_BYTEA_FORMAT)
 	}
 
+	failoverAddresses, err := network.ParseBackendAddresses(*dbFailoverBackends)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't parse list of failover databases")
+		os.Exit(1)
+	}
+	replicaAddresses, err := network.ParseBackendAddresses(*dbReplicaBackends)
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't parse list of read replicas")
+		os.Exit(1)
+	}
+	if len(replicaAddresses) > 0 && *pgPoolSize == 0 {
+		log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Configuration error: read replicas are used only by pool of connections to PostgreSQL, set <pgsql_pool_size>")
+		os.Exit(1)
+	}
+	backends, err := network.NewBackendSet(append([]string{net.JoinHostPort(*dbHost, strconv.Itoa(*dbPort))}, failoverAddresses...))
+	if err != nil {
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+			Errorln("Can't configure databases")
+		os.Exit(1)
+	}
+	config.SetDBBackends(backends)
+	var replicas *network.BackendSet
+	if len(replicaAddresses) > 0 {
+		// error isn't possible for not empty list
+		replicas, _ = network.NewBackendSet(replicaAddresses)
+	}
+
 	log.Infof("Initialising keystore...")
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("can't load master key")
+		log.WithError(err).Errorln("can't initialize key encryptor")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
+	keyStorage, err := cmd.GetKeyStoreStorage()
 	if err != nil {
-		log.WithError(err).Errorln("can't init scell encryptor")
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+			Errorln("Can't initialise storage of keys")
 		os.Exit(1)
 	}
-	keyStore, err := filesystem.NewFileSystemKeyStoreWithCacheSize(*keysDir, scellEncryptor, *keysCacheSize)
+	keyStore, err := filesystem.NewFilesystemKeyStoreWithStorage(*keysDir, *keysDir, keyStorage, scellEncryptor, *keysCacheSize)
 	if err != nil {
 		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
 			Errorln("Can't initialise keystore")
@@ -226,6 +325,22 @@ func main() {
 	}
 	log.Infof("Keystore init OK")
 
+	if *auditLogFile != "" {
+		auditLogKey, err := keyStore.GetAuditLogKey()
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+				Errorln("Can't load audit log key")
+			os.Exit(1)
+		}
+		auditLog, err := audit.OpenFile(*auditLogFile, auditLogKey)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: can't open audit log, verify it with acra-audit")
+			os.Exit(1)
+		}
+		config.SetAuditLog(auditLog)
+	}
+
 	log.Infof("Configuring transport...")
 	var tlsConfig *tls.Config
 	if *useTLS || *tlsKey != "" {
@@ -243,9 +358,115 @@ func main() {
 		}
 	}
 	config.SetTLSConfig(tlsConfig)
+	if *dbHealthCheckInterval > 0 && (len(failoverAddresses) > 0 || replicas != nil) {
+		checkUser, checkPassword, checkDatabase := *dbHealthCheckUser, os.Getenv(DBHealthCheckPasswordEnvName), pgHealthCheckDatabase
+		if checkUser == "" {
+			checkUser, checkPassword, checkDatabase = *pgPoolUser, os.Getenv(PgPoolPasswordEnvName), *pgPoolDatabase
+		}
+		if checkUser == "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: health checks of failover and replica databases require <db_health_check_user>")
+			os.Exit(1)
+		}
+		newBackendChecker := func(primary bool) (network.BackendChecker, error) {
+			if config.UseMySQL() {
+				return mysql.NewBackendChecker(checkUser, checkPassword, tlsConfig, primary)
+			}
+			return pg.NewBackendChecker(pg.PoolConfig{User: checkUser, Password: checkPassword, Database: checkDatabase, TLSConfig: tlsConfig}, primary), nil
+		}
+		healthCheckedBackends := map[*network.BackendSet]bool{}
+		if len(failoverAddresses) > 0 {
+			healthCheckedBackends[backends] = true
+		}
+		if replicas != nil {
+			healthCheckedBackends[replicas] = false
+		}
+		for backendSet, primary := range healthCheckedBackends {
+			checker, err := newBackendChecker(primary)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Can't configure health checks of databases")
+				os.Exit(1)
+			}
+			backendSet.SetChecker(checker)
+			// statuses are known before first connections
+			backendSet.CheckHealth()
+			go backendSet.RunHealthCheck(context.Background(), time.Duration(*dbHealthCheckInterval)*time.Second)
+		}
+	}
+	if *pgPoolSize > 0 {
+		if config.UseMySQL() || *pgPoolUser == "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: pool of connections is supported only for PostgreSQL and requires <pgsql_pool_user>")
+			os.Exit(1)
+		}
+		if *loginMappingFile != "" {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: <db_login_mapping_file> can't be used with pool of connections because pool doesn't pass users of clients to PostgreSQL")
+			os.Exit(1)
+		}
+		var poolUsers map[string]string
+		if *pgPoolAuthFile != "" {
+			poolUsers, err = pg.LoadPoolUsers(*pgPoolAuthFile)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Configuration error: can't load users of pool of connections")
+				os.Exit(1)
+			}
+		} else if *noEncryptionTransport || (*useTLS && tls.ClientAuthType(*tlsAuthType) != tls.RequireAndVerifyClientCert) {
+			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Configuration error: clients of pool of connections should be authenticated, set <pgsql_pool_auth_file>, use Secure Session or TLS with <tls_auth>=4")
+			os.Exit(1)
+		}
+		poolConfig := pg.PoolConfig{
+			Backends:    backends,
+			User:        *pgPoolUser,
+			Password:    os.Getenv(PgPoolPasswordEnvName),
+			Database:    *pgPoolDatabase,
+			Size:        *pgPoolSize,
+			WaitTimeout: time.Duration(*pgPoolWaitTimeout) * time.Second,
+			ResetQuery:  *pgPoolResetQuery,
+			TLSConfig:   tlsConfig,
+			Users:       poolUsers,
+		}
+		pool, err := pg.NewConnectionPool(poolConfig)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+				Errorln("Can't create pool of connections to PostgreSQL")
+			os.Exit(1)
+		}
+		if replicas != nil {
+			poolConfig.Backends = replicas
+			replicaPool, err := pg.NewConnectionPool(poolConfig)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorWrongConfiguration).
+					Errorln("Can't create pool of connections to PostgreSQL replicas")
+				os.Exit(1)
+			}
+			pool.SetReplicaPool(replicaPool)
+		}
+		config.SetPgConnectionPool(pool)
+	}
 	if *useTLS {
 		log.Println("Selecting transport: use TLS transport wrapper")
-		config.ConnectionWrapper, err = network.NewTLSConnectionWrapper([]byte(*clientID), tlsConfig)
+		if *tlsClientIDSource != "" {
+			if tls.ClientAuthType(*tlsAuthType) < tls.VerifyClientCertIfGiven {
+				log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+					Errorln("Configuration error: client ID may be taken only from verified certificate, set <tls_auth> to 3 or 4")
+				os.Exit(1)
+			}
+			var extractor network.TLSClientIDExtractor
+			extractor, err = network.NewTLSClientIDExtractor(*tlsClientIDSource, *tlsClientIDMappingFile)
+			if err != nil {
+				log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
+					Errorln("Configuration error: can't initialise extractor of client ID from TLS certificate")
+				os.Exit(1)
+			}
+			log.Infof("Take client ID from TLS certificate using source '%s'", *tlsClientIDSource)
+			config.ConnectionWrapper, err = network.NewTLSConnectionWrapperWithClientIDExtractor(extractor, tlsConfig)
+		} else {
+			config.ConnectionWrapper, err = network.NewTLSConnectionWrapper([]byte(*clientID), tlsConfig)
+		}
 		if err != nil {
 			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
 				Errorln("Configuration error: can't initialise TLS connection wrapper")
@@ -253,9 +474,9 @@ func main() {
 		}
 	} else if *noEncryptionTransport {
 		config.SetWithConnector(false)
-		if *clientID == "" && !*withZone {
+		if *clientID == "" && !*withZone && *loginMappingFile == "" {
 			log.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTransportConfiguration).
-				Errorln("Configuration error: without zone mode and without encryption you must set <client_id> which will be used to connect from AcraConnector to AcraServer")
+				Errorln("Configuration error: without zone mode and without encryption you must set <client_id> or <db_login_mapping_file> which will be used to connect from AcraConnector to AcraServer")
 			os.Exit(1)
 		}
 		log.Infof("Selecting transport: use raw transport wrapper")
@@ -330,6 +551,30 @@ func main() {
 		sigHandlerSIGTERM.AddCallback(stopPrometheusServer)
 	}
 
+	if *healthAddress != "" {
+		healthHandler := cmd.NewHealthHandler()
+		healthHandler.AddReadinessCheck("keystore", keyStore.VerifyMasterKey)
+		healthHandler.AddReadinessCheck("database", func() error {
+			connection, err := config.GetDBBackends().Dial()
+			if err != nil {
+				return err
+			}
+			return connection.Close()
+		})
+		_, healthHTTPServer, err := cmd.RunHealthHTTPHandler(*healthAddress, healthHandler)
+		if err != nil {
+			log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartService).
+				Errorln("Can't run health check handler")
+			os.Exit(1)
+		}
+		stopHealthServer := func() {
+			log.Infoln("Stop health check http handler")
+			healthHTTPServer.Close()
+		}
+		sigHandlerSIGHUP.AddCallback(stopHealthServer)
+		sigHandlerSIGTERM.AddCallback(stopHealthServer)
+	}
+
 	go sigHandlerSIGTERM.Register()
 	sigHandlerSIGTERM.AddCallback(func() {
 		log.Infof("Received incoming SIGTERM or SIGINT signal")
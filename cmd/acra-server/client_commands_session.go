@@ -17,32 +17,15 @@ limitations under the License.
 package main
 
 import (
-	"bufio"
 	"context"
-	"go.opencensus.io/trace"
+	"errors"
 	"net"
 	"net/http"
 
+	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/network"
 	log "github.com/sirupsen/logrus"
-
-	"encoding/json"
-	"errors"
-	"flag"
-	"fmt"
-	"syscall"
-
-	"github.com/cossacklabs/acra/cmd"
-	"github.com/cossacklabs/acra/keystore"
-	"github.com/cossacklabs/acra/utils"
-	"github.com/cossacklabs/acra/zone"
-	"github.com/cossacklabs/themis/gothemis/cell"
-	"github.com/cossacklabs/themis/gothemis/keys"
-)
-
-// HTTP 500 response
-const (
-	Response500Error = "HTTP/1.1 500 Server error\r\n\r\n\r\n\r\n"
 )
 
 // ClientCommandsSession handles Secure Session for client commands API
@@ -77,120 +60,19 @@ func (clientSession *ClientCommandsSession) close() {
 	log.Debugln("All connections closed")
 }
 
-// HandleSession gets, parses and executes each client HTTP request, writes response to the connection
+// HandleSession serves HTTP requests of client until connection is closed. Connection is kept alive between requests
 func (clientSession *ClientCommandsSession) HandleSession() {
-	_, requestSpan := trace.StartSpan(clientSession.ctx, "HandleSession")
-	defer requestSpan.End()
-
 	logger := logging.NewLoggerWithTrace(clientSession.ctx)
-	reader := bufio.NewReader(clientSession.connection)
-	req, err := http.ReadRequest(reader)
-	// req = clientSession.connection.Write(*http.ResponseWriter)
-	if err != nil {
-
+	server := &http.Server{
+		Handler:      clientSession.newAPIHandler(),
+		ReadTimeout:  network.DefaultNetworkTimeout,
+		WriteTimeout: network.DefaultNetworkTimeout,
+		IdleTimeout:  network.DefaultNetworkTimeout,
+	}
+	// server closes connection when client closes it or on timeout
+	if err := server.Serve(network.NewConnectionListener(clientSession.connection)); err != network.ErrConnectionListenerClosed {
 		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
-			Warningln("Got new command request, but can't read it")
+			Warningln("Can't serve HTTP API requests")
 		clientSession.close()
-		return
-	}
-	response := "HTTP/1.1 404 Not Found\r\n\r\nincorrect request\r\n\r\n"
-
-	logger.Debugf("Incoming API request to %v", req.URL.Path)
-
-	requestSpan.AddAttributes(trace.StringAttribute("http.url", req.URL.Path))
-
-	switch req.URL.Path {
-	case "/getNewZone":
-		logger.Debugln("Got /getNewZone request")
-		id, publicKey, err := clientSession.keystorage.GenerateZoneKey()
-		if err != nil {
-			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantGenerateZone).Errorln("Can't generate zone key")
-		} else {
-			zoneData, err := zone.ZoneDataToJSON(id, &keys.PublicKey{Value: publicKey})
-			if err != nil {
-				logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantGenerateZone).WithError(err).Errorln("Can't create json with zone key")
-			} else {
-				logger.Debugln("Handled request correctly")
-				response = fmt.Sprintf("HTTP/1.1 200 OK Found\r\n\r\n%s\r\n\r\n", string(zoneData))
-			}
-		}
-	case "/resetKeyStorage":
-		logger.Debugln("Got /resetKeyStorage request")
-		clientSession.keystorage.Reset()
-		response = "HTTP/1.1 200 OK Found\r\n\r\n"
-		logger.Debugln("Cleared key storage cache")
-	case "/loadAuthData":
-		response = Response500Error
-		key, err := clientSession.keystore.GetAuthKey(false)
-		if err != nil {
-			logger.WithError(err).Error("loadAuthData: keystore.GetAuthKey()")
-			response = Response500Error
-			break
-		}
-		authDataCrypted, err := getAuthDataFromFile(*authPath)
-		if err != nil {
-			logger.Warningf("%v\n", utils.ErrorMessage("loadAuthData: no auth data", err))
-			response = Response500Error
-			break
-		}
-		SecureCell := cell.New(key, cell.CELL_MODE_SEAL)
-		authData, err := SecureCell.Unprotect(authDataCrypted, nil, nil)
-		if err != nil {
-			logger.WithError(err).Error("loadAuthData: SecureCell.Unprotect")
-
-			break
-		}
-		response = fmt.Sprintf("HTTP/1.1 200 OK Found\r\n\r\n%s\r\n\r\n", authData)
-	case "/getConfig":
-		logger.Debugln("Got /getConfig request")
-		jsonOutput, err := clientSession.config.ToJSON()
-		if err != nil {
-			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
-				Warningln("Can't convert config to JSON")
-			response = Response500Error
-		} else {
-			logger.Debugln("Handled request correctly")
-			logger.Debugln(string(jsonOutput))
-			response = fmt.Sprintf("HTTP/1.1 200 OK Found\r\n\r\n%s\r\n\r\n", string(jsonOutput))
-		}
-	case "/setConfig":
-		logger.Debugln("Got /setConfig request")
-		decoder := json.NewDecoder(req.Body)
-		var configFromUI UIEditableConfig
-		err := decoder.Decode(&configFromUI)
-		if err != nil {
-			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
-				Warningln("Can't convert config from incoming")
-			response = Response500Error
-			return
-		}
-		// set config values
-		flag.Set("db_host", configFromUI.DbHost)
-		flag.Set("db_port", fmt.Sprintf("%v", configFromUI.DbPort))
-		flag.Set("incoming_connection_api_port", fmt.Sprintf("%v", configFromUI.ConnectorAPIPort))
-		flag.Set("d", fmt.Sprintf("%v", configFromUI.Debug))
-		flag.Set("poison_run_script_file", fmt.Sprintf("%v", configFromUI.ScriptOnPoison))
-		flag.Set("poison_shutdown_enable", fmt.Sprintf("%v", configFromUI.StopOnPoison))
-		flag.Set("zonemode_enable", fmt.Sprintf("%v", configFromUI.WithZone))
-
-		err = cmd.DumpConfig(clientSession.Server.config.GetConfigPath(), ServiceName, false)
-		if err != nil {
-			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantDumpConfig).
-				Errorln("DumpConfig failed")
-			response = Response500Error
-			return
-
-		}
-		logger.Debugln("Handled request correctly, restarting server")
-		clientSession.Server.restartSignalsChannel <- syscall.SIGHUP
-	default:
-		requestSpan.AddAttributes(trace.StringAttribute("http.url", "undefined"))
-	}
-
-	_, err = clientSession.connection.Write([]byte(response))
-	if err != nil {
-		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).Errorln("Can't send data with secure session to acra-connector")
-		return
 	}
-	clientSession.close()
 }
@@ -18,7 +18,6 @@ package main
 
 import (
 	"context"
-	"github.com/cossacklabs/acra/network"
 	"go.opencensus.io/trace"
 	"net"
 
@@ -27,9 +26,12 @@ import (
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/decryptor/mysql"
 	"github.com/cossacklabs/acra/decryptor/postgresql"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/tokenization"
 	"io"
+	"sync"
 )
 
 // ClientSession handles connection between database and AcraServer.
@@ -48,9 +50,14 @@ func NewClientSession(ctx context.Context, keystorage keystore.KeyStore, config
 	return &ClientSession{connection: connection, keystorage: keystorage, config: config, ctx: ctx, logger: logging.NewLoggerWithTrace(ctx)}, nil
 }
 
-// ConnectToDb connects to the database via tcp using Host and Port from config.
+// ConnectToDb connects to the first available database of config via tcp. Session uses connection which leases
+// connections of pool if pool is configured
 func (clientSession *ClientSession) ConnectToDb() error {
-	conn, err := network.Dial(network.BuildConnectionString("tcp", clientSession.config.GetDBHost(), clientSession.config.GetDBPort(), ""))
+	if pool := clientSession.config.GetPgConnectionPool(); pool != nil {
+		clientSession.connectionToDb = pool.NewConnection()
+		return nil
+	}
+	conn, err := clientSession.config.GetDBBackends().Dial()
 	if err != nil {
 		return err
 	}
@@ -75,6 +82,89 @@ func (clientSession *ClientSession) close() {
 	clientSession.logger.Debugln("All connections closed")
 }
 
+// limitedSession is session acquired from limiter for client ID which may be changed by login mapping
+type limitedSession struct {
+	limiter  *base.ClientLimiter
+	lock     sync.Mutex
+	clientID []byte
+}
+
+// newLimitedSession acquires session of client ID from limiter
+func newLimitedSession(limiter *base.ClientLimiter, clientID []byte) (*limitedSession, error) {
+	if err := limiter.AcquireSession(clientID); err != nil {
+		return nil, err
+	}
+	return &limitedSession{limiter: limiter, clientID: clientID}, nil
+}
+
+// moveTo moves session to client ID so its limits are applied to connection instead of limits of previous client ID
+func (session *limitedSession) moveTo(clientID []byte) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if err := session.limiter.MoveSession(session.clientID, clientID); err != nil {
+		return err
+	}
+	session.clientID = clientID
+	return nil
+}
+
+// release releases session of current client ID
+func (session *limitedSession) release() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.limiter.ReleaseSession(session.clientID)
+}
+
+// newLoginCallback returns callback that sets client ID of database login to components which process data of
+// connection and moves limited session to it. defaultClientID is left for logins which aren't mapped, they are
+// rejected if defaultClientID is empty
+func (clientSession *ClientSession) newLoginCallback(mapping *base.LoginMapping, defaultClientID []byte, session *limitedSession, components ...interface{}) base.LoginCallback {
+	return func(user, applicationName string) error {
+		logger := clientSession.logger.WithFields(log.Fields{"db_user": user, "application_name": applicationName})
+		clientID, ok := mapping.ClientID(user, applicationName)
+		if !ok {
+			if len(defaultClientID) == 0 {
+				return base.ErrLoginClientIDNotFound
+			}
+			logger.Debugln("Database login isn't mapped, use default client ID")
+			return nil
+		}
+		if session != nil {
+			if err := session.moveTo(clientID); err != nil {
+				return err
+			}
+		}
+		for _, component := range components {
+			if setter, ok := component.(base.ClientIDSetter); ok {
+				setter.SetClientID(clientID)
+			}
+		}
+		logger.WithField("client_id", string(clientID)).Infoln("Use client ID of database login")
+		return nil
+	}
+}
+
+// rejectByClientLimit sends error about exceeded limit to client in protocol of configured database
+func (clientSession *ClientSession) rejectByClientLimit(limitErr error) {
+	var response []byte
+	if clientSession.config.UseMySQL() {
+		packet := mysql.NewMysqlPacket()
+		packet.SetData(mysql.NewClientLimitError(limitErr, false))
+		response = packet.Dump()
+	} else {
+		var err error
+		response, err = postgresql.NewPgClientLimitError(limitErr)
+		if err != nil {
+			clientSession.logger.WithError(err).Errorln("Can't create error response for client")
+			return
+		}
+	}
+	if _, err := clientSession.connection.Write(response); err != nil {
+		clientSession.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+			Errorln("Can't write error response to client")
+	}
+}
+
 // HandleClientConnection handles Acra-connector connections from client to db and decrypt responses from db to client.
 // If any error occurred – ends processing.
 func (clientSession *ClientSession) HandleClientConnection(clientID []byte, decryptorImpl base.Decryptor) {
@@ -82,6 +172,24 @@ func (clientSession *ClientSession) HandleClientConnection(clientID []byte, decr
 	clientProxyErrorCh := make(chan error, 1)
 	dbProxyErrorCh := make(chan error, 1)
 
+	limiter := clientSession.config.GetClientLimiter()
+	var session *limitedSession
+	if limiter != nil {
+		var err error
+		session, err = newLimitedSession(limiter, clientID)
+		if err != nil {
+			clientSession.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+				Warningln("Client exceeded limit of sessions, connection rejected")
+			clientSession.rejectByClientLimit(err)
+			if err := clientSession.connection.Close(); err != nil {
+				clientSession.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantCloseConnectionToService).
+					Errorln("Error with closing connection to acra-connector")
+			}
+			return
+		}
+		defer session.release()
+	}
+
 	clientSession.logger.Debugf("Connecting to db")
 	err := clientSession.ConnectToDb()
 	if err != nil {
@@ -97,24 +205,57 @@ func (clientSession *ClientSession) HandleClientConnection(clientID []byte, decr
 		return
 	}
 	var pgProxy *postgresql.PgProxy
+	var dataEncryptor encryptor.DataEncryptor
+	var hmacCalculator encryptor.HMACCalculator
+	var tokenizer tokenization.Tokenizer
+	schemaStore := clientSession.config.GetTableSchema()
+	if schemaStore != nil {
+		dataEncryptor, err = encryptor.NewAcrawriterDataEncryptor(clientSession.keystorage)
+		if err != nil {
+			clientSession.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitClientSession).
+				Errorln("Can't initialize data encryptor")
+			return
+		}
+		hmacCalculator = encryptor.NewKeystoreHMACCalculator(clientSession.keystorage)
+		tokenizer = tokenization.NewKeystoreTokenizer(clientSession.keystorage)
+	}
 	if clientSession.config.UseMySQL() {
 		clientSession.logger.Debugln("MySQL connection")
 		trace.FromContext(clientSession.ctx).AddAttributes(trace.StringAttribute("db.type", "mysql"))
-		handler, err := mysql.NewMysqlHandler(clientSession.ctx, clientID, decryptorImpl, clientSession.connectionToDb, clientSession.connection, clientSession.config.GetTLSConfig(), clientSession.config.censor)
+		var queryEncryptor encryptor.QueryEncryptor
+		if schemaStore != nil {
+			queryEncryptor = encryptor.NewMysqlQueryEncryptor(schemaStore, clientID, dataEncryptor, hmacCalculator, tokenizer)
+		}
+		handler, err := mysql.NewMysqlHandler(clientSession.ctx, clientID, decryptorImpl, clientSession.connectionToDb, clientSession.connection, clientSession.config.GetTLSConfig(), clientSession.config.censor, queryEncryptor, schemaStore, tokenizer)
 		if err != nil {
 			clientSession.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitDecryptor).
 				Errorln("Can't initialize mysql handler")
 			return
 		}
+		handler.SetClientLimiter(limiter)
+		handler.SetAuditLog(clientSession.config.GetAuditLog())
+		if mapping := clientSession.config.GetLoginMapping(); mapping != nil {
+			handler.SetLoginCallback(clientSession.newLoginCallback(mapping, clientID, session, decryptorImpl, queryEncryptor, handler))
+		}
 		go handler.ClientToDbConnector(clientProxyErrorCh)
 		go handler.DbToClientConnector(dbProxyErrorCh)
 	} else {
 		trace.FromContext(clientSession.ctx).AddAttributes(trace.StringAttribute("db.type", "postgresql"))
-		pgProxy, err = postgresql.NewPgProxy(clientSession.ctx, clientSession.connection, clientSession.connectionToDb)
+		var queryEncryptor encryptor.QueryEncryptor
+		if schemaStore != nil {
+			queryEncryptor = encryptor.NewPostgresqlQueryEncryptor(schemaStore, clientID, dataEncryptor, hmacCalculator, tokenizer)
+		}
+		pgProxy, err = postgresql.NewPgProxy(clientSession.ctx, clientID, clientSession.connection, clientSession.connectionToDb, queryEncryptor, schemaStore, tokenizer)
 		if err != nil {
 			clientSession.logger.WithError(err).Errorln("can't initialize postgresql proxy")
 			return
 		}
+		pgProxy.SetCancelRequestRouter(clientSession.Server.cancelRequestRouter)
+		pgProxy.SetClientLimiter(limiter)
+		pgProxy.SetAuditLog(clientSession.config.GetAuditLog())
+		if mapping := clientSession.config.GetLoginMapping(); mapping != nil {
+			pgProxy.SetLoginCallback(clientSession.newLoginCallback(mapping, clientID, session, decryptorImpl, queryEncryptor, pgProxy))
+		}
 		clientSession.logger.Debugln("PostgreSQL connection")
 		go pgProxy.PgProxyClientRequests(clientSession.config.censor, clientSession.connectionToDb, clientSession.connection, clientProxyErrorCh)
 		go pgProxy.PgDecryptStream(clientSession.config.censor, decryptorImpl, clientSession.config.GetTLSConfig(), clientSession.connectionToDb, clientSession.connection, dbProxyErrorCh)
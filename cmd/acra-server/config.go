@@ -22,6 +22,10 @@ import (
 	"errors"
 
 	"github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/audit"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/decryptor/postgresql"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/network"
 	"io/ioutil"
 )
@@ -58,6 +62,13 @@ type Config struct {
 	configPath              string
 	debug                   bool
 	censor                  acracensor.AcraCensorInterface
+	tableSchema             encryptor.TableSchemaStore
+	loginMapping            *base.LoginMapping
+	pgCancelRewriteKeys     bool
+	pgConnectionPool        *postgresql.ConnectionPool
+	dbBackends              *network.BackendSet
+	clientLimiter           *base.ClientLimiter
+	auditLog                *audit.Log
 	tlsConfig               *tls.Config
 	withConnector           bool
 	TraceToLog              bool
@@ -116,6 +127,93 @@ func (config *Config) GetCensor() acracensor.AcraCensorInterface {
 	return config.censor
 }
 
+// SetTableSchema loads configuration of encryptable tables' columns. TableSchemaStore stays nil if path is empty
+// and AcraServer will not encrypt data of queries
+func (config *Config) SetTableSchema(encryptorConfigPath string) error {
+	if encryptorConfigPath == "" {
+		return nil
+	}
+	configuration, err := ioutil.ReadFile(encryptorConfigPath)
+	if err != nil {
+		return err
+	}
+	schema, err := encryptor.MapTableSchemaStoreFromConfig(configuration)
+	if err != nil {
+		return err
+	}
+	config.tableSchema = schema
+	return nil
+}
+
+// GetTableSchema returns configuration of encryptable tables' columns or nil if encryption turned off
+func (config *Config) GetTableSchema() encryptor.TableSchemaStore {
+	return config.tableSchema
+}
+
+// SetLoginMapping loads mapping of database logins to client IDs. Mapping stays nil if path is empty and client ID
+// of connection is set by transport
+func (config *Config) SetLoginMapping(loginMappingPath string) error {
+	if loginMappingPath == "" {
+		return nil
+	}
+	configuration, err := ioutil.ReadFile(loginMappingPath)
+	if err != nil {
+		return err
+	}
+	mapping, err := base.NewLoginMappingFromConfig(configuration)
+	if err != nil {
+		return err
+	}
+	config.loginMapping = mapping
+	return nil
+}
+
+// GetLoginMapping returns mapping of database logins to client IDs or nil if it's not used
+func (config *Config) GetLoginMapping() *base.LoginMapping {
+	return config.loginMapping
+}
+
+// SetPgCancelRequestRewriteKeys sets whether PostgreSQL clients receive keys of sessions generated by AcraServer
+// instead of keys generated by database
+func (config *Config) SetPgCancelRequestRewriteKeys(value bool) {
+	config.pgCancelRewriteKeys = value
+}
+
+// GetPgCancelRequestRewriteKeys returns true if PostgreSQL clients receive keys of sessions generated by AcraServer
+func (config *Config) GetPgCancelRequestRewriteKeys() bool {
+	return config.pgCancelRewriteKeys
+}
+
+// SetPgConnectionPool sets pool shared by sessions of PostgreSQL clients instead of own connections to database
+func (config *Config) SetPgConnectionPool(pool *postgresql.ConnectionPool) {
+	config.pgConnectionPool = pool
+}
+
+// GetPgConnectionPool returns pool of connections to PostgreSQL or nil if every session connects to database
+func (config *Config) GetPgConnectionPool() *postgresql.ConnectionPool {
+	return config.pgConnectionPool
+}
+
+// SetClientLimiter sets limiter of sessions, queries and decrypted data of client IDs
+func (config *Config) SetClientLimiter(limiter *base.ClientLimiter) {
+	config.clientLimiter = limiter
+}
+
+// GetClientLimiter returns limiter of client IDs or nil if clients aren't limited
+func (config *Config) GetClientLimiter() *base.ClientLimiter {
+	return config.clientLimiter
+}
+
+// SetAuditLog sets log where AcraServer writes clients' queries, decryptions and poison records
+func (config *Config) SetAuditLog(auditLog *audit.Log) {
+	config.auditLog = auditLog
+}
+
+// GetAuditLog returns audit log or nil if audit log is turned off
+func (config *Config) GetAuditLog() *audit.Log {
+	return config.auditLog
+}
+
 // SetMySQL sets that AcraServer should connect to MySQL database
 func (config *Config) SetMySQL(useMySQL bool) error {
 	if config.postgresql && useMySQL {
@@ -293,6 +391,16 @@ func (config *Config) SetDBPort(port int) error {
 	return nil
 }
 
+// SetDBBackends sets databases which AcraServer connects to in order of priority
+func (config *Config) SetDBBackends(backends *network.BackendSet) {
+	config.dbBackends = backends
+}
+
+// GetDBBackends returns databases which AcraServer connects to in order of priority
+func (config *Config) GetDBBackends() *network.BackendSet {
+	return config.dbBackends
+}
+
 // SetByteaFormat sets bytea format for connecting to database
 func (config *Config) SetByteaFormat(format int8) error {
 	if format != HEX_BYTEA_FORMAT && format != ESCAPE_BYTEA_FORMAT {
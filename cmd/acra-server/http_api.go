@@ -0,0 +1,227 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/cossacklabs/acra/cmd"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/acra/zone"
+	"github.com/cossacklabs/themis/gothemis/cell"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	"go.opencensus.io/trace"
+)
+
+// Versioned endpoints of AcraServer HTTP API
+const (
+	APIZonesPath         = "/v1/zones"
+	APIConfigPath        = "/v1/config"
+	APIKeystoreResetPath = "/v1/keystore/reset"
+)
+
+// Endpoints of AcraServer HTTP API used by AcraWebconfig and previous versions of clients
+const (
+	LegacyAPINewZonePath       = "/getNewZone"
+	LegacyAPIResetKeystorePath = "/resetKeyStorage"
+	LegacyAPILoadAuthDataPath  = "/loadAuthData"
+	LegacyAPIGetConfigPath     = "/getConfig"
+	LegacyAPISetConfigPath     = "/setConfig"
+)
+
+// APIError is JSON body of responses with error status
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// apiRoute maps HTTP methods allowed for path to their handlers
+type apiRoute map[string]http.HandlerFunc
+
+// ServeHTTP calls handler of request's method or responds with 405 status
+func (route apiRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := route[r.Method]; ok {
+		handler(w, r)
+		return
+	}
+	methods := make([]string, 0, len(route))
+	for method := range route {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeJSON writes value as JSON body of response with status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeAPIError writes APIError with message as body of response with status
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIError{Error: message})
+}
+
+// newAPIHandler returns router of HTTP API requests
+func (clientSession *ClientCommandsSession) newAPIHandler() http.Handler {
+	router := http.NewServeMux()
+	router.Handle(APIZonesPath, apiRoute{http.MethodPost: clientSession.newZoneHandler(http.StatusCreated)})
+	router.Handle(APIConfigPath, apiRoute{http.MethodGet: clientSession.getConfig, http.MethodPost: clientSession.setConfig})
+	router.Handle(APIKeystoreResetPath, apiRoute{http.MethodPost: clientSession.resetKeystore})
+
+	legacyNewZone := clientSession.newZoneHandler(http.StatusOK)
+	router.Handle(LegacyAPINewZonePath, apiRoute{http.MethodGet: legacyNewZone, http.MethodPost: legacyNewZone})
+	router.Handle(LegacyAPIResetKeystorePath, apiRoute{http.MethodGet: clientSession.resetKeystore, http.MethodPost: clientSession.resetKeystore})
+	router.Handle(LegacyAPILoadAuthDataPath, apiRoute{http.MethodGet: clientSession.loadAuthData})
+	router.Handle(LegacyAPIGetConfigPath, apiRoute{http.MethodGet: clientSession.getConfig})
+	router.Handle(LegacyAPISetConfigPath, apiRoute{http.MethodPost: clientSession.setConfig})
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "incorrect request")
+	})
+	return clientSession.traceAPIRequests(router)
+}
+
+// traceAPIRequests starts span of each request and passes its context to handler
+func (clientSession *ClientCommandsSession) traceAPIRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, requestSpan := trace.StartSpan(clientSession.ctx, "HandleRequest")
+		defer requestSpan.End()
+		requestSpan.AddAttributes(trace.StringAttribute("http.url", r.URL.Path))
+		logging.NewLoggerWithTrace(ctx).Debugf("Incoming API request %v %v", r.Method, r.URL.Path)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newZoneHandler returns handler which generates zone keys and responds with zone data and status
+func (clientSession *ClientCommandsSession) newZoneHandler(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.NewLoggerWithTrace(r.Context())
+		id, publicKey, err := clientSession.keystorage.GenerateZoneKey()
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantGenerateZone).Errorln("Can't generate zone key")
+			writeAPIError(w, http.StatusInternalServerError, "can't generate zone key")
+			return
+		}
+		zoneData, err := zone.ZoneDataToJSON(id, &keys.PublicKey{Value: publicKey})
+		if err != nil {
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantGenerateZone).WithError(err).Errorln("Can't create json with zone key")
+			writeAPIError(w, http.StatusInternalServerError, "can't create json with zone key")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(zoneData)
+		logger.Debugln("Handled request correctly")
+	}
+}
+
+// resetKeystore clears cache of keystore
+func (clientSession *ClientCommandsSession) resetKeystore(w http.ResponseWriter, r *http.Request) {
+	clientSession.keystorage.Reset()
+	w.WriteHeader(http.StatusNoContent)
+	logging.NewLoggerWithTrace(r.Context()).Debugln("Cleared key storage cache")
+}
+
+// loadAuthData responds with decrypted data of AcraWebconfig users
+func (clientSession *ClientCommandsSession) loadAuthData(w http.ResponseWriter, r *http.Request) {
+	logger := logging.NewLoggerWithTrace(r.Context())
+	key, err := clientSession.keystore.GetAuthKey(false)
+	if err != nil {
+		logger.WithError(err).Error("loadAuthData: keystore.GetAuthKey()")
+		writeAPIError(w, http.StatusInternalServerError, "can't load auth key")
+		return
+	}
+	authDataCrypted, err := getAuthDataFromFile(*authPath)
+	if err != nil {
+		logger.Warningf("%v\n", utils.ErrorMessage("loadAuthData: no auth data", err))
+		writeAPIError(w, http.StatusInternalServerError, "can't load auth data")
+		return
+	}
+	SecureCell := cell.New(key, cell.CELL_MODE_SEAL)
+	authData, err := SecureCell.Unprotect(authDataCrypted, nil, nil)
+	if err != nil {
+		logger.WithError(err).Error("loadAuthData: SecureCell.Unprotect")
+		writeAPIError(w, http.StatusInternalServerError, "can't decrypt auth data")
+		return
+	}
+	w.Write(authData)
+}
+
+// getConfig responds with configuration editable by AcraWebconfig
+func (clientSession *ClientCommandsSession) getConfig(w http.ResponseWriter, r *http.Request) {
+	logger := logging.NewLoggerWithTrace(r.Context())
+	jsonOutput, err := clientSession.config.ToJSON()
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
+			Warningln("Can't convert config to JSON")
+		writeAPIError(w, http.StatusInternalServerError, "can't convert config to JSON")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonOutput)
+	logger.Debugln("Handled request correctly")
+}
+
+// setConfig saves configuration sent by AcraWebconfig and restarts AcraServer after response
+func (clientSession *ClientCommandsSession) setConfig(w http.ResponseWriter, r *http.Request) {
+	logger := logging.NewLoggerWithTrace(r.Context())
+	var configFromUI UIEditableConfig
+	if err := json.NewDecoder(r.Body).Decode(&configFromUI); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorGeneral).
+			Warningln("Can't convert config from incoming")
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON of config")
+		return
+	}
+	values := [][2]string{
+		{"db_host", configFromUI.DbHost},
+		{"db_port", fmt.Sprintf("%v", configFromUI.DbPort)},
+		{"incoming_connection_api_port", fmt.Sprintf("%v", configFromUI.ConnectorAPIPort)},
+		{"d", fmt.Sprintf("%v", configFromUI.Debug)},
+		{"poison_run_script_file", fmt.Sprintf("%v", configFromUI.ScriptOnPoison)},
+		{"poison_shutdown_enable", fmt.Sprintf("%v", configFromUI.StopOnPoison)},
+		{"zonemode_enable", fmt.Sprintf("%v", configFromUI.WithZone)},
+	}
+	for _, value := range values {
+		if err := flag.Set(value[0], value[1]); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid value of %s", value[0]))
+			return
+		}
+	}
+	if err := cmd.DumpConfig(clientSession.Server.config.GetConfigPath(), ServiceName, false); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantDumpConfig).
+			Errorln("DumpConfig failed")
+		writeAPIError(w, http.StatusInternalServerError, "can't save config")
+		return
+	}
+	// connection shouldn't delay restart waiting for next requests
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusNoContent)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	logger.Debugln("Handled request correctly, restarting server")
+	clientSession.Server.restartSignalsChannel <- syscall.SIGHUP
+}
@@ -25,6 +25,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/decryptor/mysql"
 	pg "github.com/cossacklabs/acra/decryptor/postgresql"
@@ -50,6 +51,8 @@ type SServer struct {
 	errorSignalChannel    chan os.Signal
 	restartSignalsChannel chan os.Signal
 	traceOptions          []trace.StartOption
+	// cancelRequestRouter routes PostgreSQL cancel requests to sessions of all connections
+	cancelRequestRouter *pg.CancelRequestRouter
 }
 
 // NewServer creates new SServer.
@@ -64,6 +67,7 @@ func NewServer(config *Config, keystorage keystore.KeyStore, errorChan chan os.S
 		errorSignalChannel:    errorChan,
 		restartSignalsChannel: restarChan,
 		traceOptions:          traceOptions,
+		cancelRequestRouter:   pg.NewCancelRequestRouter(config.GetPgCancelRequestRewriteKeys()),
 	}, nil
 }
 
@@ -134,6 +138,9 @@ func (server *SServer) getDecryptor(clientID []byte) base.Decryptor {
 	pgDecryptorImpl.SetZoneMatcher(zoneMatcher)
 
 	poisonCallbackStorage := base.NewPoisonCallbackStorage()
+	if auditLog := server.config.GetAuditLog(); auditLog != nil {
+		poisonCallbackStorage.AddCallback(audit.NewPoisonCallback(auditLog, clientID))
+	}
 	if server.config.GetScriptOnPoison() != "" {
 		poisonCallbackStorage.AddCallback(base.NewExecuteScriptCallback(server.config.GetScriptOnPoison()))
 	}
@@ -360,15 +367,13 @@ to db and decrypting responses from db
 func (server *SServer) handleCommandsConnection(ctx context.Context, clientID []byte, connection net.Conn) {
 	logger := logging.NewLoggerWithTrace(ctx)
 	clientSession, err := NewClientCommandsSession(server.keystorage, server.config, connection)
-	clientSession.Server = server
 	if err != nil {
 		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantStartConnection).
 			Errorln("Can't init API session")
 		return
 	}
-	connection.SetDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+	clientSession.Server = server
 	clientSession.HandleSession()
-	connection.SetDeadline(time.Time{})
 }
 
 // StartCommands starts listening commands connections from proxy.
@@ -25,6 +25,7 @@ import (
 	"flag"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -59,6 +60,8 @@ func main() {
 
 	secureSessionID := flag.String("securesession_id", "acra_translator", "Id that will be sent in secure session")
 
+	detokenizeClientIDs := flag.String("detokenize_client_ids", "", "Comma-separated ClientIDs allowed to detokenize data with their keys, other clients may only tokenize data")
+
 	detectPoisonRecords := flag.Bool("poison_detect_enable", true, "Turn on poison record detection, if server shutdown is disabled, AcraTranslator logs the poison record detection and returns error")
 	stopOnPoison := flag.Bool("poison_shutdown_enable", false, "On detecting poison record: log about poison record detection, stop and shutdown")
 	scriptOnPoison := flag.String("poison_run_script_file", "", "On detecting poison record: log about poison record detection, execute script, return decrypted data")
@@ -66,9 +69,12 @@ func main() {
 	closeConnectionTimeout := flag.Int("incoming_connection_close_timeout", DEFAULT_WAIT_TIMEOUT, "Time that AcraTranslator will wait (in seconds) on stop signal before closing all connections")
 
 	prometheusAddress := flag.String("incoming_connection_prometheus_metrics_string", "", "URL which will be used to expose Prometheus metrics (use <URL>/metrics address to pull metrics)")
+	healthAddress := flag.String("incoming_connection_health_string", "", "URL which will be used to expose health checks (use <URL>/health/live and <URL>/health/ready addresses for liveness and readiness probes)")
 
 	cmd.RegisterTracingCmdParameters()
 	cmd.RegisterJaegerCmdParameters()
+	cmd.RegisterKeyStoreCmdParameters()
+	cmd.RegisterKeyEncryptorCmdParameters()
 
 	verbose := flag.Bool("v", false, "Log to stderr all INFO, WARNING and ERROR logs")
 	debug := flag.Bool("d", false, "Log everything to stderr")
@@ -101,21 +107,30 @@ func main() {
 	config.SetConfigPath(DEFAULT_CONFIG_PATH)
 	config.SetDebug(*debug)
 	config.SetTraceToLog(cmd.IsTraceToLogOn())
+	if *detokenizeClientIDs != "" {
+		clientIDs := strings.Split(*detokenizeClientIDs, ",")
+		for i := range clientIDs {
+			clientIDs[i] = strings.TrimSpace(clientIDs[i])
+			cmd.ValidateClientID(clientIDs[i])
+		}
+		config.SetDetokenizeClientIDs(clientIDs)
+	}
 
 	cmd.SetupTracing(ServiceName)
 
 	log.Infof("Initialising keystore...")
-	masterKey, err := keystore.GetMasterKeyFromEnvironment()
+	scellEncryptor, err := cmd.GetKeyEncryptor()
 	if err != nil {
-		log.WithError(err).Errorln("Can't load master key")
+		log.WithError(err).Errorln("Can't initialize key encryptor")
 		os.Exit(1)
 	}
-	scellEncryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
+	keyStorage, err := cmd.GetKeyStoreStorage()
 	if err != nil {
-		log.WithError(err).Errorln("Can't init scell encryptor")
+		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
+			Errorln("Can't initialise storage of keys")
 		os.Exit(1)
 	}
-	keyStore, err := filesystem.NewTranslatorFileSystemKeyStore(*keysDir, scellEncryptor, *keysCacheSize)
+	keyStore, err := filesystem.NewTranslatorKeyStoreWithStorage(*keysDir, keyStorage, scellEncryptor, *keysCacheSize)
 	if err != nil {
 		log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantInitKeyStore).
 			Errorln("Can't initialise keystore")
@@ -178,6 +193,20 @@ func main() {
 		})
 	}
 
+	if *healthAddress != "" {
+		healthHandler := cmd.NewHealthHandler()
+		healthHandler.AddReadinessCheck("keystore", keyStore.VerifyMasterKey)
+		_, healthHTTPServer, err := cmd.RunHealthHTTPHandler(*healthAddress, healthHandler)
+		if err != nil {
+			log.WithError(err).WithField("incoming_connection_health_string", *healthAddress).Errorln("Can't run health check handler")
+			os.Exit(1)
+		}
+		sigHandlerSIGTERM.AddCallback(func() {
+			log.Infoln("Stop health check http handler")
+			healthHTTPServer.Close()
+		})
+	}
+
 	// -------- START -----------
 
 	log.Infof("Setup ready. Start listening to connections. Current PID: %v", os.Getpid())
@@ -20,11 +20,33 @@ package common
 import (
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/tokenization"
 )
 
-// TranslatorData connects KeyStorage and Poison records settings for HTTP and gRPC decryptors.
+// TranslatorData connects KeyStorage, Poison records settings and Tokenizer for HTTP and gRPC decryptors.
 type TranslatorData struct {
 	Keystorage            keystore.KeyStore
 	PoisonRecordCallbacks *base.PoisonCallbackStorage
 	CheckPoisonRecords    bool
+	Tokenizer             tokenization.Tokenizer
+	// DetokenizeClientIDs are ClientIDs allowed to restore original values from tokens
+	DetokenizeClientIDs []string
+}
+
+// CanDetokenize returns true if client is allowed to restore original values from tokens.
+func (data *TranslatorData) CanDetokenize(clientID []byte) bool {
+	for _, id := range data.DetokenizeClientIDs {
+		if id == string(clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenKeyID returns id of key used to tokenize data: zoneID if it's set, otherwise clientID.
+func TokenKeyID(clientID, zoneID []byte) []byte {
+	if len(zoneID) != 0 {
+		return zoneID
+	}
+	return clientID
 }
@@ -34,6 +34,7 @@ type AcraTranslatorConfig struct {
 	configPath                   string
 	debug                        bool
 	traceToLog                   bool
+	detokenizeClientIDs          []string
 }
 
 // NewConfig creates new AcraTranslatorConfig.
@@ -140,3 +141,13 @@ func (a *AcraTranslatorConfig) Debug() bool {
 func (a *AcraTranslatorConfig) SetDebug(debug bool) {
 	a.debug = debug
 }
+
+// DetokenizeClientIDs returns ClientIDs allowed to detokenize data.
+func (a *AcraTranslatorConfig) DetokenizeClientIDs() []string {
+	return a.detokenizeClientIDs
+}
+
+// SetDetokenizeClientIDs sets ClientIDs allowed to detokenize data.
+func (a *AcraTranslatorConfig) SetDetokenizeClientIDs(clientIDs []string) {
+	a.detokenizeClientIDs = clientIDs
+}
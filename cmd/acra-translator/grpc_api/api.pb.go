@@ -36,7 +36,7 @@ func (m *DecryptRequest) Reset()         { *m = DecryptRequest{} }
 func (m *DecryptRequest) String() string { return proto.CompactTextString(m) }
 func (*DecryptRequest) ProtoMessage()    {}
 func (*DecryptRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_b01a5dd4c4213b0b, []int{0}
+	return fileDescriptor_api_132e83a5a86b1292, []int{0}
 }
 func (m *DecryptRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_DecryptRequest.Unmarshal(m, b)
@@ -88,7 +88,7 @@ func (m *DecryptResponse) Reset()         { *m = DecryptResponse{} }
 func (m *DecryptResponse) String() string { return proto.CompactTextString(m) }
 func (*DecryptResponse) ProtoMessage()    {}
 func (*DecryptResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_b01a5dd4c4213b0b, []int{1}
+	return fileDescriptor_api_132e83a5a86b1292, []int{1}
 }
 func (m *DecryptResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_DecryptResponse.Unmarshal(m, b)
@@ -115,9 +115,111 @@ func (m *DecryptResponse) GetData() []byte {
 	return nil
 }
 
+type TokenizeRequest struct {
+	ClientId             []byte   `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	ZoneId               []byte   `protobuf:"bytes,2,opt,name=zone_id,json=zoneId,proto3" json:"zone_id,omitempty"`
+	TokenType            string   `protobuf:"bytes,3,opt,name=token_type,json=tokenType,proto3" json:"token_type,omitempty"`
+	Data                 []byte   `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TokenizeRequest) Reset()         { *m = TokenizeRequest{} }
+func (m *TokenizeRequest) String() string { return proto.CompactTextString(m) }
+func (*TokenizeRequest) ProtoMessage()    {}
+func (*TokenizeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_api_132e83a5a86b1292, []int{2}
+}
+func (m *TokenizeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TokenizeRequest.Unmarshal(m, b)
+}
+func (m *TokenizeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TokenizeRequest.Marshal(b, m, deterministic)
+}
+func (dst *TokenizeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TokenizeRequest.Merge(dst, src)
+}
+func (m *TokenizeRequest) XXX_Size() int {
+	return xxx_messageInfo_TokenizeRequest.Size(m)
+}
+func (m *TokenizeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_TokenizeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TokenizeRequest proto.InternalMessageInfo
+
+func (m *TokenizeRequest) GetClientId() []byte {
+	if m != nil {
+		return m.ClientId
+	}
+	return nil
+}
+
+func (m *TokenizeRequest) GetZoneId() []byte {
+	if m != nil {
+		return m.ZoneId
+	}
+	return nil
+}
+
+func (m *TokenizeRequest) GetTokenType() string {
+	if m != nil {
+		return m.TokenType
+	}
+	return ""
+}
+
+func (m *TokenizeRequest) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type TokenizeResponse struct {
+	Data                 []byte   `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TokenizeResponse) Reset()         { *m = TokenizeResponse{} }
+func (m *TokenizeResponse) String() string { return proto.CompactTextString(m) }
+func (*TokenizeResponse) ProtoMessage()    {}
+func (*TokenizeResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_api_132e83a5a86b1292, []int{3}
+}
+func (m *TokenizeResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TokenizeResponse.Unmarshal(m, b)
+}
+func (m *TokenizeResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TokenizeResponse.Marshal(b, m, deterministic)
+}
+func (dst *TokenizeResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TokenizeResponse.Merge(dst, src)
+}
+func (m *TokenizeResponse) XXX_Size() int {
+	return xxx_messageInfo_TokenizeResponse.Size(m)
+}
+func (m *TokenizeResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_TokenizeResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TokenizeResponse proto.InternalMessageInfo
+
+func (m *TokenizeResponse) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*DecryptRequest)(nil), "grpc_api.DecryptRequest")
 	proto.RegisterType((*DecryptResponse)(nil), "grpc_api.DecryptResponse")
+	proto.RegisterType((*TokenizeRequest)(nil), "grpc_api.TokenizeRequest")
+	proto.RegisterType((*TokenizeResponse)(nil), "grpc_api.TokenizeResponse")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -192,23 +294,125 @@ var _Reader_serviceDesc = grpc.ServiceDesc{
 	Metadata: "cmd/acra-translator/grpc_api/api.proto",
 }
 
+// TokenizerClient is the client API for Tokenizer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type TokenizerClient interface {
+	Tokenize(ctx context.Context, in *TokenizeRequest, opts ...grpc.CallOption) (*TokenizeResponse, error)
+	Detokenize(ctx context.Context, in *TokenizeRequest, opts ...grpc.CallOption) (*TokenizeResponse, error)
+}
+
+type tokenizerClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewTokenizerClient(cc *grpc.ClientConn) TokenizerClient {
+	return &tokenizerClient{cc}
+}
+
+func (c *tokenizerClient) Tokenize(ctx context.Context, in *TokenizeRequest, opts ...grpc.CallOption) (*TokenizeResponse, error) {
+	out := new(TokenizeResponse)
+	err := c.cc.Invoke(ctx, "/grpc_api.Tokenizer/Tokenize", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tokenizerClient) Detokenize(ctx context.Context, in *TokenizeRequest, opts ...grpc.CallOption) (*TokenizeResponse, error) {
+	out := new(TokenizeResponse)
+	err := c.cc.Invoke(ctx, "/grpc_api.Tokenizer/Detokenize", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TokenizerServer is the server API for Tokenizer service.
+type TokenizerServer interface {
+	Tokenize(context.Context, *TokenizeRequest) (*TokenizeResponse, error)
+	Detokenize(context.Context, *TokenizeRequest) (*TokenizeResponse, error)
+}
+
+func RegisterTokenizerServer(s *grpc.Server, srv TokenizerServer) {
+	s.RegisterService(&_Tokenizer_serviceDesc, srv)
+}
+
+func _Tokenizer_Tokenize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenizerServer).Tokenize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc_api.Tokenizer/Tokenize",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenizerServer).Tokenize(ctx, req.(*TokenizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tokenizer_Detokenize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenizerServer).Detokenize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc_api.Tokenizer/Detokenize",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenizerServer).Detokenize(ctx, req.(*TokenizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Tokenizer_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "grpc_api.Tokenizer",
+	HandlerType: (*TokenizerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Tokenize",
+			Handler:    _Tokenizer_Tokenize_Handler,
+		},
+		{
+			MethodName: "Detokenize",
+			Handler:    _Tokenizer_Detokenize_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "cmd/acra-translator/grpc_api/api.proto",
+}
+
 func init() {
-	proto.RegisterFile("cmd/acra-translator/grpc_api/api.proto", fileDescriptor_api_b01a5dd4c4213b0b)
-}
-
-var fileDescriptor_api_b01a5dd4c4213b0b = []byte{
-	// 207 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x8f, 0xc1, 0x4a, 0xc4, 0x30,
-	0x10, 0x86, 0x5d, 0x95, 0xee, 0x3a, 0x88, 0xc2, 0x5c, 0xac, 0x0a, 0x22, 0x05, 0xc5, 0x8b, 0x2d,
-	0xe8, 0x0b, 0x78, 0xf0, 0xb2, 0x1e, 0xfb, 0x02, 0x65, 0x4c, 0x46, 0x09, 0xd4, 0x24, 0x4e, 0xa6,
-	0x07, 0x7d, 0x7a, 0x69, 0xda, 0x8a, 0xc2, 0xde, 0x92, 0xff, 0x63, 0xe6, 0xfb, 0x07, 0x6e, 0xcd,
-	0x87, 0x6d, 0xc8, 0x08, 0xdd, 0xab, 0x90, 0x4f, 0x3d, 0x69, 0x90, 0xe6, 0x5d, 0xa2, 0xe9, 0x28,
-	0xba, 0x86, 0xa2, 0xab, 0xa3, 0x04, 0x0d, 0xb8, 0x59, 0xb2, 0xea, 0x0d, 0x4e, 0x9e, 0xd9, 0xc8,
-	0x57, 0xd4, 0x96, 0x3f, 0x07, 0x4e, 0x8a, 0x97, 0x70, 0x64, 0x7a, 0xc7, 0x5e, 0x3b, 0x67, 0xcb,
-	0xd5, 0xf5, 0xea, 0xee, 0xb8, 0xdd, 0x4c, 0xc1, 0xd6, 0xe2, 0x19, 0xac, 0xbf, 0x83, 0xe7, 0x11,
-	0xed, 0x67, 0x54, 0x8c, 0xdf, 0xad, 0xc5, 0x2b, 0x80, 0xd1, 0x9b, 0x54, 0x06, 0xa3, 0xe5, 0x41,
-	0x66, 0x7f, 0x92, 0xea, 0x06, 0x4e, 0x7f, 0x3d, 0x29, 0x06, 0x9f, 0x18, 0x11, 0x0e, 0x2d, 0x29,
-	0xcd, 0x8e, 0xfc, 0x7e, 0x78, 0x81, 0xa2, 0x65, 0xb2, 0x2c, 0xf8, 0x04, 0xeb, 0x79, 0x00, 0xcb,
-	0x7a, 0xa9, 0x5b, 0xff, 0xef, 0x7a, 0x71, 0xbe, 0x83, 0x4c, 0xdb, 0xab, 0xbd, 0xd7, 0x22, 0xdf,
-	0xfa, 0xf8, 0x13, 0x00, 0x00, 0xff, 0xff, 0xb1, 0xa3, 0xb4, 0xaf, 0x15, 0x01, 0x00, 0x00,
+	proto.RegisterFile("cmd/acra-translator/grpc_api/api.proto", fileDescriptor_api_132e83a5a86b1292)
+}
+
+var fileDescriptor_api_132e83a5a86b1292 = []byte{
+	// 279 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x92, 0x41, 0x4b, 0xc3, 0x40,
+	0x10, 0x85, 0xad, 0x96, 0x34, 0x19, 0xc4, 0xca, 0x5c, 0x8c, 0x11, 0x45, 0x02, 0x16, 0x2f, 0x26,
+	0x50, 0xff, 0x80, 0x60, 0x3d, 0xd4, 0x63, 0xe8, 0x3d, 0xac, 0xbb, 0xa3, 0x04, 0x6b, 0x76, 0xdd,
+	0x4c, 0x0f, 0xc9, 0x1f, 0xf1, 0xef, 0x4a, 0xb6, 0x8d, 0x8d, 0x52, 0x4f, 0xbd, 0xed, 0xbc, 0xc7,
+	0xbe, 0x6f, 0xf6, 0xb1, 0x30, 0x91, 0x1f, 0x2a, 0x15, 0xd2, 0x8a, 0x3b, 0xb6, 0xa2, 0xac, 0x96,
+	0x82, 0xb5, 0x4d, 0xdf, 0xac, 0x91, 0xb9, 0x30, 0x45, 0x2a, 0x4c, 0x91, 0x18, 0xab, 0x59, 0xa3,
+	0xdf, 0x69, 0xf1, 0x2b, 0x9c, 0xcc, 0x48, 0xda, 0xda, 0x70, 0x46, 0x9f, 0x2b, 0xaa, 0x18, 0x2f,
+	0x20, 0x90, 0xcb, 0x82, 0x4a, 0xce, 0x0b, 0x15, 0x0e, 0xae, 0x07, 0xb7, 0xc7, 0x99, 0xbf, 0x16,
+	0xe6, 0x0a, 0xcf, 0x60, 0xd4, 0xe8, 0x92, 0x5a, 0xeb, 0xd0, 0x59, 0x5e, 0x3b, 0xce, 0x15, 0x5e,
+	0x01, 0xb4, 0xdc, 0x8a, 0xed, 0x4a, 0x72, 0x78, 0xe4, 0xbc, 0x9e, 0x12, 0xdf, 0xc0, 0xf8, 0x87,
+	0x53, 0x19, 0x5d, 0x56, 0x84, 0x08, 0x43, 0x25, 0x58, 0x6c, 0x18, 0xee, 0x1c, 0x37, 0x30, 0x5e,
+	0xe8, 0x77, 0x2a, 0x8b, 0x86, 0xf6, 0xdb, 0xe7, 0x12, 0x80, 0xdb, 0xa0, 0x9c, 0x6b, 0x43, 0x6e,
+	0x9f, 0x20, 0x0b, 0x9c, 0xb2, 0xa8, 0xcd, 0x96, 0x3d, 0xec, 0xb1, 0x27, 0x70, 0xba, 0x65, 0xff,
+	0xbf, 0xe3, 0xf4, 0x19, 0xbc, 0x8c, 0x84, 0x22, 0x8b, 0x0f, 0x30, 0xda, 0x3c, 0x0a, 0xc3, 0xa4,
+	0xab, 0x34, 0xf9, 0xdd, 0x67, 0x74, 0xbe, 0xc3, 0x59, 0xa7, 0xc7, 0x07, 0xd3, 0xaf, 0x01, 0x04,
+	0x1d, 0xd4, 0xe2, 0x23, 0xf8, 0xdd, 0x80, 0xbd, 0x6b, 0x7f, 0x1a, 0x89, 0xa2, 0x5d, 0x56, 0x17,
+	0x89, 0x4f, 0x00, 0x33, 0xe2, 0x7d, 0x63, 0x5e, 0x3c, 0xf7, 0x53, 0xee, 0xbf, 0x07, 0x00, 0x42,
+	0xb6, 0x44, 0x7a, 0x53, 0x02, 0x00, 0x00,
 }
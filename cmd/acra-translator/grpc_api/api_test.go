@@ -30,6 +30,26 @@ func (*testKeystore) GetPeerPublicKey(id []byte) (*keys.PublicKey, error) {
 	panic("implement me")
 }
 
+func (*testKeystore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetHMACSecretKey(id []byte) ([]byte, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetTokenizationKey(id []byte) ([]byte, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetAuditLogKey() ([]byte, error) {
+	panic("implement me")
+}
+
 func (*testKeystore) SaveDataEncryptionKeys(id []byte, keypair *keys.Keypair) error {
 	panic("implement me")
 }
@@ -63,6 +83,22 @@ func (keystore *testKeystore) GetServerDecryptionPrivateKey(id []byte) (*keys.Pr
 	return nil, ErrKeyNotFound
 }
 
+func (keystore *testKeystore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	privateKey, err := keystore.GetZonePrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*keys.PrivateKey{privateKey}, nil
+}
+
+func (keystore *testKeystore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	privateKey, err := keystore.GetServerDecryptionPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*keys.PrivateKey{privateKey}, nil
+}
+
 func (*testKeystore) GenerateZoneKey() ([]byte, []byte, error) {
 	panic("implement me")
 }
@@ -209,3 +245,62 @@ func TestDecryptGRPCService_Decrypt(t *testing.T) {
 		t.Fatal("Poison record callback was called")
 	}
 }
+
+// testTokenizer "tokenizes" data by prefixing it with key id
+type testTokenizer struct{}
+
+func (*testTokenizer) Tokenize(data []byte, tokenType string, id []byte) ([]byte, error) {
+	return append([]byte(string(id)+":"), data...), nil
+}
+
+func (*testTokenizer) Detokenize(token []byte, tokenType string, id []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte(string(id)+":")) {
+		return nil, errors.New("invalid token")
+	}
+	return bytes.TrimPrefix(token, []byte(string(id)+":")), nil
+}
+
+func TestTokenizerGRPCService(t *testing.T) {
+	ctx := context.Background()
+	clientID := []byte("client")
+	service, err := NewTokenizerGRPCService(&common.TranslatorData{Tokenizer: &testTokenizer{}, DetokenizeClientIDs: []string{string(clientID)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Tokenize(ctx, &TokenizeRequest{TokenType: "string", Data: []byte("value")}); err != ErrClientIDRequired {
+		t.Fatalf("Expected ErrClientIDRequired, took %v", err)
+	}
+	if _, err := service.Tokenize(ctx, &TokenizeRequest{ClientId: clientID, TokenType: "unknown", Data: []byte("value")}); err != ErrUnsupportedTokenType {
+		t.Fatalf("Expected ErrUnsupportedTokenType, took %v", err)
+	}
+	response, err := service.Tokenize(ctx, &TokenizeRequest{ClientId: clientID, ZoneId: []byte("zone"), TokenType: "string", Data: []byte("value")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response.Data) != "zone:value" {
+		t.Fatalf("Expected token of zone, took %s", response.Data)
+	}
+	response, err = service.Detokenize(ctx, &TokenizeRequest{ClientId: clientID, TokenType: "string", Data: []byte("client:value")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response.Data) != "value" {
+		t.Fatalf("Expected original value, took %s", response.Data)
+	}
+	if _, err := service.Detokenize(ctx, &TokenizeRequest{ClientId: clientID, TokenType: "string", Data: []byte("zone:value")}); err != ErrCantTokenize {
+		t.Fatalf("Expected ErrCantTokenize, took %v", err)
+	}
+	if _, err := service.Detokenize(ctx, &TokenizeRequest{ClientId: clientID, ZoneId: []byte("zone"), TokenType: "string", Data: []byte("zone:value")}); err != ErrDetokenizeWithZoneID {
+		t.Fatalf("Expected ErrDetokenizeWithZoneID, took %v", err)
+	}
+	if _, err := service.Detokenize(ctx, &TokenizeRequest{ClientId: []byte("other client"), TokenType: "string", Data: []byte("other client:value")}); err != ErrDetokenizeNotAllowed {
+		t.Fatalf("Expected ErrDetokenizeNotAllowed, took %v", err)
+	}
+	service, err = NewTokenizerGRPCService(&common.TranslatorData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Tokenize(ctx, &TokenizeRequest{ClientId: clientID, TokenType: "string", Data: []byte("value")}); err != ErrTokenizationNotSet {
+		t.Fatalf("Expected ErrTokenizationNotSet, took %v", err)
+	}
+}
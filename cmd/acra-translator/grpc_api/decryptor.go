@@ -61,18 +61,25 @@ func (service *DecryptGRPCService) Decrypt(ctx context.Context, request *Decrypt
 		logrus.Errorln("GRPC request without ClientID not allowed")
 		return nil, ErrClientIDRequired
 	}
+	var getPrivateKeys func() ([]*keys.PrivateKey, error)
 	if len(request.ZoneId) != 0 {
 		privateKey, err = service.TranslatorData.Keystorage.GetZonePrivateKey(request.ZoneId)
 		decryptionContext = request.ZoneId
+		getPrivateKeys = func() ([]*keys.PrivateKey, error) {
+			return service.TranslatorData.Keystorage.GetZonePrivateKeys(request.ZoneId)
+		}
 	} else {
 		privateKey, err = service.TranslatorData.Keystorage.GetServerDecryptionPrivateKey(request.ClientId)
+		getPrivateKeys = func() ([]*keys.PrivateKey, error) {
+			return service.TranslatorData.Keystorage.GetServerDecryptionPrivateKeys(request.ClientId)
+		}
 	}
 	if err != nil {
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
 		logger.WithError(err).Errorln("Can't load private key for decryption")
 		return nil, ErrCantDecrypt
 	}
-	data, decryptErr := base.DecryptAcrastruct(request.Acrastruct, privateKey, decryptionContext)
+	data, decryptErr := base.DecryptAcrastructWithPreviousKeys(request.Acrastruct, privateKey, getPrivateKeys, decryptionContext)
 	utils.FillSlice(byte(0), privateKey.Value)
 	if decryptErr != nil {
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
@@ -0,0 +1,102 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc_api
+
+import (
+	"golang.org/x/net/context"
+
+	"errors"
+	"github.com/cossacklabs/acra/cmd/acra-translator/common"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/tokenization"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Errors possible during tokenization.
+var (
+	ErrCantTokenize         = errors.New("can't process data with token type")
+	ErrTokenizationNotSet   = errors.New("tokenization isn't configured")
+	ErrUnsupportedTokenType = errors.New("unsupported token type")
+	ErrDetokenizeNotAllowed = errors.New("client isn't allowed to detokenize data")
+	ErrDetokenizeWithZoneID = errors.New("detokenization is allowed only with key of ClientID")
+)
+
+// TokenizerGRPCService represents tokenizer of data from gRPC requests.
+type TokenizerGRPCService struct {
+	*common.TranslatorData
+}
+
+// NewTokenizerGRPCService creates new TokenizerGRPCService.
+func NewTokenizerGRPCService(data *common.TranslatorData) (*TokenizerGRPCService, error) {
+	return &TokenizerGRPCService{TranslatorData: data}, nil
+}
+
+// Tokenize returns token of data from gRPC request.
+func (service *TokenizerGRPCService) Tokenize(ctx context.Context, request *TokenizeRequest) (*TokenizeResponse, error) {
+	return service.process(request, true)
+}
+
+// Detokenize returns original value of token from gRPC request. Only ClientIDs from TranslatorData.DetokenizeClientIDs
+// may detokenize data and only with key of ClientID.
+func (service *TokenizerGRPCService) Detokenize(ctx context.Context, request *TokenizeRequest) (*TokenizeResponse, error) {
+	return service.process(request, false)
+}
+
+func (service *TokenizerGRPCService) process(request *TokenizeRequest, tokenize bool) (*TokenizeResponse, error) {
+	timer := prometheus.NewTimer(prometheus.ObserverFunc(common.RequestProcessingTimeHistogram.WithLabelValues(common.GrpcRequestType).Observe))
+	defer timer.ObserveDuration()
+
+	logger := logrus.WithFields(logrus.Fields{"client_id": string(request.ClientId), "zone_id": string(request.ZoneId), "translator": "grpc"})
+	if len(request.ClientId) == 0 {
+		logger.Errorln("GRPC request without ClientID not allowed")
+		return nil, ErrClientIDRequired
+	}
+	if service.TranslatorData.Tokenizer == nil {
+		logger.Errorln("Tokenizer isn't configured")
+		return nil, ErrTokenizationNotSet
+	}
+	if err := tokenization.ValidateTokenType(request.TokenType); err != nil {
+		logger.WithError(err).Errorln("GRPC request with unsupported token type")
+		return nil, ErrUnsupportedTokenType
+	}
+	if !tokenize {
+		if len(request.ZoneId) != 0 {
+			logger.Errorln("GRPC request to detokenize data with ZoneID")
+			return nil, ErrDetokenizeWithZoneID
+		}
+		if !service.TranslatorData.CanDetokenize(request.ClientId) {
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantTokenize).
+				Errorln("Client isn't allowed to detokenize data")
+			return nil, ErrDetokenizeNotAllowed
+		}
+	}
+	keyID := common.TokenKeyID(request.ClientId, request.ZoneId)
+	var data []byte
+	var err error
+	if tokenize {
+		data, err = service.TranslatorData.Tokenizer.Tokenize(request.Data, request.TokenType, keyID)
+	} else {
+		data, err = service.TranslatorData.Tokenizer.Detokenize(request.Data, request.TokenType, keyID)
+	}
+	if err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantTokenize).
+			Errorln("Can't process data with token type")
+		return nil, ErrCantTokenize
+	}
+	return &TokenizeResponse{Data: data}, nil
+}
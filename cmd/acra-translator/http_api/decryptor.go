@@ -25,6 +25,7 @@ import (
 	"github.com/cossacklabs/acra/cmd/acra-translator/common"
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/tokenization"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/cossacklabs/themis/gothemis/keys"
 	"github.com/prometheus/client_golang/prometheus"
@@ -165,6 +166,8 @@ func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *l
 		response.Body = ioutil.NopCloser(bytes.NewReader(decryptedStruct))
 		response.ContentLength = int64(len(decryptedStruct))
 		return response
+	case "tokenize", "detokenize":
+		return decryptor.processTokenizationRequest(requestLogger, request, clientID, endpoint == "tokenize")
 	default:
 		msg := "HTTP endpoint not supported"
 		requestLogger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorEndpointNotSupported).
@@ -178,16 +181,89 @@ func (decryptor *HTTPConnectionsDecryptor) ParseRequestPrepareResponse(logger *l
 	return responseWithMessage(request, http.StatusBadRequest, msg)
 }
 
+// processTokenizationRequest tokenizes or detokenizes body of request. Type of token should be passed in "token_type"
+// URL parameter, key of optional "zone_id" URL parameter or key of connection's ClientID is used for tokenization.
+// Detokenization is allowed only for ClientIDs from TranslatorData.DetokenizeClientIDs and only with key of
+// connection's ClientID, so client can't restore values tokenized with keys of zones.
+func (decryptor *HTTPConnectionsDecryptor) processTokenizationRequest(logger *log.Entry, request *http.Request, clientID []byte, tokenize bool) *http.Response {
+	if decryptor.TranslatorData.Tokenizer == nil {
+		msg := "Tokenization isn't configured"
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorEndpointNotSupported).Warningln(msg)
+		return responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	query := request.URL.Query()
+	tokenType := query.Get("token_type")
+	if err := tokenization.ValidateTokenType(tokenType); err != nil {
+		msg := fmt.Sprintf("HTTP request has unsupported token_type %s", tokenType)
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorMalformedURL).Warningln(msg)
+		return responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	zoneID := []byte(query.Get("zone_id"))
+	if !tokenize {
+		if len(zoneID) != 0 {
+			msg := "HTTP request has zone_id, detokenization is allowed only with key of ClientID"
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorMalformedURL).Warningln(msg)
+			return responseWithMessage(request, http.StatusBadRequest, msg)
+		}
+		if !decryptor.TranslatorData.CanDetokenize(clientID) {
+			msg := "ClientID of connection isn't allowed to detokenize data"
+			logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantTokenize).Warningln(msg)
+			return responseWithMessage(request, http.StatusForbidden, msg)
+		}
+	}
+	if len(zoneID) == 0 && clientID == nil {
+		msg := fmt.Sprintf("HTTP request doesn't have a ZoneID, connection doesn't have a ClientID, expected to get one of them. Send ZoneID in request URL")
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantZoneIDMissing).Warningln(msg)
+		return responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	if request.Body == nil {
+		msg := fmt.Sprintf("HTTP request doesn't have a body, expected to get data")
+		logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantParseRequestBody).Warningln(msg)
+		return responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	data, err := ioutil.ReadAll(request.Body)
+	defer request.Body.Close()
+	if err != nil {
+		msg := fmt.Sprintf("Can't parse body from HTTP request, expected to get data")
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantParseRequestBody).Warningln(msg)
+		return responseWithMessage(request, http.StatusBadRequest, msg)
+	}
+	keyID := common.TokenKeyID(clientID, zoneID)
+	var result []byte
+	if tokenize {
+		result, err = decryptor.TranslatorData.Tokenizer.Tokenize(data, tokenType, keyID)
+	} else {
+		result, err = decryptor.TranslatorData.Tokenizer.Detokenize(data, tokenType, keyID)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Can't process data with token_type %s", tokenType)
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantTokenize).Warningln(msg)
+		return responseWithMessage(request, http.StatusUnprocessableEntity, msg)
+	}
+	response := emptyResponseWithStatus(request, http.StatusOK)
+	response.Header.Set("Content-Type", "application/octet-stream")
+	response.Body = ioutil.NopCloser(bytes.NewReader(result))
+	response.ContentLength = int64(len(result))
+	return response
+}
+
 func (decryptor *HTTPConnectionsDecryptor) decryptAcraStruct(logger *log.Entry, acraStruct []byte, zoneID []byte, clientID []byte) ([]byte, error) {
 	var err error
 	var privateKey *keys.PrivateKey
 	var decryptionContext []byte
+	var getPrivateKeys func() ([]*keys.PrivateKey, error)
 
 	if len(zoneID) != 0 {
 		privateKey, err = decryptor.TranslatorData.Keystorage.GetZonePrivateKey(zoneID)
 		decryptionContext = zoneID
+		getPrivateKeys = func() ([]*keys.PrivateKey, error) {
+			return decryptor.TranslatorData.Keystorage.GetZonePrivateKeys(zoneID)
+		}
 	} else {
 		privateKey, err = decryptor.TranslatorData.Keystorage.GetServerDecryptionPrivateKey(clientID)
+		getPrivateKeys = func() ([]*keys.PrivateKey, error) {
+			return decryptor.TranslatorData.Keystorage.GetServerDecryptionPrivateKeys(clientID)
+		}
 	}
 
 	if err != nil {
@@ -196,7 +272,7 @@ func (decryptor *HTTPConnectionsDecryptor) decryptAcraStruct(logger *log.Entry,
 	}
 
 	// decrypt
-	decryptedStruct, err := base.DecryptAcrastruct(acraStruct, privateKey, decryptionContext)
+	decryptedStruct, err := base.DecryptAcrastructWithPreviousKeys(acraStruct, privateKey, getPrivateKeys, decryptionContext)
 	// zeroing private key
 	utils.FillSlice(byte(0), privateKey.Value)
 
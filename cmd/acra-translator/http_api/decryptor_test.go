@@ -302,3 +302,57 @@ func TestHTTPDecryptionAcraStruct(t *testing.T) {
 		t.Fatal("Decrypted acrastruct is not equal to initial data")
 	}
 }
+
+// testTokenizer "tokenizes" data by prefixing it with key id
+type testTokenizer struct{}
+
+func (*testTokenizer) Tokenize(data []byte, tokenType string, id []byte) ([]byte, error) {
+	return append([]byte(string(id)+":"), data...), nil
+}
+
+func (*testTokenizer) Detokenize(token []byte, tokenType string, id []byte) ([]byte, error) {
+	return bytes.TrimPrefix(token, []byte(string(id)+":")), nil
+}
+
+func TestHTTPTokenization(t *testing.T) {
+	translatorData := &common.TranslatorData{Keystorage: &testKeystore{}, PoisonRecordCallbacks: base.NewPoisonCallbackStorage(), Tokenizer: &testTokenizer{},
+		DetokenizeClientIDs: []string{"client"}}
+	httpConnectionsDecryptor, err := NewHTTPConnectionsDecryptor(translatorData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewEntry(log.StandardLogger())
+	testcases := []struct {
+		url      string
+		clientID string
+		body     string
+		status   int
+		expected string
+	}{
+		{"http://smth.com/v1/tokenize?token_type=string", "client", "value", http.StatusOK, "client:value"},
+		{"http://smth.com/v1/tokenize?token_type=string&zone_id=zone", "client", "value", http.StatusOK, "zone:value"},
+		{"http://smth.com/v1/detokenize?token_type=string", "client", "client:value", http.StatusOK, "value"},
+		{"http://smth.com/v1/detokenize?token_type=string&zone_id=zone", "client", "zone:value", http.StatusBadRequest, ""},
+		{"http://smth.com/v1/detokenize?token_type=string", "other client", "other client:value", http.StatusForbidden, ""},
+		{"http://smth.com/v1/tokenize?token_type=unknown", "client", "value", http.StatusBadRequest, ""},
+		{"http://smth.com/v1/tokenize", "client", "value", http.StatusBadRequest, ""},
+	}
+	for i, testcase := range testcases {
+		request := &http.Request{Method: http.MethodPost, Body: ioutil.NopCloser(bytes.NewBufferString(testcase.body))}
+		request.URL, _ = url.Parse(testcase.url)
+		response := httpConnectionsDecryptor.ParseRequestPrepareResponse(logger, request, []byte(testcase.clientID))
+		if response.StatusCode != testcase.status {
+			t.Fatalf("%v. Expected status %v, took %v", i, testcase.status, response.StatusCode)
+		}
+		if testcase.status != http.StatusOK {
+			continue
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != testcase.expected {
+			t.Fatalf("%v. Expected %v, took %s", i, testcase.expected, body)
+		}
+	}
+}
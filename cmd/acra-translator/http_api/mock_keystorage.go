@@ -46,6 +46,26 @@ func (*testKeystore) GetPeerPublicKey(id []byte) (*keys.PublicKey, error) {
 	panic("implement me")
 }
 
+func (*testKeystore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetHMACSecretKey(id []byte) ([]byte, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetTokenizationKey(id []byte) ([]byte, error) {
+	panic("implement me")
+}
+
+func (*testKeystore) GetAuditLogKey() ([]byte, error) {
+	panic("implement me")
+}
+
 // ErrKeyNotFound indicates error when decryption key is not found.
 var ErrKeyNotFound = errors.New("some error")
 
@@ -76,6 +96,22 @@ func (keystore *testKeystore) GetServerDecryptionPrivateKey(id []byte) (*keys.Pr
 	return nil, ErrKeyNotFound
 }
 
+func (keystore *testKeystore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	privateKey, err := keystore.GetZonePrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*keys.PrivateKey{privateKey}, nil
+}
+
+func (keystore *testKeystore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	privateKey, err := keystore.GetServerDecryptionPrivateKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*keys.PrivateKey{privateKey}, nil
+}
+
 func (*testKeystore) GenerateZoneKey() ([]byte, []byte, error) {
 	panic("implement me")
 }
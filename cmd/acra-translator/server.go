@@ -33,6 +33,7 @@ import (
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/acra/logging"
 	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/tokenization"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -228,7 +229,8 @@ func (server *ReaderServer) Start(parentContext context.Context) {
 			poisonCallbacks.AddCallback(&base.StopCallback{})
 		}
 	}
-	decryptorData := &common.TranslatorData{Keystorage: server.keystorage, PoisonRecordCallbacks: poisonCallbacks, CheckPoisonRecords: server.config.detectPoisonRecords}
+	decryptorData := &common.TranslatorData{Keystorage: server.keystorage, PoisonRecordCallbacks: poisonCallbacks, CheckPoisonRecords: server.config.detectPoisonRecords,
+		Tokenizer: tokenization.NewKeystoreTokenizer(server.keystorage), DetokenizeClientIDs: server.config.DetokenizeClientIDs()}
 	if server.config.incomingConnectionHTTPString != "" {
 		go func() {
 			httpContext := logging.SetLoggerToContext(parentContext, logger.WithField(ConnectionTypeKey, HTTPConnectionType))
@@ -268,6 +270,13 @@ func (server *ReaderServer) Start(parentContext context.Context) {
 				return
 			}
 			grpc_api.RegisterReaderServer(grpcServer, service)
+			tokenizerService, err := grpc_api.NewTokenizerGRPCService(decryptorData)
+			if err != nil {
+				grpcLogger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorTranslatorCantHandleGRPCConnection).
+					Errorln("Can't create grpc tokenizer service")
+				return
+			}
+			grpc_api.RegisterTokenizerServer(grpcServer, tokenizerService)
 			server.grpcServer = grpcServer
 			// Register reflection service on gRPC server.
 			reflection.Register(grpcServer)
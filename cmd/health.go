@@ -0,0 +1,134 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/cossacklabs/acra/network"
+	"github.com/sirupsen/logrus"
+)
+
+// Endpoints of health checks served by RunHealthHTTPHandler
+const (
+	HealthLivePath  = "/health/live"
+	HealthReadyPath = "/health/ready"
+)
+
+// Statuses of health checks returned in responses
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+// ReadinessCheck returns error if service can't process requests
+type ReadinessCheck func() error
+
+// HealthStatus is JSON body of health check responses. Checks contain errors of failed readiness checks by their names
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthHandler serves liveness and readiness probes
+type HealthHandler struct {
+	lock   sync.RWMutex
+	names  []string
+	checks map[string]ReadinessCheck
+}
+
+// NewHealthHandler returns handler without readiness checks
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{checks: make(map[string]ReadinessCheck)}
+}
+
+// AddReadinessCheck registers check which should pass to report that service is ready
+func (handler *HealthHandler) AddReadinessCheck(name string, check ReadinessCheck) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if _, ok := handler.checks[name]; !ok {
+		handler.names = append(handler.names, name)
+	}
+	handler.checks[name] = check
+}
+
+// Ready runs all readiness checks and returns status with errors of failed ones
+func (handler *HealthHandler) Ready() HealthStatus {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	status := HealthStatus{Status: HealthStatusOK, Checks: make(map[string]string, len(handler.names))}
+	for _, name := range handler.names {
+		if err := handler.checks[name](); err != nil {
+			logrus.WithError(err).WithField("check", name).Warningln("Readiness check failed")
+			status.Status = HealthStatusFail
+			status.Checks[name] = err.Error()
+			continue
+		}
+		status.Checks[name] = HealthStatusOK
+	}
+	return status
+}
+
+// ServeHTTP responds to liveness and readiness probes
+func (handler *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var status HealthStatus
+	switch r.URL.Path {
+	case HealthLivePath:
+		status = HealthStatus{Status: HealthStatusOK}
+	case HealthReadyPath:
+		status = handler.Ready()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	code := http.StatusOK
+	if status.Status != HealthStatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// RunHealthHTTPHandler run in goroutine http server that process with connectionString address and serves
+// liveness and readiness probes of handler
+func RunHealthHTTPHandler(connectionString string, handler *HealthHandler) (net.Listener, *http.Server, error) {
+	listener, err := network.Listen(connectionString)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(HealthLivePath, handler)
+	mux.Handle(HealthReadyPath, handler)
+	server := &http.Server{Handler: mux, ReadTimeout: network.DefaultNetworkTimeout, WriteTimeout: network.DefaultNetworkTimeout}
+	go func() {
+		logrus.WithField("connection_string", connectionString).Infoln("Start health check http handler")
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Errorln("Error from http server that process health checks")
+		}
+	}()
+	return listener, server, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/kms"
+)
+
+// Sources of master key used to encrypt keys of keystore
+const (
+	// MasterKeySourceEnv is master key passed in plain in ACRA_MASTER_KEY
+	MasterKeySourceEnv = "env"
+	// MasterKeySourceKMSEnv is master key encrypted with KMS key and passed in ACRA_MASTER_KEY
+	MasterKeySourceKMSEnv = "kms_env"
+	// MasterKeySourceKMS means that there is no master key and keys are encrypted with KMS key directly
+	MasterKeySourceKMS = "kms"
+)
+
+// Errors returned on invalid master key parameters
+var (
+	ErrUnknownMasterKeySource = errors.New("unknown source of master key, should be " + MasterKeySourceEnv + ", " + MasterKeySourceKMSEnv + " or " + MasterKeySourceKMS)
+	ErrNoMasterKey            = errors.New("keys are encrypted with KMS key without master key")
+	ErrInvalidKMSKeyCacheTTL  = errors.New("TTL of cache of keys decrypted with KMS can't be negative")
+)
+
+// NewMasterKeyVarName is name of environment variable with new master key used on master key rotation
+const NewMasterKeyVarName = "ACRA_NEW_MASTER_KEY"
+
+var masterKeySource = MasterKeySourceEnv
+var kmsEndpoint = ""
+var kmsRegion = ""
+var kmsKeyID = ""
+var kmsKeyCacheTTL = int(kms.DefaultKeyCacheTTL / time.Second)
+
+// RegisterKeyEncryptorCmdParameters register cli parameters with flag for source of master key and KMS options
+func RegisterKeyEncryptorCmdParameters() {
+	flag.StringVar(&masterKeySource, "master_key_source", masterKeySource, "Source of master key: "+MasterKeySourceEnv+" - base64 encoded master key in "+keystore.AcraMasterKeyVarName+", "+MasterKeySourceKMSEnv+" - master key encrypted with KMS key in "+keystore.AcraMasterKeyVarName+", "+MasterKeySourceKMS+" - keys are encrypted with KMS key without master key")
+	flag.StringVar(&kmsEndpoint, "kms_endpoint", kmsEndpoint, "Endpoint of KMS with AWS KMS compatible API (default: AWS KMS endpoint of region). Credentials are taken from "+kms.AccessKeyIDEnvName+", "+kms.SecretAccessKeyEnvName+" and "+kms.SessionTokenEnvName+" environment variables")
+	flag.StringVar(&kmsRegion, "kms_region", kmsRegion, "Region of KMS")
+	flag.StringVar(&kmsKeyID, "kms_key_id", kmsKeyID, "ID, ARN or alias of KMS key used to encrypt master key or keys")
+	flag.IntVar(&kmsKeyCacheTTL, "kms_key_cache_ttl", kmsKeyCacheTTL, "Time in seconds during which keys decrypted with KMS are kept in memory and reused without requests to KMS. 0 - turn off cache")
+}
+
+// getKMSKeyEncryptor returns KeyEncryptor which uses KMS key from cli parameters
+func getKMSKeyEncryptor() (*kms.KeyEncryptor, error) {
+	credentials, err := kms.CredentialsFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := kmsEndpoint
+	if endpoint == "" {
+		endpoint = kms.DefaultEndpoint(kmsRegion)
+	}
+	encryptor, err := kms.NewKeyEncryptor(endpoint, kmsRegion, kmsKeyID, credentials)
+	if err != nil {
+		return nil, err
+	}
+	if kmsKeyCacheTTL < 0 {
+		return nil, ErrInvalidKMSKeyCacheTTL
+	}
+	encryptor.SetCacheTTL(time.Duration(kmsKeyCacheTTL) * time.Second)
+	return encryptor, nil
+}
+
+// getMasterKeyProvider returns provider of master key stored in envName variable in form selected with cli parameters
+func getMasterKeyProvider(envName string) (keystore.MasterKeyProvider, error) {
+	switch masterKeySource {
+	case MasterKeySourceEnv:
+		return keystore.NewEnvironmentMasterKeyProvider(envName), nil
+	case MasterKeySourceKMSEnv:
+		encryptor, err := getKMSKeyEncryptor()
+		if err != nil {
+			return nil, err
+		}
+		return kms.NewMasterKeyProvider(encryptor, envName), nil
+	case MasterKeySourceKMS:
+		return nil, ErrNoMasterKey
+	}
+	return nil, ErrUnknownMasterKeySource
+}
+
+// GetMasterKeyProvider returns provider of master key selected with cli parameters
+func GetMasterKeyProvider() (keystore.MasterKeyProvider, error) {
+	return getMasterKeyProvider(keystore.AcraMasterKeyVarName)
+}
+
+// getSCellKeyEncryptor returns SCellKeyEncryptor with master key stored in envName variable
+func getSCellKeyEncryptor(envName string) (keystore.KeyEncryptor, error) {
+	provider, err := getMasterKeyProvider(envName)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := provider.GetMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	encryptor, err := keystore.NewSCellKeyEncryptor(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return encryptor, nil
+}
+
+// GetKeyEncryptor returns KeyEncryptor for keys of keystore selected with cli parameters
+func GetKeyEncryptor() (keystore.KeyEncryptor, error) {
+	if masterKeySource == MasterKeySourceKMS {
+		encryptor, err := getKMSKeyEncryptor()
+		if err != nil {
+			return nil, err
+		}
+		return encryptor, nil
+	}
+	return getSCellKeyEncryptor(keystore.AcraMasterKeyVarName)
+}
+
+// GetNewKeyEncryptor returns KeyEncryptor with new master key from ACRA_NEW_MASTER_KEY used on master key rotation.
+// New master key is passed in the same form as current one
+func GetNewKeyEncryptor() (keystore.KeyEncryptor, error) {
+	return getSCellKeyEncryptor(NewMasterKeyVarName)
+}
+
+// WrapMasterKey returns new master key in the form expected by source of master key selected with cli parameters
+func WrapMasterKey(masterKey []byte) ([]byte, error) {
+	switch masterKeySource {
+	case MasterKeySourceEnv:
+		return masterKey, nil
+	case MasterKeySourceKMSEnv:
+		encryptor, err := getKMSKeyEncryptor()
+		if err != nil {
+			return nil, err
+		}
+		return encryptor.Encrypt(masterKey, kms.MasterKeyContext)
+	case MasterKeySourceKMS:
+		return nil, ErrNoMasterKey
+	}
+	return nil, ErrUnknownMasterKeySource
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+// KeysBackupPassphraseVarName is name of environment variable with passphrase used to encrypt keys backup
+const KeysBackupPassphraseVarName = "ACRA_KEYS_BACKUP_PASSPHRASE"
+
+// keysBackupFormatVersion is version of header of encrypted keys backup
+const keysBackupFormatVersion = 1
+
+// keysBackupSaltLength is length of random salt used to derive key from passphrase
+const keysBackupSaltLength = 16
+
+// keysBackupMaxArgon2Memory limits memory in KiB which may be requested by header of keys backup on decryption
+const keysBackupMaxArgon2Memory = 1024 * 1024
+
+// keysBackupMagic starts every encrypted keys backup
+var keysBackupMagic = []byte("ACRAKEYS")
+
+// Errors returned on encryption and decryption of keys backup
+var (
+	ErrEmptyKeysBackupPassphrase = errors.New("passphrase of keys backup should be passed via " + KeysBackupPassphraseVarName + " environment variable")
+	ErrInvalidKeysBackupFormat   = errors.New("file isn't encrypted keys backup")
+	ErrInvalidKeysBackupVersion  = errors.New("unsupported version of encrypted keys backup")
+	ErrKeysBackupDecryption      = errors.New("can't decrypt keys backup, passphrase is incorrect or backup is corrupted")
+)
+
+// keysBackupHeader is plaintext part of encrypted keys backup with parameters of key derivation
+type keysBackupHeader struct {
+	Version uint8
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Length  uint32
+	Salt    [keysBackupSaltLength]byte
+}
+
+// GetKeysBackupPassphrase returns passphrase of keys backup from KeysBackupPassphraseVarName environment variable
+func GetKeysBackupPassphrase() (string, error) {
+	passphrase := os.Getenv(KeysBackupPassphraseVarName)
+	if passphrase == "" {
+		return "", ErrEmptyKeysBackupPassphrase
+	}
+	return passphrase, nil
+}
+
+// getKeysBackupEncryptor derives key from passphrase with Argon2 parameters of header and returns encryptor with it
+func getKeysBackupEncryptor(passphrase string, header *keysBackupHeader) (keystore.KeyEncryptor, error) {
+	params := Argon2Params{Time: header.Time, Memory: header.Memory, Threads: header.Threads, Length: header.Length}
+	key, err := HashArgon2(passphrase, string(header.Salt[:]), params)
+	if err != nil {
+		return nil, err
+	}
+	return keystore.NewSCellKeyEncryptor(key)
+}
+
+// EncryptKeysBackup encrypts keys backup archive with key derived from passphrase by Argon2 with random salt. Result
+// starts with header which contains format version, salt and Argon2 parameters and is authenticated as context of
+// encryption, so it can't be changed without failing decryption
+func EncryptKeysBackup(archive []byte, passphrase string) ([]byte, error) {
+	argon2Params := InitArgon2Params()
+	header := keysBackupHeader{
+		Version: keysBackupFormatVersion,
+		Time:    argon2Params.Time,
+		Memory:  argon2Params.Memory,
+		Threads: argon2Params.Threads,
+		Length:  argon2Params.Length,
+	}
+	if _, err := rand.Read(header.Salt[:]); err != nil {
+		return nil, err
+	}
+	output := &bytes.Buffer{}
+	output.Write(keysBackupMagic)
+	if err := binary.Write(output, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	encryptor, err := getKeysBackupEncryptor(passphrase, &header)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptor.Encrypt(archive, output.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	output.Write(encrypted)
+	return output.Bytes(), nil
+}
+
+// DecryptKeysBackup checks header of keys backup encrypted by EncryptKeysBackup and decrypts archive with key derived
+// from passphrase
+func DecryptKeysBackup(data []byte, passphrase string) ([]byte, error) {
+	headerLength := len(keysBackupMagic) + binary.Size(keysBackupHeader{})
+	if len(data) <= headerLength || !bytes.Equal(data[:len(keysBackupMagic)], keysBackupMagic) {
+		return nil, ErrInvalidKeysBackupFormat
+	}
+	header := keysBackupHeader{}
+	if err := binary.Read(bytes.NewReader(data[len(keysBackupMagic):headerLength]), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != keysBackupFormatVersion {
+		return nil, ErrInvalidKeysBackupVersion
+	}
+	if header.Time == 0 || header.Threads == 0 || header.Length != keystore.SymmetricKeyLength || header.Memory > keysBackupMaxArgon2Memory {
+		return nil, ErrInvalidKeysBackupFormat
+	}
+	encryptor, err := getKeysBackupEncryptor(passphrase, &header)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := encryptor.Decrypt(data[headerLength:], data[:headerLength])
+	if err != nil {
+		return nil, ErrKeysBackupDecryption
+	}
+	return archive, nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/cossacklabs/acra/keystore/filesystem"
+	"github.com/cossacklabs/acra/keystore/kv"
+	"github.com/cossacklabs/acra/network"
+)
+
+// Types of keystore
+const (
+	KeyStoreFilesystem = "filesystem"
+	KeyStoreVault      = "vault"
+)
+
+// VaultTokenEnvName is name of environment variable with token used to access Vault
+const VaultTokenEnvName = "VAULT_TOKEN"
+
+// Errors returned on invalid keystore parameters
+var (
+	ErrUnknownKeyStore = errors.New("unknown type of keystore, should be " + KeyStoreFilesystem + " or " + KeyStoreVault)
+	ErrEmptyVaultToken = errors.New("token of Vault should be passed via " + VaultTokenEnvName + " environment variable")
+)
+
+var keyStoreType = KeyStoreFilesystem
+var vaultAddress = "http://127.0.0.1:8200"
+var vaultMountPath = "secret"
+var vaultCAPath = ""
+
+// RegisterKeyStoreCmdParameters register cli parameters with flag for type of keystore and its options
+func RegisterKeyStoreCmdParameters() {
+	flag.StringVar(&keyStoreType, "keystore", keyStoreType, "Storage of keys: "+KeyStoreFilesystem+" - key folders in local file system, "+KeyStoreVault+" - Vault KV version 2 compatible HTTP API, key folders are paths of secrets")
+	flag.StringVar(&vaultAddress, "vault_address", vaultAddress, "Address of Vault HTTP API used as keystore. Token is taken from "+VaultTokenEnvName+" environment variable")
+	flag.StringVar(&vaultMountPath, "vault_kv_mount_path", vaultMountPath, "Mount path of Vault KV version 2 secrets engine which stores keys")
+	flag.StringVar(&vaultCAPath, "vault_tls_ca", vaultCAPath, "Path to root certificate which will be used with system root certificates to validate Vault's certificate")
+}
+
+// IsFilesystemKeyStore returns true if keys are stored in local file system
+func IsFilesystemKeyStore() bool {
+	return keyStoreType == KeyStoreFilesystem
+}
+
+// GetKeyStoreStorage returns storage of keystore selected with cli parameters, or nil for local file system
+func GetKeyStoreStorage() (filesystem.Storage, error) {
+	switch keyStoreType {
+	case KeyStoreFilesystem:
+		return nil, nil
+	case KeyStoreVault:
+		token := os.Getenv(VaultTokenEnvName)
+		if token == "" {
+			return nil, ErrEmptyVaultToken
+		}
+		var tlsConfig *tls.Config
+		if vaultCAPath != "" {
+			var err error
+			tlsConfig, err = network.NewTLSConfig("", vaultCAPath, "", "", tls.NoClientCert)
+			if err != nil {
+				return nil, err
+			}
+		}
+		storage, err := kv.NewStorage(vaultAddress, vaultMountPath, token, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	}
+	return nil, ErrUnknownKeyStore
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors returned by ClientLimiter when client exceeds its limits
+var (
+	ErrSessionLimitExceeded    = errors.New("client exceeded limit of concurrent sessions")
+	ErrQueryRateLimitExceeded  = errors.New("client exceeded limit of queries per second")
+	ErrDecryptionLimitExceeded = errors.New("client exceeded limit of decrypted bytes per minute")
+	ErrInvalidClientLimits     = errors.New("limits of clients can't be negative")
+)
+
+// clientIdleTimeout is time after which usage of client without sessions is removed. Buckets of queries and decrypted
+// bytes are refilled during this time, so removed usage doesn't differ from new one
+const clientIdleTimeout = time.Minute
+
+// ClientLimits configures limits applied to every client ID separately. Zero value of limit turns it off
+type ClientLimits struct {
+	MaxSessions             int
+	QueriesPerSecond        int
+	DecryptedBytesPerMinute int
+}
+
+// tokenBucket allows to take tokens which are refilled with constant rate up to capacity
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills bucket for time passed since last update and takes amount of tokens if bucket has enough of them
+func (bucket *tokenBucket) take(amount, capacity, perSecond float64, now time.Time) bool {
+	if bucket.updated.IsZero() {
+		bucket.tokens = capacity
+	} else if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * perSecond
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+	}
+	bucket.updated = now
+	if bucket.tokens < amount {
+		return false
+	}
+	bucket.tokens -= amount
+	return true
+}
+
+// clientUsage stores usage of limited resources by one client ID
+type clientUsage struct {
+	sessions       int
+	queries        tokenBucket
+	decryptedBytes tokenBucket
+	used           time.Time
+}
+
+// ClientLimiter tracks sessions, queries and decrypted data of client IDs and reports when they exceed ClientLimits.
+// Usage of client is kept for clientIdleTimeout after its sessions are closed so reconnects don't reset rate limits
+type ClientLimiter struct {
+	limits  ClientLimits
+	lock    sync.Mutex
+	clients map[string]*clientUsage
+	evicted time.Time
+	now     func() time.Time
+}
+
+// NewClientLimiter returns limiter which applies limits to every client ID
+func NewClientLimiter(limits ClientLimits) (*ClientLimiter, error) {
+	if limits.MaxSessions < 0 || limits.QueriesPerSecond < 0 || limits.DecryptedBytesPerMinute < 0 {
+		return nil, ErrInvalidClientLimits
+	}
+	return &ClientLimiter{limits: limits, clients: make(map[string]*clientUsage), now: time.Now}, nil
+}
+
+// usage returns usage of client ID and removes usages of idle clients, should be called with acquired lock
+func (limiter *ClientLimiter) usage(clientID []byte, now time.Time) *clientUsage {
+	if now.Sub(limiter.evicted) >= clientIdleTimeout {
+		limiter.evictIdleClients(now)
+	}
+	usage, ok := limiter.clients[string(clientID)]
+	if !ok {
+		usage = &clientUsage{}
+		limiter.clients[string(clientID)] = usage
+	}
+	usage.used = now
+	return usage
+}
+
+// evictIdleClients removes usages of clients without sessions which weren't used for clientIdleTimeout, should be
+// called with acquired lock
+func (limiter *ClientLimiter) evictIdleClients(now time.Time) {
+	for clientID, usage := range limiter.clients {
+		if usage.sessions == 0 && now.Sub(usage.used) >= clientIdleTimeout {
+			delete(limiter.clients, clientID)
+		}
+	}
+	limiter.evicted = now
+}
+
+// AcquireSession registers new session of client ID or returns ErrSessionLimitExceeded. Every acquired session should
+// be released with ReleaseSession
+func (limiter *ClientLimiter) AcquireSession(clientID []byte) error {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.acquireSession(clientID, limiter.now())
+}
+
+// acquireSession registers new session of client ID if it doesn't exceed limit, should be called with acquired lock
+func (limiter *ClientLimiter) acquireSession(clientID []byte, now time.Time) error {
+	usage := limiter.usage(clientID, now)
+	if limiter.limits.MaxSessions > 0 && usage.sessions >= limiter.limits.MaxSessions {
+		return ErrSessionLimitExceeded
+	}
+	usage.sessions++
+	return nil
+}
+
+// ReleaseSession unregisters session of client ID acquired with AcquireSession
+func (limiter *ClientLimiter) ReleaseSession(clientID []byte) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.releaseSession(clientID, limiter.now())
+}
+
+// releaseSession unregisters session of client ID, should be called with acquired lock
+func (limiter *ClientLimiter) releaseSession(clientID []byte, now time.Time) {
+	if usage := limiter.usage(clientID, now); usage.sessions > 0 {
+		usage.sessions--
+	}
+}
+
+// MoveSession moves session acquired for client ID from to client ID to, when client ID of connection is changed
+// after login mapping. Returns ErrSessionLimitExceeded and keeps session of from if to has no free sessions
+func (limiter *ClientLimiter) MoveSession(from, to []byte) error {
+	if string(from) == string(to) {
+		return nil
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.now()
+	if err := limiter.acquireSession(to, now); err != nil {
+		return err
+	}
+	limiter.releaseSession(from, now)
+	return nil
+}
+
+// AllowQuery registers new query of client ID or returns ErrQueryRateLimitExceeded. Client may send up to
+// QueriesPerSecond queries at once after it was idle for a second
+func (limiter *ClientLimiter) AllowQuery(clientID []byte) error {
+	if limiter.limits.QueriesPerSecond == 0 {
+		return nil
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.now()
+	perSecond := float64(limiter.limits.QueriesPerSecond)
+	if !limiter.usage(clientID, now).queries.take(1, perSecond, perSecond, now) {
+		return ErrQueryRateLimitExceeded
+	}
+	return nil
+}
+
+// AllowDecryptedBytes registers count of bytes decrypted for client ID or returns ErrDecryptionLimitExceeded if
+// they shouldn't be returned to client
+func (limiter *ClientLimiter) AllowDecryptedBytes(clientID []byte, count int) error {
+	if limiter.limits.DecryptedBytesPerMinute == 0 || count == 0 {
+		return nil
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.now()
+	perMinute := float64(limiter.limits.DecryptedBytesPerMinute)
+	if !limiter.usage(clientID, now).decryptedBytes.take(float64(count), perMinute, perMinute/60, now) {
+		return ErrDecryptionLimitExceeded
+	}
+	return nil
+}
+
+// IsClientLimitError returns true if err is returned by ClientLimiter on exceeded limit
+func IsClientLimitError(err error) bool {
+	return err == ErrSessionLimitExceeded || err == ErrQueryRateLimitExceeded || err == ErrDecryptionLimitExceeded
+}
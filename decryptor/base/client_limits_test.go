@@ -0,0 +1,125 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	if _, err := NewClientLimiter(ClientLimits{MaxSessions: -1}); err != ErrInvalidClientLimits {
+		t.Fatalf("Expected ErrInvalidClientLimits, took %v", err)
+	}
+	limiter, err := NewClientLimiter(ClientLimits{MaxSessions: 1, QueriesPerSecond: 2, DecryptedBytesPerMinute: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time { return now }
+	first, second := []byte("first"), []byte("second")
+
+	if err := limiter.AcquireSession(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.AcquireSession(first); err != ErrSessionLimitExceeded {
+		t.Fatalf("Expected ErrSessionLimitExceeded, took %v", err)
+	}
+	if err := limiter.AcquireSession(second); err != nil {
+		t.Fatalf("Limits of other client shouldn't be affected, took %v", err)
+	}
+	limiter.ReleaseSession(first)
+	if err := limiter.AcquireSession(first); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.AllowQuery(first); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := limiter.AllowQuery(first); err != ErrQueryRateLimitExceeded {
+		t.Fatalf("Expected ErrQueryRateLimitExceeded, took %v", err)
+	}
+	now = now.Add(time.Millisecond * 500)
+	if err := limiter.AllowQuery(first); err != nil {
+		t.Fatalf("Expected refilled query after half of second, took %v", err)
+	}
+
+	if err := limiter.AllowDecryptedBytes(first, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.AllowDecryptedBytes(first, 20); err != ErrDecryptionLimitExceeded {
+		t.Fatalf("Expected ErrDecryptionLimitExceeded, took %v", err)
+	}
+	now = now.Add(time.Second * 10)
+	if err := limiter.AllowDecryptedBytes(first, 20); err != nil {
+		t.Fatalf("Expected refilled bytes after 10 seconds, took %v", err)
+	}
+	if err := limiter.AllowDecryptedBytes(second, 61); err != ErrDecryptionLimitExceeded {
+		t.Fatalf("Expected ErrDecryptionLimitExceeded for data bigger than limit, took %v", err)
+	}
+}
+
+func TestClientLimiterMoveSession(t *testing.T) {
+	limiter, err := NewClientLimiter(ClientLimits{MaxSessions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, mapped := []byte("transport"), []byte("mapped")
+	if err := limiter.AcquireSession(transport); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.MoveSession(transport, mapped); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.AcquireSession(transport); err != nil {
+		t.Fatalf("Expected released session of transport client ID, took %v", err)
+	}
+	if err := limiter.MoveSession(transport, mapped); err != ErrSessionLimitExceeded {
+		t.Fatalf("Expected ErrSessionLimitExceeded, took %v", err)
+	}
+	if err := limiter.AcquireSession(transport); err != ErrSessionLimitExceeded {
+		t.Fatalf("Session of transport client ID should be kept after failed move, took %v", err)
+	}
+}
+
+func TestClientLimiterEvictIdleClients(t *testing.T) {
+	limiter, err := NewClientLimiter(ClientLimits{QueriesPerSecond: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time { return now }
+	idle, connected := []byte("idle"), []byte("connected")
+	if err := limiter.AllowQuery(idle); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.AcquireSession(connected); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(clientIdleTimeout)
+	if err := limiter.AllowQuery([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := limiter.clients[string(idle)]; ok {
+		t.Fatal("Usage of idle client wasn't removed")
+	}
+	if _, ok := limiter.clients[string(connected)]; !ok {
+		t.Fatal("Usage of client with session was removed")
+	}
+}
@@ -104,6 +104,8 @@ type Decryptor interface {
 	// return private key for current connected client for decrypting symmetric
 	// key with secure message
 	GetPrivateKey() (*keys.PrivateKey, error)
+	// return current private key followed by its previous versions to decrypt AcraStructs encrypted before rotation
+	GetPrivateKeys() ([]*keys.PrivateKey, error)
 	TurnOnPoisonRecordCheck(bool)
 	IsPoisonRecordCheckOn() bool
 	// register storage of callbacks for detected poison records
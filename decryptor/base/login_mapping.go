@@ -0,0 +1,96 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base
+
+import (
+	"errors"
+
+	"github.com/cossacklabs/acra/keystore"
+	"gopkg.in/yaml.v2"
+)
+
+// Errors returned on loading and using mapping of database logins
+var (
+	ErrEmptyLoginUser         = errors.New("user of login mapping is empty")
+	ErrInvalidLoginClientID   = errors.New("client ID of login mapping is invalid")
+	ErrDuplicatedLoginMapping = errors.New("login mapping is duplicated")
+	ErrLoginClientIDNotFound  = errors.New("client ID for database login not found")
+)
+
+// LoginCallback is called by proxies with database user and application name sent by client on authentication.
+// Application name is empty if client didn't send it. Connection is closed if callback returns error
+type LoginCallback func(user, applicationName string) error
+
+// LoginMappingEntry maps database user connected by application to client ID. Entry matches all applications of user
+// if ApplicationName is empty
+type LoginMappingEntry struct {
+	User            string `yaml:"user"`
+	ApplicationName string `yaml:"application_name"`
+	ClientID        string `yaml:"client_id"`
+}
+
+type loginKey struct {
+	user            string
+	applicationName string
+}
+
+// LoginMapping stores client IDs of database logins
+type LoginMapping struct {
+	clientIDs map[loginKey][]byte
+}
+
+// NewLoginMappingFromConfig returns mapping loaded from yaml config with list of LoginMappingEntry under "logins" key
+func NewLoginMappingFromConfig(config []byte) (*LoginMapping, error) {
+	parsed := struct {
+		Logins []LoginMappingEntry `yaml:"logins"`
+	}{}
+	if err := yaml.Unmarshal(config, &parsed); err != nil {
+		return nil, err
+	}
+	mapping := &LoginMapping{clientIDs: make(map[loginKey][]byte, len(parsed.Logins))}
+	for _, entry := range parsed.Logins {
+		if entry.User == "" {
+			return nil, ErrEmptyLoginUser
+		}
+		if !keystore.ValidateID([]byte(entry.ClientID)) {
+			return nil, ErrInvalidLoginClientID
+		}
+		key := loginKey{user: entry.User, applicationName: entry.ApplicationName}
+		if _, ok := mapping.clientIDs[key]; ok {
+			return nil, ErrDuplicatedLoginMapping
+		}
+		mapping.clientIDs[key] = []byte(entry.ClientID)
+	}
+	return mapping, nil
+}
+
+// ClientID returns client ID of user connected by application. Entry with the same application name has priority over
+// entry without it. Returns false if login isn't mapped
+func (mapping *LoginMapping) ClientID(user, applicationName string) ([]byte, bool) {
+	if applicationName != "" {
+		if clientID, ok := mapping.clientIDs[loginKey{user: user, applicationName: applicationName}]; ok {
+			return clientID, true
+		}
+	}
+	clientID, ok := mapping.clientIDs[loginKey{user: user}]
+	return clientID, ok
+}
+
+// ClientIDSetter is implemented by components which process data of connection using its client ID
+type ClientIDSetter interface {
+	SetClientID(clientID []byte)
+}
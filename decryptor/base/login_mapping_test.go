@@ -0,0 +1,64 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package base_test
+
+import (
+	"testing"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+func TestLoginMapping(t *testing.T) {
+	config := `
+logins:
+  - user: billing
+    client_id: billing
+  - user: billing
+    application_name: reports
+    client_id: billing_reports
+`
+	mapping, err := base.NewLoginMappingFromConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		user, applicationName, clientID string
+		found                           bool
+	}{
+		{"billing", "", "billing", true},
+		{"billing", "psql", "billing", true},
+		{"billing", "reports", "billing_reports", true},
+		{"reports", "reports", "", false},
+	}
+	for _, testCase := range testCases {
+		clientID, ok := mapping.ClientID(testCase.user, testCase.applicationName)
+		if ok != testCase.found || string(clientID) != testCase.clientID {
+			t.Fatalf("Incorrect client ID <%s> of user <%s> with application <%s>", clientID, testCase.user, testCase.applicationName)
+		}
+	}
+
+	invalidConfigs := map[string]error{
+		"logins:\n  - client_id: client":                                                       base.ErrEmptyLoginUser,
+		"logins:\n  - user: user\n    client_id: invalid.id":                                   base.ErrInvalidLoginClientID,
+		"logins:\n  - user: user\n    client_id: client\n  - user: user\n    client_id: other": base.ErrDuplicatedLoginMapping,
+	}
+	for config, expectedErr := range invalidConfigs {
+		if _, err := base.NewLoginMappingFromConfig([]byte(config)); err != expectedErr {
+			t.Fatalf("Expected %v, took %v", expectedErr, err)
+		}
+	}
+}
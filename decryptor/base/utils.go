@@ -19,6 +19,7 @@ package base
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 
 	"errors"
 	"github.com/cossacklabs/acra/keystore"
@@ -47,6 +48,15 @@ var (
 	ErrIncorrectAcraStructDataLength = errors.New("AcraStruct has incorrect data length value")
 )
 
+// Errors show incorrect header of AcraStruct
+var (
+	ErrIncorrectAcraStructTagBegin  = errors.New("AcraStruct doesn't start with TagBegin")
+	ErrIncorrectAcraStructPublicKey = errors.New("AcraStruct has incorrect ephemeral public key")
+)
+
+// acraStructPublicKeyTag starts ephemeral EC public key of AcraStruct serialized by Themis
+var acraStructPublicKeyTag = []byte("UEC2")
+
 // ValidateAcraStructLength check that data has minimal length for AcraStruct and data block equal to data length in AcraStruct
 func ValidateAcraStructLength(data []byte) error {
 	baseLength := GetMinAcraStructLength()
@@ -60,6 +70,23 @@ func ValidateAcraStructLength(data []byte) error {
 	return nil
 }
 
+// ValidateAcraStruct checks length of AcraStruct, TagBegin and header of ephemeral public key. Data with correct
+// length fields but without them isn't AcraStruct
+func ValidateAcraStruct(data []byte) error {
+	if err := ValidateAcraStructLength(data); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, TagBegin) {
+		return ErrIncorrectAcraStructTagBegin
+	}
+	publicKey := data[len(TagBegin) : len(TagBegin)+PublicKeyLength]
+	if !bytes.HasPrefix(publicKey, acraStructPublicKeyTag) ||
+		binary.BigEndian.Uint32(publicKey[len(acraStructPublicKeyTag):]) != PublicKeyLength {
+		return ErrIncorrectAcraStructPublicKey
+	}
+	return nil
+}
+
 // DecryptAcrastruct returns plaintext data from AcraStruct, decrypting it using Themis SecureCell in Seal mode,
 // using zone as context and privateKey as decryption key.
 // Returns error if decryption failed.
@@ -91,6 +118,82 @@ func DecryptAcrastruct(data []byte, privateKey *keys.PrivateKey, zone []byte) ([
 	return decrypted, nil
 }
 
+// MaxPreviousKeyVersions limits count of previous versions of private key tried to decrypt AcraStruct which current
+// key can't decrypt, so data that isn't encrypted with any version doesn't cost decryption with every retired key
+const MaxPreviousKeyVersions = 10
+
+// zeroPrivateKeys fills values of private keys with zeros
+func zeroPrivateKeys(privateKeys []*keys.PrivateKey) {
+	for _, privateKey := range privateKeys {
+		utils.FillSlice(byte(0), privateKey.Value)
+	}
+}
+
+// previousKeyVersions returns up to MaxPreviousKeyVersions keys of privateKeys which differ from current privateKey
+func previousKeyVersions(privateKey *keys.PrivateKey, privateKeys []*keys.PrivateKey) []*keys.PrivateKey {
+	previousKeys := make([]*keys.PrivateKey, 0, len(privateKeys))
+	for _, previousKey := range privateKeys {
+		if len(previousKeys) == MaxPreviousKeyVersions {
+			break
+		}
+		if !bytes.Equal(previousKey.Value, privateKey.Value) {
+			previousKeys = append(previousKeys, previousKey)
+		}
+	}
+	return previousKeys
+}
+
+// DecryptAcrastructWithPreviousKeys decrypts AcraStruct with privateKey and, if it fails, with up to
+// MaxPreviousKeyVersions previous versions of private key returned by getPrivateKeys, so AcraStructs encrypted before
+// key rotation remain decryptable. Previous versions are loaded only when current key can't decrypt AcraStruct and
+// filled with zeros after use.
+func DecryptAcrastructWithPreviousKeys(data []byte, privateKey *keys.PrivateKey, getPrivateKeys func() ([]*keys.PrivateKey, error), zone []byte) ([]byte, error) {
+	decrypted, err := DecryptAcrastruct(data, privateKey, zone)
+	if err == nil {
+		return decrypted, nil
+	}
+	privateKeys, keysErr := getPrivateKeys()
+	if keysErr != nil {
+		return decrypted, err
+	}
+	defer zeroPrivateKeys(privateKeys)
+	for _, previousKey := range previousKeyVersions(privateKey, privateKeys) {
+		if previousDecrypted, previousErr := DecryptAcrastruct(data, previousKey, zone); previousErr == nil {
+			return previousDecrypted, nil
+		}
+	}
+	return decrypted, err
+}
+
+// ReadSymmetricKeyWithPreviousKeys reads symmetric key of AcraStruct from reader with privateKey and, if it fails,
+// with up to MaxPreviousKeyVersions previous versions of private key returned by decryptor which are filled with
+// zeros after use. On success reader is positioned after key block as after decryptor.ReadSymmetricKey with the key
+// which decrypted AcraStruct.
+func ReadSymmetricKeyWithPreviousKeys(decryptor Decryptor, privateKey *keys.PrivateKey, reader io.ReadSeeker) ([]byte, []byte, error) {
+	start, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+	symmetricKey, rawData, err := decryptor.ReadSymmetricKey(privateKey, reader)
+	if err == nil {
+		return symmetricKey, rawData, nil
+	}
+	privateKeys, keysErr := decryptor.GetPrivateKeys()
+	if keysErr != nil {
+		return symmetricKey, rawData, err
+	}
+	defer zeroPrivateKeys(privateKeys)
+	for _, previousKey := range previousKeyVersions(privateKey, privateKeys) {
+		if _, seekErr := reader.Seek(start, io.SeekStart); seekErr != nil {
+			return symmetricKey, rawData, err
+		}
+		if previousSymmetricKey, previousRawData, previousErr := decryptor.ReadSymmetricKey(previousKey, reader); previousErr == nil {
+			return previousSymmetricKey, previousRawData, nil
+		}
+	}
+	return symmetricKey, rawData, err
+}
+
 // CheckPoisonRecord checks if AcraStruct could be decrypted using Poison Record private key.
 // Returns true if AcraStruct is poison record, returns false otherwise.
 // Returns error if Poison record key is not found.
@@ -81,3 +81,78 @@ func TestDecryptAcrastruct(t *testing.T) {
 		t.Fatal("decrypted != test_data")
 	}
 }
+
+func TestDecryptAcrastructWithPreviousKeys(t *testing.T) {
+	testData := []byte("some data")
+	previousKeypair, err := keys.New(keys.KEYTYPE_EC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentKeypair, err := keys.New(keys.KEYTYPE_EC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneID := zone.GenerateZoneID()
+	acrastruct, err := acrawriter.CreateAcrastruct(testData, previousKeypair.Public, zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := false
+	var returnedKeys []*keys.PrivateKey
+	// keystore returns copies of keys which are filled with zeros after use
+	copyKeys := func(privateKeys ...*keys.PrivateKey) []*keys.PrivateKey {
+		returnedKeys = nil
+		for _, privateKey := range privateKeys {
+			returnedKeys = append(returnedKeys, &keys.PrivateKey{Value: append([]byte{}, privateKey.Value...)})
+		}
+		return returnedKeys
+	}
+	getPrivateKeys := func() ([]*keys.PrivateKey, error) {
+		loaded = true
+		return copyKeys(currentKeypair.Private, previousKeypair.Private), nil
+	}
+	decrypted, err := base.DecryptAcrastructWithPreviousKeys(acrastruct, currentKeypair.Private, getPrivateKeys, zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, testData) {
+		t.Fatal("Decrypted data doesn't match test data")
+	}
+	for _, privateKey := range returnedKeys {
+		if !bytes.Equal(privateKey.Value, make([]byte, len(privateKey.Value))) {
+			t.Fatal("Previous versions of key weren't filled with zeros after use")
+		}
+	}
+
+	// previous versions aren't loaded when current key decrypts AcraStruct
+	loaded = false
+	if _, err := base.DecryptAcrastructWithPreviousKeys(acrastruct, previousKeypair.Private, getPrivateKeys, zoneID); err != nil {
+		t.Fatal(err)
+	}
+	if loaded {
+		t.Fatal("Previous versions of key loaded without need")
+	}
+
+	onlyCurrentKey := func() ([]*keys.PrivateKey, error) {
+		return copyKeys(currentKeypair.Private), nil
+	}
+	if _, err := base.DecryptAcrastructWithPreviousKeys(acrastruct, currentKeypair.Private, onlyCurrentKey, zoneID); err == nil {
+		t.Fatal("Expected error without key used to encrypt AcraStruct")
+	}
+
+	// versions older than MaxPreviousKeyVersions aren't tried
+	tooOldKey := func() ([]*keys.PrivateKey, error) {
+		privateKeys := []*keys.PrivateKey{currentKeypair.Private}
+		for i := 0; i < base.MaxPreviousKeyVersions; i++ {
+			keypair, err := keys.New(keys.KEYTYPE_EC)
+			if err != nil {
+				return nil, err
+			}
+			privateKeys = append(privateKeys, keypair.Private)
+		}
+		return copyKeys(append(privateKeys, previousKeypair.Private)...), nil
+	}
+	if _, err := base.DecryptAcrastructWithPreviousKeys(acrastruct, currentKeypair.Private, tooOldKey, zoneID); err == nil {
+		t.Fatal("Expected error for AcraStruct encrypted with too old version of key")
+	}
+}
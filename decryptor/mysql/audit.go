@@ -0,0 +1,50 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"github.com/cossacklabs/acra/audit"
+	"github.com/cossacklabs/acra/logging"
+)
+
+// SetAuditLog sets audit log of client's queries and decryptions. Nothing is written if auditLog is nil
+func (handler *MysqlHandler) SetAuditLog(auditLog *audit.Log) {
+	handler.auditLog = auditLog
+}
+
+// auditQuery writes query and verdict of AcraCensor to audit log
+func (handler *MysqlHandler) auditQuery(query, verdict string) {
+	if handler.auditLog == nil {
+		return
+	}
+	if err := handler.auditLog.LogQuery(handler.getClientID(), query, verdict); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWriteAuditLog).
+			Errorln("Can't write query to audit log")
+	}
+}
+
+// auditDecryptions writes count of AcraStructs decrypted in result set to audit log when result set is sent to client
+func (handler *MysqlHandler) auditDecryptions() {
+	if handler.auditLog == nil || handler.decryptedCount == 0 {
+		return
+	}
+	if err := handler.auditLog.LogDecryption(handler.getClientID(), handler.decryptedCount); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWriteAuditLog).
+			Errorln("Can't write decryption to audit log")
+	}
+	handler.decryptedCount = 0
+}
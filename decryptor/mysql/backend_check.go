@@ -0,0 +1,72 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+
+	"github.com/cossacklabs/acra/network"
+	driver "github.com/go-sql-driver/mysql"
+)
+
+// readOnlyQuery returns 1 on read-only replicas and 0 on primary database
+const readOnlyQuery = "SELECT @@global.read_only"
+
+// backendCheckTLSConfigName is name of TLS config registered in driver for checks of backends
+const backendCheckTLSConfigName = "acra-backend-check"
+
+// ErrDatabaseReadOnly returned by checker of primary databases for read-only replica
+var ErrDatabaseReadOnly = errors.New("database is read-only")
+
+// NewBackendChecker returns checker which starts session with database authenticated by user and password. Database
+// shouldn't be read-only if primary is true, otherwise both primary databases and replicas are accepted. Connections
+// use TLS if tlsConfig isn't nil
+func NewBackendChecker(user, password string, tlsConfig *tls.Config, primary bool) (network.BackendChecker, error) {
+	if tlsConfig != nil {
+		if err := driver.RegisterTLSConfig(backendCheckTLSConfigName, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	return func(address string) error {
+		config := driver.NewConfig()
+		config.User = user
+		config.Passwd = password
+		config.Net = "tcp"
+		config.Addr = address
+		config.Timeout = network.DefaultNetworkTimeout
+		config.ReadTimeout = network.DefaultNetworkTimeout
+		config.WriteTimeout = network.DefaultNetworkTimeout
+		if tlsConfig != nil {
+			config.TLSConfig = backendCheckTLSConfigName
+		}
+		db, err := sql.Open("mysql", config.FormatDSN())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		var readOnly bool
+		if err := db.QueryRow(readOnlyQuery).Scan(&readOnly); err != nil {
+			return err
+		}
+		if primary && readOnly {
+			return ErrDatabaseReadOnly
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"net"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+)
+
+// SetClientLimiter sets limiter of client's queries and decrypted data. Limits aren't checked if limiter is nil
+func (handler *MysqlHandler) SetClientLimiter(limiter *base.ClientLimiter) {
+	handler.limiter = limiter
+}
+
+// allowQuery returns error if client exceeded limit of queries
+func (handler *MysqlHandler) allowQuery() error {
+	if handler.limiter == nil {
+		return nil
+	}
+	return handler.limiter.AllowQuery(handler.getClientID())
+}
+
+// allowDecryptedBytes returns error if client exceeded limit of decrypted data with count of decrypted bytes
+func (handler *MysqlHandler) allowDecryptedBytes(count int) error {
+	if handler.limiter == nil {
+		return nil
+	}
+	return handler.limiter.AllowDecryptedBytes(handler.getClientID(), count)
+}
+
+// sendClientLimitError replaces packet's data with error about exceeded limit and sends it to client
+func (handler *MysqlHandler) sendClientLimitError(packet *MysqlPacket, limitErr error) {
+	packet.SetData(NewClientLimitError(limitErr, handler.clientProtocol41))
+	if err := handler.writeToClient(handler.getClientConnection(), packet); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+			Errorln("Can't write response with error to client")
+	}
+}
+
+// rejectQueryResult reads rest of result set from database till packet for which isLastRow returns true and sends
+// error about exceeded limit to client instead of whole result set
+func (handler *MysqlHandler) rejectQueryResult(limitErr error, isLastRow func(*MysqlPacket) bool, dbConnection, clientConnection net.Conn) error {
+	handler.logger.WithError(limitErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+		Warningln("Client exceeded limit of decrypted data, result replaced with error")
+	// decrypted rows aren't returned to client
+	handler.decryptedCount = 0
+	for {
+		packet, err := handler.readDbPacket(dbConnection)
+		if err != nil {
+			return err
+		}
+		if packet.IsErr() || isLastRow(packet) {
+			break
+		}
+	}
+	errPacket := NewMysqlPacket()
+	errPacket.SetData(NewClientLimitError(limitErr, handler.clientProtocol41))
+	return handler.writeToClient(clientConnection, errPacket)
+}
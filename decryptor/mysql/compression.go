@@ -0,0 +1,250 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// CompressedPacketHeaderSize 3 bytes of compressed payload length, 1 byte of compressed sequence_id and 3 bytes of
+	// payload length before compression https://dev.mysql.com/doc/internals/en/compressed-packet-header.html
+	CompressedPacketHeaderSize = 7
+	// minCompressLength payloads shorter than this are sent without compression as MySQL does
+	minCompressLength = 50
+)
+
+// ErrMalformCompressedPacket if payload of compressed packet can't be decompressed
+var ErrMalformCompressedPacket = errors.New("malform compressed packet")
+
+// compressedConnection reads and writes MySQL packets wrapped into compressed packets. Connection passes data as is
+// until compression is enabled after successful authentication
+// https://dev.mysql.com/doc/internals/en/compression.html
+type compressedConnection struct {
+	net.Conn
+	// enabled is 1 if data is compressed
+	enabled int32
+	// lock protects sequence and writes of compressed packets
+	lock sync.Mutex
+	// sequence is compressed sequence_id of next written packet. It continues sequence of last read packet and is
+	// reset at every command if resetOnCommand is true
+	sequence byte
+	// resetOnCommand is true for connection with database where proxy sends commands
+	resetOnCommand bool
+	// raw is compressed data read before it was known that compression is enabled
+	raw []byte
+	// buffer is decompressed data that wasn't read yet
+	buffer []byte
+}
+
+// newCompressedConnection returns connection which passes data as is until compression is enabled. resetOnCommand
+// should be true for connection with database
+func newCompressedConnection(connection net.Conn, resetOnCommand bool) *compressedConnection {
+	return &compressedConnection{Conn: connection, resetOnCommand: resetOnCommand}
+}
+
+// enableCompression switches connection to compressed protocol
+func (connection *compressedConnection) enableCompression() {
+	atomic.StoreInt32(&connection.enabled, 1)
+}
+
+func (connection *compressedConnection) isEnabled() bool {
+	return atomic.LoadInt32(&connection.enabled) == 1
+}
+
+// Read reads decompressed data
+func (connection *compressedConnection) Read(p []byte) (int, error) {
+	for len(connection.buffer) == 0 {
+		if !connection.isEnabled() {
+			n, err := connection.Conn.Read(p)
+			if n == 0 || !connection.isEnabled() {
+				return n, err
+			}
+			// compression was enabled while waiting for data so it is compressed
+			connection.raw = append(connection.raw, p[:n]...)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := connection.readCompressedPacket(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, connection.buffer)
+	connection.buffer = connection.buffer[n:]
+	return n, nil
+}
+
+// readFull reads len(buf) bytes of compressed data
+func (connection *compressedConnection) readFull(buf []byte) error {
+	n := copy(buf, connection.raw)
+	connection.raw = connection.raw[n:]
+	if n == len(buf) {
+		return nil
+	}
+	_, err := io.ReadFull(connection.Conn, buf[n:])
+	return err
+}
+
+// readCompressedPacket reads compressed packet and puts its decompressed payload to buffer
+func (connection *compressedConnection) readCompressedPacket() error {
+	header := make([]byte, CompressedPacketHeaderSize)
+	if err := connection.readFull(header); err != nil {
+		return err
+	}
+	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	uncompressedLength := int(uint32(header[4]) | uint32(header[5])<<8 | uint32(header[6])<<16)
+	payload := make([]byte, length)
+	if err := connection.readFull(payload); err != nil {
+		return err
+	}
+	connection.lock.Lock()
+	connection.sequence = header[SequenceIDIndex] + 1
+	connection.lock.Unlock()
+	if uncompressedLength == 0 {
+		connection.buffer = payload
+		return nil
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return ErrMalformCompressedPacket
+	}
+	defer reader.Close()
+	data := make([]byte, uncompressedLength)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return ErrMalformCompressedPacket
+	}
+	connection.buffer = data
+	return nil
+}
+
+// Write wraps data into compressed packets. Data should start with header of MySQL packet
+func (connection *compressedConnection) Write(data []byte) (int, error) {
+	if !connection.isEnabled() {
+		return connection.Conn.Write(data)
+	}
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if connection.resetOnCommand && len(data) > SequenceIDIndex && data[SequenceIDIndex] == 0 {
+		// compressed sequence_id is reset with sequence_id of packets at start of every command
+		connection.sequence = 0
+	}
+	output := make([]byte, 0, len(data)+CompressedPacketHeaderSize)
+	for offset := 0; offset < len(data); offset += MaxPayloadLen {
+		end := offset + MaxPayloadLen
+		if end > len(data) {
+			end = len(data)
+		}
+		packet, err := connection.compressPacket(data[offset:end])
+		if err != nil {
+			return 0, err
+		}
+		output = append(output, packet...)
+	}
+	if _, err := connection.Conn.Write(output); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// compressPacket returns compressed packet with payload and increments sequence
+func (connection *compressedConnection) compressPacket(payload []byte) ([]byte, error) {
+	uncompressedLength := 0
+	if len(payload) >= minCompressLength {
+		compressed := bytes.NewBuffer(make([]byte, 0, len(payload)))
+		writer := zlib.NewWriter(compressed)
+		if _, err := writer.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		// incompressible data is sent as is
+		if compressed.Len() < len(payload) {
+			uncompressedLength = len(payload)
+			payload = compressed.Bytes()
+		}
+	}
+	header := []byte{
+		byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16),
+		connection.sequence,
+		byte(uncompressedLength), byte(uncompressedLength >> 8), byte(uncompressedLength >> 16),
+	}
+	connection.sequence++
+	return append(header, payload...), nil
+}
+
+// startCompression wraps connections with client and database to switch them to compressed protocol after successful
+// authentication
+func (handler *MysqlHandler) startCompression() {
+	handler.connectionLock.Lock()
+	defer handler.connectionLock.Unlock()
+	handler.clientCompression = newCompressedConnection(handler.clientConnection, false)
+	handler.dbCompression = newCompressedConnection(handler.dbConnection, true)
+	handler.clientConnection = handler.clientCompression
+	handler.dbConnection = handler.dbCompression
+}
+
+// getClientConnection returns connection with client which may be replaced with TLS or compressed connection
+func (handler *MysqlHandler) getClientConnection() net.Conn {
+	handler.connectionLock.Lock()
+	defer handler.connectionLock.Unlock()
+	return handler.clientConnection
+}
+
+// setClientConnection replaces connection with client
+func (handler *MysqlHandler) setClientConnection(connection net.Conn) {
+	handler.connectionLock.Lock()
+	defer handler.connectionLock.Unlock()
+	handler.clientConnection = connection
+}
+
+// getDbConnection returns connection with database which may be replaced with TLS or compressed connection
+func (handler *MysqlHandler) getDbConnection() net.Conn {
+	handler.connectionLock.Lock()
+	defer handler.connectionLock.Unlock()
+	return handler.dbConnection
+}
+
+// setDbConnection replaces connection with database
+func (handler *MysqlHandler) setDbConnection(connection net.Conn) {
+	handler.connectionLock.Lock()
+	defer handler.connectionLock.Unlock()
+	handler.dbConnection = connection
+}
+
+// enablePendingCompression switches connections wrapped by startCompression to compressed protocol and returns
+// connection with client without compression to send packet that finishes authentication. Returns nil if client
+// didn't request compression or it's enabled already
+func (handler *MysqlHandler) enablePendingCompression() net.Conn {
+	handler.connectionLock.Lock()
+	defer handler.connectionLock.Unlock()
+	if handler.clientCompression == nil || handler.clientCompression.isEnabled() {
+		return nil
+	}
+	// enable before client receives packet and starts to send compressed data
+	handler.clientCompression.enableCompression()
+	handler.dbCompression.enableCompression()
+	return handler.clientCompression.Conn
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// newTestPacket returns MySQL packet with payload and sequence_id
+func newTestPacket(sequence byte, payload []byte) *MysqlPacket {
+	packet := NewMysqlPacket()
+	packet.SetData(payload)
+	packet.header[SequenceIDIndex] = sequence
+	return packet
+}
+
+func TestCompressedConnection(t *testing.T) {
+	clientSide, proxySide := net.Pipe()
+	defer clientSide.Close()
+	defer proxySide.Close()
+	client := newCompressedConnection(clientSide, true)
+	proxy := newCompressedConnection(proxySide, false)
+
+	write := func(connection net.Conn, packets ...*MysqlPacket) {
+		go func() {
+			for _, packet := range packets {
+				if _, err := connection.Write(packet.Dump()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	read := func(connection net.Conn, expected *MysqlPacket) {
+		t.Helper()
+		packet, err := ReadPacket(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packet.Dump(), expected.Dump()) {
+			t.Fatalf("Expected %v, took %v", expected.Dump(), packet.Dump())
+		}
+	}
+
+	// data is passed as is before compression is enabled
+	plain := newTestPacket(1, []byte("authentication data"))
+	write(client, plain)
+	read(proxy, plain)
+
+	// proxy waits for command when compression is enabled
+	command := newTestPacket(0, append([]byte{COM_QUERY}, bytes.Repeat([]byte("select 1;"), 20)...))
+	readResult := make(chan error)
+	go func() {
+		packet, err := ReadPacket(proxy)
+		if err == nil && !bytes.Equal(packet.Dump(), command.Dump()) {
+			err = io.ErrUnexpectedEOF
+		}
+		readResult <- err
+	}()
+	proxy.enableCompression()
+	client.enableCompression()
+	write(client, command)
+	if err := <-readResult; err != nil {
+		t.Fatal(err)
+	}
+
+	// responses continue compressed sequence of command
+	responses := []*MysqlPacket{newTestPacket(1, []byte{1}), newTestPacket(2, bytes.Repeat([]byte{'a'}, 100))}
+	rawHeaders := make(chan []byte)
+	go func() {
+		for range responses {
+			header := make([]byte, CompressedPacketHeaderSize)
+			if _, err := io.ReadFull(clientSide, header); err != nil {
+				t.Error(err)
+			}
+			payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+			if _, err := io.ReadFull(clientSide, payload); err != nil {
+				t.Error(err)
+			}
+			rawHeaders <- header
+		}
+	}()
+	write(proxy, responses...)
+	for i := range responses {
+		header := <-rawHeaders
+		if header[SequenceIDIndex] != byte(i+1) {
+			t.Fatalf("Expected compressed sequence %v, took %v", i+1, header[SequenceIDIndex])
+		}
+		isCompressed := header[4] != 0
+		if isCompressed != (i == 1) {
+			t.Fatalf("Only payloads longer than %v bytes should be compressed", minCompressLength)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"sync"
 
 	"github.com/cossacklabs/acra/decryptor/base"
 	"github.com/cossacklabs/acra/decryptor/binary"
@@ -41,8 +42,10 @@ type MySQLDecryptor struct {
 	binaryDecryptor *binary.BinaryDecryptor
 	keyStore        keystore.KeyStore
 	decryptFunc     decryptFunc
-	log             *log.Entry
-	clientID        []byte
+	// lock guards clientID and log which may be changed by login mapping while data is decrypted
+	lock     sync.RWMutex
+	log      *log.Entry
+	clientID []byte
 }
 
 // Possible decryption modes: AcraStruct can start from beginning of cell, or be part of the cell
@@ -53,7 +56,7 @@ const (
 
 // NewMySQLDecryptor returns MySQLDecryptor with turned on poison record detection
 func NewMySQLDecryptor(clientID []byte, pgDecryptor *postgresql.PgDecryptor, keyStore keystore.KeyStore) *MySQLDecryptor {
-	decryptor := &MySQLDecryptor{keyStore: keyStore, binaryDecryptor: binary.NewBinaryDecryptor(), Decryptor: pgDecryptor}
+	decryptor := &MySQLDecryptor{keyStore: keyStore, binaryDecryptor: binary.NewBinaryDecryptor(), Decryptor: pgDecryptor, clientID: clientID}
 	// because we will use internal value of pgDecryptor then set it `true` as default on initialization
 	pgDecryptor.TurnOnPoisonRecordCheck(true)
 	decryptor.log = log.WithFields(log.Fields{"decryptor": "mysql", "client_id": string(clientID)})
@@ -61,6 +64,17 @@ func NewMySQLDecryptor(clientID []byte, pgDecryptor *postgresql.PgDecryptor, key
 	return decryptor
 }
 
+// SetClientID sets client ID which private key is used to decrypt AcraStructs without zones
+func (decryptor *MySQLDecryptor) SetClientID(clientID []byte) {
+	decryptor.lock.Lock()
+	decryptor.clientID = clientID
+	decryptor.log = log.WithFields(log.Fields{"decryptor": "mysql", "client_id": string(clientID)})
+	decryptor.lock.Unlock()
+	if setter, ok := decryptor.Decryptor.(base.ClientIDSetter); ok {
+		setter.SetClientID(clientID)
+	}
+}
+
 // SkipBeginInBlock returns AcraStruct without BeginTag or error if BeginTag not found
 func (decryptor *MySQLDecryptor) SkipBeginInBlock(block []byte) ([]byte, error) {
 	n := 0
@@ -160,21 +174,21 @@ func (decryptor *MySQLDecryptor) checkPoisonRecord(block []byte) error {
 	decryptor.Reset()
 	data, err := decryptor.SkipBeginInBlock(block)
 	if err != nil {
-		decryptor.log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantSkipBeginInBlock).
+		decryptor.getLogger().WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantSkipBeginInBlock).
 			Debugln("Can't skip begin tag in block")
 		return nil
 	}
-	decryptor.log.Debugln("Check block on poison")
+	decryptor.getLogger().Debugln("Check block on poison")
 	_, err = decryptor.decryptBlock(bytes.NewReader(data), nil, decryptor.getPoisonPrivateKey)
 	if err == nil {
-		decryptor.log.Warningln("Recognized poison record")
+		decryptor.getLogger().Warningln("Recognized poison record")
 		if decryptor.GetPoisonCallbackStorage().HasCallbacks() {
-			decryptor.log.Debugln("Check poison records")
+			decryptor.getLogger().Debugln("Check poison records")
 			if err := decryptor.GetPoisonCallbackStorage().Call(); err != nil {
-				decryptor.log.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantHandleRecognizedPoisonRecord).
+				decryptor.getLogger().WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantHandleRecognizedPoisonRecord).
 					Errorln("Unexpected error in poison record callbacks")
 			}
-			decryptor.log.Debugln("Processed all callbacks on poison record")
+			decryptor.getLogger().Debugln("Processed all callbacks on poison record")
 		}
 		return base.ErrPoisonRecord
 	}
@@ -198,7 +212,7 @@ func (decryptor *MySQLDecryptor) inlinePoisonRecordCheck(block []byte) error {
 			log.Debugln("Found AcraStruct")
 			err := decryptor.checkPoisonRecord(block[index+beginTagIndex:])
 			if err != nil {
-				decryptor.log.WithError(err).Errorln("Can't check on poison record")
+				decryptor.getLogger().WithError(err).Errorln("Can't check on poison record")
 				return err
 			}
 
@@ -211,14 +225,14 @@ func (decryptor *MySQLDecryptor) inlinePoisonRecordCheck(block []byte) error {
 type getKeyFunc func() (*keys.PrivateKey, error)
 
 // decryptBlock try to process data after BEGIN_TAG, decrypt and return result
-func (decryptor *MySQLDecryptor) decryptBlock(reader io.Reader, id []byte, keyFunc getKeyFunc) ([]byte, error) {
-	logger := decryptor.log.WithField("zone_id", string(id))
+func (decryptor *MySQLDecryptor) decryptBlock(reader *bytes.Reader, id []byte, keyFunc getKeyFunc) ([]byte, error) {
+	logger := decryptor.getLogger().WithField("zone_id", string(id))
 	privateKey, err := keyFunc()
 	if err != nil {
 		logger.Warningln("Can't read private key")
 		return []byte{}, err
 	}
-	key, _, err := decryptor.ReadSymmetricKey(privateKey, reader)
+	key, _, err := base.ReadSymmetricKeyWithPreviousKeys(decryptor, privateKey, reader)
 	if err != nil {
 		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantDecryptSymmetricKey).Warningln("Can't unwrap symmetric key")
 		return []byte{}, err
@@ -236,6 +250,8 @@ func (decryptor *MySQLDecryptor) decryptBlock(reader io.Reader, id []byte, keyFu
 // if WholeMode: Decryptor tries to find AcraStruct from the beginning of cell
 // if InlineMode: Decryptor tries to find AcraStruct in the middle of cell
 func (decryptor *MySQLDecryptor) SetWholeMatch(value bool) {
+	decryptor.lock.Lock()
+	defer decryptor.lock.Unlock()
 	if value {
 		decryptor.decryptFunc = decryptor.decryptWholeBlock
 		decryptor.log = decryptor.log.WithField("decrypt_mode", DecryptWhole)
@@ -245,6 +261,13 @@ func (decryptor *MySQLDecryptor) SetWholeMatch(value bool) {
 	}
 }
 
+// getLogger returns logger with current client ID
+func (decryptor *MySQLDecryptor) getLogger() *log.Entry {
+	decryptor.lock.RLock()
+	defer decryptor.lock.RUnlock()
+	return decryptor.log
+}
+
 func (decryptor *MySQLDecryptor) decryptWholeBlock(block []byte) ([]byte, error) {
 	decryptor.Reset()
 	if !decryptor.IsWithZone() || decryptor.IsMatchedZone() {
@@ -276,7 +299,7 @@ func (decryptor *MySQLDecryptor) decryptWholeBlock(block []byte) ([]byte, error)
 func (decryptor *MySQLDecryptor) decryptInlineBlock(block []byte) ([]byte, error) {
 	var output bytes.Buffer
 	index := 0
-	decryptor.log.Debugf("block len %v", len(block))
+	decryptor.getLogger().Debugf("block len %v", len(block))
 	if decryptor.IsWithZone() && !decryptor.IsMatchedZone() {
 		decryptor.MatchZoneInBlock(block)
 		if err := decryptor.inlinePoisonRecordCheck(block); err != nil {
@@ -301,7 +324,7 @@ func (decryptor *MySQLDecryptor) decryptInlineBlock(block []byte) ([]byte, error
 			}
 			output.Write(block[index : index+1])
 			index++
-			decryptor.log.Debugln("Can't decrypt block")
+			decryptor.getLogger().Debugln("Can't decrypt block")
 			continue
 		}
 		base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeSuccess).Inc()
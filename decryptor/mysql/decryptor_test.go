@@ -31,6 +31,21 @@ func (keystore *testKeystore) GetPrivateKey(id []byte) (*keys.PrivateKey, error)
 func (keystore *testKeystore) GetPeerPublicKey(id []byte) (*keys.PublicKey, error) {
 	return nil, nil
 }
+func (keystore *testKeystore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error) {
+	return nil, nil
+}
+func (keystore *testKeystore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	return nil, nil
+}
+func (keystore *testKeystore) GetHMACSecretKey(id []byte) ([]byte, error) {
+	return nil, nil
+}
+func (keystore *testKeystore) GetTokenizationKey(id []byte) ([]byte, error) {
+	return nil, nil
+}
+func (keystore *testKeystore) GetAuditLogKey() ([]byte, error) {
+	return nil, nil
+}
 func (keystore *testKeystore) GetZonePrivateKey(id []byte) (*keys.PrivateKey, error) {
 	return nil, nil
 }
@@ -40,6 +55,12 @@ func (keystore *testKeystore) HasZonePrivateKey(id []byte) bool {
 func (keystore *testKeystore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error) {
 	return nil, nil
 }
+func (keystore *testKeystore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return nil, nil
+}
+func (keystore *testKeystore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return nil, nil
+}
 func (keystore *testKeystore) GenerateZoneKey() ([]byte, []byte, error) {
 	return nil, nil, nil
 }
@@ -16,6 +16,10 @@ limitations under the License.
 
 package mysql
 
+import (
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
 // SQLError is used for passing SQL errors
 type SQLError struct {
 	Code    uint16
@@ -30,6 +34,22 @@ const (
 	ErQueryInterruptedState = "70100"
 )
 
+// Access denied code constants.
+const (
+	// https://dev.mysql.com/doc/refman/5.5/en/error-messages-server.html#error_er_access_denied_error
+	ErAccessDeniedCode  = 1045
+	ErAccessDeniedState = "28000"
+)
+
+// User limits code constants.
+const (
+	// https://dev.mysql.com/doc/refman/5.5/en/error-messages-server.html#error_er_too_many_user_connections
+	ErTooManyUserConnectionsCode = 1203
+	// https://dev.mysql.com/doc/refman/5.5/en/error-messages-server.html#error_er_user_limit_reached
+	ErUserLimitReachedCode = 1226
+	ErUserLimitState       = "42000"
+)
+
 func newQueryInterruptedError() *SQLError {
 	e := new(SQLError)
 	e.Code = ErQueryInterruptedCode
@@ -41,7 +61,26 @@ func newQueryInterruptedError() *SQLError {
 // NewQueryInterruptedError return packed QueryInterrupted error
 // https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
 func NewQueryInterruptedError(isProtocol41 bool) []byte {
-	mysqlError := newQueryInterruptedError()
+	return newErrPacket(newQueryInterruptedError(), isProtocol41)
+}
+
+// NewAccessDeniedError return packed AccessDenied error with message
+// https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+func NewAccessDeniedError(message string, isProtocol41 bool) []byte {
+	return newErrPacket(&SQLError{Code: ErAccessDeniedCode, State: ErAccessDeniedState, Message: message}, isProtocol41)
+}
+
+// NewClientLimitError return packed error for client which exceeded limit with err
+// https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+func NewClientLimitError(err error, isProtocol41 bool) []byte {
+	code := uint16(ErUserLimitReachedCode)
+	if err == base.ErrSessionLimitExceeded {
+		code = ErTooManyUserConnectionsCode
+	}
+	return newErrPacket(&SQLError{Code: code, State: ErUserLimitState, Message: "AcraServer rejected request: " + err.Error()}, isProtocol41)
+}
+
+func newErrPacket(mysqlError *SQLError, isProtocol41 bool) []byte {
 	var data []byte
 	if isProtocol41 {
 		// 1 byte ErrPacket flag + 2 bytes of error code = 3
@@ -0,0 +1,230 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// capability flags, max packet size, character set and 23 reserved bytes precede username in HandshakeResponse41
+	handshakeResponse41UserOffset = 4 + 4 + 1 + 23
+	// capability flags and max packet size precede username in HandshakeResponse320
+	handshakeResponse320UserOffset = 2 + 3
+	// ProgramNameAttribute connection attribute with name of client's application
+	// https://dev.mysql.com/doc/refman/8.0/en/performance-schema-connection-attribute-tables.html
+	ProgramNameAttribute = "program_name"
+)
+
+// readNullTerminatedString returns string till null byte and count of read bytes including null byte
+func readNullTerminatedString(data []byte) (string, int, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", 0, ErrMalformPacket
+	}
+	return string(data[:end]), end + 1, nil
+}
+
+// handshakeResponseCapabilities returns capability flags of client from HandshakeResponse41 or HandshakeResponse320
+func handshakeResponseCapabilities(data []byte) (uint32, error) {
+	if len(data) < handshakeResponse320UserOffset {
+		return 0, ErrMalformPacket
+	}
+	capabilities := uint32(binary.LittleEndian.Uint16(data))
+	if capabilities&ClientProtocol41 == 0 {
+		return capabilities, nil
+	}
+	if len(data) < handshakeResponse41UserOffset {
+		return 0, ErrMalformPacket
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+// parseHandshakeResponseLogin returns username and program name from connection attributes of HandshakeResponse. Program
+// name is empty if client didn't send it
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse
+func parseHandshakeResponseLogin(data []byte) (string, string, error) {
+	capabilities, err := handshakeResponseCapabilities(data)
+	if err != nil {
+		return "", "", err
+	}
+	if capabilities&ClientProtocol41 == 0 {
+		user, _, err := readNullTerminatedString(data[handshakeResponse320UserOffset:])
+		return user, "", err
+	}
+	data = data[handshakeResponse41UserOffset:]
+	user, n, err := readNullTerminatedString(data)
+	if err != nil {
+		return "", "", err
+	}
+	data = data[n:]
+	if capabilities&ClientConnectAttrs == 0 {
+		return user, "", nil
+	}
+	// skip auth response
+	switch {
+	case capabilities&ClientPluginAuthLenencClientData != 0:
+		n, err = SkipLengthEncodedString(data)
+	case capabilities&ClientSecureConnection != 0:
+		if len(data) == 0 {
+			return "", "", ErrMalformPacket
+		}
+		n = 1 + int(data[0])
+	default:
+		_, n, err = readNullTerminatedString(data)
+	}
+	if err != nil || n > len(data) {
+		return "", "", ErrMalformPacket
+	}
+	data = data[n:]
+	if capabilities&ClientConnectWithDB != 0 {
+		if _, n, err = readNullTerminatedString(data); err != nil {
+			return "", "", err
+		}
+		data = data[n:]
+	}
+	if capabilities&ClientPluginAuth != 0 {
+		if _, n, err = readNullTerminatedString(data); err != nil {
+			return "", "", err
+		}
+		data = data[n:]
+	}
+	programName, err := parseProgramName(data)
+	if err != nil {
+		return "", "", err
+	}
+	return user, programName, nil
+}
+
+// parseChangeUserLogin returns username and program name from connection attributes of COM_CHANGE_USER without
+// command byte. capabilities are flags sent by client in HandshakeResponse
+// https://dev.mysql.com/doc/internals/en/com-change-user.html
+func parseChangeUserLogin(data []byte, capabilities uint32) (string, string, error) {
+	user, n, err := readNullTerminatedString(data)
+	if err != nil {
+		return "", "", err
+	}
+	data = data[n:]
+	// skip auth response
+	if capabilities&ClientSecureConnection != 0 {
+		if len(data) == 0 || 1+int(data[0]) > len(data) {
+			return "", "", ErrMalformPacket
+		}
+		n = 1 + int(data[0])
+	} else if _, n, err = readNullTerminatedString(data); err != nil {
+		return "", "", err
+	}
+	data = data[n:]
+	// skip schema name
+	if _, n, err = readNullTerminatedString(data); err != nil {
+		return "", "", err
+	}
+	data = data[n:]
+	// character set and following fields are optional
+	if len(data) == 0 || capabilities&ClientConnectAttrs == 0 {
+		return user, "", nil
+	}
+	if len(data) < 2 {
+		return "", "", ErrMalformPacket
+	}
+	data = data[2:]
+	if capabilities&ClientPluginAuth != 0 {
+		if _, n, err = readNullTerminatedString(data); err != nil {
+			return "", "", err
+		}
+		data = data[n:]
+	}
+	programName, err := parseProgramName(data)
+	if err != nil {
+		return "", "", err
+	}
+	return user, programName, nil
+}
+
+// parseProgramName returns value of ProgramNameAttribute from length encoded connection attributes or empty string if
+// client didn't send it
+func parseProgramName(data []byte) (string, error) {
+	attributesLength, _, n, err := LengthEncodedInt(data)
+	if err != nil || uint64(len(data)-n) < attributesLength {
+		return "", ErrMalformPacket
+	}
+	attributes := data[n : n+int(attributesLength)]
+	for len(attributes) > 0 {
+		name, _, n, err := LengthEncodedString(attributes)
+		if err != nil {
+			return "", ErrMalformPacket
+		}
+		attributes = attributes[n:]
+		value, _, n, err := LengthEncodedString(attributes)
+		if err != nil {
+			return "", ErrMalformPacket
+		}
+		attributes = attributes[n:]
+		if string(name) == ProgramNameAttribute {
+			return string(value), nil
+		}
+	}
+	return "", nil
+}
+
+// onHandshakeResponse passes username and program name of client to login callback and remembers capabilities of
+// client used to parse COM_CHANGE_USER
+func (handler *MysqlHandler) onHandshakeResponse(packet *MysqlPacket) error {
+	capabilities, err := handshakeResponseCapabilities(packet.GetData())
+	if err != nil {
+		return err
+	}
+	handler.clientCapabilities = capabilities
+	user, programName, err := parseHandshakeResponseLogin(packet.GetData())
+	if err != nil {
+		return err
+	}
+	return handler.onLogin(user, programName)
+}
+
+// onChangeUser passes username and program name of COM_CHANGE_USER without command byte to login callback, so client
+// ID changes with database user
+func (handler *MysqlHandler) onChangeUser(data []byte) error {
+	user, programName, err := parseChangeUserLogin(data, handler.clientCapabilities)
+	if err != nil {
+		return err
+	}
+	return handler.onLogin(user, programName)
+}
+
+// sendLoginError sends to client error returned on login, either about exceeded limit of sessions or about unknown
+// client ID of database login
+func (handler *MysqlHandler) sendLoginError(packet *MysqlPacket, loginErr error, isProtocol41 bool, logger *logrus.Entry) {
+	if base.IsClientLimitError(loginErr) {
+		logger.WithError(loginErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+			Warningln("Client ID of database login exceeded limit of sessions")
+		packet.SetData(NewClientLimitError(loginErr, isProtocol41))
+	} else {
+		logger.WithError(loginErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorUnknownDatabaseLogin).
+			Errorln("Can't find out client ID of database login")
+		packet.SetData(NewAccessDeniedError("AcraServer can't find out client ID of database login", isProtocol41))
+	}
+	if err := handler.writeToClient(handler.getClientConnection(), packet); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+			Debugln("Can't write response with error to client")
+	}
+}
@@ -27,10 +27,22 @@ import (
 
 // MySQL protocol capability flags https://dev.mysql.com/doc/internals/en/capability-flags.html
 const (
+	// ClientConnectWithDB - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_CONNECT_WITH_DB
+	ClientConnectWithDB = 0x00000008
+	// ClientCompress - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_COMPRESS
+	ClientCompress = 0x00000020
 	// ClientProtocol41 - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_PROTOCOL_41
 	ClientProtocol41 = 0x00000200
 	// SslRequest - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_SSL
 	SslRequest = 0x00000800
+	// ClientSecureConnection - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_SECURE_CONNECTION
+	ClientSecureConnection = 0x00008000
+	// ClientPluginAuth - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_PLUGIN_AUTH
+	ClientPluginAuth = 0x00080000
+	// ClientConnectAttrs - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_CONNECT_ATTRS
+	ClientConnectAttrs = 0x00100000
+	// ClientPluginAuthLenencClientData - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA
+	ClientPluginAuthLenencClientData = 0x00200000
 	// ClientDeprecateEOF - https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_DEPRECATE_EOF - 0x1000000
 	ClientDeprecateEOF = 0x01000000
 )
@@ -80,11 +92,16 @@ func NewMysqlPacket() *MysqlPacket {
 	return &MysqlPacket{header: make([]byte, PacketHeaderSize)}
 }
 
-// GetPacketPayloadLength returns payload length from first 3 bytes of header
-func (packet *MysqlPacket) GetPacketPayloadLength() int {
+// getHeaderPayloadLength returns payload length from first 3 bytes of header
+func getHeaderPayloadLength(header []byte) int {
 	// first 3 bytes of header
 	// https://dev.mysql.com/doc/internals/en/mysql-packet.html#idm140406396409840
-	return int(uint32(packet.header[0]) | uint32(packet.header[1])<<8 | uint32(packet.header[2])<<16)
+	return int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+}
+
+// GetPacketPayloadLength returns length of whole payload which may be split into several packets
+func (packet *MysqlPacket) GetPacketPayloadLength() int {
+	return len(packet.data)
 }
 
 // GetSequenceNumber returned as byte
@@ -92,29 +109,36 @@ func (packet *MysqlPacket) GetSequenceNumber() byte {
 	return packet.header[SequenceIDIndex]
 }
 
+// SetSequenceNumber sets sequence_id of packet, next packets of split payload get next sequence_id values
+func (packet *MysqlPacket) SetSequenceNumber(sequence byte) {
+	packet.header[SequenceIDIndex] = sequence
+}
+
+// PacketCount returns count of packets used to send payload. Payload of MaxPayloadLen bytes or longer is split into
+// packets of MaxPayloadLen bytes and last shorter packet which may be empty
+// https://dev.mysql.com/doc/internals/en/sending-more-than-16mbyte.html
+func (packet *MysqlPacket) PacketCount() int {
+	return len(packet.data)/MaxPayloadLen + 1
+}
+
 // GetData returns packet payload
 func (packet *MysqlPacket) GetData() []byte {
 	return packet.data
 }
 
-// SetData replace packet data with newData and update payload length in header
+// SetData replace packet data with newData, payload length in header is updated on Dump
 func (packet *MysqlPacket) SetData(newData []byte) {
 	packet.data = newData
-	newSize := len(newData)
-	// update payload size, first 3 bytes of header
-	// https://dev.mysql.com/doc/internals/en/mysql-packet.html#idm140406396409840
-	packet.header[0] = byte(newSize)
-	packet.header[1] = byte(newSize >> 8)
-	packet.header[2] = byte(newSize >> 16)
 }
 
-// readPacket read header to struct and return payload as return result or error
+// readPacket read header of first packet to struct and return whole payload which may be split into several packets
+// as return result or error
 func (packet *MysqlPacket) readPacket(connection net.Conn) ([]byte, error) {
-	if _, err := connection.Read(packet.header); err != nil {
+	if _, err := io.ReadFull(connection, packet.header); err != nil {
 		return nil, err
 	}
 
-	length := packet.GetPacketPayloadLength()
+	length := getHeaderPayloadLength(packet.header)
 	if length < 1 {
 		return nil, fmt.Errorf("invalid payload length %d", length)
 	}
@@ -123,21 +147,42 @@ func (packet *MysqlPacket) readPacket(connection net.Conn) ([]byte, error) {
 	if _, err := io.ReadFull(connection, data); err != nil {
 		return nil, err
 	}
-	if length < MaxPayloadLen {
-		return data, nil
+	// payload continues in next packets till packet shorter than MaxPayloadLen
+	// https://dev.mysql.com/doc/internals/en/sending-more-than-16mbyte.html
+	header := make([]byte, PacketHeaderSize)
+	for length == MaxPayloadLen {
+		if _, err := io.ReadFull(connection, header); err != nil {
+			return nil, err
+		}
+		length = getHeaderPayloadLength(header)
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(connection, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
 	}
-
-	var buf []byte
-	buf, err := packet.readPacket(connection)
-	if err != nil {
-		return nil, err
-	}
-	return append(data, buf...), nil
+	return data, nil
 }
 
-// Dump returns packet header and data as []byte
+// Dump returns packet header and data as []byte. Payload of MaxPayloadLen bytes or longer is split into several
+// packets with consecutive sequence_id
 func (packet *MysqlPacket) Dump() []byte {
-	return append(packet.header, packet.data...)
+	output := make([]byte, 0, len(packet.data)+packet.PacketCount()*PacketHeaderSize)
+	sequence := packet.GetSequenceNumber()
+	data := packet.data
+	for {
+		length := len(data)
+		if length > MaxPayloadLen {
+			length = MaxPayloadLen
+		}
+		output = append(output, byte(length), byte(length>>8), byte(length>>16), sequence)
+		output = append(output, data[:length]...)
+		data = data[length:]
+		sequence++
+		if length < MaxPayloadLen {
+			return output
+		}
+	}
 }
 
 // ReadPacket header and payload from connection or return error
@@ -208,6 +253,13 @@ func (packet *MysqlPacket) IsSSLRequest() bool {
 	return (capabilities & SslRequest) > 0
 }
 
+// IsClientCompress return true if client requests compressed protocol
+// https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_COMPRESS
+func (packet *MysqlPacket) IsClientCompress() bool {
+	capabilities := packet.getClientCapabilities()
+	return (capabilities & ClientCompress) > 0
+}
+
 // IsClientDeprecateEOF return true if flag set
 // https://dev.mysql.com/doc/internals/en/capability-flags.html#flag-CLIENT_DEPRECATE_EOF
 func (packet *MysqlPacket) IsClientDeprecateEOF() bool {
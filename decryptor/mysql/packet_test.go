@@ -0,0 +1,182 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestLargePayload(t *testing.T) {
+	for _, length := range []int{MaxPayloadLen - 1, MaxPayloadLen, MaxPayloadLen*2 + 10} {
+		payload := bytes.Repeat([]byte{'a'}, length)
+		packet := newTestPacket(3, payload)
+		expectedCount := length/MaxPayloadLen + 1
+		if packet.PacketCount() != expectedCount {
+			t.Fatalf("Expected %v packets, took %v", expectedCount, packet.PacketCount())
+		}
+		dump := packet.Dump()
+		if len(dump) != length+expectedCount*PacketHeaderSize {
+			t.Fatalf("Incorrect length of dumped packets %v", len(dump))
+		}
+		// headers of split packets have consecutive sequence_id and last packet is shorter than MaxPayloadLen
+		offset := 0
+		for i := 0; i < expectedCount; i++ {
+			chunkLength := getHeaderPayloadLength(dump[offset:])
+			if dump[offset+SequenceIDIndex] != byte(3+i) || (i < expectedCount-1) != (chunkLength == MaxPayloadLen) {
+				t.Fatalf("Incorrect header %v of packet %v", dump[offset:offset+PacketHeaderSize], i)
+			}
+			offset += PacketHeaderSize + chunkLength
+		}
+
+		writer, reader := net.Pipe()
+		go func() {
+			writer.Write(dump)
+			writer.Close()
+		}()
+		readPacket, err := ReadPacket(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+		if readPacket.GetSequenceNumber() != 3 || !bytes.Equal(readPacket.GetData(), payload) {
+			t.Fatalf("Incorrect reassembled payload of %v bytes", length)
+		}
+	}
+}
+
+func TestSequenceAfterChangedPacketCount(t *testing.T) {
+	handler := &MysqlHandler{}
+	// command with sequence_id 0 split into 2 packets
+	handler.onClientPacket(newTestPacket(0, make([]byte, MaxPayloadLen)))
+	clientSide, proxySide := net.Pipe()
+	defer clientSide.Close()
+	// database responded with 2 packets of large row but decrypted row fits in one packet
+	response := []*MysqlPacket{newTestPacket(5, []byte{1}), newTestPacket(6, []byte("decrypted")), newTestPacket(8, []byte{EOFPacket})}
+	go func() {
+		if err := handler.writeToClient(proxySide, response...); err != nil {
+			t.Error(err)
+		}
+		proxySide.Close()
+	}()
+	for i := range response {
+		packet, err := ReadPacket(clientSide)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.GetSequenceNumber() != byte(2+i) {
+			t.Fatalf("Expected sequence_id %v, took %v", 2+i, packet.GetSequenceNumber())
+		}
+	}
+
+	// next command starts new sequence of packets sent to database
+	handler.onClientPacket(newTestPacket(0, []byte{COM_QUERY}))
+	databaseSide, proxyDbSide := net.Pipe()
+	defer databaseSide.Close()
+	go func() {
+		if err := handler.writeToDb(proxyDbSide, newTestPacket(0, make([]byte, MaxPayloadLen))); err != nil {
+			t.Error(err)
+		}
+		proxyDbSide.Close()
+	}()
+	packet, err := ReadPacket(databaseSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.GetSequenceNumber() != 0 || handler.serverSequenceNumber != 2 {
+		t.Fatal("Incorrect sequence of packets sent to database")
+	}
+}
+
+func TestParseHandshakeResponseLogin(t *testing.T) {
+	capabilities := uint32(ClientProtocol41 | ClientSecureConnection | ClientConnectWithDB | ClientPluginAuth | ClientConnectAttrs)
+	header := make([]byte, handshakeResponse41UserOffset)
+	binary.LittleEndian.PutUint32(header, capabilities)
+	attributes := append(PutLengthEncodedString([]byte("_os")), PutLengthEncodedString([]byte("linux"))...)
+	attributes = append(attributes, PutLengthEncodedString([]byte(ProgramNameAttribute))...)
+	attributes = append(attributes, PutLengthEncodedString([]byte("reports"))...)
+	data := append(header, []byte("billing\x00")...)
+	// auth response with length
+	data = append(data, 3, 1, 2, 3)
+	data = append(data, []byte("database\x00mysql_native_password\x00")...)
+	data = append(data, PutLengthEncodedInt(uint64(len(attributes)))...)
+	data = append(data, attributes...)
+
+	user, programName, err := parseHandshakeResponseLogin(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "billing" || programName != "reports" {
+		t.Fatalf("Incorrect login %s, %s", user, programName)
+	}
+	if _, _, err := parseHandshakeResponseLogin(data[:len(data)-1]); err != ErrMalformPacket {
+		t.Fatalf("Expected ErrMalformPacket, took %v", err)
+	}
+
+	// client without connection attributes
+	binary.LittleEndian.PutUint32(data, capabilities&^ClientConnectAttrs)
+	user, programName, err = parseHandshakeResponseLogin(data)
+	if err != nil || user != "billing" || programName != "" {
+		t.Fatalf("Incorrect login %s, %s, %v", user, programName, err)
+	}
+
+	// HandshakeResponse320
+	data = append([]byte{0, 0, 0, 0, 0}, []byte("old\x00")...)
+	user, _, err = parseHandshakeResponseLogin(data)
+	if err != nil || user != "old" {
+		t.Fatalf("Incorrect login %s, %v", user, err)
+	}
+}
+
+func TestParseChangeUserLogin(t *testing.T) {
+	capabilities := uint32(ClientProtocol41 | ClientSecureConnection | ClientPluginAuth | ClientConnectAttrs)
+	attributes := append(PutLengthEncodedString([]byte(ProgramNameAttribute)), PutLengthEncodedString([]byte("reports"))...)
+	data := []byte("billing\x00")
+	// auth response with length
+	data = append(data, 3, 1, 2, 3)
+	data = append(data, []byte("database\x00")...)
+	// character set
+	data = append(data, 33, 0)
+	data = append(data, []byte("mysql_native_password\x00")...)
+	data = append(data, PutLengthEncodedInt(uint64(len(attributes)))...)
+	data = append(data, attributes...)
+
+	user, programName, err := parseChangeUserLogin(data, capabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "billing" || programName != "reports" {
+		t.Fatalf("Incorrect login %s, %s", user, programName)
+	}
+	if _, _, err := parseChangeUserLogin(data[:len(data)-1], capabilities); err != ErrMalformPacket {
+		t.Fatalf("Expected ErrMalformPacket, took %v", err)
+	}
+
+	// client without connection attributes
+	user, programName, err = parseChangeUserLogin(data, capabilities&^ClientConnectAttrs)
+	if err != nil || user != "billing" || programName != "" {
+		t.Fatalf("Incorrect login %s, %s, %v", user, programName, err)
+	}
+
+	// old client with null terminated auth response and without optional fields
+	user, _, err = parseChangeUserLogin([]byte("old\x00auth\x00\x00"), 0)
+	if err != nil || user != "old" {
+		t.Fatalf("Incorrect login %s, %v", user, err)
+	}
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/logging"
+)
+
+// Errors returned while processing prepared statements
+var (
+	ErrUnsupportedParameterType = errors.New("unsupported type of parameter for encryption")
+	ErrLongDataEncryption       = errors.New("parameters sent with COM_STMT_SEND_LONG_DATA can't be encrypted")
+)
+
+// UnsignedParameterFlag set in second byte of parameter type if value is unsigned
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+const UnsignedParameterFlag = 0x80
+
+// preparedStatement stores information about statement prepared by client that used to encrypt its parameters
+type preparedStatement struct {
+	placeholders encryptor.PlaceholderSettings
+	paramsCount  int
+	// types of parameters sent by client on last execution, client may not send them again
+	paramTypes []byte
+	// indexes of parameters which values were sent with COM_STMT_SEND_LONG_DATA and absent in COM_STMT_EXECUTE
+	longDataParams map[int]bool
+}
+
+func newPreparedStatement(placeholders encryptor.PlaceholderSettings, paramsCount int) *preparedStatement {
+	return &preparedStatement{placeholders: placeholders, paramsCount: paramsCount, longDataParams: make(map[int]bool)}
+}
+
+// preparedStatementStore maps statement id to prepared statement. Statements added from goroutine that handles
+// database responses and used from goroutine that handles client requests
+type preparedStatementStore struct {
+	lock       sync.Mutex
+	statements map[uint32]*preparedStatement
+}
+
+func newPreparedStatementStore() *preparedStatementStore {
+	return &preparedStatementStore{statements: make(map[uint32]*preparedStatement)}
+}
+
+func (store *preparedStatementStore) add(statementID uint32, statement *preparedStatement) {
+	store.lock.Lock()
+	store.statements[statementID] = statement
+	store.lock.Unlock()
+}
+
+func (store *preparedStatementStore) get(statementID uint32) *preparedStatement {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.statements[statementID]
+}
+
+func (store *preparedStatementStore) remove(statementID uint32) {
+	store.lock.Lock()
+	delete(store.statements, statementID)
+	store.lock.Unlock()
+}
+
+// parseStatementID returns statement id from payload of COM_STMT_* command (without command byte)
+func parseStatementID(data []byte) (uint32, error) {
+	if len(data) < 4 {
+		return 0, ErrMalformPacket
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+// parsePrepareOkResponse returns statement id and count of parameters from COM_STMT_PREPARE_OK response
+// https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html
+func parsePrepareOkResponse(data []byte) (uint32, int, error) {
+	// 1 byte status + 4 bytes statement id + 2 bytes of columns count + 2 bytes of params count
+	if len(data) < 9 || data[0] != OkPacket {
+		return 0, 0, ErrMalformPacket
+	}
+	return binary.LittleEndian.Uint32(data[1:]), int(binary.LittleEndian.Uint16(data[7:])), nil
+}
+
+// StmtExecutePacket stores fields of COM_STMT_EXECUTE packet
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+type StmtExecutePacket struct {
+	statementID    uint32
+	flags          byte
+	iterationCount uint32
+	nullBitmap     []byte
+	newParamsBound bool
+	// 2 bytes per parameter: type and flag
+	paramTypes []byte
+	// values in binary protocol format, nil for NULL values and values sent with COM_STMT_SEND_LONG_DATA
+	paramValues [][]byte
+}
+
+// binaryValueLength returns length of value in binary protocol format
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func binaryValueLength(fieldType byte, data []byte) (int, error) {
+	var length int
+	switch fieldType {
+	case MYSQL_TYPE_NULL:
+		return 0, nil
+	case MYSQL_TYPE_TINY:
+		length = 1
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		length = 2
+	case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG, MYSQL_TYPE_FLOAT:
+		length = 4
+	case MYSQL_TYPE_LONGLONG, MYSQL_TYPE_DOUBLE:
+		length = 8
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE, MYSQL_TYPE_TIMESTAMP, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIME:
+		// 1 byte of length and value
+		if len(data) < 1 {
+			return 0, ErrMalformPacket
+		}
+		length = 1 + int(data[0])
+	default:
+		n, err := SkipLengthEncodedString(data)
+		if err != nil {
+			return 0, ErrMalformPacket
+		}
+		return n, nil
+	}
+	if len(data) < length {
+		return 0, ErrMalformPacket
+	}
+	return length, nil
+}
+
+// ParseStmtExecutePacket parses payload of COM_STMT_EXECUTE packet (without command byte). paramsCount and
+// paramTypes are taken from prepared statement because packet may not contain them
+func ParseStmtExecutePacket(data []byte, paramsCount int, paramTypes []byte, longDataParams map[int]bool) (*StmtExecutePacket, error) {
+	// 4 bytes statement id + 1 byte flags + 4 bytes iteration count
+	if len(data) < 9 {
+		return nil, ErrMalformPacket
+	}
+	packet := &StmtExecutePacket{
+		statementID:    binary.LittleEndian.Uint32(data),
+		flags:          data[4],
+		iterationCount: binary.LittleEndian.Uint32(data[5:]),
+	}
+	if paramsCount == 0 {
+		return packet, nil
+	}
+	data = data[9:]
+	nullBitmapLength := (paramsCount + 7) / 8
+	if len(data) < nullBitmapLength+1 {
+		return nil, ErrMalformPacket
+	}
+	packet.nullBitmap = data[:nullBitmapLength]
+	packet.newParamsBound = data[nullBitmapLength] == 1
+	data = data[nullBitmapLength+1:]
+	if packet.newParamsBound {
+		if len(data) < paramsCount*2 {
+			return nil, ErrMalformPacket
+		}
+		paramTypes = data[:paramsCount*2]
+		data = data[paramsCount*2:]
+	}
+	if len(paramTypes) != paramsCount*2 {
+		return nil, ErrMalformPacket
+	}
+	packet.paramTypes = paramTypes
+	packet.paramValues = make([][]byte, paramsCount)
+	for i := 0; i < paramsCount; i++ {
+		if packet.IsNull(i) || longDataParams[i] {
+			continue
+		}
+		n, err := binaryValueLength(paramTypes[i*2], data)
+		if err != nil {
+			return nil, err
+		}
+		packet.paramValues[i] = data[:n]
+		data = data[n:]
+	}
+	return packet, nil
+}
+
+// IsNull returns true if parameter with index has NULL value
+func (packet *StmtExecutePacket) IsNull(index int) bool {
+	return packet.nullBitmap[index/8]&(1<<uint(index%8)) > 0
+}
+
+// ParamsCount returns count of parameters
+func (packet *StmtExecutePacket) ParamsCount() int {
+	return len(packet.paramValues)
+}
+
+// GetParameterValue returns parameter's value converted to bytes as it would be sent in text protocol
+func (packet *StmtExecutePacket) GetParameterValue(index int) ([]byte, error) {
+	value := packet.paramValues[index]
+	unsigned := packet.paramTypes[index*2+1]&UnsignedParameterFlag > 0
+	switch packet.paramTypes[index*2] {
+	case MYSQL_TYPE_TINY:
+		if unsigned {
+			return []byte(strconv.FormatUint(uint64(value[0]), 10)), nil
+		}
+		return []byte(strconv.FormatInt(int64(int8(value[0])), 10)), nil
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		number := binary.LittleEndian.Uint16(value)
+		if unsigned {
+			return []byte(strconv.FormatUint(uint64(number), 10)), nil
+		}
+		return []byte(strconv.FormatInt(int64(int16(number)), 10)), nil
+	case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG:
+		number := binary.LittleEndian.Uint32(value)
+		if unsigned {
+			return []byte(strconv.FormatUint(uint64(number), 10)), nil
+		}
+		return []byte(strconv.FormatInt(int64(int32(number)), 10)), nil
+	case MYSQL_TYPE_LONGLONG:
+		number := binary.LittleEndian.Uint64(value)
+		if unsigned {
+			return []byte(strconv.FormatUint(number, 10)), nil
+		}
+		return []byte(strconv.FormatInt(int64(number), 10)), nil
+	case MYSQL_TYPE_FLOAT:
+		return []byte(strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(value))), 'g', -1, 32)), nil
+	case MYSQL_TYPE_DOUBLE:
+		return []byte(strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(value)), 'g', -1, 64)), nil
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE, MYSQL_TYPE_TIMESTAMP, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIME, MYSQL_TYPE_NULL:
+		return nil, ErrUnsupportedParameterType
+	}
+	data, _, _, err := LengthEncodedString(value)
+	return data, err
+}
+
+// SetParameterBlob replaces parameter's value with data and changes its type to blob
+func (packet *StmtExecutePacket) SetParameterBlob(index int, data []byte) {
+	if !packet.newParamsBound {
+		// types will be sent with packet so make a copy to not change types remembered from previous execution
+		packet.paramTypes = append([]byte{}, packet.paramTypes...)
+		packet.newParamsBound = true
+	}
+	packet.paramTypes[index*2] = MysqlTypeBlob
+	packet.paramTypes[index*2+1] = 0
+	packet.paramValues[index] = PutLengthEncodedString(data)
+}
+
+// Marshal returns payload of COM_STMT_EXECUTE packet with command byte
+func (packet *StmtExecutePacket) Marshal() []byte {
+	output := make([]byte, 0, 10+len(packet.nullBitmap)+1+len(packet.paramTypes))
+	output = append(output, COM_STMT_EXECUTE)
+	output = append(output, Uint32ToBytes(packet.statementID)...)
+	output = append(output, packet.flags)
+	output = append(output, Uint32ToBytes(packet.iterationCount)...)
+	if len(packet.paramValues) == 0 {
+		return output
+	}
+	output = append(output, packet.nullBitmap...)
+	if packet.newParamsBound {
+		output = append(output, 1)
+		output = append(output, packet.paramTypes...)
+	} else {
+		output = append(output, 0)
+	}
+	for _, value := range packet.paramValues {
+		output = append(output, value...)
+	}
+	return output
+}
+
+// newPrepareResponseHandler returns ResponseHandler that remembers statement with placeholders which values should
+// be encrypted if database successfully prepared it
+func (handler *MysqlHandler) newPrepareResponseHandler(placeholders encryptor.PlaceholderSettings) ResponseHandler {
+	return func(packet *MysqlPacket, dbConnection, clientConnection net.Conn) error {
+		handler.resetQueryHandler()
+		if !packet.IsErr() {
+			statementID, paramsCount, err := parsePrepareOkResponse(packet.GetData())
+			if err != nil {
+				handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+					Errorln("Can't parse COM_STMT_PREPARE response")
+				return err
+			}
+			handler.preparedStatements.add(statementID, newPreparedStatement(placeholders, paramsCount))
+		}
+		// column and parameter definitions will be proxied as is
+		return handler.defaultResponseHandler(packet, dbConnection, clientConnection)
+	}
+}
+
+// encryptQuery encrypts values of COM_QUERY and COM_STMT_PREPARE queries and replaces query in packet if it was changed
+func (handler *MysqlHandler) encryptQuery(cmd byte, query string, packet *MysqlPacket) error {
+	newQuery, changed, placeholders, err := handler.queryEncryptor.OnPreparedQuery(query)
+	if err != nil {
+		return err
+	}
+	if changed {
+		packet.SetData(append([]byte{cmd}, newQuery...))
+	}
+	if cmd == COM_STMT_PREPARE && len(placeholders) > 0 {
+		handler.setQueryHandler(handler.newPrepareResponseHandler(placeholders))
+	}
+	return nil
+}
+
+// encryptExecuteParameters encrypts values of COM_STMT_EXECUTE parameters that will be stored in encryptable columns
+// and replaces packet's data if any parameter was encrypted
+func (handler *MysqlHandler) encryptExecuteParameters(packet *MysqlPacket) error {
+	data := packet.GetData()[1:]
+	statementID, err := parseStatementID(data)
+	if err != nil {
+		return err
+	}
+	statement := handler.preparedStatements.get(statementID)
+	if statement == nil {
+		return nil
+	}
+	// long data is reset after execution
+	defer func() { statement.longDataParams = make(map[int]bool) }()
+	executePacket, err := ParseStmtExecutePacket(data, statement.paramsCount, statement.paramTypes, statement.longDataParams)
+	if err != nil {
+		return err
+	}
+	statement.paramTypes = append([]byte{}, executePacket.paramTypes...)
+	changed := false
+	for index, setting := range statement.placeholders {
+		if index >= executePacket.ParamsCount() || executePacket.IsNull(index) {
+			continue
+		}
+		if statement.longDataParams[index] {
+			return ErrLongDataEncryption
+		}
+		value, err := executePacket.GetParameterValue(index)
+		if err != nil {
+			return err
+		}
+		var encrypted []byte
+		switch {
+		case setting.IsTokenized():
+			// MySQL converts string tokens to types of columns
+			encrypted, err = handler.queryEncryptor.TokenizeWithColumnSettings(setting.ColumnEncryptionSetting, value)
+		case setting.IsHash:
+			// placeholder is compared with hash column
+			encrypted, err = handler.queryEncryptor.HMACWithColumnSettings(setting.ColumnEncryptionSetting, value)
+		default:
+			encrypted, err = handler.queryEncryptor.EncryptWithColumnSettings(setting.ColumnEncryptionSetting, value)
+		}
+		if err != nil {
+			return err
+		}
+		executePacket.SetParameterBlob(index, encrypted)
+		changed = true
+	}
+	if changed {
+		packet.SetData(executePacket.Marshal())
+	}
+	return nil
+}
+
+// onStatementCommand updates state of prepared statement on COM_STMT_SEND_LONG_DATA, COM_STMT_RESET and COM_STMT_CLOSE
+func (handler *MysqlHandler) onStatementCommand(cmd byte, data []byte) error {
+	statementID, err := parseStatementID(data)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case COM_STMT_CLOSE:
+		handler.preparedStatements.remove(statementID)
+	case COM_STMT_RESET:
+		if statement := handler.preparedStatements.get(statementID); statement != nil {
+			statement.longDataParams = make(map[int]bool)
+		}
+	case COM_STMT_SEND_LONG_DATA:
+		// 4 bytes statement id + 2 bytes parameter id
+		if len(data) < 6 {
+			return ErrMalformPacket
+		}
+		if statement := handler.preparedStatements.get(statementID); statement != nil {
+			statement.longDataParams[int(binary.LittleEndian.Uint16(data[4:]))] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cossacklabs/acra/encryptor"
+)
+
+func TestStmtExecutePacket(t *testing.T) {
+	// statement id 1, no flags, iteration count 1, 3 params where second is NULL, new params bound with types
+	// LONGLONG, NULL and VAR_STRING
+	data := []byte{
+		1, 0, 0, 0, 0, 1, 0, 0, 0,
+		2, 1,
+		MYSQL_TYPE_LONGLONG, 0, MYSQL_TYPE_NULL, 0, MysqlTypeVarString, 0,
+		0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		3, 'a', 'b', 'c',
+	}
+	packet, err := ParseStmtExecutePacket(data, 3, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.ParamsCount() != 3 || packet.IsNull(0) || !packet.IsNull(1) || packet.IsNull(2) {
+		t.Fatal("Incorrect parsed parameters")
+	}
+	if value, err := packet.GetParameterValue(0); err != nil || string(value) != "-2" {
+		t.Fatalf("Incorrect integer value %s, %v", value, err)
+	}
+	if value, err := packet.GetParameterValue(2); err != nil || string(value) != "abc" {
+		t.Fatalf("Incorrect string value %s, %v", value, err)
+	}
+	if !bytes.Equal(packet.Marshal(), append([]byte{COM_STMT_EXECUTE}, data...)) {
+		t.Fatal("Marshaled packet not equal to source packet")
+	}
+
+	// execution without types uses types from previous execution
+	types := append([]byte{}, packet.paramTypes...)
+	dataWithoutTypes := append(append([]byte{}, data[:10]...), 0)
+	dataWithoutTypes = append(dataWithoutTypes, data[17:]...)
+	packet, err = ParseStmtExecutePacket(dataWithoutTypes, 3, types, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.SetParameterBlob(0, []byte("encrypted"))
+	expected := append([]byte{COM_STMT_EXECUTE}, data[:10]...)
+	expected = append(expected, 1, MysqlTypeBlob, 0, MYSQL_TYPE_NULL, 0, MysqlTypeVarString, 0, 9)
+	expected = append(expected, []byte("encrypted")...)
+	expected = append(expected, 3, 'a', 'b', 'c')
+	if !bytes.Equal(packet.Marshal(), expected) {
+		t.Fatal("Marshaled packet with encrypted parameter has incorrect format")
+	}
+	if types[0] != MYSQL_TYPE_LONGLONG {
+		t.Fatal("Types of previous execution shouldn't be changed")
+	}
+
+	if _, err := ParseStmtExecutePacket(data[:len(data)-1], 3, nil, nil); err != ErrMalformPacket {
+		t.Fatalf("Expected ErrMalformPacket, took %v", err)
+	}
+}
+
+// testQueryEncryptor "encrypts" values by wrapping them with names of operations
+type testQueryEncryptor struct{}
+
+func (*testQueryEncryptor) OnQuery(query string) (string, bool, error) {
+	return query, false, nil
+}
+
+func (*testQueryEncryptor) OnPreparedQuery(query string) (string, bool, encryptor.PlaceholderSettings, error) {
+	return query, false, nil, nil
+}
+
+func (*testQueryEncryptor) EncryptWithColumnSettings(setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	return []byte("encrypted(" + string(data) + ")"), nil
+}
+
+func (*testQueryEncryptor) HMACWithColumnSettings(setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	return []byte("hmac(" + string(data) + ")"), nil
+}
+
+func (*testQueryEncryptor) TokenizeWithColumnSettings(setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	return []byte("token(" + string(data) + ")"), nil
+}
+
+func TestEncryptExecuteParameters(t *testing.T) {
+	handler := &MysqlHandler{queryEncryptor: &testQueryEncryptor{}, preparedStatements: newPreparedStatementStore()}
+	setting := &encryptor.ColumnEncryptionSetting{Name: "email", HashColumn: "email_hash"}
+	// first parameter is stored in encrypted column and second is compared with its hash column
+	handler.preparedStatements.add(1, newPreparedStatement(encryptor.PlaceholderSettings{
+		0: {ColumnEncryptionSetting: setting},
+		1: {ColumnEncryptionSetting: setting, IsHash: true},
+	}, 2))
+	data := []byte{
+		COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0,
+		0, 1,
+		MysqlTypeVarString, 0, MysqlTypeVarString, 0,
+		3, 'a', '@', 'b',
+		3, 'c', '@', 'd',
+	}
+	packet := newTestPacket(0, data)
+	if err := handler.encryptExecuteParameters(packet); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{}, data[:12]...)
+	expected = append(expected, MysqlTypeBlob, 0, MysqlTypeBlob, 0, 14)
+	expected = append(expected, []byte("encrypted(a@b)")...)
+	expected = append(expected, 9)
+	expected = append(expected, []byte("hmac(c@d)")...)
+	if !bytes.Equal(packet.GetData(), expected) {
+		t.Fatalf("Incorrect COM_STMT_EXECUTE packet %v", packet.GetData())
+	}
+}
@@ -19,18 +19,25 @@ package mysql
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"go.opencensus.io/trace"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cossacklabs/acra/acra-censor"
 	"github.com/cossacklabs/acra/acra-censor/common"
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/masking"
 	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/tokenization"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -125,18 +132,18 @@ func IsBinaryColumn(value byte) bool {
 // ResponseHandler database response header
 type ResponseHandler func(packet *MysqlPacket, dbConnection, clientConnection net.Conn) error
 
-func defaultResponseHandler(packet *MysqlPacket, dbConnection, clientConnection net.Conn) error {
-	if _, err := clientConnection.Write(packet.Dump()); err != nil {
-		return err
-	}
-	return nil
+func (handler *MysqlHandler) defaultResponseHandler(packet *MysqlPacket, dbConnection, clientConnection net.Conn) error {
+	return handler.writeToClient(clientConnection, packet)
 }
 
 // MysqlHandler handles connection between client and MySQL db
 type MysqlHandler struct {
-	responseHandler      ResponseHandler
-	clientSequenceNumber int
-	serverSequenceNumber int
+	responseHandler ResponseHandler
+	// sequence_id of next packets sent to client and database. Payloads longer than MaxPayloadLen may be split into
+	// different count of packets after encryption or decryption so sequences of both sides are maintained separately
+	clientSequenceNumber byte
+	serverSequenceNumber byte
+	sequenceLock         sync.Mutex
 	clientProtocol41     bool
 	serverProtocol41     bool
 	currentCommand       byte
@@ -149,13 +156,38 @@ type MysqlHandler struct {
 	clientConnection       net.Conn
 	dbConnection           net.Conn
 	tlsConfig              *tls.Config
-	clientID               []byte
-	logger                 *logrus.Entry
-	ctx                    context.Context
+	// clientIDLock guards clientID which may be changed by login mapping while responses are processed
+	clientIDLock       sync.RWMutex
+	clientID           []byte
+	logger             *logrus.Entry
+	ctx                context.Context
+	queryEncryptor     encryptor.QueryEncryptor
+	preparedStatements *preparedStatementStore
+	schemaStore        encryptor.TableSchemaStore
+	tokenizer          tokenization.Tokenizer
+	// connections switched to compressed protocol after authentication if client requested it
+	clientCompression *compressedConnection
+	dbCompression     *compressedConnection
+	// connectionLock guards clientConnection and dbConnection which are replaced with TLS and compressed connections
+	// by goroutines that process packets of client and database
+	connectionLock sync.Mutex
+	// onLogin is called with database user from HandshakeResponse and COM_CHANGE_USER, nil if client ID doesn't depend on it
+	onLogin base.LoginCallback
+	// clientCapabilities are flags from client's HandshakeResponse used to parse COM_CHANGE_USER
+	clientCapabilities uint32
+	// limiter rejects queries and decrypted data of client which exceeded limits, nil if there are no limits
+	limiter *base.ClientLimiter
+	// auditLog stores client's queries and decryptions, nil if audit log is turned off
+	auditLog *audit.Log
+	// decryptedCount is count of AcraStructs decrypted in current result set, used only by goroutine that processes
+	// database's responses
+	decryptedCount int
 }
 
-// NewMysqlHandler returns new MysqlHandler
-func NewMysqlHandler(ctx context.Context, clientID []byte, decryptor base.Decryptor, dbConnection, clientConnection net.Conn, tlsConfig *tls.Config, censor acracensor.AcraCensorInterface) (*MysqlHandler, error) {
+// NewMysqlHandler returns new MysqlHandler. queryEncryptor may be nil if AcraServer shouldn't encrypt queries' data.
+// schemaStore may be nil if AcraServer should try to decrypt all binary columns, otherwise only configured encrypted
+// columns will be decrypted. tokenizer may be nil if tokens shouldn't be replaced with original values in responses
+func NewMysqlHandler(ctx context.Context, clientID []byte, decryptor base.Decryptor, dbConnection, clientConnection net.Conn, tlsConfig *tls.Config, censor acracensor.AcraCensorInterface, queryEncryptor encryptor.QueryEncryptor, schemaStore encryptor.TableSchemaStore, tokenizer tokenization.Tokenizer) (*MysqlHandler, error) {
 	logger := logging.NewLoggerWithTrace(ctx)
 	var newTLSConfig *tls.Config
 	if tlsConfig != nil {
@@ -163,25 +195,109 @@ func NewMysqlHandler(ctx context.Context, clientID []byte, decryptor base.Decryp
 		newTLSConfig = tlsConfig.Clone()
 		network.SetMySQLCompatibleTLSSettings(newTLSConfig)
 	}
-	return &MysqlHandler{
+	handler := &MysqlHandler{
 		isTLSHandshake:         false,
 		dbTLSHandshakeFinished: make(chan bool),
 		clientDeprecateEOF:     false,
 		decryptor:              decryptor,
-		responseHandler:        defaultResponseHandler,
 		acracensor:             censor,
 		clientConnection:       clientConnection,
 		dbConnection:           dbConnection,
 		tlsConfig:              newTLSConfig,
 		ctx:                    ctx,
-		logger:                 logger.WithField("client_id", string(clientID))}, nil
+		queryEncryptor:         queryEncryptor,
+		preparedStatements:     newPreparedStatementStore(),
+		schemaStore:            schemaStore,
+		tokenizer:              tokenizer,
+		clientID:               clientID,
+		logger:                 logger.WithField("client_id", string(clientID))}
+	handler.responseHandler = handler.defaultResponseHandler
+	return handler, nil
+}
+
+// SetLoginCallback sets callback called with database user and program name from client's HandshakeResponse and
+// COM_CHANGE_USER before they are sent to database
+func (handler *MysqlHandler) SetLoginCallback(callback base.LoginCallback) {
+	handler.onLogin = callback
+}
+
+// SetClientID sets client ID used to find masking policies of decrypted columns and keys of tokens. Should be called
+// before client's queries are proxied
+func (handler *MysqlHandler) SetClientID(clientID []byte) {
+	handler.clientIDLock.Lock()
+	handler.clientID = clientID
+	handler.clientIDLock.Unlock()
+}
+
+// getClientID returns current client ID of connection
+func (handler *MysqlHandler) getClientID() []byte {
+	handler.clientIDLock.RLock()
+	defer handler.clientIDLock.RUnlock()
+	return handler.clientID
+}
+
+// onClientPacket continues sequence of packet read from client in responses. Packet with sequence_id 0 starts new
+// command so packets sent to database start new sequence too
+func (handler *MysqlHandler) onClientPacket(packet *MysqlPacket) {
+	handler.sequenceLock.Lock()
+	handler.clientSequenceNumber = packet.GetSequenceNumber() + byte(packet.PacketCount())
+	if packet.GetSequenceNumber() == 0 {
+		handler.serverSequenceNumber = 0
+	}
+	handler.sequenceLock.Unlock()
+}
+
+// readDbPacket reads packet from database and continues its sequence in next packets sent to database
+func (handler *MysqlHandler) readDbPacket(connection net.Conn) (*MysqlPacket, error) {
+	packet, err := ReadPacket(connection)
+	if err != nil {
+		return nil, err
+	}
+	handler.sequenceLock.Lock()
+	handler.serverSequenceNumber = packet.GetSequenceNumber() + byte(packet.PacketCount())
+	handler.sequenceLock.Unlock()
+	return packet, nil
+}
+
+// writeToClient sends packets to client with sequence_id that continue client's sequence
+func (handler *MysqlHandler) writeToClient(connection net.Conn, packets ...*MysqlPacket) error {
+	handler.sequenceLock.Lock()
+	defer handler.sequenceLock.Unlock()
+	for _, packet := range packets {
+		packet.SetSequenceNumber(handler.clientSequenceNumber)
+		handler.clientSequenceNumber += byte(packet.PacketCount())
+		if _, err := connection.Write(packet.Dump()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeToDb sends packet to database with sequence_id that continue database's sequence
+func (handler *MysqlHandler) writeToDb(connection net.Conn, packet *MysqlPacket) error {
+	handler.sequenceLock.Lock()
+	defer handler.sequenceLock.Unlock()
+	packet.SetSequenceNumber(handler.serverSequenceNumber)
+	handler.serverSequenceNumber += byte(packet.PacketCount())
+	_, err := connection.Write(packet.Dump())
+	return err
+}
+
+// sendClientError replaces packet's data with QueryInterrupted error and sends it to client
+func (handler *MysqlHandler) sendClientError(packet *MysqlPacket) {
+	errPacket := NewQueryInterruptedError(handler.clientProtocol41)
+	packet.SetData(errPacket)
+	if err := handler.writeToClient(handler.getClientConnection(), packet); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+			Errorln("Can't write response with error to client")
+	}
 }
 
 func (handler *MysqlHandler) setQueryHandler(callback ResponseHandler) {
 	handler.responseHandler = callback
 }
 func (handler *MysqlHandler) resetQueryHandler() {
-	handler.responseHandler = defaultResponseHandler
+	handler.responseHandler = handler.defaultResponseHandler
 }
 
 func (handler *MysqlHandler) getResponseHandler() ResponseHandler {
@@ -195,6 +311,8 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 	clientLog := handler.logger.WithField("proxy", "client")
 	clientLog.Debugln("Start proxy client's requests")
 	firstPacket := true
+	// handshake response is first client's packet or first packet after SSL request
+	handshakeResponse := true
 	prometheusLabels := []string{base.DecryptionDBMysql}
 	// use pointers to function where should be stored some function that should be called if code return error and interrupt loop
 	// default value empty func to avoid != nil check
@@ -215,15 +333,31 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 		packetSpanCtx, packetSpan := trace.StartSpan(ctx, "ClientToDbConnectorLoop")
 		packetSpanEndFunc = packetSpan.End
 
-		packet, err := ReadPacket(handler.clientConnection)
+		packet, err := ReadPacket(handler.getClientConnection())
 		if err != nil {
 			handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantReadFromClient).
 				Debugln("Can't read packet from client")
 			errCh <- err
 			return
 		}
+		handler.onClientPacket(packet)
 		// after reading client's packet we start deadline on write to db side
-		handler.dbConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		handler.getDbConnection().SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		if handshakeResponse && !(firstPacket && packet.IsSSLRequest()) {
+			handshakeResponse = false
+			if handler.onLogin != nil {
+				if err := handler.onHandshakeResponse(packet); err != nil {
+					handler.sendLoginError(packet, err, packet.ClientSupportProtocol41(), clientLog)
+					errCh <- err
+					return
+				}
+			}
+			if packet.IsClientCompress() {
+				clientLog.Debugln("Client requested compressed protocol")
+				// wrap connections before database receives handshake response and finishes authentication
+				handler.startCompression()
+			}
+		}
 		if firstPacket {
 			firstPacket = false
 			handler.clientProtocol41 = packet.ClientSupportProtocol41()
@@ -237,14 +371,14 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 					handler.logger.Debugln("Send error to db")
 					errPacket := NewQueryInterruptedError(handler.clientProtocol41)
 					packet.SetData(errPacket)
-					if _, err := handler.clientConnection.Write(packet.Dump()); err != nil {
+					if err := handler.writeToClient(handler.getClientConnection(), packet); err != nil {
 						handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
 							Debugln("Can't write response with error to client")
 					}
 					errCh <- network.ErrEmptyTLSConfig
 					return
 				}
-				tlsConnection := tls.Server(handler.clientConnection, handler.tlsConfig)
+				tlsConnection := tls.Server(handler.getClientConnection(), handler.tlsConfig)
 				if err := tlsConnection.Handshake(); err != nil {
 					handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantInitializeTLS).
 						Errorln("Error in tls handshake with client")
@@ -253,14 +387,14 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 				}
 				handler.logger.Debugln("Switched to tls with client. wait switching with db")
 				handler.isTLSHandshake = true
-				handler.clientConnection = tlsConnection
-				if _, err := handler.dbConnection.Write(packet.Dump()); err != nil {
+				handler.setClientConnection(tlsConnection)
+				if err := handler.writeToDb(handler.getDbConnection(), packet); err != nil {
 					clientLog.Debugln("Can't write send packet to db")
 					errCh <- err
 					return
 				}
 				// stop reading and init switching to tls
-				handler.dbConnection.SetReadDeadline(time.Now())
+				handler.getDbConnection().SetReadDeadline(time.Now())
 				// we should wait when db proxy part will finish handshake to avoid case when new packets from client
 				// will be proxied in this function to db before handshake will be completed
 				select {
@@ -276,10 +410,8 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 				continue
 			}
 		}
-		handler.clientSequenceNumber = int(packet.GetSequenceNumber())
-		clientLog = clientLog.WithField("sequence_number", handler.clientSequenceNumber)
+		clientLog = clientLog.WithField("sequence_number", packet.GetSequenceNumber())
 		clientLog.Debugln("New packet")
-		inOutput := packet.Dump()
 		data := packet.GetData()
 		cmd := data[0]
 		data = data[1:]
@@ -287,14 +419,14 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 		switch cmd {
 		case COM_QUIT:
 			clientLog.Debugln("Close connections on COM_QUIT command")
-			if _, err := handler.dbConnection.Write(inOutput); err != nil {
+			if err := handler.writeToDb(handler.getDbConnection(), packet); err != nil {
 				clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToDB).
 					Debugln("Can't write send packet to db")
 				errCh <- err
 				return
 			}
-			handler.clientConnection.Close()
-			handler.dbConnection.Close()
+			handler.getClientConnection().Close()
+			handler.getDbConnection().Close()
 			errCh <- io.EOF
 			return
 		case COM_QUERY, COM_STMT_PREPARE:
@@ -314,28 +446,73 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 			if err := handler.acracensor.HandleQuery(query); err != nil {
 				censorSpan.End()
 				clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCensorQueryIsNotAllowed).Errorln("Error on AcraCensor check")
-				errPacket := NewQueryInterruptedError(handler.clientProtocol41)
-				packet.SetData(errPacket)
-				if _, err := handler.clientConnection.Write(packet.Dump()); err != nil {
-					handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
-						Errorln("Can't write response with error to client")
-				}
+				handler.auditQuery(query, audit.VerdictBlocked)
+				handler.sendClientError(packet)
 				continue
 			}
+			censorSpan.End()
+			handler.auditQuery(query, audit.VerdictAllowed)
 			if cmd == COM_QUERY {
+				if err := handler.allowQuery(); err != nil {
+					clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+						Warningln("Client exceeded limit of queries")
+					handler.sendClientLimitError(packet, err)
+					continue
+				}
 				handler.setQueryHandler(handler.QueryResponseHandler)
 			}
-			censorSpan.End()
+			if handler.queryEncryptor != nil {
+				_, encryptorSpan := trace.StartSpan(packetSpanCtx, "encryptor")
+				err := handler.encryptQuery(cmd, query, packet)
+				encryptorSpan.End()
+				if err != nil {
+					handler.resetQueryHandler()
+					clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptQuery).Errorln("Can't encrypt query")
+					handler.sendClientError(packet)
+					continue
+				}
+			}
 			break
 		case COM_STMT_EXECUTE:
+			if err := handler.allowQuery(); err != nil {
+				clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+					Warningln("Client exceeded limit of queries")
+				handler.sendClientLimitError(packet, err)
+				continue
+			}
+			if handler.queryEncryptor != nil {
+				_, encryptorSpan := trace.StartSpan(packetSpanCtx, "encryptor")
+				err := handler.encryptExecuteParameters(packet)
+				encryptorSpan.End()
+				if err != nil {
+					clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptQuery).
+						Errorln("Can't encrypt parameters of prepared statement")
+					handler.sendClientError(packet)
+					continue
+				}
+			}
 			handler.setQueryHandler(handler.QueryResponseHandler)
 			break
+		case COM_CHANGE_USER:
+			// client ID depends on database user, so it should be changed before database authenticates new user
+			if handler.onLogin != nil {
+				if err := handler.onChangeUser(data); err != nil {
+					handler.sendLoginError(packet, err, handler.clientProtocol41, clientLog)
+					errCh <- err
+					return
+				}
+			}
 		case COM_STMT_CLOSE, COM_STMT_SEND_LONG_DATA, COM_STMT_RESET:
-			fallthrough
+			if handler.queryEncryptor != nil {
+				if err := handler.onStatementCommand(cmd, data); err != nil {
+					clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+						Errorln("Can't process prepared statement command")
+				}
+			}
 		default:
 			clientLog.Debugf("Command %d not supported now", cmd)
 		}
-		if _, err := handler.dbConnection.Write(inOutput); err != nil {
+		if err := handler.writeToDb(handler.getDbConnection(), packet); err != nil {
 			clientLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToDB).
 				Debugln("Can't write send packet to db")
 			errCh <- err
@@ -345,6 +522,9 @@ func (handler *MysqlHandler) ClientToDbConnector(errCh chan<- error) {
 }
 
 func (handler *MysqlHandler) isFieldToDecrypt(field *ColumnDescription) bool {
+	if handler.schemaStore != nil && !encryptor.IsEncryptedColumn(handler.schemaStore, string(field.OrgTable), string(field.OrgName)) {
+		return false
+	}
 	switch field.Type {
 	case MYSQL_TYPE_VARCHAR, MysqlTypeTinyBlob, MysqlTypeMediumBlob, MysqlTypeLongBlob, MysqlTypeBlob,
 		MysqlTypeVarString, MysqlTypeString:
@@ -354,23 +534,141 @@ func (handler *MysqlHandler) isFieldToDecrypt(field *ColumnDescription) bool {
 	}
 }
 
+// textRowNullValue used in text protocol rows instead of length encoded string for NULL values
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::ResultsetRow
+const textRowNullValue = 0xfb
+
+// getColumnSetting returns setting of field's column or nil if column isn't configured
+func (handler *MysqlHandler) getColumnSetting(field *ColumnDescription) *encryptor.ColumnEncryptionSetting {
+	if handler.schemaStore == nil {
+		return nil
+	}
+	schema := handler.schemaStore.GetTableSchema(string(field.OrgTable))
+	if schema == nil {
+		return nil
+	}
+	return schema.GetColumnEncryptionSettings(string(field.OrgName))
+}
+
+// getMaskingPolicy returns masking policy of field's column for client or nil if value shouldn't be masked
+func (handler *MysqlHandler) getMaskingPolicy(field *ColumnDescription) *masking.Policy {
+	setting := handler.getColumnSetting(field)
+	if setting == nil {
+		return nil
+	}
+	return setting.GetMaskingPolicy(handler.getClientID())
+}
+
+// appendMaskedTextValue appends value masked with policy to row in text protocol
+func appendMaskedTextValue(output, value []byte, policy *masking.Policy) []byte {
+	if policy.IsNull() {
+		return append(output, textRowNullValue)
+	}
+	return append(output, PutLengthEncodedString(policy.Mask(value))...)
+}
+
+// detokenizeValue returns original value of token if client may see it, otherwise token as is
+func (handler *MysqlHandler) detokenizeValue(setting *encryptor.ColumnEncryptionSetting, token []byte) []byte {
+	if handler.tokenizer == nil || !setting.CanDetokenize(handler.getClientID()) {
+		return token
+	}
+	value, err := handler.tokenizer.Detokenize(token, setting.TokenType, setting.TokenKeyID(handler.getClientID()))
+	if err != nil {
+		handler.logger.WithError(err).Warningln("Can't detokenize column's value")
+		return token
+	}
+	return value
+}
+
+// isTokenizableBinaryType returns true if values of type in binary protocol may be detokenized
+func isTokenizableBinaryType(fieldType byte) bool {
+	switch fieldType {
+	case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG, MYSQL_TYPE_LONGLONG, MYSQL_TYPE_VARCHAR, MysqlTypeTinyBlob,
+		MysqlTypeMediumBlob, MysqlTypeLongBlob, MysqlTypeBlob, MysqlTypeVarString, MysqlTypeString:
+		return true
+	}
+	return false
+}
+
+// processBinaryTokenValue returns detokenized and masked value of tokenized column in binary protocol, length of
+// source value and true if value should be replaced with NULL. Integers aren't masked because masked values can't be
+// integers
+func (handler *MysqlHandler) processBinaryTokenValue(field *ColumnDescription, setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, int, bool, error) {
+	size := 0
+	switch field.Type {
+	case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG:
+		size = 4
+	case MYSQL_TYPE_LONGLONG:
+		size = 8
+	}
+	if size == 0 {
+		value, _, n, err := LengthEncodedString(data)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		value = handler.detokenizeValue(setting, value)
+		if policy := setting.GetMaskingPolicy(handler.getClientID()); policy != nil {
+			if policy.IsNull() {
+				return nil, n, true, nil
+			}
+			value = policy.Mask(value)
+		}
+		return PutLengthEncodedString(value), n, false, nil
+	}
+	if len(data) < size {
+		return nil, 0, false, ErrMalformPacket
+	}
+	var number int64
+	if size == 4 {
+		number = int64(int32(binary.LittleEndian.Uint32(data)))
+	} else {
+		number = int64(binary.LittleEndian.Uint64(data))
+	}
+	detokenized := handler.detokenizeValue(setting, []byte(strconv.FormatInt(number, 10)))
+	number, err := strconv.ParseInt(string(detokenized), 10, size*8)
+	if err != nil {
+		handler.logger.WithError(err).Warningln("Detokenized value isn't integer of column's size")
+		return data[:size], size, false, nil
+	}
+	output := make([]byte, size)
+	if size == 4 {
+		binary.LittleEndian.PutUint32(output, uint32(number))
+	} else {
+		binary.LittleEndian.PutUint64(output, uint64(number))
+	}
+	return output, size, false, nil
+}
+
 func (handler *MysqlHandler) processTextDataRow(rowData []byte, fields []*ColumnDescription) ([]byte, error) {
 	var err error
 	var value []byte
+	var isNull bool
 	var pos int
 	var n int
 	var output []byte
 	var fieldLogger *logrus.Entry
+	decryptedBytes := 0
+	decryptedCount := 0
 	handler.logger.Debugln("Process data rows in text protocol")
 	for i := range fields {
 		fieldLogger = handler.logger.WithField("field_index", i)
-		value, _, n, err = LengthEncodedString(rowData[pos:])
+		value, isNull, n, err = LengthEncodedString(rowData[pos:])
 		if err != nil {
 			return nil, err
 		}
 		if handler.isFieldToDecrypt(fields[i]) {
 			decryptedValue, err := handler.decryptor.DecryptBlock(value)
 			if err == nil && len(decryptedValue) != len(value) {
+				decryptedBytes += len(decryptedValue)
+				decryptedCount++
+			}
+			if policy := handler.getMaskingPolicy(fields[i]); policy != nil && !isNull {
+				fieldLogger.Debugln("Update with masked value")
+				if err == nil {
+					value = decryptedValue
+				}
+				output = appendMaskedTextValue(output, value, policy)
+			} else if err == nil && len(decryptedValue) != len(value) {
 				fieldLogger.Debugln("Update with decrypted value")
 				output = append(output, PutLengthEncodedString(decryptedValue)...)
 			} else {
@@ -380,13 +678,27 @@ func (handler *MysqlHandler) processTextDataRow(rowData []byte, fields []*Column
 			pos += n
 			continue
 		}
+		if setting := handler.getColumnSetting(fields[i]); setting != nil && setting.IsTokenized() && !isNull {
+			fieldLogger.Debugln("Process tokenized value")
+			value = handler.detokenizeValue(setting, value)
+			if policy := setting.GetMaskingPolicy(handler.getClientID()); policy != nil {
+				output = appendMaskedTextValue(output, value, policy)
+			} else {
+				output = append(output, PutLengthEncodedString(value)...)
+			}
+			pos += n
+			continue
+		}
 		fieldLogger.Debugln("Field is not binary")
 
 		output = append(output, rowData[pos:pos+n]...)
 		pos += n
 	}
 	handler.logger.Debugln("Finish processing text data row")
-
+	if err := handler.allowDecryptedBytes(decryptedBytes); err != nil {
+		return nil, err
+	}
+	handler.decryptedCount += decryptedCount
 	return output, nil
 }
 
@@ -396,6 +708,8 @@ func (handler *MysqlHandler) processBinaryDataRow(rowData []byte, fields []*Colu
 	var err error
 	var value []byte
 	var output []byte
+	decryptedBytes := 0
+	decryptedCount := 0
 
 	handler.logger.Debugln("Process data rows in binary protocol")
 	// no data in response
@@ -435,6 +749,17 @@ func (handler *MysqlHandler) processBinaryDataRow(rowData []byte, fields []*Colu
 				return nil, err
 			}
 			if len(value) != len(decryptedValue) {
+				decryptedBytes += len(decryptedValue)
+				decryptedCount++
+			}
+			if policy := handler.getMaskingPolicy(fields[i]); policy != nil {
+				if policy.IsNull() {
+					// mark value as NULL in bitmap of output row and don't write it
+					output[1+(i+2)/8] |= 1 << (uint(i+2) % 8)
+				} else {
+					output = append(output, PutLengthEncodedString(policy.Mask(decryptedValue))...)
+				}
+			} else if len(value) != len(decryptedValue) {
 				output = append(output, PutLengthEncodedString(decryptedValue)...)
 			} else {
 				output = append(output, rowData[pos:pos+n]...)
@@ -443,6 +768,19 @@ func (handler *MysqlHandler) processBinaryDataRow(rowData []byte, fields []*Colu
 			pos += n
 			continue
 		}
+		if setting := handler.getColumnSetting(fields[i]); setting != nil && setting.IsTokenized() && isTokenizableBinaryType(fields[i].Type) {
+			value, n, isNull, err := handler.processBinaryTokenValue(fields[i], setting, rowData[pos:])
+			if err != nil {
+				return nil, err
+			}
+			if isNull {
+				output[1+(i+2)/8] |= 1 << (uint(i+2) % 8)
+			} else {
+				output = append(output, value...)
+			}
+			pos += n
+			continue
+		}
 		// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
 		switch fields[i].Type {
 		case MYSQL_TYPE_NULL:
@@ -501,6 +839,10 @@ func (handler *MysqlHandler) processBinaryDataRow(rowData []byte, fields []*Colu
 			return nil, fmt.Errorf("while decrypting MySQL query found unknown FieldType %d %s", fields[i].Type, fields[i].Name)
 		}
 	}
+	if err := handler.allowDecryptedBytes(decryptedBytes); err != nil {
+		return nil, err
+	}
+	handler.decryptedCount += decryptedCount
 	return output, nil
 }
 
@@ -523,12 +865,12 @@ func (handler *MysqlHandler) QueryResponseHandler(packet *MysqlPacket, dbConnect
 	// first byte of payload is field count
 	// https://dev.mysql.com/doc/internals/en/com-query-response.html#text-resultset
 	fieldCount := int(packet.GetData()[0])
-	output := []Dumper{packet}
+	output := []*MysqlPacket{packet}
 	if fieldCount != ErrPacket && fieldCount > 0 {
 		handler.logger.Debugln("Read column descriptions")
 		for i := 0; ; i++ {
 			handler.logger.WithField("column_index", i).Debugln("Read column description")
-			fieldPacket, err := ReadPacket(dbConnection)
+			fieldPacket, err := handler.readDbPacket(dbConnection)
 			if err != nil {
 				handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantProcessColumn).
 					Debugln("Can't read packet with column description")
@@ -563,7 +905,7 @@ func (handler *MysqlHandler) QueryResponseHandler(packet *MysqlPacket, dbConnect
 		handler.logger.Debugln("Read data rows")
 		if handler.isPreparedStatementResult() {
 			for {
-				fieldDataPacket, err := ReadPacket(dbConnection)
+				fieldDataPacket, err := handler.readDbPacket(dbConnection)
 				if err != nil {
 					handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).WithError(err).Debugln("Can't read data packet")
 					return err
@@ -573,17 +915,19 @@ func (handler *MysqlHandler) QueryResponseHandler(packet *MysqlPacket, dbConnect
 					break
 				}
 				newData, err := handler.processBinaryDataRow(fieldDataPacket.GetData(), fields)
+				if base.IsClientLimitError(err) {
+					return handler.rejectQueryResult(err, func(packet *MysqlPacket) bool {
+						return packet.GetData()[0] == EOFPacket
+					}, dbConnection, clientConnection)
+				}
 				if err != nil {
 					handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
 						Debugln("Can't process binary data row")
 					return err
 				}
-				dataLength := fieldDataPacket.GetPacketPayloadLength()
-				// decrypted data always less than ecrypted
-				if len(newData) < dataLength {
-					handler.logger.WithFields(logrus.Fields{"oldLength": dataLength, "newLength": len(newData)}).Debugln("Update row data")
-					fieldDataPacket.SetData(newData)
-				}
+				// row is split into packets again on dump if its length is changed
+				handler.logger.WithFields(logrus.Fields{"oldLength": fieldDataPacket.GetPacketPayloadLength(), "newLength": len(newData)}).Debugln("Update row data")
+				fieldDataPacket.SetData(newData)
 			}
 		} else {
 			var dataLog *logrus.Entry
@@ -591,7 +935,7 @@ func (handler *MysqlHandler) QueryResponseHandler(packet *MysqlPacket, dbConnect
 			for i := 0; ; i++ {
 				dataLog = handler.logger.WithField("data_row_index", i)
 				dataLog.Debugln("Read data row")
-				fieldDataPacket, err := ReadPacket(dbConnection)
+				fieldDataPacket, err := handler.readDbPacket(dbConnection)
 				if err != nil {
 					handler.logger.WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).WithError(err).Debugln("Can't read data packet")
 					return err
@@ -607,17 +951,17 @@ func (handler *MysqlHandler) QueryResponseHandler(packet *MysqlPacket, dbConnect
 				}
 				dataLog.Debugln("Process data text row")
 				newData, err := handler.processTextDataRow(fieldDataPacket.GetData(), fields)
+				if base.IsClientLimitError(err) {
+					return handler.rejectQueryResult(err, (*MysqlPacket).IsEOF, dbConnection, clientConnection)
+				}
 				if err != nil {
 					dataLog.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
 						Debugln("Can't process text data row")
 					return err
 				}
-				dataLength := fieldDataPacket.GetPacketPayloadLength()
-				// decrypted data always less than ecrypted
-				if len(newData) < dataLength {
-					dataLog.WithFields(logrus.Fields{"oldLength": dataLength, "newLength": len(newData)}).Debugln("Update row data")
-					fieldDataPacket.SetData(newData)
-				}
+				// row is split into packets again on dump if its length is changed
+				dataLog.WithFields(logrus.Fields{"oldLength": fieldDataPacket.GetPacketPayloadLength(), "newLength": len(newData)}).Debugln("Update row data")
+				fieldDataPacket.SetData(newData)
 
 			}
 		}
@@ -626,14 +970,13 @@ func (handler *MysqlHandler) QueryResponseHandler(packet *MysqlPacket, dbConnect
 
 	// proxy output
 	handler.logger.Debugln("Proxy output")
-	for _, dumper := range output {
-		if _, err := clientConnection.Write(dumper.Dump()); err != nil {
-			handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
-				Debugln("Can't proxy output")
-			return err
-		}
+	if err := handler.writeToClient(clientConnection, output...); err != nil {
+		handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+			Debugln("Can't proxy output")
+		return err
 	}
 	handler.resetQueryHandler()
+	handler.auditDecryptions()
 	handler.logger.Debugln("Query handler finish")
 	return nil
 }
@@ -669,13 +1012,13 @@ func (handler *MysqlHandler) DbToClientConnector(errCh chan<- error) {
 		timer := prometheus.NewTimer(prometheus.ObserverFunc(base.ResponseProcessingTimeHistogram.WithLabelValues(prometheusLabels...).Observe))
 		timerObserveFunc = timer.ObserveDuration
 
-		packet, err := ReadPacket(handler.dbConnection)
+		packet, err := handler.readDbPacket(handler.getDbConnection())
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() && handler.isTLSHandshake {
 					// reset deadline
-					handler.dbConnection.SetReadDeadline(time.Time{})
-					tlsConnection := tls.Client(handler.dbConnection, handler.tlsConfig)
+					handler.getDbConnection().SetReadDeadline(time.Time{})
+					tlsConnection := tls.Client(handler.getDbConnection(), handler.tlsConfig)
 					if err := tlsConnection.Handshake(); err != nil {
 						handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDecryptorCantInitializeTLS).
 							Errorln("Error in tls handshake with db")
@@ -683,7 +1026,7 @@ func (handler *MysqlHandler) DbToClientConnector(errCh chan<- error) {
 						return
 					}
 					handler.logger.Debugln("Switched to tls with db")
-					handler.dbConnection = tlsConnection
+					handler.setDbConnection(tlsConnection)
 					handler.dbTLSHandshakeFinished <- true
 					continue
 				}
@@ -693,7 +1036,7 @@ func (handler *MysqlHandler) DbToClientConnector(errCh chan<- error) {
 			return
 		}
 		// after reading response from db response set deadline on writing data to client
-		handler.clientConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		handler.getClientConnection().SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
 		handler.logger.WithField("sequence_number", packet.GetSequenceNumber()).Debugln("New packet from db to client")
 		if packet.IsErr() {
 			handler.resetQueryHandler()
@@ -702,9 +1045,20 @@ func (handler *MysqlHandler) DbToClientConnector(errCh chan<- error) {
 			firstPacket = false
 			handler.serverProtocol41 = packet.ServerSupportProtocol41()
 			serverLog.Debugf("Set support protocol 41 %v", handler.serverProtocol41)
+		} else if packet.GetData()[0] == OkPacket {
+			if clientConnection := handler.enablePendingCompression(); clientConnection != nil {
+				serverLog.Debugln("Switch to compressed protocol after authentication")
+				if err := handler.writeToClient(clientConnection, packet); err != nil {
+					handler.logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorResponseConnectorCantWriteToClient).
+						Debugln("Can't write OK packet to client")
+					errCh <- err
+					return
+				}
+				continue
+			}
 		}
 		responseHandler = handler.getResponseHandler()
-		err = responseHandler(packet, handler.dbConnection, handler.clientConnection)
+		err = responseHandler(packet, handler.getDbConnection(), handler.getClientConnection())
 		if err != nil {
 			handler.resetQueryHandler()
 			errCh <- err
@@ -0,0 +1,61 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"github.com/cossacklabs/acra/audit"
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetAuditLog sets audit log of client's queries and decryptions. Nothing is written if auditLog is nil
+func (proxy *PgProxy) SetAuditLog(auditLog *audit.Log) {
+	proxy.auditLog = auditLog
+}
+
+// auditQuery writes query and verdict of AcraCensor to audit log
+func (proxy *PgProxy) auditQuery(query, verdict string, logger *log.Entry) {
+	if proxy.auditLog == nil {
+		return
+	}
+	if err := proxy.auditLog.LogQuery(proxy.getClientID(), query, verdict); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWriteAuditLog).
+			Errorln("Can't write query to audit log")
+	}
+}
+
+// countDecryptedColumns adds columns changed by decryption to count of AcraStructs decrypted in current response.
+// Should be called before columns are changed by other processing
+func (proxy *PgProxy) countDecryptedColumns(columns []*ColumnData) {
+	for _, column := range columns {
+		if column.changed {
+			proxy.decryptedCount++
+		}
+	}
+}
+
+// auditDecryptions writes count of AcraStructs decrypted in response to audit log when response is finished
+func (proxy *PgProxy) auditDecryptions(logger *log.Entry) {
+	if proxy.auditLog == nil || proxy.decryptedCount == 0 {
+		return
+	}
+	if err := proxy.auditLog.LogDecryption(proxy.getClientID(), proxy.decryptedCount); err != nil {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorCantWriteAuditLog).
+			Errorln("Can't write decryption to audit log")
+	}
+	proxy.decryptedCount = 0
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/network"
+)
+
+// recoveryQuery returns "t" on read replicas and "f" on primary database
+const recoveryQuery = "SELECT pg_is_in_recovery()"
+
+// ErrDatabaseInRecovery returned by checker of primary databases for read replica
+var ErrDatabaseInRecovery = errors.New("database is in recovery and executes only read-only queries")
+
+// NewBackendChecker returns checker which starts session with database authenticated by credentials of config.
+// Database shouldn't be in recovery if primary is true, otherwise both primary databases and replicas are accepted
+func NewBackendChecker(config PoolConfig, primary bool) network.BackendChecker {
+	pool := &ConnectionPool{config: config}
+	return func(address string) error {
+		connection, err := net.DialTimeout("tcp", address, network.DefaultNetworkTimeout)
+		if err != nil {
+			return err
+		}
+		defer func() { connection.Close() }()
+		if config.TLSConfig != nil {
+			if connection, err = startTLSWithDb(connection, config.TLSConfig); err != nil {
+				return err
+			}
+		}
+		connection.SetDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		if _, err := pool.startup(connection); err != nil {
+			return err
+		}
+		inRecovery, err := queryInRecovery(connection)
+		connection.Write(marshalMessage(terminateMessageType, nil))
+		if err != nil {
+			return err
+		}
+		if primary && inRecovery {
+			return ErrDatabaseInRecovery
+		}
+		return nil
+	}
+}
+
+// queryInRecovery executes recoveryQuery with simple query protocol and returns its result
+func queryInRecovery(connection net.Conn) (bool, error) {
+	query := marshalMessage(QueryMessageType, append([]byte(recoveryQuery), 0))
+	n, err := connection.Write(query)
+	if err := base.CheckReadWrite(n, len(query), err); err != nil {
+		return false, err
+	}
+	var value []byte
+	var queryErr error
+	for {
+		messageType, data, err := readMessage(connection)
+		if err != nil {
+			return false, err
+		}
+		switch messageType {
+		case ErrorResponseMessageType:
+			queryErr = errors.New(parseErrorResponseMessage(data))
+		case DataRowMessageType:
+			// 2 bytes of columns count and 4 bytes of length of the only column
+			if len(data) < 6 || binary.BigEndian.Uint16(data) != 1 || int32(binary.BigEndian.Uint32(data[2:])) != int32(len(data)-6) {
+				queryErr = ErrUnexpectedDatabaseResponse
+				continue
+			}
+			value = data[6:]
+		case ReadyForQueryMessageType:
+			if queryErr != nil {
+				return false, queryErr
+			}
+			switch string(value) {
+			case "t":
+				return true, nil
+			case "f":
+				return false, nil
+			}
+			return false, ErrUnexpectedDatabaseResponse
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/network"
+)
+
+// BackendKeyDataMessageType is type of message with keys that client uses to cancel queries of session
+// https://www.postgresql.org/docs/current/static/protocol-message-formats.html
+const BackendKeyDataMessageType byte = 'K'
+
+// Lengths of CancelRequest and BackendKeyData messages
+const (
+	// 4 bytes of length, 4 bytes of cancel request code, 4 bytes of process ID and 4 bytes of secret key
+	cancelRequestLength = 16
+	// 4 bytes of process ID and 4 bytes of secret key
+	backendKeyDataLength = 8
+)
+
+// Errors returned on processing of CancelRequest
+var (
+	ErrInvalidBackendKeyData = errors.New("invalid BackendKeyData packet")
+	ErrInvalidCancelRequest  = errors.New("invalid CancelRequest packet")
+	ErrUnknownCancelKey      = errors.New("session of CancelRequest not found")
+	ErrDbRefusedTLS          = errors.New("database refused TLS connection")
+)
+
+// BackendKeyData identifies session which queries client may cancel with CancelRequest
+type BackendKeyData struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+// parseBackendKeyData returns keys from data of BackendKeyData packet or CancelRequest packet without length and code
+func parseBackendKeyData(data []byte) (BackendKeyData, error) {
+	if len(data) != backendKeyDataLength {
+		return BackendKeyData{}, ErrInvalidBackendKeyData
+	}
+	return BackendKeyData{ProcessID: binary.BigEndian.Uint32(data), SecretKey: binary.BigEndian.Uint32(data[4:])}, nil
+}
+
+// Marshal returns data of BackendKeyData packet
+func (key BackendKeyData) Marshal() []byte {
+	output := make([]byte, backendKeyDataLength)
+	binary.BigEndian.PutUint32(output, key.ProcessID)
+	binary.BigEndian.PutUint32(output[4:], key.SecretKey)
+	return output
+}
+
+// cancelRequestPacket returns CancelRequest packet with key
+func (key BackendKeyData) cancelRequestPacket() []byte {
+	output := make([]byte, 0, cancelRequestLength)
+	output = append(output, 0, 0, 0, cancelRequestLength)
+	output = append(output, CancelRequest...)
+	return append(output, key.Marshal()...)
+}
+
+// IsCancelRequest returns true if packet is CancelRequest sent by client to cancel query of other session
+func (packet *PacketHandler) IsCancelRequest() bool {
+	return packet.messageType[0] == WithoutMessageType && bytes.HasPrefix(packet.descriptionBuf.Bytes(), CancelRequest)
+}
+
+// IsBackendKeyData returns true if packet is BackendKeyData sent by database on session start
+func (packet *PacketHandler) IsBackendKeyData() bool {
+	return packet.messageType[0] == BackendKeyDataMessageType
+}
+
+// cancelTarget is database session which queries may be canceled
+type cancelTarget struct {
+	// key sent by database
+	key BackendKeyData
+	// address of database which started session
+	address net.Addr
+	// tlsConfig is not nil if session uses TLS and cancel request should be sent over TLS too
+	tlsConfig *tls.Config
+}
+
+// CancelRequestRouter remembers sessions of all connections to send cancel requests to databases which started them.
+// Clients' connections which send cancel requests are new connections that may be connected to other database or
+// without TLS, so requests can't be forwarded as is. If keys are rewritten then clients receive keys generated by
+// AcraServer that are unique across all databases and don't disclose keys of database
+type CancelRequestRouter struct {
+	lock        sync.Mutex
+	targets     map[BackendKeyData]*cancelTarget
+	rewriteKeys bool
+}
+
+// NewCancelRequestRouter returns new CancelRequestRouter which rewrites keys sent to clients if rewriteKeys is true
+func NewCancelRequestRouter(rewriteKeys bool) *CancelRequestRouter {
+	return &CancelRequestRouter{targets: make(map[BackendKeyData]*cancelTarget), rewriteKeys: rewriteKeys}
+}
+
+// register remembers session of database and returns key that should be sent to client
+func (router *CancelRequestRouter) register(target *cancelTarget) (BackendKeyData, error) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if !router.rewriteKeys {
+		router.targets[target.key] = target
+		return target.key, nil
+	}
+	buf := make([]byte, backendKeyDataLength)
+	for {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return BackendKeyData{}, err
+		}
+		clientKey, err := parseBackendKeyData(buf)
+		if err != nil {
+			return BackendKeyData{}, err
+		}
+		if _, ok := router.targets[clientKey]; !ok {
+			router.targets[clientKey] = target
+			return clientKey, nil
+		}
+	}
+}
+
+// unregister forgets session which connection was closed
+func (router *CancelRequestRouter) unregister(clientKey BackendKeyData) {
+	router.lock.Lock()
+	delete(router.targets, clientKey)
+	router.lock.Unlock()
+}
+
+// Cancel sends CancelRequest to database which session has clientKey
+func (router *CancelRequestRouter) Cancel(clientKey BackendKeyData) error {
+	router.lock.Lock()
+	target, ok := router.targets[clientKey]
+	router.lock.Unlock()
+	if !ok {
+		return ErrUnknownCancelKey
+	}
+	connection, err := net.DialTimeout(target.address.Network(), target.address.String(), network.DefaultNetworkTimeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	if target.tlsConfig != nil {
+		if connection, err = startTLSWithDb(connection, target.tlsConfig); err != nil {
+			return err
+		}
+	}
+	request := target.key.cancelRequestPacket()
+	n, err := connection.Write(request)
+	return base.CheckReadWrite(n, len(request), err)
+}
+
+// startTLSWithDb sends SSLRequest and wraps connection with TLS. Returns ErrDbRefusedTLS if database doesn't support
+// TLS, so credentials and requests are never sent in plaintext over connection expected to be encrypted
+func startTLSWithDb(connection net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	request := append([]byte{0, 0, 0, 8}, SSLRequest...)
+	n, err := connection.Write(request)
+	if err := base.CheckReadWrite(n, len(request), err); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(connection, response); err != nil {
+		return nil, err
+	}
+	if response[0] != 'S' {
+		return nil, ErrDbRefusedTLS
+	}
+	tlsConnection := tls.Client(connection, tlsConfig)
+	if err := tlsConnection.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConnection, nil
+}
+
+// SetCancelRequestRouter sets router used to register session of connection and route client's CancelRequest. Cancel
+// requests are forwarded to database as is if router is nil
+func (proxy *PgProxy) SetCancelRequestRouter(router *CancelRequestRouter) {
+	proxy.cancelRouter = router
+}
+
+// onBackendKeyData registers session of database and replaces keys sent to client if router rewrites them
+func (proxy *PgProxy) onBackendKeyData(packet *PacketHandler, dbConnection net.Conn, tlsConfig *tls.Config) error {
+	key, err := parseBackendKeyData(packet.GetPacketData())
+	if err != nil {
+		return err
+	}
+	target := &cancelTarget{key: key, address: dbConnection.RemoteAddr()}
+	if _, ok := dbConnection.(*tls.Conn); ok {
+		target.tlsConfig = tlsConfig
+	}
+	clientKey, err := proxy.cancelRouter.register(target)
+	if err != nil {
+		return err
+	}
+	proxy.cancelKey = &clientKey
+	if clientKey != key {
+		packet.ReplacePacketData(clientKey.Marshal())
+	}
+	return nil
+}
+
+// releaseCancelKey unregisters session of closed connection
+func (proxy *PgProxy) releaseCancelKey() {
+	if proxy.cancelKey != nil {
+		proxy.cancelRouter.unregister(*proxy.cancelKey)
+		proxy.cancelKey = nil
+	}
+}
+
+// onCancelRequest routes client's CancelRequest to database which started session
+func (proxy *PgProxy) onCancelRequest(packet *PacketHandler) error {
+	data := packet.GetPacketData()
+	if len(data) != len(CancelRequest)+backendKeyDataLength {
+		return ErrInvalidCancelRequest
+	}
+	key, err := parseBackendKeyData(data[len(CancelRequest):])
+	if err != nil {
+		return err
+	}
+	return proxy.cancelRouter.Cancel(key)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCancelRequestRouting(t *testing.T) {
+	// database which receives cancel request
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		// first connection is connection of session, second one is connection with cancel request
+		session, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		request := make([]byte, cancelRequestLength)
+		io.ReadFull(connection, request)
+		received <- request
+	}()
+	dbConnection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbConnection.Close()
+
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetCancelRequestRouter(NewCancelRequestRouter(true))
+	dbKey := BackendKeyData{ProcessID: 1234, SecretKey: 5678}
+	packet, err := NewDbSidePacketHandler(bytes.NewReader(append([]byte{BackendKeyDataMessageType, 0, 0, 0, 12}, dbKey.Marshal()...)), bufio.NewWriter(&bytes.Buffer{}), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.Reset()
+	if err := packet.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if !packet.IsBackendKeyData() {
+		t.Fatal("Expected BackendKeyData packet")
+	}
+	if err := proxy.onBackendKeyData(packet, dbConnection, nil); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := parseBackendKeyData(packet.GetPacketData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientKey == dbKey {
+		t.Fatal("Key sent to client should be rewritten")
+	}
+
+	// client sends cancel request with key generated by AcraServer in new connection
+	cancelPacket, err := NewClientSidePacketHandler(bytes.NewReader(clientKey.cancelRequestPacket()), bufio.NewWriter(&bytes.Buffer{}), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cancelPacket.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if !cancelPacket.IsCancelRequest() {
+		t.Fatal("Expected CancelRequest packet")
+	}
+	if err := proxy.onCancelRequest(cancelPacket); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-received; !bytes.Equal(request, dbKey.cancelRequestPacket()) {
+		t.Fatalf("Database received incorrect cancel request %v", request)
+	}
+
+	// session of closed connection can't be canceled
+	proxy.releaseCancelKey()
+	if err := proxy.cancelRouter.Cancel(clientKey); err != ErrUnknownCancelKey {
+		t.Fatalf("Expected ErrUnknownCancelKey, took %v", err)
+	}
+}
+
+func TestStartTLSWithDbRefused(t *testing.T) {
+	client, database := net.Pipe()
+	defer client.Close()
+	defer database.Close()
+	go func() {
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(database, request); err != nil {
+			return
+		}
+		database.Write([]byte{'N'})
+	}()
+	if _, err := startTLSWithDb(client, &tls.Config{}); err != ErrDbRefusedTLS {
+		t.Fatalf("Expected ErrDbRefusedTLS, took %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+// PostgreSQL error codes returned to clients which exceeded their limits
+// https://www.postgresql.org/docs/current/static/errcodes-appendix.html
+const (
+	ErrorCodeTooManyConnections         = "53300"
+	ErrorCodeConfigurationLimitExceeded = "53400"
+)
+
+// NewPgClientLimitError returns packed ErrorResponse for client which exceeded limit with err
+func NewPgClientLimitError(err error) ([]byte, error) {
+	code := ErrorCodeConfigurationLimitExceeded
+	if err == base.ErrSessionLimitExceeded {
+		code = ErrorCodeTooManyConnections
+	}
+	return NewPgErrorWithCode(code, "AcraServer rejected request: "+err.Error())
+}
+
+// SetClientLimiter sets limiter of client's queries and decrypted data. Limits aren't checked if limiter is nil
+func (proxy *PgProxy) SetClientLimiter(limiter *base.ClientLimiter) {
+	proxy.limiter = limiter
+}
+
+// allowQuery returns error if client exceeded limit of queries
+func (proxy *PgProxy) allowQuery() error {
+	if proxy.limiter == nil {
+		return nil
+	}
+	return proxy.limiter.AllowQuery(proxy.getClientID())
+}
+
+// allowDecryptedColumns returns error if client exceeded limit of decrypted data with values of columns changed by
+// decryption. Should be called before columns are changed by other processing
+func (proxy *PgProxy) allowDecryptedColumns(columns []*ColumnData) error {
+	if proxy.limiter == nil {
+		return nil
+	}
+	decryptedBytes := 0
+	for _, column := range columns {
+		if column.changed {
+			decryptedBytes += len(column.Data)
+		}
+	}
+	return proxy.limiter.AllowDecryptedBytes(proxy.getClientID(), decryptedBytes)
+}
@@ -0,0 +1,477 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/network"
+)
+
+// Message types used by pool to start sessions with database
+// https://www.postgresql.org/docs/current/static/protocol-message-formats.html
+const (
+	authenticationMessageType  byte = 'R'
+	passwordMessageType        byte = 'p'
+	parameterStatusMessageType byte = 'S'
+	terminateMessageType       byte = 'X'
+)
+
+// Authentication requests of database supported by pool
+const (
+	authenticationOk                = 0
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+// scramSHA256Mechanism is the only SASL mechanism supported by PostgreSQL
+const scramSHA256Mechanism = "SCRAM-SHA-256"
+
+// DefaultPoolResetQuery resets state of session changed by client before connection is returned to pool
+const DefaultPoolResetQuery = "DISCARD ALL"
+
+// Errors returned by connection pool
+var (
+	ErrInvalidPoolSize            = errors.New("size of connection pool should be greater than 0")
+	ErrPoolWaitTimeout            = errors.New("timeout of waiting for free connection of pool")
+	ErrUnsupportedAuthentication  = errors.New("unsupported authentication method requested by database")
+	ErrInvalidServerSignature     = errors.New("invalid SCRAM signature of database")
+	ErrUnexpectedDatabaseResponse = errors.New("unexpected response of database")
+)
+
+// maxPoolMessageLength limits size of messages read by pool on startup and reset of session
+const maxPoolMessageLength = 1 << 24
+
+// PoolConfig describes how pool connects to database
+type PoolConfig struct {
+	// Backends are databases which pool connects to in order of priority
+	Backends *network.BackendSet
+	User     string
+	Password string
+	Database string
+	// Size is maximum count of opened connections
+	Size int
+	// WaitTimeout limits time of waiting for free connection when all connections are in use
+	WaitTimeout time.Duration
+	// ResetQuery is executed on connections which session state was changed by client before they are returned to pool
+	ResetQuery string
+	// TLSConfig is used if database supports TLS. Connections are not encrypted if it is nil
+	TLSConfig *tls.Config
+	// Users are md5 hashes of passwords of clients allowed to use pool. Clients should be authenticated by transport of
+	// AcraServer if it is nil
+	Users map[string]string
+}
+
+// ConnectionPool keeps authenticated connections to database which are shared by clients' sessions. Connection is
+// leased by session for one transaction and returned to pool when database becomes idle
+type ConnectionPool struct {
+	config PoolConfig
+	// slots limits count of leased and connecting connections
+	slots chan struct{}
+	lock  sync.Mutex
+	idle  []net.Conn
+	// parameters are ParameterStatus packets sent by database on startup which are sent to clients too
+	parameters []byte
+	// replicas is used for read-only queries if not nil
+	replicas *ConnectionPool
+}
+
+// NewConnectionPool returns pool which opens connections to database on demand
+func NewConnectionPool(config PoolConfig) (*ConnectionPool, error) {
+	if config.Size <= 0 {
+		return nil, ErrInvalidPoolSize
+	}
+	if config.Backends == nil {
+		return nil, network.ErrEmptyBackendSet
+	}
+	if config.ResetQuery == "" {
+		config.ResetQuery = DefaultPoolResetQuery
+	}
+	return &ConnectionPool{config: config, slots: make(chan struct{}, config.Size)}, nil
+}
+
+// SetReplicaPool sets pool of read replicas which connections are leased for autocommit SELECT queries
+func (pool *ConnectionPool) SetReplicaPool(replicas *ConnectionPool) {
+	pool.replicas = replicas
+}
+
+// database returns name of database which connections of pool use
+func (pool *ConnectionPool) database() string {
+	if pool.config.Database != "" {
+		return pool.config.Database
+	}
+	return pool.config.User
+}
+
+// NewConnection returns connection which client's session uses instead of own connection to database
+func (pool *ConnectionPool) NewConnection() net.Conn {
+	return newPooledConnection(pool)
+}
+
+// acquire returns idle connection or opens new one if all are in use and pool is not full
+func (pool *ConnectionPool) acquire() (net.Conn, error) {
+	timer := time.NewTimer(pool.config.WaitTimeout)
+	defer timer.Stop()
+	select {
+	case pool.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, ErrPoolWaitTimeout
+	}
+	pool.lock.Lock()
+	if count := len(pool.idle); count > 0 {
+		connection := pool.idle[count-1]
+		pool.idle = pool.idle[:count-1]
+		pool.lock.Unlock()
+		return connection, nil
+	}
+	pool.lock.Unlock()
+	connection, err := pool.connect()
+	if err != nil {
+		<-pool.slots
+		return nil, err
+	}
+	return connection, nil
+}
+
+// release returns connection to pool
+func (pool *ConnectionPool) release(connection net.Conn) {
+	pool.lock.Lock()
+	pool.idle = append(pool.idle, connection)
+	pool.lock.Unlock()
+	<-pool.slots
+}
+
+// discard closes connection which state is unknown
+func (pool *ConnectionPool) discard(connection net.Conn) {
+	connection.Close()
+	<-pool.slots
+}
+
+// reset executes reset query and returns connection to pool or closes it if query failed
+func (pool *ConnectionPool) reset(connection net.Conn) {
+	if err := pool.executeResetQuery(connection); err != nil {
+		pool.discard(connection)
+		return
+	}
+	pool.release(connection)
+}
+
+// startupParameters returns ParameterStatus packets of database, opening connection if pool didn't connect yet
+func (pool *ConnectionPool) startupParameters() ([]byte, error) {
+	pool.lock.Lock()
+	parameters := pool.parameters
+	pool.lock.Unlock()
+	if parameters != nil {
+		return parameters, nil
+	}
+	connection, err := pool.acquire()
+	if err != nil {
+		return nil, err
+	}
+	pool.release(connection)
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.parameters, nil
+}
+
+// connect opens new connection to database and authenticates it
+func (pool *ConnectionPool) connect() (net.Conn, error) {
+	connection, err := pool.config.Backends.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if pool.config.TLSConfig != nil {
+		tlsConnection, err := startTLSWithDb(connection, pool.config.TLSConfig)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		connection = tlsConnection
+	}
+	connection.SetDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+	parameters, err := pool.startup(connection)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	connection.SetDeadline(time.Time{})
+	pool.lock.Lock()
+	if pool.parameters == nil {
+		pool.parameters = parameters
+	}
+	pool.lock.Unlock()
+	return connection, nil
+}
+
+// startup sends StartupMessage, authenticates and returns ParameterStatus packets sent by database
+func (pool *ConnectionPool) startup(connection net.Conn) ([]byte, error) {
+	startup := append([]byte{0, 0, 0, 0}, StartupRequest...)
+	for _, parameter := range [][2]string{
+		{StartupUserParameter, pool.config.User},
+		{"database", pool.config.Database},
+		{StartupApplicationNameParameter, "acra-server"},
+	} {
+		if parameter[1] != "" {
+			startup = append(startup, parameter[0]...)
+			startup = append(startup, 0)
+			startup = append(startup, parameter[1]...)
+			startup = append(startup, 0)
+		}
+	}
+	startup = append(startup, 0)
+	binary.BigEndian.PutUint32(startup, uint32(len(startup)))
+	n, err := connection.Write(startup)
+	if err := base.CheckReadWrite(n, len(startup), err); err != nil {
+		return nil, err
+	}
+	var scram *scramClient
+	parameters := []byte{}
+	for {
+		messageType, data, err := readMessage(connection)
+		if err != nil {
+			return nil, err
+		}
+		switch messageType {
+		case ErrorResponseMessageType:
+			return nil, errors.New(parseErrorResponseMessage(data))
+		case parameterStatusMessageType:
+			parameters = append(parameters, marshalMessage(messageType, data)...)
+		case ReadyForQueryMessageType:
+			return parameters, nil
+		case authenticationMessageType:
+			if len(data) < 4 {
+				return nil, ErrUnexpectedDatabaseResponse
+			}
+			var response []byte
+			switch binary.BigEndian.Uint32(data) {
+			case authenticationOk:
+				continue
+			case authenticationCleartextPassword:
+				response = append([]byte(pool.config.Password), 0)
+			case authenticationMD5Password:
+				if len(data) != 8 {
+					return nil, ErrUnexpectedDatabaseResponse
+				}
+				response = append([]byte(md5Password(pool.config.User, pool.config.Password, data[4:])), 0)
+			case authenticationSASL:
+				if !bytes.Contains(data[4:], append([]byte(scramSHA256Mechanism), 0)) {
+					return nil, ErrUnsupportedAuthentication
+				}
+				if scram, err = newSCRAMClient(pool.config.Password); err != nil {
+					return nil, err
+				}
+				clientFirst := scram.clientFirstMessage()
+				response = append([]byte(scramSHA256Mechanism), 0, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(response[len(scramSHA256Mechanism)+1:], uint32(len(clientFirst)))
+				response = append(response, clientFirst...)
+			case authenticationSASLContinue:
+				if scram == nil {
+					return nil, ErrUnexpectedDatabaseResponse
+				}
+				if response, err = scram.clientFinalMessage(data[4:]); err != nil {
+					return nil, err
+				}
+			case authenticationSASLFinal:
+				if scram == nil {
+					return nil, ErrUnexpectedDatabaseResponse
+				}
+				if err := scram.verifyServerFinalMessage(data[4:]); err != nil {
+					return nil, err
+				}
+				continue
+			default:
+				return nil, ErrUnsupportedAuthentication
+			}
+			packet := marshalMessage(passwordMessageType, response)
+			n, err := connection.Write(packet)
+			if err := base.CheckReadWrite(n, len(packet), err); err != nil {
+				return nil, err
+			}
+		}
+		// BackendKeyData and NoticeResponse are not needed by pool
+	}
+}
+
+// executeResetQuery executes reset query with simple query protocol and waits for its completion
+func (pool *ConnectionPool) executeResetQuery(connection net.Conn) error {
+	connection.SetDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+	defer connection.SetDeadline(time.Time{})
+	query := marshalMessage(QueryMessageType, append([]byte(pool.config.ResetQuery), 0))
+	n, err := connection.Write(query)
+	if err := base.CheckReadWrite(n, len(query), err); err != nil {
+		return err
+	}
+	var queryErr error
+	for {
+		messageType, data, err := readMessage(connection)
+		if err != nil {
+			return err
+		}
+		switch messageType {
+		case ErrorResponseMessageType:
+			queryErr = errors.New(parseErrorResponseMessage(data))
+		case ReadyForQueryMessageType:
+			if queryErr == nil && (len(data) != 1 || data[0] != 'I') {
+				queryErr = ErrUnexpectedDatabaseResponse
+			}
+			return queryErr
+		}
+	}
+}
+
+// readMessage reads message with type from connection
+func readMessage(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > maxPoolMessageLength {
+		return 0, nil, ErrUnexpectedDatabaseResponse
+	}
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+// marshalMessage returns packet with type, length and data
+func marshalMessage(messageType byte, data []byte) []byte {
+	output := make([]byte, 5, 5+len(data))
+	output[0] = messageType
+	binary.BigEndian.PutUint32(output[1:], uint32(4+len(data)))
+	return append(output, data...)
+}
+
+// parseErrorResponseMessage returns human readable message of ErrorResponse
+func parseErrorResponseMessage(data []byte) string {
+	for _, field := range bytes.Split(data, []byte{0}) {
+		if len(field) > 0 && field[0] == 'M' {
+			return string(field[1:])
+		}
+	}
+	return "database returned error"
+}
+
+// md5Password returns password hashed as "md5" + md5(md5(password + user) + salt)
+func md5Password(user, password string, salt []byte) string {
+	return md5SaltedPassword(md5PasswordHash(user, password), salt)
+}
+
+// scramClient authenticates with SCRAM-SHA-256 mechanism
+// https://www.postgresql.org/docs/current/static/sasl-authentication.html
+type scramClient struct {
+	password           string
+	clientNonce        string
+	clientFirstBare    string
+	expectedServerSign []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	clientNonce := base64.StdEncoding.EncodeToString(nonce)
+	// user name is ignored by PostgreSQL and taken from StartupMessage
+	return &scramClient{password: password, clientNonce: clientNonce, clientFirstBare: "n=,r=" + clientNonce}, nil
+}
+
+// clientFirstMessage returns message without channel binding
+func (client *scramClient) clientFirstMessage() []byte {
+	return []byte("n,," + client.clientFirstBare)
+}
+
+// clientFinalMessage returns client's proof computed from nonce, salt and iteration count of server-first-message
+func (client *scramClient) clientFinalMessage(serverFirst []byte) ([]byte, error) {
+	var serverNonce, salt string
+	iterations := 0
+	for _, attribute := range strings.Split(string(serverFirst), ",") {
+		switch {
+		case strings.HasPrefix(attribute, "r="):
+			serverNonce = attribute[2:]
+		case strings.HasPrefix(attribute, "s="):
+			salt = attribute[2:]
+		case strings.HasPrefix(attribute, "i="):
+			iterations, _ = strconv.Atoi(attribute[2:])
+		}
+	}
+	decodedSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || iterations <= 0 || !strings.HasPrefix(serverNonce, client.clientNonce) {
+		return nil, ErrUnexpectedDatabaseResponse
+	}
+	saltedPassword := pbkdf2SHA256([]byte(client.password), decodedSalt, iterations)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientFinalWithoutProof := "c=biws,r=" + serverNonce
+	authMessage := []byte(client.clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	client.expectedServerSign = hmacSHA256(hmacSHA256(saltedPassword, []byte("Server Key")), authMessage)
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServerFinalMessage checks that server knows password too
+func (client *scramClient) verifyServerFinalMessage(serverFinal []byte) error {
+	if !bytes.HasPrefix(serverFinal, []byte("v=")) {
+		return ErrInvalidServerSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(serverFinal[2:]))
+	if err != nil || !hmac.Equal(signature, client.expectedServerSign) {
+		return ErrInvalidServerSignature
+	}
+	return nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives key with size of one SHA256 block that is enough for SCRAM-SHA-256
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	u := hmacSHA256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/network"
+)
+
+// fakePoolDatabase accepts connections authenticated with md5 password and answers simple queries
+type fakePoolDatabase struct {
+	listener    net.Listener
+	lock        sync.Mutex
+	connections int
+	queries     []string
+	// inRecovery is result of recoveryQuery
+	inRecovery bool
+}
+
+func newFakePoolDatabase(t *testing.T) *fakePoolDatabase {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &fakePoolDatabase{listener: listener}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			database.lock.Lock()
+			database.connections++
+			database.lock.Unlock()
+			go database.serve(connection)
+		}
+	}()
+	return database
+}
+
+func (database *fakePoolDatabase) serve(connection net.Conn) {
+	defer connection.Close()
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(connection, lengthBuf); err != nil {
+		return
+	}
+	startup := make([]byte, binary.BigEndian.Uint32(lengthBuf)-4)
+	if _, err := io.ReadFull(connection, startup); err != nil {
+		return
+	}
+	parameters, err := parseStartupParameters(startup)
+	if err != nil {
+		return
+	}
+	salt := []byte{1, 2, 3, 4}
+	connection.Write(marshalMessage(authenticationMessageType, append([]byte{0, 0, 0, authenticationMD5Password}, salt...)))
+	_, password, err := readMessage(connection)
+	if err != nil || string(password) != md5Password(parameters[StartupUserParameter], "password", salt)+"\x00" {
+		connection.Write(marshalMessage(ErrorResponseMessageType, []byte("Mpassword authentication failed\x00\x00")))
+		return
+	}
+	connection.Write(marshalMessage(authenticationMessageType, []byte{0, 0, 0, authenticationOk}))
+	connection.Write(marshalMessage(parameterStatusMessageType, []byte("server_version\x0011.0\x00")))
+	connection.Write(marshalMessage(BackendKeyDataMessageType, []byte{0, 0, 0, 1, 0, 0, 0, 2}))
+	connection.Write(ReadyForQueryPacket)
+	status := transactionStatusIdle
+	for {
+		messageType, data, err := readMessage(connection)
+		if err != nil || messageType == terminateMessageType {
+			return
+		}
+		query := string(bytes.TrimRight(data, "\x00"))
+		database.lock.Lock()
+		database.queries = append(database.queries, query)
+		inRecovery := database.inRecovery
+		database.lock.Unlock()
+		switch query {
+		case "BEGIN":
+			status = 'T'
+		case "COMMIT":
+			status = transactionStatusIdle
+		case recoveryQuery:
+			value := byte('f')
+			if inRecovery {
+				value = 't'
+			}
+			connection.Write(marshalMessage(DataRowMessageType, []byte{0, 1, 0, 0, 0, 1, value}))
+		}
+		connection.Write(marshalMessage(CommandCompleteMessageType, []byte("SELECT 1\x00")))
+		connection.Write(marshalMessage(ReadyForQueryMessageType, []byte{status}))
+	}
+}
+
+func (database *fakePoolDatabase) stats() (int, []string) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.connections, append([]string{}, database.queries...)
+}
+
+// readTillReadyForQuery returns types of messages read from connection and transaction status of ReadyForQuery
+func readTillReadyForQuery(t *testing.T, connection net.Conn) ([]byte, byte) {
+	var types []byte
+	for {
+		messageType, data, err := readMessage(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, messageType)
+		if messageType == ReadyForQueryMessageType {
+			return types, data[0]
+		}
+	}
+}
+
+func sendStartupMessage(t *testing.T, connection net.Conn, user, database string) {
+	startup := append([]byte{0, 0, 0, 0}, StartupRequest...)
+	startup = append(startup, "user\x00"+user+"\x00database\x00"+database+"\x00\x00"...)
+	binary.BigEndian.PutUint32(startup, uint32(len(startup)))
+	if _, err := connection.Write(startup); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startPooledSession(t *testing.T, pool *ConnectionPool) net.Conn {
+	connection := pool.NewConnection()
+	sendStartupMessage(t, connection, "client", "pool")
+	types, _ := readTillReadyForQuery(t, connection)
+	if string(types) != "RSZ" {
+		t.Fatalf("Incorrect startup response %s", types)
+	}
+	return connection
+}
+
+func simpleQuery(t *testing.T, connection net.Conn, query string) byte {
+	if _, err := connection.Write(marshalMessage(QueryMessageType, append([]byte(query), 0))); err != nil {
+		t.Fatal(err)
+	}
+	_, status := readTillReadyForQuery(t, connection)
+	return status
+}
+
+func newTestPool(t *testing.T, database *fakePoolDatabase) *ConnectionPool {
+	backends, err := network.NewBackendSet([]string{database.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewConnectionPool(PoolConfig{
+		Backends:    backends,
+		User:        "pool",
+		Password:    "password",
+		Size:        1,
+		WaitTimeout: time.Millisecond * 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestConnectionPool(t *testing.T) {
+	database := newFakePoolDatabase(t)
+	defer database.listener.Close()
+	pool := newTestPool(t, database)
+
+	// sessions share one connection between transactions
+	first := startPooledSession(t, pool)
+	defer first.Close()
+	second := startPooledSession(t, pool)
+	defer second.Close()
+	simpleQuery(t, first, "SELECT 1")
+	simpleQuery(t, second, "SELECT 2")
+	if status := simpleQuery(t, first, "BEGIN"); status != 'T' {
+		t.Fatalf("Expected transaction status, took %c", status)
+	}
+	if _, err := second.Write(marshalMessage(QueryMessageType, []byte("SELECT 3\x00"))); err != ErrPoolWaitTimeout {
+		t.Fatalf("Expected ErrPoolWaitTimeout while connection is used by transaction, took %v", err)
+	}
+	simpleQuery(t, first, "COMMIT")
+
+	// connection is pinned to session which changed its state and reset on close
+	third := startPooledSession(t, pool)
+	simpleQuery(t, third, "SET search_path TO public")
+	fourth := startPooledSession(t, pool)
+	defer fourth.Close()
+	if _, err := fourth.Write(marshalMessage(QueryMessageType, []byte("SELECT 4\x00"))); err != ErrPoolWaitTimeout {
+		t.Fatalf("Expected ErrPoolWaitTimeout while connection is pinned, took %v", err)
+	}
+	third.Close()
+	simpleQuery(t, fourth, "SELECT 5")
+
+	connections, queries := database.stats()
+	if connections != 1 {
+		t.Fatalf("Expected one connection to database, took %d", connections)
+	}
+	expected := []string{"SELECT 1", "SELECT 2", "BEGIN", "COMMIT", "SET search_path TO public", DefaultPoolResetQuery, "SELECT 5"}
+	if strings.Join(queries, ";") != strings.Join(expected, ";") {
+		t.Fatalf("Incorrect queries %v", queries)
+	}
+
+	pool.config.Password = "invalid"
+	pool.idle = nil
+	if _, err := pool.connect(); err == nil || err.Error() != "password authentication failed" {
+		t.Fatalf("Expected authentication error, took %v", err)
+	}
+}
+
+func TestConnectionPoolReplicas(t *testing.T) {
+	primary := newFakePoolDatabase(t)
+	defer primary.listener.Close()
+	replica := newFakePoolDatabase(t)
+	defer replica.listener.Close()
+	pool := newTestPool(t, primary)
+	pool.SetReplicaPool(newTestPool(t, replica))
+
+	session := startPooledSession(t, pool)
+	defer session.Close()
+	for _, query := range []string{"SELECT 1", "INSERT INTO t VALUES (1)", "SELECT a FROM t FOR UPDATE", "SELECT a FROM t UNION SELECT b FROM t2", "SELECT nextval('seq')"} {
+		simpleQuery(t, session, query)
+	}
+	simpleQuery(t, session, "BEGIN")
+	simpleQuery(t, session, "SELECT 2")
+	simpleQuery(t, session, "COMMIT")
+
+	_, primaryQueries := primary.stats()
+	_, replicaQueries := replica.stats()
+	if strings.Join(replicaQueries, ";") != "SELECT 1;SELECT a FROM t UNION SELECT b FROM t2" {
+		t.Fatalf("Incorrect queries of replica %v", replicaQueries)
+	}
+	if strings.Join(primaryQueries, ";") != "INSERT INTO t VALUES (1);SELECT a FROM t FOR UPDATE;SELECT nextval('seq');DISCARD ALL;BEGIN;SELECT 2;COMMIT" {
+		t.Fatalf("Incorrect queries of primary %v", primaryQueries)
+	}
+}
+
+func TestBackendChecker(t *testing.T) {
+	database := newFakePoolDatabase(t)
+	defer database.listener.Close()
+	config := PoolConfig{User: "pool", Password: "password"}
+	address := database.listener.Addr().String()
+	if err := NewBackendChecker(config, true)(address); err != nil {
+		t.Fatal(err)
+	}
+	database.lock.Lock()
+	database.inRecovery = true
+	database.lock.Unlock()
+	if err := NewBackendChecker(config, true)(address); err != ErrDatabaseInRecovery {
+		t.Fatalf("Expected ErrDatabaseInRecovery, took %v", err)
+	}
+	if err := NewBackendChecker(config, false)(address); err != nil {
+		t.Fatalf("Replica should be accepted by checker of replicas, took %v", err)
+	}
+	config.Password = "wrong"
+	if err := NewBackendChecker(config, false)(address); err == nil {
+		t.Fatal("Expected authentication error")
+	}
+}
+
+func TestConnectionPoolAuthentication(t *testing.T) {
+	database := newFakePoolDatabase(t)
+	defer database.listener.Close()
+	pool := newTestPool(t, database)
+	users, err := ParsePoolUsers([]byte("client: secret\nother: " + md5PasswordHash("other", "other secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.config.Users = users
+
+	// authenticate returns first message after PasswordMessage
+	authenticate := func(user, password string) (net.Conn, byte) {
+		connection := pool.NewConnection()
+		sendStartupMessage(t, connection, user, "pool")
+		messageType, data, err := readMessage(connection)
+		if err != nil || messageType != authenticationMessageType || len(data) != 8 || data[3] != authenticationMD5Password {
+			t.Fatalf("Expected AuthenticationMD5Password, took %c %v", messageType, err)
+		}
+		response := append([]byte(md5Password(user, password, data[4:])), 0)
+		if _, err := connection.Write(marshalMessage(passwordMessageType, response)); err != nil {
+			t.Fatal(err)
+		}
+		messageType, _, err = readMessage(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return connection, messageType
+	}
+	for _, credentials := range [][2]string{{"client", "secret"}, {"other", "other secret"}} {
+		connection, messageType := authenticate(credentials[0], credentials[1])
+		if messageType != authenticationMessageType {
+			t.Fatalf("Expected AuthenticationOk for %s, took %c", credentials[0], messageType)
+		}
+		readTillReadyForQuery(t, connection)
+		simpleQuery(t, connection, "SELECT 1")
+		connection.Close()
+	}
+	for _, credentials := range [][2]string{{"client", "other secret"}, {"unknown", "secret"}} {
+		connection, messageType := authenticate(credentials[0], credentials[1])
+		if messageType != ErrorResponseMessageType {
+			t.Fatalf("Expected ErrorResponse for %s, took %c", credentials[0], messageType)
+		}
+		if _, _, err := readMessage(connection); err != io.EOF {
+			t.Fatalf("Expected EOF after failed authentication, took %v", err)
+		}
+		if _, err := connection.Write(marshalMessage(QueryMessageType, []byte("SELECT 1\x00"))); err != ErrPoolAuthenticationFail {
+			t.Fatalf("Expected ErrPoolAuthenticationFail, took %v", err)
+		}
+	}
+
+	// database of pool can't be changed by client
+	connection := pool.NewConnection()
+	sendStartupMessage(t, connection, "client", "other")
+	if messageType, _, err := readMessage(connection); err != nil || messageType != ErrorResponseMessageType {
+		t.Fatalf("Expected ErrorResponse on other database, took %c %v", messageType, err)
+	}
+
+	_, queries := database.stats()
+	if strings.Join(queries, ";") != "SELECT 1;SELECT 1" {
+		t.Fatalf("Incorrect queries %v", queries)
+	}
+}
+
+func TestChangesSessionState(t *testing.T) {
+	for query, expected := range map[string]bool{
+		"select 1":                                                       false,
+		"SET search_path TO public":                                      true,
+		"set  local search_path to public":                               false,
+		"begin; set transaction isolation level serializable":            false,
+		"select 1; -- comment\n prepare statement as select 1":           true,
+		"select ';set a to 1'":                                           false,
+		"/* set a to 1 */ select 1":                                      false,
+		"DECLARE c CURSOR FOR SELECT 1":                                  false,
+		"DECLARE c CURSOR WITH HOLD FOR SELECT 1":                        true,
+		"create temp table t (a int)":                                    true,
+		"LISTEN channel":                                                 true,
+		"SELECT set_config('role', 'admin', false)":                      true,
+		"select 1 from t where SET_CONFIG ('a', 'b', false) is not null": true,
+		"SELECT pg_try_advisory_lock(1)":                                 true,
+		"SELECT pg_advisory_xact_lock(1)":                                false,
+	} {
+		if changesSessionState(query) != expected {
+			t.Errorf("Incorrect result for %s", query)
+		}
+	}
+}
+
+func TestMayChangeSessionState(t *testing.T) {
+	for query, expected := range map[string]bool{
+		"select a, count(*) from t where b = $1 group by a": false,
+		"insert into t (a) values ($1)":                     false,
+		"begin; update t set a = 'x' where b = 1; commit":   false,
+		"select nextval('sequence')":                        true,
+		"select * from t where a = my_function(1)":          true,
+		"do $$ begin perform 1; end $$":                     true,
+		"call procedure()":                                  true,
+	} {
+		if mayChangeSessionState(query) != expected {
+			t.Errorf("Incorrect result for %s", query)
+		}
+	}
+}
+
+func TestPooledConnectionExtendedProtocolState(t *testing.T) {
+	parse := func(name, query string) []byte {
+		return marshalMessage(ParseMessageType, append(append(append([]byte(name), 0), query...), 0, 0, 0))
+	}
+	for _, testCase := range []struct {
+		message       []byte
+		pinned, dirty bool
+	}{
+		{parse("", "SELECT a FROM t WHERE b = $1"), false, false},
+		{parse("", "SET ROLE admin"), true, false},
+		{parse("", "SET search_path TO other"), true, false},
+		{parse("", "SELECT set_config('search_path', $1, false)"), true, false},
+		{parse("", "SELECT my_function($1)"), false, true},
+		{parse("statement", "SELECT 1"), true, false},
+	} {
+		connection := newPooledConnection(nil)
+		connection.started = true
+		connection.clientData = append(testCase.message, marshalMessage(SyncMessageType, nil)...)
+		output, readOnly, err := connection.processClientData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(output) != len(testCase.message)+5 || readOnly {
+			t.Fatal("Extended protocol messages should be forwarded to primary database")
+		}
+		if connection.pinned != testCase.pinned || connection.dirty != testCase.dirty {
+			t.Errorf("Incorrect state of connection after %q, pinned %v, dirty %v", testCase.message, connection.pinned, connection.dirty)
+		}
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// test vector of RFC 7677
+	client := &scramClient{password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO", clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO"}
+	clientFinal, err := client.clientFinalMessage([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(clientFinal) != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Fatalf("Incorrect client-final-message %s", clientFinal)
+	}
+	if err := client.verifyServerFinalMessage([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.verifyServerFinalMessage([]byte("v=AAAA")); err != ErrInvalidServerSignature {
+		t.Fatalf("Expected ErrInvalidServerSignature, took %v", err)
+	}
+}
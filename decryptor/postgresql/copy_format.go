@@ -0,0 +1,946 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/cossacklabs/acra/utils"
+)
+
+// Errors returned while processing COPY statements and data
+var (
+	ErrNotCopyStatement     = errors.New("query isn't COPY statement that transfers data between client and database")
+	ErrInvalidCopyStatement = errors.New("invalid COPY statement")
+	ErrInvalidCopyResponse  = errors.New("invalid CopyInResponse/CopyOutResponse packet")
+	ErrInvalidCopyData      = errors.New("invalid data of COPY in binary format")
+	ErrIncompleteCopyData   = errors.New("COPY data ended in the middle of row")
+)
+
+// copyBinarySignature starts data of COPY in binary format
+// https://www.postgresql.org/docs/current/static/sql-copy.html
+var copyBinarySignature = []byte("PGCOPY\n\377\r\n\x00")
+
+// copyBinaryTrailer is field count that marks end of data in binary format
+const copyBinaryTrailer = -1
+
+// copyEndMarker is line that marks end of data in text and CSV formats
+var copyEndMarker = []byte(`\.`)
+
+// copyFormat describes format of data transferred with COPY
+type copyFormat struct {
+	binary    bool
+	csv       bool
+	delimiter byte
+	null      []byte
+	quote     byte
+	escape    byte
+	// header is true if first line of text or CSV data contains names of columns
+	header bool
+}
+
+// copyStatement describes COPY statement which data is transferred through connection between client and database
+type copyStatement struct {
+	// table is empty if statement copies result of query
+	table   string
+	columns []string
+	// toClient is true for COPY TO STDOUT and false for COPY FROM STDIN
+	toClient bool
+	format   *copyFormat
+}
+
+type copyTokenType int
+
+const (
+	copyTokenWord copyTokenType = iota
+	copyTokenQuotedIdentifier
+	copyTokenString
+	copyTokenSymbol
+)
+
+type copyToken struct {
+	tokenType copyTokenType
+	value     string
+}
+
+// is returns true if token is keyword or symbol equal to value
+func (token copyToken) is(value string) bool {
+	return (token.tokenType == copyTokenWord || token.tokenType == copyTokenSymbol) && strings.EqualFold(token.value, value)
+}
+
+// splitCopyStatement splits COPY statement into words, quoted identifiers, string literals and symbols
+func splitCopyStatement(query string) ([]copyToken, error) {
+	var tokens []copyToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case c == '"':
+			value, length, err := readQuotedCopyToken(query[i:], '"', false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, copyToken{copyTokenQuotedIdentifier, value})
+			i += length
+		case c == '\'':
+			value, length, err := readQuotedCopyToken(query[i:], '\'', false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, copyToken{copyTokenString, value})
+			i += length
+		case (c == 'e' || c == 'E') && i+1 < len(query) && query[i+1] == '\'':
+			value, length, err := readQuotedCopyToken(query[i+1:], '\'', true)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, copyToken{copyTokenString, value})
+			i += length + 1
+		case c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+			start := i
+			for i < len(query) {
+				c = query[i]
+				if !(c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80) {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, copyToken{copyTokenWord, query[start:i]})
+		default:
+			tokens = append(tokens, copyToken{copyTokenSymbol, string(c)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// readQuotedCopyToken returns value of quoted token at start of data and its length with quotes. Quote is escaped by
+// doubling. If withEscapes is true then backslash escape sequences of PostgreSQL E'...' strings are processed too
+func readQuotedCopyToken(data string, quote byte, withEscapes bool) (string, int, error) {
+	value := make([]byte, 0, len(data))
+	for i := 1; i < len(data); i++ {
+		c := data[i]
+		if withEscapes && c == '\\' && i+1 < len(data) {
+			i++
+			value = append(value, unescapeCopyChar(data[i]))
+			continue
+		}
+		if c == quote {
+			if i+1 < len(data) && data[i+1] == quote {
+				value = append(value, quote)
+				i++
+				continue
+			}
+			return string(value), i + 1, nil
+		}
+		value = append(value, c)
+	}
+	return "", 0, ErrInvalidCopyStatement
+}
+
+// unescapeCopyChar returns character represented by backslash escape sequence with one character c
+func unescapeCopyChar(c byte) byte {
+	switch c {
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'v':
+		return '\v'
+	}
+	return c
+}
+
+// copyTokenReader iterates over tokens of COPY statement
+type copyTokenReader struct {
+	tokens []copyToken
+	index  int
+}
+
+func (reader *copyTokenReader) hasNext() bool {
+	return reader.index < len(reader.tokens)
+}
+
+// peekIs returns true if next token is keyword or symbol equal to value
+func (reader *copyTokenReader) peekIs(value string) bool {
+	return reader.hasNext() && reader.tokens[reader.index].is(value)
+}
+
+// skipIf skips next token if it's keyword or symbol equal to value and returns true if it was skipped
+func (reader *copyTokenReader) skipIf(value string) bool {
+	if reader.peekIs(value) {
+		reader.index++
+		return true
+	}
+	return false
+}
+
+func (reader *copyTokenReader) next() (copyToken, error) {
+	if !reader.hasNext() {
+		return copyToken{}, ErrInvalidCopyStatement
+	}
+	reader.index++
+	return reader.tokens[reader.index-1], nil
+}
+
+// skipParentheses skips tokens till closing parenthesis of already skipped opening parenthesis
+func (reader *copyTokenReader) skipParentheses() error {
+	depth := 1
+	for depth > 0 {
+		token, err := reader.next()
+		if err != nil {
+			return err
+		}
+		if token.is("(") {
+			depth++
+		} else if token.is(")") {
+			depth--
+		}
+	}
+	return nil
+}
+
+// readIdentifier returns name of table or column
+func (reader *copyTokenReader) readIdentifier() (string, error) {
+	token, err := reader.next()
+	if err != nil {
+		return "", err
+	}
+	if token.tokenType != copyTokenWord && token.tokenType != copyTokenQuotedIdentifier {
+		return "", ErrInvalidCopyStatement
+	}
+	return token.value, nil
+}
+
+// readOptionValue returns value of option which may be string literal or keyword
+func (reader *copyTokenReader) readOptionValue() (string, error) {
+	// "AS" is optional in old syntax of options
+	reader.skipIf("as")
+	token, err := reader.next()
+	if err != nil {
+		return "", err
+	}
+	if token.tokenType == copyTokenSymbol {
+		return "", ErrInvalidCopyStatement
+	}
+	return token.value, nil
+}
+
+// copyOptions stores options of COPY statement before their defaults are known
+type copyOptions struct {
+	format                         string
+	delimiter, null, quote, escape *string
+	header                         bool
+}
+
+// readOption reads one option of new syntax "(option [value], ...)"
+func (reader *copyTokenReader) readOption(options *copyOptions) error {
+	name, err := reader.next()
+	if err != nil {
+		return err
+	}
+	// options without values are boolean options enabled by default
+	hasValue := reader.hasNext() && !reader.peekIs(",") && !reader.peekIs(")")
+	switch strings.ToLower(name.value) {
+	case "format", "delimiter", "null", "quote", "escape":
+		value, err := reader.readOptionValue()
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(name.value) {
+		case "format":
+			options.format = strings.ToLower(value)
+		case "delimiter":
+			options.delimiter = &value
+		case "null":
+			options.null = &value
+		case "quote":
+			options.quote = &value
+		case "escape":
+			options.escape = &value
+		}
+	case "header":
+		options.header = true
+		if hasValue {
+			value, err := reader.readOptionValue()
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(value) {
+			case "false", "off", "0":
+				options.header = false
+			}
+		}
+	default:
+		// other options don't change format of data
+		if reader.skipIf("(") {
+			return reader.skipParentheses()
+		}
+		if hasValue {
+			if reader.skipIf("*") {
+				return nil
+			}
+			_, err := reader.next()
+			return err
+		}
+	}
+	return nil
+}
+
+// readOldOption reads one option of old syntax "[BINARY] [DELIMITER [AS] 'x'] [NULL [AS] 'x'] [CSV [HEADER] ...]"
+func (reader *copyTokenReader) readOldOption(options *copyOptions) error {
+	name, err := reader.next()
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(name.value) {
+	case "binary":
+		options.format = "binary"
+	case "csv":
+		options.format = "csv"
+	case "header":
+		options.header = true
+	case "delimiter", "null", "quote", "escape":
+		value, err := reader.readOptionValue()
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(name.value) {
+		case "delimiter":
+			options.delimiter = &value
+		case "null":
+			options.null = &value
+		case "quote":
+			options.quote = &value
+		case "escape":
+			options.escape = &value
+		}
+	case "force":
+		// FORCE QUOTE columns|* or FORCE NOT NULL columns
+		reader.skipIf("not")
+		if _, err := reader.next(); err != nil {
+			return err
+		}
+		if reader.skipIf("*") {
+			return nil
+		}
+		for {
+			if _, err := reader.readIdentifier(); err != nil {
+				return err
+			}
+			if !reader.skipIf(",") {
+				return nil
+			}
+		}
+	case "where":
+		// condition of COPY FROM doesn't affect format of data
+		reader.index = len(reader.tokens)
+	}
+	return nil
+}
+
+// newCopyFormat returns format of data with default values of options that weren't specified in statement
+func newCopyFormat(options *copyOptions) (*copyFormat, error) {
+	format := &copyFormat{header: options.header}
+	switch options.format {
+	case "binary":
+		format.binary = true
+		return format, nil
+	case "csv":
+		format.csv = true
+		format.delimiter = ','
+		format.null = []byte{}
+		format.quote = '"'
+	case "", "text":
+		format.delimiter = '\t'
+		format.null = []byte(`\N`)
+	default:
+		return nil, ErrInvalidCopyStatement
+	}
+	if options.delimiter != nil {
+		if len(*options.delimiter) != 1 {
+			return nil, ErrInvalidCopyStatement
+		}
+		format.delimiter = (*options.delimiter)[0]
+	}
+	if options.null != nil {
+		format.null = []byte(*options.null)
+	}
+	if options.quote != nil {
+		if len(*options.quote) != 1 {
+			return nil, ErrInvalidCopyStatement
+		}
+		format.quote = (*options.quote)[0]
+	}
+	format.escape = format.quote
+	if options.escape != nil {
+		if len(*options.escape) != 1 {
+			return nil, ErrInvalidCopyStatement
+		}
+		format.escape = (*options.escape)[0]
+	}
+	return format, nil
+}
+
+// parseCopyStatement returns description of COPY FROM STDIN or COPY TO STDOUT statement. Returns ErrNotCopyStatement
+// for other queries
+func parseCopyStatement(query string) (*copyStatement, error) {
+	tokens, err := splitCopyStatement(query)
+	if err != nil || len(tokens) == 0 || !tokens[0].is("copy") {
+		return nil, ErrNotCopyStatement
+	}
+	reader := &copyTokenReader{tokens: tokens, index: 1}
+	statement := &copyStatement{}
+	options := &copyOptions{}
+	// BINARY before table name is syntax of PostgreSQL before 7.3
+	if reader.skipIf("binary") {
+		options.format = "binary"
+	}
+	if reader.skipIf("(") {
+		// COPY (query) TO STDOUT copies result of query
+		if err := reader.skipParentheses(); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			name, err := reader.readIdentifier()
+			if err != nil {
+				return nil, err
+			}
+			// use name of table without schema
+			statement.table = name
+			if !reader.skipIf(".") {
+				break
+			}
+		}
+		if reader.skipIf("(") {
+			for {
+				column, err := reader.readIdentifier()
+				if err != nil {
+					return nil, err
+				}
+				statement.columns = append(statement.columns, column)
+				if !reader.skipIf(",") {
+					break
+				}
+			}
+			if !reader.skipIf(")") {
+				return nil, ErrInvalidCopyStatement
+			}
+		}
+	}
+	switch {
+	case reader.skipIf("to"):
+		if !reader.skipIf("stdout") {
+			return nil, ErrNotCopyStatement
+		}
+		statement.toClient = true
+	case reader.skipIf("from"):
+		if !reader.skipIf("stdin") {
+			return nil, ErrNotCopyStatement
+		}
+	default:
+		return nil, ErrInvalidCopyStatement
+	}
+	reader.skipIf("with")
+	if reader.skipIf("(") {
+		for !reader.skipIf(")") {
+			if err := reader.readOption(options); err != nil {
+				return nil, err
+			}
+			reader.skipIf(",")
+		}
+	}
+	for reader.hasNext() && !reader.peekIs(";") {
+		if err := reader.readOldOption(options); err != nil {
+			return nil, err
+		}
+	}
+	statement.format, err = newCopyFormat(options)
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// copyResponse describes data of CopyInResponse and CopyOutResponse packets
+type copyResponse struct {
+	binary        bool
+	columnFormats []uint16
+}
+
+// parseCopyResponse returns description of COPY data from payload of CopyInResponse or CopyOutResponse packet
+// https://www.postgresql.org/docs/current/static/protocol-message-formats.html
+func parseCopyResponse(data []byte) (*copyResponse, error) {
+	// overall format (1) + column count (2)
+	if len(data) < 3 {
+		return nil, ErrInvalidCopyResponse
+	}
+	columnCount := int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < 3+columnCount*2 {
+		return nil, ErrInvalidCopyResponse
+	}
+	response := &copyResponse{binary: data[0] == 1, columnFormats: make([]uint16, columnCount)}
+	for i := range response.columnFormats {
+		response.columnFormats[i] = binary.BigEndian.Uint16(data[3+i*2:])
+	}
+	return response, nil
+}
+
+// writeCopyData writes CopyData packet with data to writer
+func writeCopyData(writer *bufio.Writer, data []byte) error {
+	header := make([]byte, 5)
+	header[0] = CopyDataMessageType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)+DataRowLengthBufSize))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+// newCopyColumn returns column with value of COPY data, data is nil for NULL
+func newCopyColumn(data []byte) *ColumnData {
+	if data == nil {
+		column := &ColumnData{isNull: true}
+		nullLength := NullColumnValue
+		binary.BigEndian.PutUint32(column.LengthBuf[:], uint32(nullLength))
+		return column
+	}
+	column := &ColumnData{Data: data}
+	binary.BigEndian.PutUint32(column.LengthBuf[:], uint32(len(data)))
+	return column
+}
+
+// unescapeCopyText returns value of field of text format with processed backslash escape sequences
+func unescapeCopyText(data []byte) []byte {
+	if bytes.IndexByte(data, '\\') == -1 {
+		return data
+	}
+	output := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c != '\\' || i+1 == len(data) {
+			output = append(output, c)
+			continue
+		}
+		i++
+		c = data[i]
+		switch {
+		case c >= '0' && c <= '7':
+			// up to 3 octal digits
+			value := int(c - '0')
+			for j := 0; j < 2 && i+1 < len(data) && data[i+1] >= '0' && data[i+1] <= '7'; j++ {
+				i++
+				value = value*8 + int(data[i]-'0')
+			}
+			output = append(output, byte(value))
+		case c == 'x' && i+1 < len(data) && isHexDigit(data[i+1]):
+			// up to 2 hex digits
+			i++
+			value := hexDigitValue(data[i])
+			if i+1 < len(data) && isHexDigit(data[i+1]) {
+				i++
+				value = value*16 + hexDigitValue(data[i])
+			}
+			output = append(output, value)
+		default:
+			output = append(output, unescapeCopyChar(c))
+		}
+	}
+	return output
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// escapeText returns value escaped as field of text format
+func (format *copyFormat) escapeText(data []byte) []byte {
+	output := make([]byte, 0, len(data))
+	for _, c := range data {
+		switch c {
+		case '\b':
+			output = append(output, '\\', 'b')
+		case '\f':
+			output = append(output, '\\', 'f')
+		case '\n':
+			output = append(output, '\\', 'n')
+		case '\r':
+			output = append(output, '\\', 'r')
+		case '\t':
+			output = append(output, '\\', 't')
+		case '\v':
+			output = append(output, '\\', 'v')
+		case '\\', format.delimiter:
+			output = append(output, '\\', c)
+		default:
+			output = append(output, c)
+		}
+	}
+	return output
+}
+
+// unquoteCSV returns value of field of CSV format without quotes
+func (format *copyFormat) unquoteCSV(data []byte) []byte {
+	if bytes.IndexByte(data, format.quote) == -1 {
+		return data
+	}
+	output := make([]byte, 0, len(data))
+	inQuotes := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if !inQuotes {
+			if c == format.quote {
+				inQuotes = true
+			} else {
+				output = append(output, c)
+			}
+			continue
+		}
+		if c == format.escape && i+1 < len(data) && (data[i+1] == format.quote || data[i+1] == format.escape) {
+			i++
+			output = append(output, data[i])
+			continue
+		}
+		if c == format.quote {
+			inQuotes = false
+			continue
+		}
+		output = append(output, c)
+	}
+	return output
+}
+
+// quoteCSV returns value as field of CSV format quoted if needed
+func (format *copyFormat) quoteCSV(data []byte) []byte {
+	needQuotes := bytes.Equal(data, format.null)
+	for _, c := range data {
+		if c == format.delimiter || c == format.quote || c == '\n' || c == '\r' {
+			needQuotes = true
+			break
+		}
+	}
+	if !needQuotes {
+		return data
+	}
+	output := make([]byte, 0, len(data)+2)
+	output = append(output, format.quote)
+	for _, c := range data {
+		if c == format.quote || c == format.escape {
+			output = append(output, format.escape)
+		}
+		output = append(output, c)
+	}
+	return append(output, format.quote)
+}
+
+// rowEnd returns index of newline that ends first row of text or CSV data or -1 if data doesn't contain whole row.
+// Newlines of values are escaped in text format and quoted in CSV format
+func (format *copyFormat) rowEnd(data []byte) int {
+	if !format.csv {
+		return bytes.IndexByte(data, '\n')
+	}
+	inQuotes := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inQuotes {
+			if c == format.escape && format.escape != format.quote && i+1 < len(data) && (data[i+1] == format.quote || data[i+1] == format.escape) {
+				i++
+			} else if c == format.quote {
+				inQuotes = false
+			}
+			continue
+		}
+		if c == format.quote {
+			inQuotes = true
+		} else if c == '\n' {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitFields returns raw fields of row of text or CSV format
+func (format *copyFormat) splitFields(line []byte) [][]byte {
+	var fields [][]byte
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case !format.csv && c == '\\':
+			// escaped character can't be delimiter
+			i++
+		case format.csv && inQuotes:
+			if c == format.escape && format.escape != format.quote && i+1 < len(line) && (line[i+1] == format.quote || line[i+1] == format.escape) {
+				i++
+			} else if c == format.quote {
+				inQuotes = false
+			}
+		case format.csv && c == format.quote:
+			inQuotes = true
+		case c == format.delimiter:
+			fields = append(fields, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, line[start:])
+}
+
+// parseField returns value of raw field of text or CSV format or nil if field is NULL
+func (format *copyFormat) parseField(field []byte) []byte {
+	if bytes.Equal(field, format.null) {
+		return nil
+	}
+	if format.csv {
+		return format.unquoteCSV(field)
+	}
+	return unescapeCopyText(field)
+}
+
+// encodeField returns value as field of text or CSV format
+func (format *copyFormat) encodeField(column *ColumnData) []byte {
+	if column.IsNull() {
+		return format.null
+	}
+	if format.csv {
+		return format.quoteCSV(column.Data)
+	}
+	return format.escapeText(column.Data)
+}
+
+// copyStream processes rows of data of one COPY statement that may be split into CopyData packets at any position
+type copyStream struct {
+	format *copyFormat
+	// processRow may change values of columns of row
+	processRow func(columns []*ColumnData) error
+	buffer     []byte
+	// headerProcessed is true when binary header or header line of text and CSV formats was passed
+	headerProcessed bool
+	// finished is true when end of data marker was passed, data after it is passed as is
+	finished bool
+}
+
+func newCopyStream(format *copyFormat, processRow func(columns []*ColumnData) error) *copyStream {
+	return &copyStream{format: format, processRow: processRow, headerProcessed: !format.binary && !format.header}
+}
+
+// Process returns processed rows of data. Incomplete row at the end is buffered until next call
+func (stream *copyStream) Process(data []byte) ([]byte, error) {
+	stream.buffer = append(stream.buffer, data...)
+	return stream.processRows(false)
+}
+
+// Flush returns processed rest of buffered data. Called at the end of data
+func (stream *copyStream) Flush() ([]byte, error) {
+	return stream.processRows(true)
+}
+
+func (stream *copyStream) processRows(final bool) ([]byte, error) {
+	var output []byte
+	for len(stream.buffer) > 0 {
+		if stream.finished {
+			output = append(output, stream.buffer...)
+			stream.buffer = nil
+			break
+		}
+		var row []byte
+		var length int
+		var err error
+		if stream.format.binary {
+			row, length, err = stream.processBinaryRow()
+		} else {
+			row, length, err = stream.processTextRow(final)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			break
+		}
+		output = append(output, row...)
+		stream.buffer = stream.buffer[length:]
+	}
+	if final && len(stream.buffer) > 0 {
+		return nil, ErrIncompleteCopyData
+	}
+	return output, nil
+}
+
+// processTextRow processes first row of buffer in text or CSV format and returns it with length of processed data
+// or zero length if buffer doesn't contain whole row
+func (stream *copyStream) processTextRow(final bool) ([]byte, int, error) {
+	end := stream.format.rowEnd(stream.buffer)
+	length := end + 1
+	if end == -1 {
+		if !final {
+			return nil, 0, nil
+		}
+		// last row without newline
+		end = len(stream.buffer)
+		length = end
+	}
+	line := stream.buffer[:end]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	raw := stream.buffer[:length]
+	if bytes.Equal(line, copyEndMarker) {
+		stream.finished = true
+		return raw, length, nil
+	}
+	if !stream.headerProcessed {
+		stream.headerProcessed = true
+		return raw, length, nil
+	}
+	fields := stream.format.splitFields(line)
+	columns := make([]*ColumnData, len(fields))
+	for i, field := range fields {
+		columns[i] = newCopyColumn(stream.format.parseField(field))
+	}
+	if err := stream.processRow(columns); err != nil {
+		return nil, 0, err
+	}
+	output := make([]byte, 0, length)
+	for i, column := range columns {
+		if i > 0 {
+			output = append(output, stream.format.delimiter)
+		}
+		if column.changed {
+			output = append(output, stream.format.encodeField(column)...)
+		} else {
+			output = append(output, fields[i]...)
+		}
+	}
+	// keep original line ending
+	return append(output, raw[len(line):]...), length, nil
+}
+
+// copyBinaryHeaderLength returns length of header of binary format at start of data or 0 if data doesn't contain
+// whole header
+func copyBinaryHeaderLength(data []byte) (int, error) {
+	// signature + flags (4) + length of header extension (4)
+	fixedLength := len(copyBinarySignature) + 8
+	if len(data) < fixedLength {
+		if !bytes.HasPrefix(copyBinarySignature, data[:utils.Min(len(data), len(copyBinarySignature))]) {
+			return 0, ErrInvalidCopyData
+		}
+		return 0, nil
+	}
+	if !bytes.HasPrefix(data, copyBinarySignature) {
+		return 0, ErrInvalidCopyData
+	}
+	length := fixedLength + int(binary.BigEndian.Uint32(data[fixedLength-4:]))
+	if len(data) < length {
+		return 0, nil
+	}
+	return length, nil
+}
+
+// processBinaryRow processes header or first tuple of buffer in binary format and returns it with length of
+// processed data or zero length if buffer doesn't contain whole tuple
+func (stream *copyStream) processBinaryRow() ([]byte, int, error) {
+	data := stream.buffer
+	if !stream.headerProcessed {
+		length, err := copyBinaryHeaderLength(data)
+		if err != nil || length == 0 {
+			return nil, 0, err
+		}
+		stream.headerProcessed = true
+		return data[:length], length, nil
+	}
+	if len(data) < 2 {
+		return nil, 0, nil
+	}
+	fieldCount := int(int16(binary.BigEndian.Uint16(data)))
+	if fieldCount == copyBinaryTrailer {
+		stream.finished = true
+		return data[:2], 2, nil
+	}
+	if fieldCount < 0 {
+		return nil, 0, ErrInvalidCopyData
+	}
+	columns := make([]*ColumnData, fieldCount)
+	offset := 2
+	for i := range columns {
+		if len(data) < offset+4 {
+			return nil, 0, nil
+		}
+		fieldLength := int(int32(binary.BigEndian.Uint32(data[offset:])))
+		offset += 4
+		if fieldLength == int(NullColumnValue) {
+			columns[i] = newCopyColumn(nil)
+			continue
+		}
+		if fieldLength < 0 {
+			return nil, 0, ErrInvalidCopyData
+		}
+		if len(data) < offset+fieldLength {
+			return nil, 0, nil
+		}
+		columns[i] = newCopyColumn(data[offset : offset+fieldLength])
+		offset += fieldLength
+	}
+	if err := stream.processRow(columns); err != nil {
+		return nil, 0, err
+	}
+	changed := false
+	for _, column := range columns {
+		changed = changed || column.changed
+	}
+	if !changed {
+		return data[:offset], offset, nil
+	}
+	output := make([]byte, 2, offset)
+	binary.BigEndian.PutUint16(output, uint16(fieldCount))
+	for _, column := range columns {
+		output = append(output, column.LengthBuf[:]...)
+		output = append(output, column.Data...)
+	}
+	return output, offset, nil
+}
+
+// encodeHexBytea returns value in hex format of bytea
+func encodeHexBytea(value []byte) []byte {
+	output := make([]byte, len(HexPrefix)+hex.EncodedLen(len(value)))
+	copy(output, HexPrefix)
+	hex.Encode(output[len(HexPrefix):], value)
+	return output
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseCopyStatement(t *testing.T) {
+	testcases := []struct {
+		query     string
+		table     string
+		columns   []string
+		toClient  bool
+		binary    bool
+		csv       bool
+		delimiter byte
+		null      string
+		header    bool
+	}{
+		{"COPY users TO STDOUT", "users", nil, true, false, false, '\t', `\N`, false},
+		{"copy public.users (id, \"Email\") from stdin;", "users", []string{"id", "Email"}, false, false, false, '\t', `\N`, false},
+		{"COPY users TO STDOUT WITH (FORMAT csv, HEADER, DELIMITER ';', FORCE_QUOTE *)", "users", nil, true, false, true, ';', "", true},
+		{"COPY users FROM STDIN WITH CSV HEADER NULL AS 'null' QUOTE AS '\"'", "users", nil, false, false, true, ',', "null", true},
+		{"COPY users TO STDOUT (FORMAT binary)", "users", nil, true, true, false, 0, "", false},
+		{"COPY BINARY users FROM STDIN", "users", nil, false, true, false, 0, "", false},
+		{"COPY (SELECT email FROM users WHERE id IN (1, 2)) TO STDOUT DELIMITER E'\\t' NULL ''", "", nil, true, false, false, '\t', "", false},
+	}
+	for i, testcase := range testcases {
+		statement, err := parseCopyStatement(testcase.query)
+		if err != nil {
+			t.Fatalf("%v. Unexpected error %v", i, err)
+		}
+		if statement.table != testcase.table || !reflect.DeepEqual(statement.columns, testcase.columns) || statement.toClient != testcase.toClient {
+			t.Fatalf("%v. Incorrect statement %+v", i, statement)
+		}
+		format := statement.format
+		if format.binary != testcase.binary || format.csv != testcase.csv || format.delimiter != testcase.delimiter ||
+			string(format.null) != testcase.null || format.header != testcase.header {
+			t.Fatalf("%v. Incorrect format %+v", i, format)
+		}
+	}
+	for _, query := range []string{"SELECT 1", "COPY users TO '/tmp/users.txt'", "COPY users FROM PROGRAM 'cat users.txt'"} {
+		if _, err := parseCopyStatement(query); err != ErrNotCopyStatement {
+			t.Fatalf("Expected ErrNotCopyStatement for %v, took %v", query, err)
+		}
+	}
+	for _, query := range []string{"COPY users (id TO STDOUT", "COPY users TO STDOUT (FORMAT xml)", "COPY users TO STDOUT DELIMITER ';;'"} {
+		if _, err := parseCopyStatement(query); err != ErrInvalidCopyStatement {
+			t.Fatalf("Expected ErrInvalidCopyStatement for %v, took %v", query, err)
+		}
+	}
+}
+
+// processCopyStreamByBytes passes data to stream by one byte to check processing of rows split between packets
+func processCopyStreamByBytes(t *testing.T, stream *copyStream, data []byte) []byte {
+	var output []byte
+	for i := range data {
+		processed, err := stream.Process(data[i : i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		output = append(output, processed...)
+	}
+	processed, err := stream.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(output, processed...)
+}
+
+// appendSuffixToColumn returns function that appends suffix to value of column with index
+func appendSuffixToColumn(t *testing.T, index int, expected [][]byte, suffix string) func(columns []*ColumnData) error {
+	row := 0
+	return func(columns []*ColumnData) error {
+		if row >= len(expected) {
+			t.Fatalf("Unexpected row %v", row)
+		}
+		if !bytes.Equal(columns[index].Data, expected[row]) || (expected[row] == nil) != columns[index].IsNull() {
+			t.Fatalf("Incorrect value of row %v: %q", row, columns[index].Data)
+		}
+		row++
+		if !columns[index].IsNull() {
+			columns[index].SetData(append(columns[index].Data, suffix...))
+		}
+		return nil
+	}
+}
+
+func TestCopyStreamText(t *testing.T) {
+	statement, err := parseCopyStatement("COPY users (id, data) TO STDOUT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("1\t\\\\x0a\\t\\101\\x42\n2\t\\N\r\n\\.\nignored")
+	expectedValues := [][]byte{[]byte("\\x0a\tAB"), nil}
+	stream := newCopyStream(statement.format, appendSuffixToColumn(t, 1, expectedValues, "\\\n"))
+	output := processCopyStreamByBytes(t, stream, data)
+	expected := "1\t\\\\x0a\\tAB\\\\\\n\n2\t\\N\r\n\\.\nignored"
+	if string(output) != expected {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+
+	// last row without newline
+	stream = newCopyStream(statement.format, appendSuffixToColumn(t, 1, [][]byte{[]byte("value")}, "1"))
+	output = processCopyStreamByBytes(t, stream, []byte("1\tvalue"))
+	if string(output) != "1\tvalue1" {
+		t.Fatalf("Incorrect last row %q", output)
+	}
+}
+
+func TestCopyStreamCSV(t *testing.T) {
+	statement, err := parseCopyStatement("COPY users (id, data) TO STDOUT WITH (FORMAT csv, HEADER true)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("id,data\n1,\"multi\nline, \"\"quoted\"\"\"\n2,\n3,\"\"\n")
+	expectedValues := [][]byte{[]byte("multi\nline, \"quoted\""), nil, {}}
+	stream := newCopyStream(statement.format, appendSuffixToColumn(t, 1, expectedValues, ","))
+	output := processCopyStreamByBytes(t, stream, data)
+	expected := "id,data\n1,\"multi\nline, \"\"quoted\"\",\"\n2,\n3,\",\"\n"
+	if string(output) != expected {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+}
+
+func binaryCopyTuple(values ...[]byte) []byte {
+	output := make([]byte, 2)
+	binary.BigEndian.PutUint16(output, uint16(len(values)))
+	for _, value := range values {
+		length := make([]byte, 4)
+		if value == nil {
+			nullLength := NullColumnValue
+			binary.BigEndian.PutUint32(length, uint32(nullLength))
+		} else {
+			binary.BigEndian.PutUint32(length, uint32(len(value)))
+		}
+		output = append(output, length...)
+		output = append(output, value...)
+	}
+	return output
+}
+
+func TestCopyStreamBinary(t *testing.T) {
+	statement, err := parseCopyStatement("COPY users (id, data) TO STDOUT (FORMAT binary)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := append(append([]byte{}, copyBinarySignature...), 0, 0, 0, 0, 0, 0, 0, 2, 'e', 'x')
+	trailer := []byte{0xff, 0xff}
+	data := bytes.Join([][]byte{header, binaryCopyTuple([]byte{1}, []byte("value")), binaryCopyTuple([]byte{2}, nil), trailer}, nil)
+	stream := newCopyStream(statement.format, appendSuffixToColumn(t, 1, [][]byte{[]byte("value"), nil}, "!"))
+	output := processCopyStreamByBytes(t, stream, data)
+	expected := bytes.Join([][]byte{header, binaryCopyTuple([]byte{1}, []byte("value!")), binaryCopyTuple([]byte{2}, nil), trailer}, nil)
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("Expected %v, took %v", expected, output)
+	}
+
+	stream = newCopyStream(statement.format, appendSuffixToColumn(t, 1, nil, ""))
+	if _, err := stream.Process([]byte("PGCOPY\n\377\r\n\x01")); err != ErrInvalidCopyData {
+		t.Fatalf("Expected ErrInvalidCopyData, took %v", err)
+	}
+	stream = newCopyStream(statement.format, appendSuffixToColumn(t, 1, nil, ""))
+	if _, err := stream.Process(append(header, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Flush(); err != ErrIncompleteCopyData {
+		t.Fatalf("Expected ErrIncompleteCopyData, took %v", err)
+	}
+}
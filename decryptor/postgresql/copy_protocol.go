@@ -0,0 +1,243 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/masking"
+	log "github.com/sirupsen/logrus"
+)
+
+// setCopyStatement remembers COPY TO STDOUT statement which data will be sent by database
+func (proxy *PgProxy) setCopyStatement(statement *copyStatement) {
+	proxy.copyStatementLock.Lock()
+	proxy.copyStatement = statement
+	proxy.copyStatementLock.Unlock()
+}
+
+// takeCopyStatement returns and forgets last COPY TO STDOUT statement or nil if it's unknown
+func (proxy *PgProxy) takeCopyStatement() *copyStatement {
+	proxy.copyStatementLock.Lock()
+	defer proxy.copyStatementLock.Unlock()
+	statement := proxy.copyStatement
+	proxy.copyStatement = nil
+	return statement
+}
+
+// copyColumnSettings returns names of copied columns and their encryption settings or nil settings if table isn't
+// configured or copied columns are unknown
+func (proxy *PgProxy) copyColumnSettings(statement *copyStatement) ([]string, []*encryptor.ColumnEncryptionSetting) {
+	if proxy.encryptedColumns == nil || statement == nil || statement.table == "" {
+		return nil, nil
+	}
+	schema := proxy.encryptedColumns.schemaStore.GetTableSchema(statement.table)
+	if schema == nil {
+		return nil, nil
+	}
+	columns := statement.columns
+	if len(columns) == 0 {
+		columns = schema.InsertColumns()
+	}
+	var settings []*encryptor.ColumnEncryptionSetting
+	for i, column := range columns {
+		if setting := schema.GetColumnEncryptionSettings(column); setting != nil {
+			if settings == nil {
+				settings = make([]*encryptor.ColumnEncryptionSetting, len(columns))
+			}
+			settings[i] = setting
+		}
+	}
+	return columns, settings
+}
+
+// onCopyStatement remembers COPY TO STDOUT statement to process data of its response and returns stream that
+// encrypts data of COPY FROM STDIN statement or nil if query isn't COPY or its data shouldn't be encrypted. Returns
+// error if COPY can't be parsed while AcraServer encrypts data because its data would be stored without encryption
+func (proxy *PgProxy) onCopyStatement(query string, logger *log.Entry) (*copyStream, error) {
+	statement, err := parseCopyStatement(query)
+	if err == ErrNotCopyStatement {
+		return nil, nil
+	}
+	if err != nil {
+		proxy.setCopyStatement(nil)
+		if proxy.queryEncryptor != nil {
+			return nil, err
+		}
+		logger.WithError(err).Warningln("Can't parse COPY statement, its data will be processed as data in text format")
+		return nil, nil
+	}
+	if statement.toClient {
+		proxy.setCopyStatement(statement)
+		return nil, nil
+	}
+	if proxy.queryEncryptor == nil {
+		return nil, nil
+	}
+	columns, settings := proxy.copyColumnSettings(statement)
+	if settings == nil {
+		return nil, nil
+	}
+	return newCopyStream(statement.format, func(values []*ColumnData) error {
+		return proxy.encryptCopyColumns(statement.format, columns, settings, values)
+	}), nil
+}
+
+// encryptCopyColumns replaces values of encrypted columns of one row of COPY FROM STDIN with AcraStructs or tokens
+// and fills hash columns if they are copied too
+func (proxy *PgProxy) encryptCopyColumns(copyFormat *copyFormat, columns []string, settings []*encryptor.ColumnEncryptionSetting, values []*ColumnData) error {
+	format := TextFormat
+	if copyFormat.binary {
+		format = BinaryFormat
+	}
+	for i, setting := range settings {
+		if setting == nil || i >= len(values) || values[i].IsNull() {
+			continue
+		}
+		if setting.IsTokenized() {
+			token, err := processTokenValue(values[i].Data, format, setting.TokenType, func(data []byte) ([]byte, error) {
+				return proxy.queryEncryptor.TokenizeWithColumnSettings(setting, data)
+			})
+			if err != nil {
+				return err
+			}
+			values[i].SetData(token)
+			continue
+		}
+		// encrypted columns store AcraStructs in bytea columns
+		plaintext, err := decodeByteaParameter(values[i].Data, format, ByteaOID)
+		if err != nil {
+			return err
+		}
+		encrypted, err := proxy.queryEncryptor.EncryptWithColumnSettings(setting, plaintext)
+		if err != nil {
+			return err
+		}
+		values[i].SetData(encodeByteaParameter(encrypted, format))
+		if setting.HashColumn == "" {
+			continue
+		}
+		hashIndex := -1
+		for j, column := range columns {
+			if strings.EqualFold(column, setting.HashColumn) {
+				hashIndex = j
+				break
+			}
+		}
+		if hashIndex == -1 || hashIndex >= len(values) {
+			log.WithField("column", setting.HashColumn).Debugln("Hash column isn't copied, skip calculation of HMAC")
+			continue
+		}
+		hash, err := proxy.queryEncryptor.HMACWithColumnSettings(setting, plaintext)
+		if err != nil {
+			return err
+		}
+		values[hashIndex].SetData(encodeByteaParameter(hash, format))
+	}
+	return nil
+}
+
+// newCopyOutStream returns stream that decrypts, detokenizes and masks data of COPY TO STDOUT described by payload of
+// CopyOutResponse packet. If AcraServer decrypts only configured columns then only columns of configured tables are
+// processed, result of COPY (query) TO STDOUT is passed as is because its columns can't be matched with tables' columns
+func (proxy *PgProxy) newCopyOutStream(ctx context.Context, data []byte, decryptor base.Decryptor, logger *log.Entry) (*copyStream, error) {
+	response, err := parseCopyResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	statement := proxy.takeCopyStatement()
+	format := &copyFormat{delimiter: '\t', null: []byte(`\N`)}
+	if statement != nil {
+		format = statement.format
+	}
+	if response.binary != format.binary {
+		// format of response is more reliable than format parsed from query
+		format = &copyFormat{binary: response.binary, delimiter: '\t', null: []byte(`\N`)}
+	}
+	// nil if all columns should be checked on AcraStructs
+	var columnsToDecrypt []bool
+	var policies []*masking.Policy
+	var fieldsToDetokenize []*encryptor.ColumnEncryptionSetting
+	if proxy.encryptedColumns != nil {
+		_, settings := proxy.copyColumnSettings(statement)
+		columnsToDecrypt = make([]bool, len(settings))
+		for i, setting := range settings {
+			if setting == nil {
+				continue
+			}
+			if !setting.IsTokenized() {
+				columnsToDecrypt[i] = true
+			} else if proxy.tokenizer != nil && setting.CanDetokenize(proxy.getClientID()) {
+				if fieldsToDetokenize == nil {
+					fieldsToDetokenize = make([]*encryptor.ColumnEncryptionSetting, len(settings))
+				}
+				fieldsToDetokenize[i] = setting
+			}
+			if policy := setting.GetMaskingPolicy(proxy.getClientID()); policy != nil {
+				if policies == nil {
+					policies = make([]*masking.Policy, len(settings))
+				}
+				policies[i] = policy
+			}
+		}
+	}
+	return newCopyStream(format, func(columns []*ColumnData) error {
+		defer func() {
+			decryptor.Reset()
+			decryptor.ResetZoneMatch()
+		}()
+		if err := proxy.decryptColumns(ctx, columns, columnsToDecrypt, response.columnFormats, decryptor, logger); err != nil {
+			return err
+		}
+		if err := proxy.allowDecryptedColumns(columns); err != nil {
+			return err
+		}
+		proxy.countDecryptedColumns(columns)
+		proxy.detokenizeColumns(columns, fieldsToDetokenize, response.columnFormats, logger)
+		maskColumns(columns, policies)
+		return nil
+	}), nil
+}
+
+// processCopyData replaces data of CopyData packet with processed rows. Incomplete row at the end of data is buffered
+// till next CopyData packet and true returned if packet should be skipped because it doesn't contain whole rows. Rest
+// of buffered data is sent in separate CopyData packet before CopyDone
+func (proxy *PgProxy) processCopyData(packet *PacketHandler, stream *copyStream) (bool, error) {
+	switch {
+	case packet.IsCopyData():
+		data, err := stream.Process(packet.GetPacketData())
+		if err != nil {
+			return false, err
+		}
+		if len(data) == 0 {
+			return true, nil
+		}
+		packet.ReplacePacketData(data)
+	case packet.IsCopyDone():
+		data, err := stream.Flush()
+		if err != nil {
+			return false, err
+		}
+		if len(data) > 0 {
+			return false, writeCopyData(packet.writer, data)
+		}
+	}
+	return false, nil
+}
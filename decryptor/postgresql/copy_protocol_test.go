@@ -0,0 +1,113 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/sirupsen/logrus"
+)
+
+// testQueryEncryptor "encrypts" values by wrapping them with names of operations
+type testQueryEncryptor struct{}
+
+func (*testQueryEncryptor) OnQuery(query string) (string, bool, error) {
+	return query, false, nil
+}
+
+func (*testQueryEncryptor) OnPreparedQuery(query string) (string, bool, encryptor.PlaceholderSettings, error) {
+	return query, false, nil, nil
+}
+
+func (*testQueryEncryptor) EncryptWithColumnSettings(setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	return []byte("encrypted(" + string(data) + ")"), nil
+}
+
+func (*testQueryEncryptor) HMACWithColumnSettings(setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	return []byte("hmac(" + string(data) + ")"), nil
+}
+
+func (*testQueryEncryptor) TokenizeWithColumnSettings(setting *encryptor.ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	return []byte("token(" + string(data) + ")"), nil
+}
+
+func TestCopyFromStdinEncryption(t *testing.T) {
+	config := `
+schemas:
+  - table: users
+    columns: ["id", "email", "email_hash", "card"]
+    encrypted:
+      - column: email
+        hash_column: email_hash
+      - column: card
+        token_type: string
+`
+	schemaStore, err := encryptor.MapTableSchemaStoreFromConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), nil, nil, &testQueryEncryptor{}, schemaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	if stream, err := proxy.onCopyStatement("COPY orders FROM STDIN", logger); stream != nil || err != nil {
+		t.Fatal("Data of not configured table shouldn't be processed")
+	}
+	if stream, err := proxy.onCopyStatement("COPY users (id) FROM STDIN", logger); stream != nil || err != nil {
+		t.Fatal("Data without encrypted columns shouldn't be processed")
+	}
+
+	stream, err := proxy.onCopyStatement("COPY users FROM STDIN WITH CSV", logger)
+	if err != nil || stream == nil {
+		t.Fatal("Expected stream that encrypts data")
+	}
+	output := processCopyStreamByBytes(t, stream, []byte("1,\\x61,,1234\n2,,,\n"))
+	expected := "1,\\x656e63727970746564286129,\\x686d6163286129,token(1234)\n2,,,\n"
+	if string(output) != expected {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+
+	// hash column isn't copied
+	stream, err = proxy.onCopyStatement("COPY users (email) FROM STDIN (FORMAT binary)", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := append(append([]byte{}, copyBinarySignature...), 0, 0, 0, 0, 0, 0, 0, 0)
+	output = processCopyStreamByBytes(t, stream, append(append(header, binaryCopyTuple([]byte("a"))...), 0xff, 0xff))
+	expected = string(append(append(header, binaryCopyTuple([]byte("encrypted(a)"))...), 0xff, 0xff))
+	if string(output) != expected {
+		t.Fatalf("Expected %q, took %q", expected, output)
+	}
+
+	if stream, err := proxy.onCopyStatement("COPY users TO STDOUT WITH CSV", logger); stream != nil || err != nil {
+		t.Fatal("COPY TO STDOUT shouldn't encrypt client's data")
+	}
+	if statement := proxy.takeCopyStatement(); statement == nil || !statement.format.csv {
+		t.Fatal("COPY TO STDOUT statement wasn't remembered")
+	}
+	if statement := proxy.takeCopyStatement(); statement != nil {
+		t.Fatal("COPY TO STDOUT statement should be used only once")
+	}
+
+	// data of COPY which can't be parsed can't be encrypted
+	if stream, err := proxy.onCopyStatement("COPY users FROM STDIN WITH (FORMAT", logger); stream != nil || err == nil {
+		t.Fatal("Expected error for COPY which can't be parsed")
+	}
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Format codes of parameters and result columns
+// https://www.postgresql.org/docs/current/static/protocol-overview.html#PROTOCOL-FORMAT-CODES
+const (
+	TextFormat   uint16 = 0
+	BinaryFormat uint16 = 1
+)
+
+// ByteaOID is OID of bytea type in pg_type
+const ByteaOID uint32 = 17
+
+// ErrInvalidParsePacket returned when Parse packet has incorrect structure
+var ErrInvalidParsePacket = errors.New("invalid Parse packet")
+
+// ErrInvalidBindPacket returned when Bind packet has incorrect structure
+var ErrInvalidBindPacket = errors.New("invalid Bind packet")
+
+// ErrInvalidExecutePacket returned when Execute packet has incorrect structure
+var ErrInvalidExecutePacket = errors.New("invalid Execute packet")
+
+// ErrInvalidClosePacket returned when Close packet has incorrect structure
+var ErrInvalidClosePacket = errors.New("invalid Close packet")
+
+// formatCode returns format code of value with index. If there is no format codes then all values use text format,
+// if there is only one then it used for all values
+func formatCode(formats []uint16, index int) uint16 {
+	switch len(formats) {
+	case 0:
+		return TextFormat
+	case 1:
+		return formats[0]
+	}
+	if index >= len(formats) {
+		return TextFormat
+	}
+	return formats[index]
+}
+
+// readFormatCodes reads int16 count of format codes and int16[n] codes, returns codes and rest of data
+func readFormatCodes(data []byte) ([]uint16, []byte, bool) {
+	if len(data) < 2 {
+		return nil, nil, false
+	}
+	count := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < count*2 {
+		return nil, nil, false
+	}
+	formats := make([]uint16, count)
+	for i := 0; i < count; i++ {
+		formats[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return formats, data[count*2:], true
+}
+
+// readCString returns null-terminated string without terminator and rest of data after terminator
+func readCString(data []byte) ([]byte, []byte, error) {
+	end := bytes.Index(data, terminator)
+	if end == -1 {
+		return nil, nil, ErrTerminatorNotFound
+	}
+	return data[:end], data[end+1:], nil
+}
+
+// ParsePacket stores fields of Parse message
+// Parse packet has next structure: 'P' + int32 (length of packet) + NullTerminatedString (prepared statement name) +
+// + NullTerminatedString (query) + int16 (number of next int32 parameters) + int32[n] (OIDs of parameters' types)
+type ParsePacket struct {
+	name       []byte
+	query      []byte
+	paramTypes []uint32
+}
+
+// NewParsePacket parses payload of Parse packet (without message type and length of packet)
+func NewParsePacket(data []byte) (*ParsePacket, error) {
+	name, data, err := readCString(data)
+	if err != nil {
+		return nil, err
+	}
+	query, data, err := readCString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 {
+		return nil, ErrInvalidParsePacket
+	}
+	count := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != count*4 {
+		return nil, ErrInvalidParsePacket
+	}
+	paramTypes := make([]uint32, count)
+	for i := range paramTypes {
+		paramTypes[i] = binary.BigEndian.Uint32(data[i*4:])
+	}
+	return &ParsePacket{name: name, query: query, paramTypes: paramTypes}, nil
+}
+
+// Name returns name of prepared statement
+func (packet *ParsePacket) Name() string {
+	return string(packet.name)
+}
+
+// QueryString returns query of prepared statement
+func (packet *ParsePacket) QueryString() string {
+	return string(packet.query)
+}
+
+// ReplaceQuery sets new query of prepared statement
+func (packet *ParsePacket) ReplaceQuery(newQuery string) {
+	packet.query = []byte(newQuery)
+}
+
+// ParamType returns OID of type of parameter with index or 0 if client left it unspecified
+func (packet *ParsePacket) ParamType(index int) uint32 {
+	if index >= len(packet.paramTypes) {
+		return 0
+	}
+	return packet.paramTypes[index]
+}
+
+// ParamTypes returns OIDs of types of parameters specified by client
+func (packet *ParsePacket) ParamTypes() []uint32 {
+	return append([]uint32{}, packet.paramTypes...)
+}
+
+// SetParamType sets OID of type of parameter with index. Types of parameters after last specified are unspecified
+// so they are set to 0
+func (packet *ParsePacket) SetParamType(index int, oid uint32) {
+	for len(packet.paramTypes) <= index {
+		packet.paramTypes = append(packet.paramTypes, 0)
+	}
+	packet.paramTypes[index] = oid
+}
+
+// Marshal returns payload of Parse packet
+func (packet *ParsePacket) Marshal() []byte {
+	output := bytes.NewBuffer(make([]byte, 0, len(packet.name)+len(packet.query)+4+len(packet.paramTypes)*4))
+	output.Write(packet.name)
+	output.WriteByte(0)
+	output.Write(packet.query)
+	output.WriteByte(0)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf, uint16(len(packet.paramTypes)))
+	output.Write(buf[:2])
+	for _, oid := range packet.paramTypes {
+		binary.BigEndian.PutUint32(buf, oid)
+		output.Write(buf)
+	}
+	return output.Bytes()
+}
+
+// BindPacket stores fields of Bind message
+// Bind packet has next structure: 'B' + int32 (length of packet) + NullTerminatedString (portal name) +
+// + NullTerminatedString (prepared statement name) + int16 (number of parameter format codes) + int16[n] (format codes) +
+// + int16 (number of parameters) + [int32 (length of parameter value or -1 for NULL) + byte[n] (value)] +
+// + int16 (number of result-column format codes) + int16[n] (format codes)
+type BindPacket struct {
+	portal        []byte
+	statement     []byte
+	paramFormats  []uint16
+	paramValues   [][]byte
+	resultFormats []uint16
+}
+
+// NewBindPacket parses payload of Bind packet (without message type and length of packet)
+func NewBindPacket(data []byte) (*BindPacket, error) {
+	portal, data, err := readCString(data)
+	if err != nil {
+		return nil, err
+	}
+	statement, data, err := readCString(data)
+	if err != nil {
+		return nil, err
+	}
+	paramFormats, data, ok := readFormatCodes(data)
+	if !ok || len(data) < 2 {
+		return nil, ErrInvalidBindPacket
+	}
+	packet := &BindPacket{portal: portal, statement: statement, paramFormats: paramFormats}
+	paramCount := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	packet.paramValues = make([][]byte, paramCount)
+	for i := 0; i < paramCount; i++ {
+		if len(data) < 4 {
+			return nil, ErrInvalidBindPacket
+		}
+		length := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if length == NullColumnValue {
+			packet.paramValues[i] = nil
+			continue
+		}
+		if length < 0 || len(data) < int(length) {
+			return nil, ErrInvalidBindPacket
+		}
+		packet.paramValues[i] = data[:length]
+		data = data[length:]
+	}
+	resultFormats, _, ok := readFormatCodes(data)
+	if !ok {
+		return nil, ErrInvalidBindPacket
+	}
+	packet.resultFormats = resultFormats
+	return packet, nil
+}
+
+// PortalName returns name of portal created by Bind
+func (packet *BindPacket) PortalName() string {
+	return string(packet.portal)
+}
+
+// ResultFormats returns format codes of result columns
+func (packet *BindPacket) ResultFormats() []uint16 {
+	return packet.resultFormats
+}
+
+// StatementName returns name of prepared statement which parameters are bound
+func (packet *BindPacket) StatementName() string {
+	return string(packet.statement)
+}
+
+// ParamsCount returns count of bound parameters
+func (packet *BindPacket) ParamsCount() int {
+	return len(packet.paramValues)
+}
+
+// GetParameterFormat returns format code of parameter with index. If there is no format codes then all parameters
+// use text format, if there is only one then it used for all parameters
+func (packet *BindPacket) GetParameterFormat(index int) uint16 {
+	return formatCode(packet.paramFormats, index)
+}
+
+// GetParameter returns value of parameter with index or nil if it's NULL
+func (packet *BindPacket) GetParameter(index int) []byte {
+	return packet.paramValues[index]
+}
+
+// SetParameter sets new value of parameter with index
+func (packet *BindPacket) SetParameter(index int, value []byte) {
+	packet.paramValues[index] = value
+}
+
+// Marshal returns payload of Bind packet
+func (packet *BindPacket) Marshal() []byte {
+	output := bytes.NewBuffer(make([]byte, 0, OutputDefaultSize))
+	output.Write(packet.portal)
+	output.WriteByte(0)
+	output.Write(packet.statement)
+	output.WriteByte(0)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf, uint16(len(packet.paramFormats)))
+	output.Write(buf[:2])
+	for _, format := range packet.paramFormats {
+		binary.BigEndian.PutUint16(buf, format)
+		output.Write(buf[:2])
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(packet.paramValues)))
+	output.Write(buf[:2])
+	for _, value := range packet.paramValues {
+		length := NullColumnValue
+		if value != nil {
+			length = int32(len(value))
+		}
+		binary.BigEndian.PutUint32(buf, uint32(length))
+		output.Write(buf)
+		output.Write(value)
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(packet.resultFormats)))
+	output.Write(buf[:2])
+	for _, format := range packet.resultFormats {
+		binary.BigEndian.PutUint16(buf, format)
+		output.Write(buf[:2])
+	}
+	return output.Bytes()
+}
+
+// ExecutePacket stores fields of Execute message
+// Execute packet has next structure: 'E' + int32 (length of packet) + NullTerminatedString (portal name) +
+// + int32 (maximum number of rows to return or 0 for no limit)
+type ExecutePacket struct {
+	portal []byte
+}
+
+// NewExecutePacket parses payload of Execute packet (without message type and length of packet)
+func NewExecutePacket(data []byte) (*ExecutePacket, error) {
+	portal, data, err := readCString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 4 {
+		return nil, ErrInvalidExecutePacket
+	}
+	return &ExecutePacket{portal: portal}, nil
+}
+
+// PortalName returns name of executed portal
+func (packet *ExecutePacket) PortalName() string {
+	return string(packet.portal)
+}
+
+// Close message targets
+const (
+	ClosePreparedStatement byte = 'S'
+	ClosePortal            byte = 'P'
+)
+
+// ClosePacket stores fields of Close message
+// Close packet has next structure: 'C' + int32 (length of packet) + byte ('S' to close prepared statement or 'P' to
+// close portal) + NullTerminatedString (name of prepared statement or portal)
+type ClosePacket struct {
+	target byte
+	name   []byte
+}
+
+// NewClosePacket parses payload of Close packet (without message type and length of packet)
+func NewClosePacket(data []byte) (*ClosePacket, error) {
+	if len(data) < 1 || (data[0] != ClosePreparedStatement && data[0] != ClosePortal) {
+		return nil, ErrInvalidClosePacket
+	}
+	name, _, err := readCString(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &ClosePacket{target: data[0], name: name}, nil
+}
+
+// IsPortal returns true if packet closes portal
+func (packet *ClosePacket) IsPortal() bool {
+	return packet.target == ClosePortal
+}
+
+// Name returns name of closed prepared statement or portal
+func (packet *ClosePacket) Name() string {
+	return string(packet.name)
+}
@@ -169,10 +169,20 @@ func (column *ColumnData) readData(reader io.Reader) error {
 // SetData to column and update LengthBuf with new size
 func (column *ColumnData) SetData(newData []byte) {
 	column.changed = true
+	column.isNull = false
 	column.Data = newData
 	binary.BigEndian.PutUint32(column.LengthBuf[:], uint32(len(newData)))
 }
 
+// SetNull replaces column's data with null value
+func (column *ColumnData) SetNull() {
+	column.changed = true
+	column.isNull = true
+	column.Data = nil
+	nullLength := NullColumnValue
+	binary.BigEndian.PutUint32(column.LengthBuf[:], uint32(nullLength))
+}
+
 // parseColumns split whole data row packet into separate columns data
 func (packet *PacketHandler) parseColumns() error {
 	packet.columnCount = int(binary.BigEndian.Uint16(packet.descriptionBuf.Bytes()[:2]))
@@ -225,6 +235,81 @@ func (packet *PacketHandler) IsParse() bool {
 	return packet.messageType[0] == ParseMessageType
 }
 
+// IsRowDescription return true if packet has RowDescription type
+func (packet *PacketHandler) IsRowDescription() bool {
+	return packet.messageType[0] == RowDescriptionMessageType
+}
+
+// IsCommandComplete return true if packet has CommandComplete type
+func (packet *PacketHandler) IsCommandComplete() bool {
+	return packet.messageType[0] == CommandCompleteMessageType
+}
+
+// IsReadyForQuery return true if packet has ReadyForQuery type
+func (packet *PacketHandler) IsReadyForQuery() bool {
+	return packet.messageType[0] == ReadyForQueryMessageType
+}
+
+// IsBind return true if packet has Bind type
+func (packet *PacketHandler) IsBind() bool {
+	return packet.messageType[0] == BindMessageType
+}
+
+// IsExecute return true if packet has Execute type
+func (packet *PacketHandler) IsExecute() bool {
+	return packet.messageType[0] == ExecuteMessageType
+}
+
+// IsSync return true if packet has Sync type
+func (packet *PacketHandler) IsSync() bool {
+	return packet.messageType[0] == SyncMessageType
+}
+
+// IsClose return true if packet has Close type
+func (packet *PacketHandler) IsClose() bool {
+	return packet.messageType[0] == CloseMessageType
+}
+
+// IsFunctionCall return true if packet has FunctionCall type
+func (packet *PacketHandler) IsFunctionCall() bool {
+	return packet.messageType[0] == FunctionCallMessageType
+}
+
+// IsErrorResponse return true if packet has ErrorResponse type
+func (packet *PacketHandler) IsErrorResponse() bool {
+	return packet.messageType[0] == ErrorResponseMessageType
+}
+
+// IsEmptyQueryResponse return true if packet has EmptyQueryResponse type
+func (packet *PacketHandler) IsEmptyQueryResponse() bool {
+	return packet.messageType[0] == EmptyQueryResponseMessageType
+}
+
+// IsPortalSuspended return true if packet has PortalSuspended type
+func (packet *PacketHandler) IsPortalSuspended() bool {
+	return packet.messageType[0] == PortalSuspendedMessageType
+}
+
+// IsCopyOutResponse return true if packet has CopyOutResponse type
+func (packet *PacketHandler) IsCopyOutResponse() bool {
+	return packet.messageType[0] == CopyOutResponseMessageType
+}
+
+// IsCopyData return true if packet has CopyData type
+func (packet *PacketHandler) IsCopyData() bool {
+	return packet.messageType[0] == CopyDataMessageType
+}
+
+// IsCopyDone return true if packet has CopyDone type
+func (packet *PacketHandler) IsCopyDone() bool {
+	return packet.messageType[0] == CopyDoneMessageType
+}
+
+// IsCopyFail return true if packet has CopyFail type
+func (packet *PacketHandler) IsCopyFail() bool {
+	return packet.messageType[0] == CopyFailMessageType
+}
+
 //GetParseQuery return query string from Parse packet or error
 func (packet *PacketHandler) GetParseQuery() (string, error) {
 	query, err := FetchQueryFromParse(packet.descriptionBuf.Bytes())
@@ -239,6 +324,25 @@ func (packet *PacketHandler) GetSimpleQuery() (string, error) {
 	return string(packet.descriptionBuf.Bytes()[:packet.dataLength-1]), nil
 }
 
+// ReplaceQuery replace query value in Query packet with new query and update packet length
+func (packet *PacketHandler) ReplaceQuery(newQuery string) {
+	// query is null-terminated string
+	packet.ReplacePacketData(append([]byte(newQuery), 0))
+}
+
+// ReplacePacketData replace payload of packet with new data and update packet length
+func (packet *PacketHandler) ReplacePacketData(newData []byte) {
+	packet.descriptionBuf.Reset()
+	packet.descriptionBuf.Write(newData)
+	packet.dataLength = packet.descriptionBuf.Len()
+	binary.BigEndian.PutUint32(packet.descriptionLengthBuf, uint32(packet.dataLength+len(packet.descriptionLengthBuf)))
+}
+
+// GetPacketData return payload of packet without message type and length
+func (packet *PacketHandler) GetPacketData() []byte {
+	return packet.descriptionBuf.Bytes()
+}
+
 func (packet *PacketHandler) setDataLengthBuffer(dataLengthBuffer []byte) {
 	copy(packet.descriptionLengthBuf, dataLengthBuffer)
 	// set data length without length itself
@@ -350,6 +454,12 @@ func (packet *PacketHandler) ReadClientPacket() error {
 			if bytes.Equal(SSLRequest, packetBuf[4:]) {
 				return nil
 			} else if bytes.Equal(CancelRequest, packetBuf[4:]) {
+				// read process ID and secret key after cancel request code
+				packet.dataLength -= len(CancelRequest)
+				if err := packet.readData(false); err != nil {
+					return err
+				}
+				packet.dataLength += len(CancelRequest)
 				return nil
 			}
 			return ErrUnsupportedPacketType
@@ -19,8 +19,17 @@ package postgresql
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"github.com/cossacklabs/acra/acra-censor"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
 )
 
@@ -60,10 +69,12 @@ func TestClientSpecialMessageTypes(t *testing.T) {
 	sslLengthBuf := []byte{0, 0, 0, 8}
 	cancelRequestLengthBuf := []byte{0, 0, 0, 16}
 	lengthBufs := [][]byte{sslLengthBuf, cancelRequestLengthBuf}
-	for i, data := range [][]byte{SSLRequest, CancelRequest} {
+	// cancel request contains process ID and secret key after code
+	cancelRequestData := append(append([]byte{}, CancelRequest...), 0, 0, 4, 210, 0, 0, 22, 46)
+	for i, data := range [][]byte{SSLRequest, cancelRequestData} {
 		packet := bytes.Join([][]byte{lengthBufs[i], data}, []byte{})
 		reader := bytes.NewReader(packet)
-		output := make([]byte, 8)
+		output := make([]byte, len(packet))
 		writer := bufio.NewWriter(bytes.NewBuffer(output[:0]))
 		packetHander, err := NewClientSidePacketHandler(reader, writer, logrus.NewEntry(logrus.StandardLogger()))
 		if err != nil {
@@ -106,9 +117,19 @@ func TestClientStartupMessageWithData(t *testing.T) {
 	if err := packetHander.ReadClientPacket(); err != nil {
 		t.Fatal(err)
 	}
-	if packetHander.messageType[0] != WithoutMessageType {
+	if packetHander.messageType[0] != WithoutMessageType || !packetHander.IsStartupMessage() {
 		t.Fatal("Incorrect message type")
 	}
+	parameters, err := parseStartupParameters(packetHander.GetPacketData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parameters[StartupUserParameter] != "test" || parameters[StartupApplicationNameParameter] != "psql" || len(parameters) != 4 {
+		t.Fatalf("Incorrect startup parameters %v", parameters)
+	}
+	if _, err := parseStartupParameters(packetHander.GetPacketData()[:20]); err != ErrInvalidStartupMessage {
+		t.Fatalf("Expected ErrInvalidStartupMessage, took %v", err)
+	}
 	if err := packetHander.sendPacket(); err != nil {
 		t.Fatal(err)
 	}
@@ -116,3 +137,362 @@ func TestClientStartupMessageWithData(t *testing.T) {
 		t.Fatal("Output not equal to correct packet")
 	}
 }
+
+func TestReplaceSimpleQuery(t *testing.T) {
+	query := []byte("select 1\x00")
+	lengthBuf := []byte{0, 0, 0, byte(4 + len(query))}
+	packet := bytes.Join([][]byte{{QueryMessageType}, lengthBuf, query}, []byte{})
+	reader := bytes.NewReader(packet)
+	output := bytes.NewBuffer(nil)
+	writer := bufio.NewWriter(output)
+	packetHandler, err := NewClientSidePacketHandler(reader, writer, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packetHandler.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	oldQuery, err := packetHandler.GetSimpleQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldQuery != "select 1" {
+		t.Fatal("Incorrect query")
+	}
+	newQuery := "select 'some new query'"
+	packetHandler.ReplaceQuery(newQuery)
+	if err := packetHandler.sendPacket(); err != nil {
+		t.Fatal(err)
+	}
+	newQueryData := append([]byte(newQuery), 0)
+	expectedLengthBuf := []byte{0, 0, 0, byte(4 + len(newQueryData))}
+	expectedPacket := bytes.Join([][]byte{{QueryMessageType}, expectedLengthBuf, newQueryData}, []byte{})
+	if !bytes.Equal(output.Bytes(), expectedPacket) {
+		t.Fatal("Output not equal to packet with new query")
+	}
+}
+
+func TestBindPacket(t *testing.T) {
+	// portal "", statement "stmt", 2 format codes (text, binary), 3 parameters ("1", NULL, {1,2}), 1 result format code
+	data := bytes.Join([][]byte{
+		{0}, []byte("stmt\x00"),
+		{0, 2, 0, 0, 0, 1},
+		{0, 3}, {0, 0, 0, 1}, []byte("1"), {0xff, 0xff, 0xff, 0xff}, {0, 0, 0, 2, 1, 2},
+		{0, 1, 0, 1},
+	}, []byte{})
+	packet, err := NewBindPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.StatementName() != "stmt" || packet.ParamsCount() != 3 {
+		t.Fatal("Incorrect parsed Bind packet")
+	}
+	if packet.GetParameterFormat(0) != TextFormat || packet.GetParameterFormat(1) != BinaryFormat {
+		t.Fatal("Incorrect parameter format")
+	}
+	if !bytes.Equal(packet.GetParameter(0), []byte("1")) || packet.GetParameter(1) != nil || !bytes.Equal(packet.GetParameter(2), []byte{1, 2}) {
+		t.Fatal("Incorrect parameter values")
+	}
+	if !bytes.Equal(packet.Marshal(), data) {
+		t.Fatal("Marshaled packet not equal to source packet")
+	}
+	packet.SetParameter(0, []byte("123"))
+	expected := bytes.Replace(data, []byte{0, 0, 0, 1, '1'}, []byte{0, 0, 0, 3, '1', '2', '3'}, 1)
+	if !bytes.Equal(packet.Marshal(), expected) {
+		t.Fatal("Marshaled packet with new parameter has incorrect format")
+	}
+	if packet.PortalName() != "" || len(packet.ResultFormats()) != 1 || formatCode(packet.ResultFormats(), 5) != BinaryFormat {
+		t.Fatal("Incorrect result formats")
+	}
+	if _, err := NewBindPacket(data[:len(data)-9]); err != ErrInvalidBindPacket {
+		t.Fatalf("Expected ErrInvalidBindPacket, took %v", err)
+	}
+	if _, err := NewBindPacket(data[:len(data)-1]); err != ErrInvalidBindPacket {
+		t.Fatalf("Expected ErrInvalidBindPacket for truncated result formats, took %v", err)
+	}
+}
+
+func TestExecuteAndClosePackets(t *testing.T) {
+	execute, err := NewExecutePacket([]byte("portal\x00\x00\x00\x00\x0a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if execute.PortalName() != "portal" {
+		t.Fatal("Incorrect portal name of Execute packet")
+	}
+	if _, err := NewExecutePacket([]byte("portal\x00\x00")); err != ErrInvalidExecutePacket {
+		t.Fatalf("Expected ErrInvalidExecutePacket, took %v", err)
+	}
+	closePacket, err := NewClosePacket([]byte("Pportal\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closePacket.IsPortal() || closePacket.Name() != "portal" {
+		t.Fatal("Incorrect parsed Close packet")
+	}
+	if _, err := NewClosePacket([]byte("Xportal\x00")); err != ErrInvalidClosePacket {
+		t.Fatalf("Expected ErrInvalidClosePacket, took %v", err)
+	}
+}
+
+// placeholdersQueryEncryptor encrypts first placeholder of prepared statements which have placeholders
+type placeholdersQueryEncryptor struct {
+	testQueryEncryptor
+}
+
+func (*placeholdersQueryEncryptor) OnPreparedQuery(query string) (string, bool, encryptor.PlaceholderSettings, error) {
+	if strings.Contains(query, "$1") {
+		return query, false, encryptor.PlaceholderSettings{0: {ColumnEncryptionSetting: &encryptor.ColumnEncryptionSetting{Name: "email"}}}, nil
+	}
+	return query, false, nil, nil
+}
+
+// readTestClientPacket returns client's packet with messageType and payload data
+func readTestClientPacket(t *testing.T, messageType byte, data []byte) *PacketHandler {
+	reader := bytes.NewReader(marshalMessage(messageType, data))
+	packet, err := NewClientSidePacketHandler(reader, bufio.NewWriter(ioutil.Discard), logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packet.ReadClientPacket(); err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestPreparedStatementsRemoved(t *testing.T) {
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), nil, nil, &placeholdersQueryEncryptor{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(name, query string) {
+		packet := readTestClientPacket(t, ParseMessageType, []byte(name+"\x00"+query+"\x00\x00\x00"))
+		_, _, statement, err := proxy.onParse(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.addPreparedStatement(statement)
+	}
+	parse("named", "insert into users (email) values ($1)")
+	parse("", "insert into users (email) values ($1)")
+	if len(proxy.preparedStatements) != 2 {
+		t.Fatalf("Expected 2 prepared statements, took %v", proxy.preparedStatements)
+	}
+	// unnamed statement is replaced with statement without encrypted placeholders
+	parse("", "select 1")
+	if _, ok := proxy.preparedStatements[""]; ok {
+		t.Fatal("Replaced unnamed statement wasn't removed")
+	}
+	// closing portal with the same name doesn't close statement
+	if err := proxy.onClose(readTestClientPacket(t, CloseMessageType, []byte("Pnamed\x00"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxy.preparedStatements["named"]; !ok {
+		t.Fatal("Statement was removed on closing portal")
+	}
+	if err := proxy.onClose(readTestClientPacket(t, CloseMessageType, []byte("Snamed\x00"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxy.preparedStatements) != 0 {
+		t.Fatalf("Expected no prepared statements, took %v", proxy.preparedStatements)
+	}
+	if err := proxy.onClose(readTestClientPacket(t, CloseMessageType, []byte("X\x00"))); err != ErrInvalidClosePacket {
+		t.Fatalf("Expected ErrInvalidClosePacket, took %v", err)
+	}
+}
+
+// failingQueryEncryptor rejects every prepared statement
+type failingQueryEncryptor struct {
+	testQueryEncryptor
+}
+
+func (*failingQueryEncryptor) OnPreparedQuery(query string) (string, bool, encryptor.PlaceholderSettings, error) {
+	return query, false, nil, errors.New("test error")
+}
+
+func TestRejectedParseSkipsPipeline(t *testing.T) {
+	clientSide, proxyClientSide := net.Pipe()
+	defer clientSide.Close()
+	dbSide, proxyDbSide := net.Pipe()
+	defer dbSide.Close()
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), proxyClientSide, proxyDbSide, &failingQueryEncryptor{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// previous unnamed statement which database still has after rejected Parse
+	proxy.addPreparedStatement(&preparedStatement{placeholders: encryptor.PlaceholderSettings{0: {ColumnEncryptionSetting: &encryptor.ColumnEncryptionSetting{Name: "email"}}}})
+	errCh := make(chan error, 1)
+	go proxy.PgProxyClientRequests(acracensor.NewAcraCensor(), proxyDbSide, proxyClientSide, errCh)
+
+	sync := marshalMessage(SyncMessageType, nil)
+	pipeline := bytes.Join([][]byte{
+		marshalMessage(ParseMessageType, []byte("\x00insert into users (email) values ($1)\x00\x00\x00")),
+		marshalMessage(BindMessageType, []byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x06secret\x00\x00")),
+		marshalMessage(ExecuteMessageType, []byte("\x00\x00\x00\x00\x00")),
+		sync,
+	}, nil)
+	go clientSide.Write(pipeline)
+
+	// client receives only ErrorResponse, ReadyForQuery is sent by database in response on Sync
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(clientSide, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != ErrorResponseMessageType {
+		t.Fatalf("Expected ErrorResponse, took %c", header[0])
+	}
+	if _, err := io.ReadFull(clientSide, make([]byte, binary.BigEndian.Uint32(header[1:])-4)); err != nil {
+		t.Fatal(err)
+	}
+	// database receives only Sync instead of Bind with plaintext parameter for previous statement
+	received := make([]byte, len(sync))
+	if _, err := io.ReadFull(dbSide, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sync) {
+		t.Fatalf("Expected Sync, took %q", received)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error %v", err)
+	default:
+	}
+}
+
+// hashPlaceholdersQueryEncryptor compares first placeholder of prepared statements with hash column
+type hashPlaceholdersQueryEncryptor struct {
+	testQueryEncryptor
+}
+
+func (*hashPlaceholdersQueryEncryptor) OnPreparedQuery(query string) (string, bool, encryptor.PlaceholderSettings, error) {
+	return strings.Replace(query, "email", "email_hash", 1), true, encryptor.PlaceholderSettings{0: {ColumnEncryptionSetting: &encryptor.ColumnEncryptionSetting{Name: "email"}, IsHash: true}}, nil
+}
+
+func TestHashPlaceholders(t *testing.T) {
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), nil, nil, &hashPlaceholdersQueryEncryptor{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// types of parameters are text and int4
+	packet := readTestClientPacket(t, ParseMessageType, []byte("stmt\x00select id from users where email = $1 and id = $2\x00\x00\x02\x00\x00\x00\x19\x00\x00\x00\x17"))
+	_, _, statement, err := proxy.onParse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("stmt\x00select id from users where email_hash = $1 and id = $2\x00\x00\x02\x00\x00\x00\x11\x00\x00\x00\x17")
+	if !bytes.Equal(packet.GetPacketData(), expected) {
+		t.Fatalf("Incorrect Parse packet %q", packet.GetPacketData())
+	}
+	proxy.addPreparedStatement(statement)
+
+	packet = readTestClientPacket(t, BindMessageType, []byte("\x00stmt\x00\x00\x00\x00\x02\x00\x00\x00\x03a@b\x00\x00\x00\x011\x00\x00"))
+	if err := proxy.encryptBindParameters(packet); err != nil {
+		t.Fatal(err)
+	}
+	bindPacket, err := NewBindPacket(packet.GetPacketData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bindPacket.GetParameter(0), encodeHexBytea([]byte("hmac(a@b)"))) || !bytes.Equal(bindPacket.GetParameter(1), []byte("1")) {
+		t.Fatalf("Incorrect parameters of Bind packet %q", packet.GetPacketData())
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	data := []byte("stmt\x00select $1\x00\x00\x01\x00\x00\x00\x19")
+	packet, err := NewParsePacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Name() != "stmt" || packet.QueryString() != "select $1" || packet.ParamType(0) != 25 || packet.ParamType(1) != 0 {
+		t.Fatal("Incorrect parsed Parse packet")
+	}
+	if !bytes.Equal(packet.Marshal(), data) {
+		t.Fatal("Marshaled packet not equal to source packet")
+	}
+	packet.SetParamType(2, ByteaOID)
+	expected := []byte("stmt\x00select $1\x00\x00\x03\x00\x00\x00\x19\x00\x00\x00\x00\x00\x00\x00\x11")
+	if !bytes.Equal(packet.Marshal(), expected) {
+		t.Fatal("Marshaled packet with new parameter type has incorrect format")
+	}
+	if _, err := NewParsePacket(data[:len(data)-1]); err != ErrInvalidParsePacket {
+		t.Fatalf("Expected ErrInvalidParsePacket, took %v", err)
+	}
+}
+
+func TestBindParameterTypes(t *testing.T) {
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), nil, nil, &placeholdersQueryEncryptor{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting := &encryptor.PlaceholderSetting{ColumnEncryptionSetting: &encryptor.ColumnEncryptionSetting{Name: "email"}}
+	// text values in hex format are decoded only for bytea parameters and parameters with unspecified type
+	for i, testcase := range []struct {
+		paramType uint32
+		expected  string
+	}{
+		{0, "encrypted(A)"},
+		{ByteaOID, "encrypted(A)"},
+		// text
+		{25, `encrypted(\x41)`},
+	} {
+		proxy.addPreparedStatement(&preparedStatement{placeholders: encryptor.PlaceholderSettings{0: setting}, paramTypes: []uint32{testcase.paramType}})
+		packet := readTestClientPacket(t, BindMessageType, []byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x04\\x41\x00\x00"))
+		if err := proxy.encryptBindParameters(packet); err != nil {
+			t.Fatal(err)
+		}
+		bindPacket, err := NewBindPacket(packet.GetPacketData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bindPacket.GetParameter(0), encodeHexBytea([]byte(testcase.expected))) {
+			t.Fatalf("%v. Incorrect parameter %q", i, bindPacket.GetParameter(0))
+		}
+	}
+}
+
+func TestRejectedBindSkipsPipeline(t *testing.T) {
+	clientSide, proxyClientSide := net.Pipe()
+	defer clientSide.Close()
+	dbSide, proxyDbSide := net.Pipe()
+	defer dbSide.Close()
+	proxy, err := NewPgProxy(context.Background(), []byte("client"), proxyClientSide, proxyDbSide, &placeholdersQueryEncryptor{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.addPreparedStatement(&preparedStatement{placeholders: encryptor.PlaceholderSettings{0: {ColumnEncryptionSetting: &encryptor.ColumnEncryptionSetting{Name: "email"}}}})
+	errCh := make(chan error, 1)
+	go proxy.PgProxyClientRequests(acracensor.NewAcraCensor(), proxyDbSide, proxyClientSide, errCh)
+
+	sync := marshalMessage(SyncMessageType, nil)
+	// bytea parameter with invalid hex value
+	pipeline := bytes.Join([][]byte{
+		marshalMessage(BindMessageType, []byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x04\\xZZ\x00\x00")),
+		marshalMessage(ExecuteMessageType, []byte("\x00\x00\x00\x00\x00")),
+		sync,
+	}, nil)
+	go clientSide.Write(pipeline)
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(clientSide, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != ErrorResponseMessageType {
+		t.Fatalf("Expected ErrorResponse, took %c", header[0])
+	}
+	if _, err := io.ReadFull(clientSide, make([]byte, binary.BigEndian.Uint32(header[1:])-4)); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(sync))
+	if _, err := io.ReadFull(dbSide, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sync) {
+		t.Fatalf("Expected Sync, took %q", received)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error %v", err)
+	default:
+	}
+}
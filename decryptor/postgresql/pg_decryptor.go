@@ -23,17 +23,23 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"go.opencensus.io/trace"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/cossacklabs/acra/acra-censor"
 	"github.com/cossacklabs/acra/acra-censor/common"
+	"github.com/cossacklabs/acra/audit"
 	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/encryptor"
 	"github.com/cossacklabs/acra/logging"
+	"github.com/cossacklabs/acra/masking"
 	"github.com/cossacklabs/acra/network"
+	"github.com/cossacklabs/acra/tokenization"
 	"github.com/cossacklabs/acra/utils"
 	"github.com/cossacklabs/acra/zone"
 	"github.com/prometheus/client_golang/prometheus"
@@ -50,19 +56,25 @@ var TerminatePacket = []byte{'X', 0, 0, 0, 4}
 
 // NewPgError returns packed error
 func NewPgError(message string) ([]byte, error) {
+	// 42000 - syntax_error_or_access_rule_violation
+	// https://www.postgresql.org/docs/9.3/static/errcodes-appendix.html
+	return NewPgErrorWithCode("42000", message)
+}
+
+// NewPgErrorWithCode returns packed error with SQLSTATE code
+func NewPgErrorWithCode(code, message string) ([]byte, error) {
 	// 5 = E marker + 4 bytes for message length
 	// 7 is severity error with null terminator
 	// +1 for null terminator of message and packet
-	output := make([]byte, 5+7+7+len(message)+2)
+	output := make([]byte, 5+7+2+len(code)+len(message)+2)
 	// error message
 	output[0] = 'E'
 	// leave untouched place for length of data
 	output = output[:5]
 	// error severity
 	output = append(output, []byte{'S', 'E', 'R', 'R', 'O', 'R', 0}...)
-	// 42000 - syntax_error_or_access_rule_violation
-	// https://www.postgresql.org/docs/9.3/static/errcodes-appendix.html
-	output = append(output, []byte("C42000")...)
+	output = append(output, 'C')
+	output = append(output, []byte(code)...)
 	output = append(output, 0)
 	// human readable message
 	output = append(output, append([]byte{'M'}, []byte(message)...)...)
@@ -84,20 +96,155 @@ const (
 	DataRowMessageType byte = 'D'
 	QueryMessageType   byte = 'Q'
 	ParseMessageType   byte = 'P'
+	BindMessageType    byte = 'B'
 	TLSTimeout              = time.Second * 2
 )
 
+// PgSQL backend message types.
+// https://www.postgresql.org/docs/9.4/static/protocol-message-formats.html
+const (
+	RowDescriptionMessageType  byte = 'T'
+	CommandCompleteMessageType byte = 'C'
+	ReadyForQueryMessageType   byte = 'Z'
+)
+
+// PgSQL COPY sub-protocol message types.
+// https://www.postgresql.org/docs/current/static/protocol-flow.html#PROTOCOL-COPY
+const (
+	CopyOutResponseMessageType byte = 'H'
+	CopyDataMessageType        byte = 'd'
+	CopyDoneMessageType        byte = 'c'
+	CopyFailMessageType        byte = 'f'
+)
+
+// PgSQL message types used to match results of extended query protocol with client's requests.
+// https://www.postgresql.org/docs/current/static/protocol-flow.html#PROTOCOL-FLOW-EXT-QUERY
+const (
+	// sent by client
+	ExecuteMessageType      byte = 'E'
+	SyncMessageType         byte = 'S'
+	CloseMessageType        byte = 'C'
+	FunctionCallMessageType byte = 'F'
+	// sent by database
+	ErrorResponseMessageType      byte = 'E'
+	EmptyQueryResponseMessageType byte = 'I'
+	PortalSuspendedMessageType    byte = 's'
+)
+
+// preparedStatement stores settings of placeholders of prepared statement which values should be encrypted on Bind
+type preparedStatement struct {
+	name         string
+	placeholders encryptor.PlaceholderSettings
+	// OIDs of types of parameters specified by client in Parse, 0 if type is inferred by database
+	paramTypes []uint32
+}
+
+// paramType returns OID of type of parameter with index specified by client or 0
+func (statement *preparedStatement) paramType(index int) uint32 {
+	if index >= len(statement.paramTypes) {
+		return 0
+	}
+	return statement.paramTypes[index]
+}
+
 // PgProxy represents PgSQL database connection between client and database with TLS support
 type PgProxy struct {
 	clientConnection net.Conn
 	dbConnection     net.Conn
 	TLSCh            chan bool
 	ctx              context.Context
+	queryEncryptor   encryptor.QueryEncryptor
+	// settings of placeholders of prepared statements which values should be encrypted on Bind, used only by
+	// goroutine that proxies client's requests
+	preparedStatements map[string]*preparedStatement
+	// encryptedColumns is nil if all columns should be checked on AcraStructs
+	encryptedColumns *encryptedColumnResolver
+	// clientID used to find masking policies of decrypted columns and keys of tokens. clientIDLock guards it because
+	// login mapping may change it while responses are processed
+	clientIDLock sync.RWMutex
+	clientID     []byte
+	tokenizer    tokenization.Tokenizer
+	// copyStatement is last COPY TO STDOUT statement sent by client, used to process data of CopyOutResponse
+	copyStatement     *copyStatement
+	copyStatementLock sync.Mutex
+	// resultFormats tracks format codes of result columns requested by client for executed portals
+	resultFormats *resultFormatTracker
+	// onLogin is called with database user from StartupMessage, nil if client ID doesn't depend on it
+	onLogin base.LoginCallback
+	// cancelRouter routes client's cancel requests, nil if they should be forwarded as is
+	cancelRouter *CancelRequestRouter
+	// cancelKey is key of session sent to client, used only by goroutine that processes database's responses
+	cancelKey *BackendKeyData
+	// limiter rejects queries and decrypted data of client which exceeded limits, nil if there are no limits
+	limiter *base.ClientLimiter
+	// auditLog stores client's queries and decryptions, nil if audit log is turned off
+	auditLog *audit.Log
+	// decryptedCount is count of AcraStructs decrypted in current response, used only by goroutine that processes
+	// database's responses
+	decryptedCount int
+}
+
+// NewPgProxy returns new PgProxy. queryEncryptor may be nil if AcraServer shouldn't encrypt queries' data.
+// schemaStore may be nil if AcraServer should try to decrypt all columns, otherwise only configured encrypted columns
+// will be decrypted and masked according to masking policies of clientID. tokenizer may be nil if tokens shouldn't be
+// replaced with original values in responses
+func NewPgProxy(ctx context.Context, clientID []byte, clientConnection, dbConnection net.Conn, queryEncryptor encryptor.QueryEncryptor, schemaStore encryptor.TableSchemaStore, tokenizer tokenization.Tokenizer) (*PgProxy, error) {
+	proxy := &PgProxy{clientConnection: clientConnection, dbConnection: dbConnection, TLSCh: make(chan bool), ctx: ctx, queryEncryptor: queryEncryptor,
+		preparedStatements: make(map[string]*preparedStatement), clientID: clientID, tokenizer: tokenizer,
+		resultFormats: newResultFormatTracker()}
+	if schemaStore != nil {
+		proxy.encryptedColumns = newEncryptedColumnResolver(schemaStore)
+	}
+	return proxy, nil
+}
+
+// SetLoginCallback sets callback called with database user and application name from client's StartupMessage before it
+// is sent to database
+func (proxy *PgProxy) SetLoginCallback(callback base.LoginCallback) {
+	proxy.onLogin = callback
+}
+
+// SetClientID sets client ID used to find masking policies of decrypted columns and keys of tokens. Should be called
+// before client's queries are proxied
+func (proxy *PgProxy) SetClientID(clientID []byte) {
+	proxy.clientIDLock.Lock()
+	proxy.clientID = clientID
+	proxy.clientIDLock.Unlock()
 }
 
-// NewPgProxy returns new PgProxy
-func NewPgProxy(ctx context.Context, clientConnection, dbConnection net.Conn) (*PgProxy, error) {
-	return &PgProxy{clientConnection: clientConnection, dbConnection: dbConnection, TLSCh: make(chan bool), ctx: ctx}, nil
+// getClientID returns current client ID of connection
+func (proxy *PgProxy) getClientID() []byte {
+	proxy.clientIDLock.RLock()
+	defer proxy.clientIDLock.RUnlock()
+	return proxy.clientID
+}
+
+// sendClientError sends ErrorResponse with message and ReadyForQuery to client
+func sendClientError(message string, clientConnection net.Conn) error {
+	errorMessage, err := NewPgError(message)
+	if err != nil {
+		return err
+	}
+	return sendErrorResponse(errorMessage, clientConnection)
+}
+
+// sendClientLimitError sends ErrorResponse about exceeded limit and ReadyForQuery to client
+func sendClientLimitError(limitErr error, clientConnection net.Conn) error {
+	errorMessage, err := NewPgClientLimitError(limitErr)
+	if err != nil {
+		return err
+	}
+	return sendErrorResponse(errorMessage, clientConnection)
+}
+
+// sendErrorResponse sends packed ErrorResponse and ReadyForQuery to client
+func sendErrorResponse(errorMessage []byte, clientConnection net.Conn) error {
+	n, err := clientConnection.Write(errorMessage)
+	if err := base.CheckReadWrite(n, len(errorMessage), err); err != nil {
+		return err
+	}
+	n, err = clientConnection.Write(ReadyForQueryPacket)
+	return base.CheckReadWrite(n, len(ReadyForQueryPacket), err)
 }
 
 // PgProxyClientRequests checks every client request using AcraCensor,
@@ -117,6 +264,11 @@ func (proxy *PgProxy) PgProxyClientRequests(acraCensor acracensor.AcraCensorInte
 		return
 	}
 	prometheusLabels := []string{base.DecryptionDBPostgresql}
+	// encrypts data of current COPY FROM STDIN statement, nil if there is no data to encrypt
+	var copyInStream *copyStream
+	// true after Execute or Parse was rejected until client sends Sync, database skips messages of failed extended query
+	// the same way
+	skipUntilSync := false
 	// use pointers to function where should be stored some function that should be called if code return error and interrupt loop
 	// default value empty func to avoid != nil check
 	var spanEndFunc = func() {}
@@ -143,8 +295,112 @@ func (proxy *PgProxy) PgProxyClientRequests(acraCensor acracensor.AcraCensorInte
 			return
 		}
 		dbConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
+		if proxy.onLogin != nil && packet.IsStartupMessage() {
+			if err := proxy.onStartupMessage(packet); err != nil {
+				// database didn't start session yet so client expects only ErrorResponse
+				var errorMessage []byte
+				var packErr error
+				if base.IsClientLimitError(err) {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+						Warningln("Client ID of database login exceeded limit of sessions")
+					errorMessage, packErr = NewPgClientLimitError(err)
+				} else {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorUnknownDatabaseLogin).
+						Errorln("Can't find out client ID of database login")
+					errorMessage, packErr = NewPgError("AcraServer can't find out client ID of database login")
+				}
+				if packErr == nil {
+					clientConnection.Write(errorMessage)
+				}
+				errCh <- err
+				return
+			}
+		}
+		if proxy.cancelRouter != nil && packet.IsCancelRequest() {
+			if err := proxy.onCancelRequest(packet); err != nil {
+				logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+					Warningln("Can't cancel query")
+			}
+			// database closes connection after CancelRequest without response
+			errCh <- io.EOF
+			return
+		}
+		if skipUntilSync {
+			if !(packet.IsSync() || packet.terminatePacket) {
+				continue
+			}
+			skipUntilSync = false
+		}
 		// we are interested only in requests that contains sql queries
 		if !(packet.IsSimpleQuery() || packet.IsParse()) {
+			if packet.IsExecute() {
+				if limitErr := proxy.allowQuery(); limitErr != nil {
+					logger.WithError(limitErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+						Warningln("Client exceeded limit of queries")
+					// database sends ReadyForQuery on Sync which is forwarded after skipped messages
+					errorMessage, err := NewPgClientLimitError(limitErr)
+					if err != nil {
+						logger.WithError(err).Errorln("Can't create PostgreSQL error message")
+						errCh <- err
+						return
+					}
+					n, err := clientConnection.Write(errorMessage)
+					if err := base.CheckReadWrite(n, len(errorMessage), err); err != nil {
+						errCh <- err
+						return
+					}
+					skipUntilSync = true
+					continue
+				}
+			}
+			if copyInStream != nil && (packet.IsCopyData() || packet.IsCopyDone() || packet.IsCopyFail()) {
+				_, encryptorSpan := trace.StartSpan(packetSpanCtx, "encryptor")
+				skipPacket, err := proxy.processCopyData(packet, copyInStream)
+				encryptorSpan.End()
+				if err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptQuery).
+						Errorln("Can't encrypt data of COPY FROM STDIN")
+					errCh <- err
+					return
+				}
+				if !packet.IsCopyData() {
+					copyInStream = nil
+				}
+				if skipPacket {
+					continue
+				}
+			}
+			if packet.IsBind() && proxy.queryEncryptor != nil {
+				_, encryptorSpan := trace.StartSpan(packetSpanCtx, "encryptor")
+				err := proxy.encryptBindParameters(packet)
+				encryptorSpan.End()
+				if err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptQuery).
+						Errorln("Can't encrypt parameters of Bind packet")
+					skipUntilSync, err = sendRequestError("AcraServer can't encrypt parameters of this query", packet, clientConnection)
+					if err != nil {
+						logger.WithError(err).Errorln("Can't send PostgreSQL error message to client")
+						errCh <- err
+						return
+					}
+					continue
+				}
+			}
+			if packet.IsClose() && proxy.queryEncryptor != nil {
+				if err := proxy.onClose(packet); err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+						Errorln("Can't parse Close packet")
+					errCh <- err
+					return
+				}
+			}
+			// track formats before forwarding to know them when database responds
+			if err := proxy.trackResultFormats(packet); err != nil {
+				logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+					Errorln("Can't parse packet of extended query protocol")
+				errCh <- err
+				return
+			}
 			if err := packet.sendPacket(); err != nil {
 				logger.WithError(err).Errorln("Can't forward packet to db")
 				errCh <- err
@@ -188,35 +444,234 @@ func (proxy *PgProxy) PgProxyClientRequests(acraCensor acracensor.AcraCensorInte
 			}
 		}
 
+		// prepared statements are charged on Execute
+		if packet.IsSimpleQuery() {
+			if limitErr := proxy.allowQuery(); limitErr != nil {
+				censorSpan.End()
+				logger.WithError(limitErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+					Warningln("Client exceeded limit of queries")
+				if err := sendClientLimitError(limitErr, clientConnection); err != nil {
+					logger.WithError(err).Errorln("Can't send PostgreSQL error message to client")
+					errCh <- err
+					return
+				}
+				continue
+			}
+		}
+
 		if censorErr := acraCensor.HandleQuery(query); censorErr != nil {
 			censorSpan.End()
 			logger.WithError(censorErr).Errorln("AcraCensor blocked query")
-			errorMessage, err := NewPgError("AcraCensor blocked this query")
+			proxy.auditQuery(query, audit.VerdictBlocked, logger)
+			skipUntilSync, err = sendRequestError("AcraCensor blocked this query", packet, clientConnection)
 			if err != nil {
-				logger.WithError(err).Errorln("Can't create PostgreSQL error message")
-				errCh <- err
-				return
-			}
-			n, err := clientConnection.Write(errorMessage)
-			if err := base.CheckReadWrite(n, len(errorMessage), err); err != nil {
+				logger.WithError(err).Errorln("Can't send PostgreSQL error message to client")
 				errCh <- err
 				return
 			}
-			n, err = clientConnection.Write(ReadyForQueryPacket)
-			if err := base.CheckReadWrite(n, len(ReadyForQueryPacket), err); err != nil {
+			continue
+		}
+		censorSpan.End()
+		proxy.auditQuery(query, audit.VerdictAllowed, logger)
+
+		copyInStream, err = proxy.onCopyStatement(query, logger)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptQuery).
+				Errorln("Can't parse COPY statement to encrypt its data")
+			skipUntilSync, err = sendRequestError("AcraServer can't encrypt data of this COPY statement", packet, clientConnection)
+			if err != nil {
+				logger.WithError(err).Errorln("Can't send PostgreSQL error message to client")
 				errCh <- err
 				return
 			}
 			continue
 		}
-		censorSpan.End()
 
+		// statement from Parse which replaces previous statement with the same name after Parse is forwarded
+		var parsedStatement *preparedStatement
+		if proxy.queryEncryptor != nil {
+			_, encryptorSpan := trace.StartSpan(packetSpanCtx, "encryptor")
+			var newQuery string
+			var changed bool
+			if packet.IsSimpleQuery() {
+				newQuery, changed, err = proxy.queryEncryptor.OnQuery(query)
+			} else {
+				newQuery, changed, parsedStatement, err = proxy.onParse(packet)
+			}
+			encryptorSpan.End()
+			if err != nil {
+				logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorEncryptorCantEncryptQuery).
+					Errorln("Can't encrypt query")
+				skipUntilSync, err = sendRequestError("AcraServer can't encrypt data of this query", packet, clientConnection)
+				if err != nil {
+					logger.WithError(err).Errorln("Can't send PostgreSQL error message to client")
+					errCh <- err
+					return
+				}
+				continue
+			}
+			if changed && packet.IsSimpleQuery() {
+				packet.ReplaceQuery(newQuery)
+			}
+		}
+
+		if packet.IsSimpleQuery() {
+			// database finishes response on simple query with ReadyForQuery
+			proxy.resultFormats.onSync()
+			// simple query destroys unnamed prepared statement
+			delete(proxy.preparedStatements, "")
+		}
 		if err := packet.sendPacket(); err != nil {
 			logger.WithError(err).Errorln("Can't send packet")
 			errCh <- err
 			return
 		}
+		if parsedStatement != nil {
+			proxy.addPreparedStatement(parsedStatement)
+		}
+	}
+}
+
+// onParse encrypts literal values of prepared statement's query, replaces query in Parse packet if it was changed and
+// returns statement with placeholders which should be encrypted on Bind. Placeholders compared with hash columns
+// receive HMACs, so their types are changed to bytea if client specified them. Statement should be remembered only
+// after Parse is forwarded to database
+func (proxy *PgProxy) onParse(packet *PacketHandler) (string, bool, *preparedStatement, error) {
+	parsePacket, err := NewParsePacket(packet.GetPacketData())
+	if err != nil {
+		return "", false, nil, err
+	}
+	newQuery, changed, placeholders, err := proxy.queryEncryptor.OnPreparedQuery(parsePacket.QueryString())
+	if err != nil {
+		return "", false, nil, err
+	}
+	// values are bound in types specified by client, not changed
+	paramTypes := parsePacket.ParamTypes()
+	packetChanged := changed
+	for index, setting := range placeholders {
+		if setting.IsHash && parsePacket.ParamType(index) != 0 && parsePacket.ParamType(index) != ByteaOID {
+			parsePacket.SetParamType(index, ByteaOID)
+			packetChanged = true
+		}
+	}
+	if changed {
+		parsePacket.ReplaceQuery(newQuery)
+	}
+	if packetChanged {
+		packet.ReplacePacketData(parsePacket.Marshal())
+	}
+	return newQuery, changed, &preparedStatement{name: parsePacket.Name(), placeholders: placeholders, paramTypes: paramTypes}, nil
+}
+
+// addPreparedStatement remembers statement from forwarded Parse. Parse replaces unnamed statement and named statement
+// is parsed again only after Close, so placeholders of previous statement with the same name aren't valid anymore
+func (proxy *PgProxy) addPreparedStatement(statement *preparedStatement) {
+	if len(statement.placeholders) == 0 {
+		delete(proxy.preparedStatements, statement.name)
+		return
+	}
+	proxy.preparedStatements[statement.name] = statement
+}
+
+// sendRequestError sends ErrorResponse with message to client instead of response on rejected Query, Parse or Bind.
+// Rejected Query is finished with ReadyForQuery. Database doesn't receive rejected Parse or Bind, so following
+// messages of extended query should be skipped till Sync like database skips them after error, otherwise they would
+// use previous statement or portal with the same name. Returns true if messages should be skipped
+func sendRequestError(message string, packet *PacketHandler, clientConnection net.Conn) (bool, error) {
+	errorMessage, err := NewPgError(message)
+	if err != nil {
+		return false, err
+	}
+	if packet.IsSimpleQuery() {
+		return false, sendErrorResponse(errorMessage, clientConnection)
+	}
+	n, err := clientConnection.Write(errorMessage)
+	return true, base.CheckReadWrite(n, len(errorMessage), err)
+}
+
+// onClose forgets placeholders of prepared statement closed by client
+func (proxy *PgProxy) onClose(packet *PacketHandler) error {
+	closePacket, err := NewClosePacket(packet.GetPacketData())
+	if err != nil {
+		return err
+	}
+	if !closePacket.IsPortal() {
+		delete(proxy.preparedStatements, closePacket.Name())
+	}
+	return nil
+}
+
+// encryptBindParameters encrypts or tokenizes values of bound parameters that correspond to encryptable columns of
+// prepared statement and replaces them in Bind packet
+func (proxy *PgProxy) encryptBindParameters(packet *PacketHandler) error {
+	bindPacket, err := NewBindPacket(packet.GetPacketData())
+	if err != nil {
+		return err
+	}
+	statement, ok := proxy.preparedStatements[bindPacket.StatementName()]
+	if !ok {
+		return nil
+	}
+	changed := false
+	for index, setting := range statement.placeholders {
+		if index >= bindPacket.ParamsCount() {
+			continue
+		}
+		value := bindPacket.GetParameter(index)
+		if value == nil {
+			continue
+		}
+		format := bindPacket.GetParameterFormat(index)
+		if setting.IsTokenized() {
+			token, err := processTokenValue(value, format, setting.TokenType, func(data []byte) ([]byte, error) {
+				return proxy.queryEncryptor.TokenizeWithColumnSettings(setting.ColumnEncryptionSetting, data)
+			})
+			if err != nil {
+				return err
+			}
+			bindPacket.SetParameter(index, token)
+			changed = true
+			continue
+		}
+		value, err = decodeByteaParameter(value, format, statement.paramType(index))
+		if err != nil {
+			return err
+		}
+		var encrypted []byte
+		if setting.IsHash {
+			// placeholder is compared with hash column
+			encrypted, err = proxy.queryEncryptor.HMACWithColumnSettings(setting.ColumnEncryptionSetting, value)
+		} else {
+			encrypted, err = proxy.queryEncryptor.EncryptWithColumnSettings(setting.ColumnEncryptionSetting, value)
+		}
+		if err != nil {
+			return err
+		}
+		bindPacket.SetParameter(index, encodeByteaParameter(encrypted, format))
+		changed = true
+	}
+	if changed {
+		packet.ReplacePacketData(bindPacket.Marshal())
+	}
+	return nil
+}
+
+// decodeByteaParameter returns binary value of parameter of type with typeOID. Values in text format are decoded only
+// if parameter is bytea or its type is unspecified and inferred by database from bytea column, and they are in
+// hex format, other values are used as is
+func decodeByteaParameter(value []byte, format uint16, typeOID uint32) ([]byte, error) {
+	if format == TextFormat && (typeOID == 0 || typeOID == ByteaOID) && bytes.HasPrefix(value, HexPrefix) {
+		return hex.DecodeString(string(value[len(HexPrefix):]))
+	}
+	return value, nil
+}
+
+// encodeByteaParameter returns binary value as bytea parameter in format
+func encodeByteaParameter(value []byte, format uint16) []byte {
+	if format == TextFormat {
+		return encodeHexBytea(value)
 	}
+	return value
 }
 
 // handlePoisonCheckResult return error err != nil, if can't check on poison record or any callback on poison record
@@ -277,7 +732,7 @@ func checkWholePoisonRecord(block []byte, decryptor base.Decryptor, logger *log.
 }
 
 // processWholeBlockDecryption try to decrypt data of column as whole AcraStruct and replace with decrypted data on success
-func (proxy *PgProxy) processWholeBlockDecryption(ctx context.Context, packet *PacketHandler, column *ColumnData, decryptor base.Decryptor, logger *log.Entry) error {
+func (proxy *PgProxy) processWholeBlockDecryption(ctx context.Context, column *ColumnData, decryptor base.Decryptor, logger *log.Entry) error {
 	span := trace.FromContext(ctx)
 	decryptor.Reset()
 	decrypted, err := decryptor.DecryptBlock(column.Data)
@@ -299,6 +754,21 @@ func (proxy *PgProxy) processWholeBlockDecryption(ctx context.Context, packet *P
 	return nil
 }
 
+// maskColumns replaces values of columns with masked values according to policies. Values are masked even if they
+// weren't decrypted to not show AcraStructs to clients which shouldn't see them
+func maskColumns(columns []*ColumnData, policies []*masking.Policy) {
+	for i, policy := range policies {
+		if policy == nil || i >= len(columns) || columns[i].IsNull() {
+			continue
+		}
+		if policy.IsNull() {
+			columns[i].SetNull()
+		} else {
+			columns[i].SetData(policy.Mask(columns[i].Data))
+		}
+	}
+}
+
 // handleSSLRequest return wrapped with tls (client's, db's connections, nil) or (nil, nil, error)
 func (proxy *PgProxy) handleSSLRequest(packet *PacketHandler, tlsConfig *tls.Config, clientConnection, dbConnection net.Conn, logger *log.Entry) (net.Conn, net.Conn, error) {
 	// if server allow SSLRequest than we wrap our connections with tls
@@ -355,7 +825,7 @@ func (proxy *PgProxy) handleSSLRequest(packet *PacketHandler, tlsConfig *tls.Con
 	return tlsClientConnection, dbTLSConnection, nil
 }
 
-func (proxy *PgProxy) processInlineBlockDecryption(ctx context.Context, packet *PacketHandler, column *ColumnData, decryptor base.Decryptor, logger *log.Entry) error {
+func (proxy *PgProxy) processInlineBlockDecryption(ctx context.Context, column *ColumnData, decryptor base.Decryptor, logger *log.Entry) error {
 	span := trace.FromContext(ctx)
 	// inline mode
 	currentIndex := 0
@@ -392,7 +862,7 @@ func (proxy *PgProxy) processInlineBlockDecryption(ctx context.Context, packet *
 			continue
 		}
 		blockReader := bytes.NewReader(column.Data[beginTagIndex+tagLength:])
-		symKey, _, err := decryptor.ReadSymmetricKey(key, blockReader)
+		symKey, _, err := base.ReadSymmetricKeyWithPreviousKeys(decryptor, key, blockReader)
 		if err != nil {
 			span.AddAttributes(trace.BoolAttribute("failed_decryption", true))
 			base.AcrastructDecryptionCounter.WithLabelValues(base.DecryptionTypeFail).Inc()
@@ -439,10 +909,75 @@ func (proxy *PgProxy) processInlineBlockDecryption(ctx context.Context, packet *
 	return nil
 }
 
+// decryptColumns decrypts AcraStructs in values of columns of one row. columnsToDecrypt is nil if all columns should
+// be checked on AcraStructs, formats are format codes of columns and nil if all columns use text format
+func (proxy *PgProxy) decryptColumns(ctx context.Context, columns []*ColumnData, columnsToDecrypt []bool, formats []uint16, decryptor base.Decryptor, logger *log.Entry) error {
+	span := trace.FromContext(ctx)
+	// next values are decrypted in text format by default
+	defer setDecryptorFormat(decryptor, TextFormat)
+	for i, column := range columns {
+		if column.IsNull() {
+			continue
+		}
+		setDecryptorFormat(decryptor, formatCode(formats, i))
+		// try to skip small piece of data that can't be valuable for us
+		if (decryptor.IsWithZone() && column.Length() >= zone.ZoneIDBlockLength) || column.Length() >= base.KeyBlockLength {
+			decryptor.Reset()
+			span.AddAttributes(trace.BoolAttribute("decryption", true))
+
+			// Zone anyway should be passed as whole block
+			// so try to match before any operations if we process with ZoneMode on
+			if decryptor.IsWithZone() && !decryptor.IsMatchedZone() {
+				span.AddAttributes(trace.BoolAttribute("match_zone", true))
+				// try to match zone
+				decryptor.MatchZoneBlock(column.Data)
+				var err error
+				if decryptor.IsWholeMatch() {
+					// check that it's not poison record
+					err = checkWholePoisonRecord(column.Data, decryptor, logger)
+				} else {
+					// check that it's not poison record
+					err = checkInlinePoisonRecordInBlock(column.Data, decryptor, logger)
+				}
+
+				if err != nil {
+					logger.WithError(err).Errorln("Can't check poison record in block")
+					return err
+				}
+				continue
+			}
+
+			if columnsToDecrypt != nil && (i >= len(columnsToDecrypt) || !columnsToDecrypt[i]) {
+				logger.WithField("column_index", i).Debugln("Skip decryption of column that isn't configured as encrypted")
+				continue
+			}
+
+			if decryptor.IsWholeMatch() {
+				err := proxy.processWholeBlockDecryption(ctx, column, decryptor, logger)
+				if err != nil {
+					logger.WithError(err).Errorln("Can't process whole block")
+					return err
+				}
+			} else {
+				err := proxy.processInlineBlockDecryption(ctx, column, decryptor, logger)
+				if err != nil {
+					logger.WithError(err).Errorln("Can't process block with inline mode")
+					return err
+				}
+			}
+		} else {
+			logger.Debugln("Skip decryption because length of block too small for ZoneId or AcraStruct")
+		}
+	}
+	return nil
+}
+
 // PgDecryptStream process data rows from database
 func (proxy *PgProxy) PgDecryptStream(censor acracensor.AcraCensorInterface, decryptor base.Decryptor, tlsConfig *tls.Config, dbConnection net.Conn, clientConnection net.Conn, errCh chan<- error) {
 	ctx, span := trace.StartSpan(proxy.ctx, "PgDecryptStream")
 	defer span.End()
+	// session can't be canceled after connection is closed
+	defer proxy.releaseCancelKey()
 	logger := logging.NewLoggerWithTrace(ctx).WithField("proxy", "server")
 	if decryptor.IsWholeMatch() {
 		logger = logger.WithField("decrypt_mode", "wholecell")
@@ -467,6 +1002,31 @@ func (proxy *PgProxy) PgDecryptStream(censor acracensor.AcraCensorInterface, dec
 		prometheusLabels = append(prometheusLabels, base.DecryptionModeInline)
 	}
 	firstByte := true
+	// flags of columns of current result set that should be decrypted, nil if all columns should be checked
+	var columnsToDecrypt []bool
+	// masking policies of columns of current result set, nil if no column should be masked
+	var columnsMasking []*masking.Policy
+	// tokenized columns of current result set which values should be detokenized, nil if there are no such columns
+	var columnsToDetokenize []*encryptor.ColumnEncryptionSetting
+	// format codes of columns of current result set from RowDescription, used if result isn't result of Execute
+	var columnsFormats []uint16
+	// decrypts data of current COPY TO STDOUT statement
+	var copyOutStream *copyStream
+	// true after response was replaced with error about exceeded limit, next messages are dropped till ReadyForQuery
+	var rejectResponse bool
+	rejectOnLimit := func(limitErr error) error {
+		logger.WithError(limitErr).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorClientLimitExceeded).
+			Warningln("Client exceeded limit of decrypted data, response replaced with error")
+		rejectResponse = true
+		errorMessage, err := NewPgClientLimitError(limitErr)
+		if err != nil {
+			return err
+		}
+		if _, err := packetHandler.writer.Write(errorMessage); err != nil {
+			return err
+		}
+		return packetHandler.writer.Flush()
+	}
 	// use pointer to function where should be stored some function that should be called if code return error and interrupt loop
 	// default value empty func to avoid != nil check
 	var endLoopSpanFunc = func() {}
@@ -513,6 +1073,7 @@ func (proxy *PgProxy) PgDecryptStream(censor acracensor.AcraCensorInterface, dec
 				go proxy.PgProxyClientRequests(censor, dbTLSConnection, tlsClientConnection, errCh)
 				reader = bufio.NewReader(dbTLSConnection)
 				writer = bufio.NewWriter(tlsClientConnection)
+				dbConnection = dbTLSConnection
 				firstByte = true
 
 				packetHandler.reader = reader
@@ -545,6 +1106,84 @@ func (proxy *PgProxy) PgDecryptStream(censor acracensor.AcraCensorInterface, dec
 		clientConnection.SetWriteDeadline(time.Now().Add(network.DefaultNetworkTimeout))
 
 		if !packetHandler.IsDataRow() {
+			if packetHandler.IsCopyOutResponse() {
+				copyOutStream, err = proxy.newCopyOutStream(packetCtx, packetHandler.GetPacketData(), decryptor, logger)
+				if err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+						Errorln("Can't parse CopyOutResponse packet")
+					errCh <- err
+					return
+				}
+			} else if copyOutStream != nil && (packetHandler.IsCopyData() || packetHandler.IsCopyDone()) {
+				skipPacket, err := proxy.processCopyData(packetHandler, copyOutStream)
+				if base.IsClientLimitError(err) {
+					copyOutStream = nil
+					if err := rejectOnLimit(err); err != nil {
+						logger.WithError(err).Errorln("Can't send error about exceeded limit")
+						errCh <- err
+						return
+					}
+				} else if err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+						Errorln("Can't process data of COPY TO STDOUT")
+					errCh <- err
+					return
+				}
+				if packetHandler.IsCopyDone() {
+					copyOutStream = nil
+				}
+				if skipPacket || rejectResponse {
+					timer.ObserveDuration()
+					continue
+				}
+			} else if packetHandler.IsRowDescription() {
+				fields, err := ParseRowDescription(packetHandler.GetPacketData())
+				if err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+						Errorln("Can't parse RowDescription packet")
+					errCh <- err
+					return
+				}
+				columnsFormats = make([]uint16, len(fields))
+				for i, field := range fields {
+					columnsFormats[i] = field.Format
+				}
+				if proxy.encryptedColumns != nil {
+					columnsToDecrypt = proxy.encryptedColumns.columnsToDecrypt(fields)
+					columnsMasking = proxy.encryptedColumns.maskingPolicies(fields, proxy.getClientID())
+					if proxy.tokenizer != nil {
+						columnsToDetokenize = proxy.encryptedColumns.fieldsToDetokenize(fields, proxy.getClientID())
+					}
+				}
+			} else if packetHandler.IsBackendKeyData() && proxy.cancelRouter != nil {
+				if err := proxy.onBackendKeyData(packetHandler, dbConnection, tlsConfig); err != nil {
+					logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorProtocolProcessing).
+						Errorln("Can't register session to cancel its queries")
+					errCh <- err
+					return
+				}
+			} else if packetHandler.IsCommandComplete() || packetHandler.IsReadyForQuery() {
+				// next result set will be described with new RowDescription
+				columnsToDecrypt = nil
+				columnsMasking = nil
+				columnsToDetokenize = nil
+				columnsFormats = nil
+				copyOutStream = nil
+			}
+			if packetHandler.IsReadyForQuery() {
+				proxy.resultFormats.onReadyForQuery()
+				proxy.auditDecryptions(logger)
+			} else if packetHandler.IsCommandComplete() || packetHandler.IsEmptyQueryResponse() ||
+				packetHandler.IsPortalSuspended() || packetHandler.IsErrorResponse() {
+				proxy.resultFormats.onResultEnd()
+			}
+			if rejectResponse {
+				if !packetHandler.IsReadyForQuery() {
+					timer.ObserveDuration()
+					continue
+				}
+				rejectResponse = false
+			}
 			if err := packetHandler.sendPacket(); err != nil {
 				logger.WithError(err).Errorln("Can't forward packet")
 				errCh <- err
@@ -554,6 +1193,10 @@ func (proxy *PgProxy) PgDecryptStream(censor acracensor.AcraCensorInterface, dec
 			continue
 		}
 
+		if rejectResponse {
+			timer.ObserveDuration()
+			continue
+		}
 		logger.Debugln("Matched data row packet")
 		if err := packetHandler.parseColumns(); err != nil {
 			logger.WithError(err).Errorln("Can't parse columns in packet")
@@ -572,57 +1215,29 @@ func (proxy *PgProxy) PgDecryptStream(censor acracensor.AcraCensorInterface, dec
 		}
 
 		logger.Debugf("Process columns data")
-		for i := 0; i < packetHandler.columnCount; i++ {
-			column := packetHandler.Columns[i]
-			if column.IsNull() {
-				continue
-			}
-			// try to skip small piece of data that can't be valuable for us
-			if (decryptor.IsWithZone() && column.Length() >= zone.ZoneIDBlockLength) || column.Length() >= base.KeyBlockLength {
-				decryptor.Reset()
-				packetSpan.AddAttributes(trace.BoolAttribute("decryption", true))
-
-				// Zone anyway should be passed as whole block
-				// so try to match before any operations if we process with ZoneMode on
-				if decryptor.IsWithZone() && !decryptor.IsMatchedZone() {
-					packetSpan.AddAttributes(trace.BoolAttribute("match_zone", true))
-					// try to match zone
-					decryptor.MatchZoneBlock(column.Data)
-					if decryptor.IsWholeMatch() {
-						// check that it's not poison record
-						err = checkWholePoisonRecord(column.Data, decryptor, logger)
-					} else {
-						// check that it's not poison record
-						err = checkInlinePoisonRecordInBlock(column.Data, decryptor, logger)
-					}
-
-					if err != nil {
-						logger.WithError(err).Errorln("Can't check poison record in block")
-						errCh <- err
-						return
-					}
-					continue
-				}
-
-				if decryptor.IsWholeMatch() {
-					err := proxy.processWholeBlockDecryption(packetCtx, packetHandler, column, decryptor, logger)
-					if err != nil {
-						logger.WithError(err).Errorln("Can't process whole block")
-						errCh <- err
-						return
-					}
-				} else {
-					err := proxy.processInlineBlockDecryption(packetCtx, packetHandler, column, decryptor, logger)
-					if err != nil {
-						logger.WithError(err).Errorln("Can't process block with inline mode")
-						errCh <- err
-						return
-					}
-				}
-			} else {
-				logger.Debugln("Skip decryption because length of block too small for ZoneId or AcraStruct")
+		// formats requested in Bind are more reliable because RowDescription of prepared statement has only text formats
+		formats, ok := proxy.resultFormats.currentFormats()
+		if !ok {
+			formats = columnsFormats
+		}
+		if err := proxy.decryptColumns(packetCtx, packetHandler.Columns, columnsToDecrypt, formats, decryptor, logger); err != nil {
+			errCh <- err
+			return
+		}
+		if limitErr := proxy.allowDecryptedColumns(packetHandler.Columns); limitErr != nil {
+			if err := rejectOnLimit(limitErr); err != nil {
+				logger.WithError(err).Errorln("Can't send error about exceeded limit")
+				errCh <- err
+				return
 			}
+			decryptor.Reset()
+			decryptor.ResetZoneMatch()
+			timer.ObserveDuration()
+			continue
 		}
+		proxy.countDecryptedColumns(packetHandler.Columns)
+		proxy.detokenizeColumns(packetHandler.Columns, columnsToDetokenize, formats, logger)
+		maskColumns(packetHandler.Columns, columnsMasking)
 		packetHandler.updateDataFromColumns()
 		if err := packetHandler.sendPacket(); err != nil {
 			logger.WithError(err).Errorln("Can't send packet")
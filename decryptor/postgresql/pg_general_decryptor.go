@@ -27,6 +27,7 @@ import (
 	"github.com/cossacklabs/themis/gothemis/keys"
 	"github.com/sirupsen/logrus"
 	"io"
+	"sync"
 )
 
 // PgDecryptor implements particular data decryptor for PostgreSQL binary format
@@ -39,13 +40,17 @@ type PgDecryptor struct {
 	binaryDecryptor    base.DataDecryptor
 	matchedDecryptor   base.DataDecryptor
 	checkPoisonRecords bool
+	// isBinaryFormat is true if decrypted value is in binary format and only binaryDecryptor should be used
+	isBinaryFormat bool
 
 	poisonKey       []byte
-	clientID        []byte
 	matchBuffer     []byte
 	matchIndex      int
 	callbackStorage *base.PoisonCallbackStorage
-	logger          *logrus.Entry
+	// clientIDLock guards clientID and logger which may be changed by login mapping while data is decrypted
+	clientIDLock sync.RWMutex
+	clientID     []byte
+	logger       *logrus.Entry
 }
 
 // NewPgDecryptor returns new PgDecryptor hiding inner HEX decryptor or ESCAPE decryptor
@@ -65,6 +70,39 @@ func NewPgDecryptor(clientID []byte, decryptor base.DataDecryptor) *PgDecryptor
 	}
 }
 
+// SetClientID sets client ID which private key is used to decrypt AcraStructs without zones
+func (decryptor *PgDecryptor) SetClientID(clientID []byte) {
+	decryptor.clientIDLock.Lock()
+	decryptor.clientID = clientID
+	decryptor.logger = logrus.WithField("client_id", string(clientID))
+	decryptor.clientIDLock.Unlock()
+}
+
+// getClientID returns current client ID which private key is used to decrypt AcraStructs without zones
+func (decryptor *PgDecryptor) getClientID() []byte {
+	decryptor.clientIDLock.RLock()
+	defer decryptor.clientIDLock.RUnlock()
+	return decryptor.clientID
+}
+
+// getLogger returns logger with current client ID
+func (decryptor *PgDecryptor) getLogger() *logrus.Entry {
+	decryptor.clientIDLock.RLock()
+	defer decryptor.clientIDLock.RUnlock()
+	return decryptor.logger
+}
+
+// SetBinaryFormat sets format of next decrypted values. Values in binary format contain raw AcraStructs and are
+// decrypted only with binary decryptor, values in text format are decrypted with HEX or ESCAPE decryptor too
+func (decryptor *PgDecryptor) SetBinaryFormat(value bool) {
+	decryptor.isBinaryFormat = value
+}
+
+// IsBinaryFormat returns true if next decrypted values are in binary format
+func (decryptor *PgDecryptor) IsBinaryFormat() bool {
+	return decryptor.isBinaryFormat
+}
+
 // SetWithZone enables or disables decrypting with ZoneID
 func (decryptor *PgDecryptor) SetWithZone(b bool) {
 	decryptor.isWithZone = b
@@ -108,7 +146,10 @@ func (decryptor *PgDecryptor) ResetZoneMatch() {
 // MatchBeginTag returns true if PgDecryptor and Binary decryptor found BeginTag
 func (decryptor *PgDecryptor) MatchBeginTag(char byte) bool {
 	/* should be called two decryptors */
-	matched := decryptor.pgDecryptor.MatchBeginTag(char)
+	matched := false
+	if !decryptor.isBinaryFormat {
+		matched = decryptor.pgDecryptor.MatchBeginTag(char)
+	}
 	matched = decryptor.binaryDecryptor.MatchBeginTag(char) || matched
 	if matched {
 		decryptor.matchBuffer[decryptor.matchIndex] = char
@@ -128,12 +169,12 @@ func (decryptor *PgDecryptor) IsMatched() bool {
 	// TODO here pg_decryptor has higher priority than binary_decryptor
 	// but can be case when begin tag is equal for binary and escape formats
 	// in this case may be error in stream mode
-	if decryptor.pgDecryptor.IsMatched() {
-		decryptor.logger.Debugln("Matched pg decryptor")
+	if !decryptor.isBinaryFormat && decryptor.pgDecryptor.IsMatched() {
+		decryptor.getLogger().Debugln("Matched pg decryptor")
 		decryptor.matchedDecryptor = decryptor.pgDecryptor
 		return true
 	} else if decryptor.binaryDecryptor.IsMatched() {
-		decryptor.logger.Debugln("Matched binary decryptor")
+		decryptor.getLogger().Debugln("Matched binary decryptor")
 		decryptor.matchedDecryptor = decryptor.binaryDecryptor
 		return true
 	} else {
@@ -186,16 +227,16 @@ func (decryptor *PgDecryptor) ReadData(symmetricKey, zoneID []byte, reader io.Re
 	// take diff count of matched between two decryptors
 	falseBufferedBeginTagLength := decryptor.matchIndex - correctMatchBeginTagLength
 	if falseBufferedBeginTagLength > 0 {
-		decryptor.logger.Debugf("Return with false matched %v bytes", falseBufferedBeginTagLength)
+		decryptor.getLogger().Debugf("Return with false matched %v bytes", falseBufferedBeginTagLength)
 		decrypted, err := decryptor.matchedDecryptor.ReadData(symmetricKey, zoneID, reader)
 		return append(decryptor.matchBuffer[:falseBufferedBeginTagLength], decrypted...), err
 	}
 	// add zone_id to log if it used
 	var tempLogger *logrus.Entry
 	if decryptor.GetMatchedZoneID() != nil {
-		tempLogger = decryptor.logger.WithField("zone_id", string(decryptor.GetMatchedZoneID()))
+		tempLogger = decryptor.getLogger().WithField("zone_id", string(decryptor.GetMatchedZoneID()))
 	} else {
-		tempLogger = decryptor.logger
+		tempLogger = decryptor.getLogger()
 	}
 
 	decrypted, err := decryptor.matchedDecryptor.ReadData(symmetricKey, zoneID, reader)
@@ -216,12 +257,21 @@ func (decryptor *PgDecryptor) GetPrivateKey() (*keys.PrivateKey, error) {
 	if decryptor.IsWithZone() {
 		return decryptor.keyStore.GetZonePrivateKey(decryptor.GetMatchedZoneID())
 	}
-	return decryptor.keyStore.GetServerDecryptionPrivateKey(decryptor.clientID)
+	return decryptor.keyStore.GetServerDecryptionPrivateKey(decryptor.getClientID())
+}
+
+// GetPrivateKeys returns current and previous versions of either ZonePrivate key (if Zone mode enabled) or
+// Server Decryption private key otherwise
+func (decryptor *PgDecryptor) GetPrivateKeys() ([]*keys.PrivateKey, error) {
+	if decryptor.IsWithZone() {
+		return decryptor.keyStore.GetZonePrivateKeys(decryptor.GetMatchedZoneID())
+	}
+	return decryptor.keyStore.GetServerDecryptionPrivateKeys(decryptor.getClientID())
 }
 
 // TurnOnPoisonRecordCheck turns on or off poison recods check
 func (decryptor *PgDecryptor) TurnOnPoisonRecordCheck(val bool) {
-	decryptor.logger.Debugf("Set poison record check: %v", val)
+	decryptor.getLogger().Debugf("Set poison record check: %v", val)
 	decryptor.checkPoisonRecords = val
 }
 
@@ -256,6 +306,13 @@ func (decryptor *PgDecryptor) SetWholeMatch(value bool) {
 
 // MatchZoneBlock returns zone data
 func (decryptor *PgDecryptor) MatchZoneBlock(block []byte) {
+	if decryptor.isBinaryFormat {
+		// binary value contains raw ZoneID which text matchers can't recognize
+		if len(block) == zone.ZoneIDBlockLength && bytes.HasPrefix(block, zone.ZoneIDBegin) && decryptor.keyStore.HasZonePrivateKey(block) {
+			decryptor.zoneMatcher.SetMatched(block)
+		}
+		return
+	}
 	if _, ok := decryptor.pgDecryptor.(*PgHexDecryptor); ok && bytes.Equal(block[:2], HexPrefix) {
 		block = block[2:]
 	}
@@ -276,7 +333,7 @@ func (decryptor *PgDecryptor) SkipBeginInBlock(block []byte) ([]byte, error) {
 	// in hex format can be \x bytes at beginning
 	// we need skip them for correct matching begin tag
 	n := 0
-	if ok && bytes.Equal(block[:2], HexPrefix) {
+	if ok && !decryptor.isBinaryFormat && bytes.Equal(block[:2], HexPrefix) {
 		block = block[2:]
 		for _, c := range block {
 			if !decryptor.pgDecryptor.MatchBeginTag(c) {
@@ -316,20 +373,20 @@ func (decryptor *PgDecryptor) DecryptBlock(block []byte) ([]byte, error) {
 	reader := bytes.NewReader(dataBlock)
 	privateKey, err := decryptor.GetPrivateKey()
 	if err != nil {
-		decryptor.logger.Warningln("Can't read private key")
+		decryptor.getLogger().Warningln("Can't read private key")
 		return []byte{}, err
 	}
-	key, _, err := decryptor.ReadSymmetricKey(privateKey, reader)
+	key, _, err := base.ReadSymmetricKeyWithPreviousKeys(decryptor, privateKey, reader)
 	if err != nil {
-		decryptor.logger.Warningf("%v", utils.ErrorMessage("Can't unwrap symmetric key", err))
+		decryptor.getLogger().Warningf("%v", utils.ErrorMessage("Can't unwrap symmetric key", err))
 		return []byte{}, err
 	}
 	data, err := decryptor.ReadData(key, decryptor.GetMatchedZoneID(), reader)
 	if err != nil {
-		decryptor.logger.Warningf("%v", utils.ErrorMessage("Can't decrypt data with unwrapped symmetric key", err))
+		decryptor.getLogger().Warningf("%v", utils.ErrorMessage("Can't decrypt data with unwrapped symmetric key", err))
 		return []byte{}, err
 	}
-	if _, ok := decryptor.pgDecryptor.(*PgHexDecryptor); ok {
+	if _, ok := decryptor.pgDecryptor.(*PgHexDecryptor); ok && !decryptor.isBinaryFormat {
 		return append(HexPrefix, data...), nil
 	}
 	return data, nil
@@ -346,22 +403,22 @@ func (decryptor *PgDecryptor) CheckPoisonRecord(reader io.Reader) (bool, error)
 	// check poison record
 	poisonKeypair, err := decryptor.keyStore.GetPoisonKeyPair()
 	if err != nil {
-		decryptor.logger.WithError(err).Errorln("Can't load poison keypair")
+		decryptor.getLogger().WithError(err).Errorln("Can't load poison keypair")
 		return true, err
 	}
 	// try decrypt using poison key pair
 	_, _, err = decryptor.matchedDecryptor.ReadSymmetricKey(poisonKeypair.Private, reader)
 	if err == nil {
-		decryptor.logger.Warningln("Recognized poison record")
+		decryptor.getLogger().Warningln("Recognized poison record")
 		if decryptor.GetPoisonCallbackStorage().HasCallbacks() {
 			err := decryptor.GetPoisonCallbackStorage().Call()
 			if err != nil {
-				decryptor.logger.WithError(err).Errorln("Unexpected error in poison record callbacks")
+				decryptor.getLogger().WithError(err).Errorln("Unexpected error in poison record callbacks")
 			}
 		}
 		return true, nil
 	}
-	decryptor.logger.Debugf("Not recognized poison record. error returned - %v", err)
+	decryptor.getLogger().Debugf("Not recognized poison record. error returned - %v", err)
 	return false, nil
 }
 
@@ -373,23 +430,23 @@ var HexSymbol = byte(hexTagSymbols[0])
 // BeginTagIndex returns tag start index and length of tag (depends on decryptor type)
 func (decryptor *PgDecryptor) BeginTagIndex(block []byte) (int, int) {
 	_, ok := decryptor.pgDecryptor.(*PgHexDecryptor)
-	if ok {
+	if ok && !decryptor.isBinaryFormat {
 		if i := bytes.Index(block, HexTagBegin); i != utils.NotFound {
-			decryptor.logger.Debugln("Matched pg decryptor")
+			decryptor.getLogger().Debugln("Matched pg decryptor")
 			decryptor.matchedDecryptor = decryptor.pgDecryptor
 			return i, decryptor.pgDecryptor.GetTagBeginLength()
 		}
-	} else {
+	} else if !decryptor.isBinaryFormat {
 		// escape format
 		if i := bytes.Index(block, base.TagBegin); i != utils.NotFound {
-			decryptor.logger.Debugln("Matched pg decryptor")
+			decryptor.getLogger().Debugln("Matched pg decryptor")
 			decryptor.matchedDecryptor = decryptor.pgDecryptor
 			return i, decryptor.pgDecryptor.GetTagBeginLength()
-			// binary format
 		}
 	}
+	// binary format
 	if i := bytes.Index(block, base.TagBegin); i != utils.NotFound {
-		decryptor.logger.Debugln("Matched binary decryptor")
+		decryptor.getLogger().Debugln("Matched binary decryptor")
 		decryptor.matchedDecryptor = decryptor.binaryDecryptor
 		return i, decryptor.binaryDecryptor.GetTagBeginLength()
 	}
@@ -459,6 +516,9 @@ func (decryptor *PgDecryptor) MatchZoneInBlock(block []byte) {
 
 // GetTagBeginLength returns begin tag length, depends on decryptor type
 func (decryptor *PgDecryptor) GetTagBeginLength() int {
+	if decryptor.isBinaryFormat {
+		return decryptor.binaryDecryptor.GetTagBeginLength()
+	}
 	return decryptor.pgDecryptor.GetTagBeginLength()
 }
 
@@ -0,0 +1,129 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// passwordHashPrefix starts md5 hashes of passwords stored by PostgreSQL
+const passwordHashPrefix = "md5"
+
+// SQLSTATE codes sent to clients which can't start session with pool
+// https://www.postgresql.org/docs/current/static/errcodes-appendix.html
+const (
+	invalidPasswordErrorCode = "28P01"
+	invalidDatabaseErrorCode = "3D000"
+)
+
+// Errors returned on authentication of pool's clients
+var (
+	ErrInvalidPoolUsers       = errors.New("invalid users of connection pool, expected '<user>: <password or md5 hash>' pairs")
+	ErrPoolAuthenticationFail = errors.New("client of connection pool failed authentication")
+)
+
+// LoadPoolUsers returns md5 hashes of passwords of clients allowed to use pool from yaml file with
+// "<user>: <password>" pairs. Passwords may be stored as "md5" + md5(password + user) hashes like in pg_authid
+func LoadPoolUsers(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePoolUsers(data)
+}
+
+// ParsePoolUsers returns md5 hashes of passwords from yaml config with "<user>: <password or md5 hash>" pairs
+func ParsePoolUsers(config []byte) (map[string]string, error) {
+	parsed := make(map[string]string)
+	if err := yaml.Unmarshal(config, &parsed); err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(parsed))
+	for user, password := range parsed {
+		if user == "" || password == "" {
+			return nil, ErrInvalidPoolUsers
+		}
+		if !isPasswordHash(password) {
+			password = md5PasswordHash(user, password)
+		}
+		users[user] = password
+	}
+	return users, nil
+}
+
+// isPasswordHash returns true if password looks like "md5" + hex encoded md5 hash
+func isPasswordHash(password string) bool {
+	if len(password) != len(passwordHashPrefix)+md5.Size*2 || !strings.HasPrefix(password, passwordHashPrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(password[len(passwordHashPrefix):])
+	return err == nil
+}
+
+// md5PasswordHash returns "md5" + md5(password + user) as PostgreSQL stores passwords
+func md5PasswordHash(user, password string) string {
+	hash := md5.Sum([]byte(password + user))
+	return passwordHashPrefix + hex.EncodeToString(hash[:])
+}
+
+// md5SaltedPassword returns "md5" + md5(hash + salt) sent by client in response to AuthenticationMD5Password where
+// hash is password hashed by md5PasswordHash without prefix
+func md5SaltedPassword(passwordHash string, salt []byte) string {
+	hash := md5.Sum(append([]byte(strings.TrimPrefix(passwordHash, passwordHashPrefix)), salt...))
+	return passwordHashPrefix + hex.EncodeToString(hash[:])
+}
+
+// poolAuthentication verifies md5 password of client who sent StartupMessage to pool
+type poolAuthentication struct {
+	user string
+	salt []byte
+}
+
+// newPoolAuthentication returns authentication of user with random salt
+func newPoolAuthentication(user string) (*poolAuthentication, error) {
+	salt := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &poolAuthentication{user: user, salt: salt}, nil
+}
+
+// request returns AuthenticationMD5Password message with salt
+func (authentication *poolAuthentication) request() []byte {
+	return marshalMessage(authenticationMessageType, append([]byte{0, 0, 0, authenticationMD5Password}, authentication.salt...))
+}
+
+// verify checks data of PasswordMessage against password hash of user. Unknown users fail like users with wrong
+// password, so clients can't find out which users exist
+func (authentication *poolAuthentication) verify(users map[string]string, data []byte) error {
+	passwordHash, ok := users[authentication.user]
+	expected := md5SaltedPassword(passwordHash, authentication.salt)
+	response := strings.TrimSuffix(string(data), "\x00")
+	if !hmac.Equal([]byte(response), []byte(expected)) || !ok {
+		return ErrPoolAuthenticationFail
+	}
+	return nil
+}
@@ -0,0 +1,614 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/acra-censor/common"
+	log "github.com/sirupsen/logrus"
+	"github.com/xwb1989/sqlparser"
+)
+
+// transactionStatusIdle is status of ReadyForQuery sent outside of transaction block
+const transactionStatusIdle byte = 'I'
+
+// pooledConnectionReadBufferSize is size of chunks read from leased connection
+const pooledConnectionReadBufferSize = 8192
+
+// poolAddress is address of database used when connection isn't leased
+type poolAddress string
+
+// Network returns name of network
+func (address poolAddress) Network() string {
+	return "tcp"
+}
+
+// String returns address in host:port format
+func (address poolAddress) String() string {
+	return string(address)
+}
+
+// GSSENCRequest is sent by client to negotiate GSSAPI encryption before StartupMessage
+var GSSENCRequest = []byte{4, 210, 22, 48}
+
+// pooledConnection is used by client's session instead of connection to database. It leases connection from pool when
+// client sends request and returns it to pool after database becomes idle. StartupMessage is answered by AcraServer
+// because connections of pool are already authenticated, so client is authenticated by pool with password or by
+// transport of AcraServer. Connection is pinned to session till the end if client changes state of session or prepares
+// named statements, and then reset query is executed before returning it to pool
+type pooledConnection struct {
+	pool *ConnectionPool
+	lock sync.Mutex
+	// cond signals about changed lease, closing and finished reading from leased connection
+	cond  *sync.Cond
+	lease net.Conn
+	// leasePool is pool of leased connection
+	leasePool *ConnectionPool
+	closed    bool
+	// started is true after StartupMessage of client
+	started bool
+	// authentication is not nil while pool waits for password of client
+	authentication *poolAuthentication
+	// failed is true if client's session was rejected on startup
+	failed bool
+	pinned bool
+	// dirty is true if session state may be changed by request, so connection is reset before it's returned to pool
+	dirty bool
+	// pendingResponses is count of sent requests which end with ReadyForQuery
+	pendingResponses  int
+	transactionStatus byte
+	// readerActive is true while Read waits for data from leased connection
+	readerActive bool
+	// writerActive is true while Write sends requests to leased connection
+	writerActive bool
+	// clientData is incomplete message of client
+	clientData []byte
+	// localData are responses generated by AcraServer
+	localData []byte
+	// dbData is incomplete message of database
+	dbData []byte
+	// readBuffer is used only by reader of leased connection
+	readBuffer []byte
+	// readyData are complete messages of database which weren't read by client's session yet
+	readyData     []byte
+	writeDeadline time.Time
+}
+
+func newPooledConnection(pool *ConnectionPool) *pooledConnection {
+	connection := &pooledConnection{
+		pool:              pool,
+		transactionStatus: transactionStatusIdle,
+		readBuffer:        make([]byte, pooledConnectionReadBufferSize),
+	}
+	connection.cond = sync.NewCond(&connection.lock)
+	return connection
+}
+
+// Read returns responses of database and blocks while connection isn't leased
+func (connection *pooledConnection) Read(p []byte) (int, error) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	for {
+		if len(connection.localData) > 0 {
+			n := copy(p, connection.localData)
+			connection.localData = connection.localData[n:]
+			return n, nil
+		}
+		if len(connection.readyData) > 0 {
+			n := copy(p, connection.readyData)
+			connection.readyData = connection.readyData[n:]
+			return n, nil
+		}
+		if connection.closed || connection.failed {
+			return 0, io.EOF
+		}
+		if connection.lease == nil {
+			connection.cond.Wait()
+			continue
+		}
+		lease := connection.lease
+		connection.readerActive = true
+		connection.lock.Unlock()
+		n, err := lease.Read(connection.readBuffer)
+		connection.lock.Lock()
+		connection.readerActive = false
+		connection.cond.Broadcast()
+		if connection.closed {
+			return 0, io.EOF
+		}
+		connection.dbData = append(connection.dbData, connection.readBuffer[:n]...)
+		connection.processDbData()
+		if err != nil {
+			if connection.lease == lease {
+				connection.leasePool.discard(lease)
+				connection.lease = nil
+			}
+			return 0, err
+		}
+	}
+}
+
+// processDbData moves complete messages of database to readyData and releases lease when database becomes idle
+func (connection *pooledConnection) processDbData() {
+	for len(connection.dbData) >= 5 {
+		length := int(binary.BigEndian.Uint32(connection.dbData[1:5])) + 1
+		if len(connection.dbData) < length {
+			return
+		}
+		message := connection.dbData[:length]
+		connection.readyData = append(connection.readyData, message...)
+		connection.dbData = connection.dbData[length:]
+		if message[0] != ReadyForQueryMessageType || length != len(ReadyForQueryPacket) {
+			continue
+		}
+		if connection.pendingResponses > 0 {
+			connection.pendingResponses--
+		}
+		connection.transactionStatus = message[5]
+		if connection.pendingResponses == 0 && connection.transactionStatus == transactionStatusIdle &&
+			!connection.pinned && len(connection.dbData) == 0 {
+			if connection.dirty {
+				// slot of pool is taken till reset query completes
+				go connection.leasePool.reset(connection.lease)
+				connection.dirty = false
+			} else {
+				connection.leasePool.release(connection.lease)
+			}
+			connection.lease = nil
+			return
+		}
+	}
+}
+
+// Write forwards requests of client to leased connection
+func (connection *pooledConnection) Write(p []byte) (int, error) {
+	connection.lock.Lock()
+	if connection.closed {
+		connection.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if connection.failed {
+		connection.lock.Unlock()
+		return 0, ErrPoolAuthenticationFail
+	}
+	connection.clientData = append(connection.clientData, p...)
+	output, readOnly, err := connection.processClientData()
+	if err != nil || len(output) == 0 {
+		connection.lock.Unlock()
+		return len(p), err
+	}
+	if connection.lease == nil {
+		if err := connection.acquire(readOnly); err != nil {
+			connection.lock.Unlock()
+			return 0, err
+		}
+	}
+	lease := connection.lease
+	connection.writerActive = true
+	lease.SetWriteDeadline(connection.writeDeadline)
+	connection.lock.Unlock()
+	_, err = lease.Write(output)
+	connection.lock.Lock()
+	connection.writerActive = false
+	connection.cond.Broadcast()
+	connection.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// acquire leases connection of replica for read-only request if replicas are configured and available, otherwise
+// connection of primary database
+func (connection *pooledConnection) acquire(readOnly bool) error {
+	if replicas := connection.pool.replicas; readOnly && replicas != nil {
+		if lease, err := replicas.acquire(); err == nil {
+			connection.lease, connection.leasePool = lease, replicas
+			connection.cond.Broadcast()
+			return nil
+		}
+	}
+	lease, err := connection.pool.acquire()
+	if err != nil {
+		return err
+	}
+	connection.lease, connection.leasePool = lease, connection.pool
+	connection.cond.Broadcast()
+	return nil
+}
+
+// processClientData handles complete messages of client and returns messages which should be sent to database. Output
+// is read-only if it's single autocommit SELECT query which may be executed by replica
+func (connection *pooledConnection) processClientData() ([]byte, bool, error) {
+	var output []byte
+	readOnly := false
+	for {
+		if connection.failed {
+			// client reads ErrorResponse before connection is closed
+			connection.cond.Broadcast()
+			return nil, false, nil
+		}
+		if !connection.started && connection.authentication == nil {
+			if len(connection.clientData) < 8 {
+				return output, false, nil
+			}
+			length := int(binary.BigEndian.Uint32(connection.clientData))
+			if len(connection.clientData) < length {
+				return output, false, nil
+			}
+			if length < 8 {
+				return nil, false, ErrInvalidStartupMessage
+			}
+			message := connection.clientData[4:length]
+			connection.clientData = connection.clientData[length:]
+			switch {
+			case bytes.HasPrefix(message, SSLRequest), bytes.HasPrefix(message, GSSENCRequest):
+				// connections of pool use own encryption, client's connection is protected by transport of AcraServer
+				connection.localData = append(connection.localData, 'N')
+			case bytes.HasPrefix(message, StartupRequest):
+				if err := connection.onStartupMessage(message); err != nil {
+					return nil, false, err
+				}
+			default:
+				// CancelRequest can't be routed to session which uses connection at this moment
+				return nil, false, ErrInvalidStartupMessage
+			}
+			connection.cond.Broadcast()
+			continue
+		}
+		if len(connection.clientData) < 5 {
+			return output, readOnly, nil
+		}
+		length := int(binary.BigEndian.Uint32(connection.clientData[1:5])) + 1
+		if len(connection.clientData) < length {
+			return output, readOnly, nil
+		}
+		message := connection.clientData[:length]
+		connection.clientData = connection.clientData[length:]
+		if !connection.started {
+			if message[0] != passwordMessageType {
+				return nil, false, ErrInvalidStartupMessage
+			}
+			if err := connection.onPasswordMessage(message[5:]); err != nil {
+				return nil, false, err
+			}
+			connection.cond.Broadcast()
+			continue
+		}
+		switch message[0] {
+		case terminateMessageType:
+			// connection of pool stays opened
+			continue
+		case QueryMessageType:
+			query := string(bytes.TrimRight(message[5:], "\x00"))
+			connection.checkSessionState(query)
+			readOnly = output == nil && connection.lease == nil && connection.pendingResponses == 0 &&
+				connection.transactionStatus == transactionStatusIdle && !connection.pinned && isReadOnlyQuery(query)
+			connection.pendingResponses++
+			output = append(output, message...)
+			continue
+		case SyncMessageType, FunctionCallMessageType:
+			connection.pendingResponses++
+		case ParseMessageType:
+			parsePacket, err := NewParsePacket(message[5:])
+			if err != nil {
+				return nil, false, err
+			}
+			// named prepared statements live till the end of session
+			if parsePacket.Name() != "" {
+				connection.pinned = true
+			}
+			connection.checkSessionState(parsePacket.QueryString())
+		}
+		readOnly = false
+		output = append(output, message...)
+	}
+}
+
+// onStartupMessage checks database requested by client and asks for password if pool authenticates clients itself,
+// otherwise accepts session of client authenticated by transport
+func (connection *pooledConnection) onStartupMessage(message []byte) error {
+	parameters, err := parseStartupParameters(message)
+	if err != nil {
+		return err
+	}
+	user := parameters[StartupUserParameter]
+	database, ok := parameters["database"]
+	if !ok || database == "" {
+		database = user
+	}
+	if database != connection.pool.database() {
+		return connection.fail(invalidDatabaseErrorCode, fmt.Sprintf("database \"%s\" isn't served by pool of connections", database))
+	}
+	if connection.pool.config.Users == nil {
+		return connection.acceptSession()
+	}
+	connection.authentication, err = newPoolAuthentication(user)
+	if err != nil {
+		return err
+	}
+	connection.localData = append(connection.localData, connection.authentication.request()...)
+	return nil
+}
+
+// onPasswordMessage verifies password of client and accepts session
+func (connection *pooledConnection) onPasswordMessage(data []byte) error {
+	user := connection.authentication.user
+	if err := connection.authentication.verify(connection.pool.config.Users, data); err != nil {
+		log.WithField("user", user).Warningln("Client of connection pool failed password authentication")
+		return connection.fail(invalidPasswordErrorCode, fmt.Sprintf("password authentication failed for user \"%s\"", user))
+	}
+	connection.authentication = nil
+	return connection.acceptSession()
+}
+
+// acceptSession answers client as database does after successful authentication
+func (connection *pooledConnection) acceptSession() error {
+	parameters, err := connection.pool.startupParameters()
+	if err != nil {
+		return err
+	}
+	connection.localData = append(connection.localData, authenticationMessageType, 0, 0, 0, 8, 0, 0, 0, authenticationOk)
+	connection.localData = append(connection.localData, parameters...)
+	connection.localData = append(connection.localData, ReadyForQueryPacket...)
+	connection.started = true
+	return nil
+}
+
+// fail sends ErrorResponse to client which can't start session. Read returns EOF after the error and Write fails
+func (connection *pooledConnection) fail(code, message string) error {
+	errorMessage, err := NewPgErrorWithCode(code, message)
+	if err != nil {
+		return err
+	}
+	connection.localData = append(connection.localData, errorMessage...)
+	connection.failed = true
+	connection.clientData = nil
+	return nil
+}
+
+// checkSessionState pins connection if query changes state of session and marks it for reset if it's unknown whether
+// query changes state of session
+func (connection *pooledConnection) checkSessionState(query string) {
+	if changesSessionState(query) {
+		connection.pinned = true
+	} else if mayChangeSessionState(query) {
+		connection.dirty = true
+	}
+}
+
+// Close returns leased connection to pool or closes it if session was interrupted inside transaction
+func (connection *pooledConnection) Close() error {
+	connection.lock.Lock()
+	if connection.closed {
+		connection.lock.Unlock()
+		return nil
+	}
+	connection.closed = true
+	connection.cond.Broadcast()
+	lease := connection.lease
+	connection.lease = nil
+	if lease == nil {
+		connection.lock.Unlock()
+		return nil
+	}
+	// request could be written partially if writing is interrupted
+	reusable := !connection.writerActive
+	if connection.readerActive || connection.writerActive {
+		// interrupt reading and writing to return connection to pool
+		lease.SetDeadline(time.Now())
+		for connection.readerActive || connection.writerActive {
+			connection.cond.Wait()
+		}
+		lease.SetDeadline(time.Time{})
+	}
+	reusable = reusable && connection.pendingResponses == 0 && connection.transactionStatus == transactionStatusIdle &&
+		len(connection.dbData) == 0
+	pinned := connection.pinned || connection.dirty
+	connection.lock.Unlock()
+	switch {
+	case !reusable:
+		connection.leasePool.discard(lease)
+	case pinned:
+		connection.leasePool.reset(lease)
+	default:
+		connection.leasePool.release(lease)
+	}
+	return nil
+}
+
+// LocalAddr returns local address of leased connection
+func (connection *pooledConnection) LocalAddr() net.Addr {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if connection.lease != nil {
+		return connection.lease.LocalAddr()
+	}
+	return poolAddress("")
+}
+
+// RemoteAddr returns address of leased connection or address of the first primary database
+func (connection *pooledConnection) RemoteAddr() net.Addr {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if connection.lease != nil {
+		return connection.lease.RemoteAddr()
+	}
+	return poolAddress(connection.pool.config.Backends.Addresses()[0])
+}
+
+// SetDeadline sets write deadline of leased connections. Reading doesn't time out because session waits for requests
+// of client while connection isn't leased
+func (connection *pooledConnection) SetDeadline(t time.Time) error {
+	return connection.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is ignored because Read waits till client sends request
+func (connection *pooledConnection) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets deadline of writing to leased connections
+func (connection *pooledConnection) SetWriteDeadline(t time.Time) error {
+	connection.lock.Lock()
+	connection.writeDeadline = t
+	connection.lock.Unlock()
+	return nil
+}
+
+// sessionStatePrefixes are statements that change state of session which outlives transaction
+var sessionStatePrefixes = []string{"SET ", "RESET ", "PREPARE ", "LISTEN ", "LOAD ", "DECLARE ", "CREATE TEMP ",
+	"CREATE TEMPORARY ", "CREATE LOCAL TEMP ", "CREATE LOCAL TEMPORARY ", "CREATE GLOBAL TEMP ", "CREATE GLOBAL TEMPORARY "}
+
+// transactionScopedPrefixes are statements which match sessionStatePrefixes but don't outlive transaction
+var transactionScopedPrefixes = []string{"SET LOCAL ", "SET TRANSACTION ", "SET CONSTRAINTS "}
+
+// sessionStateFunctions are functions that change state of session wherever they are called
+var sessionStateFunctions = []string{"SET_CONFIG(", "ADVISORY_LOCK(", "ADVISORY_LOCK_SHARED(", "DBLINK_CONNECT("}
+
+// changesSessionState returns true if query has statements which change state of session that shouldn't be visible to
+// other clients of pool. Cursors are taken into account only if declared WITH HOLD
+func changesSessionState(query string) bool {
+	for _, statement := range splitStatements(query) {
+		statement = strings.ToUpper(strings.Join(strings.Fields(statement), " ")) + " "
+		for _, function := range sessionStateFunctions {
+			if strings.Contains(strings.Replace(statement, " (", "(", -1), function) {
+				return true
+			}
+		}
+		for _, prefix := range sessionStatePrefixes {
+			if !strings.HasPrefix(statement, prefix) {
+				continue
+			}
+			transactionScoped := prefix == "DECLARE " && !strings.Contains(statement, " WITH HOLD ")
+			for _, scopedPrefix := range transactionScopedPrefixes {
+				if strings.HasPrefix(statement, scopedPrefix) {
+					transactionScoped = true
+				}
+			}
+			if !transactionScoped {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// placeholderRegexp matches placeholders of PostgreSQL prepared statements which parser doesn't support
+var placeholderRegexp = regexp.MustCompile(`\$[0-9]+`)
+
+// mayChangeSessionState returns true if query has statements that aren't recognized by parser of AcraCensor, or
+// statements that call functions which may change state of session. Such queries don't pin connection to session but
+// connection is reset before it's returned to pool
+func mayChangeSessionState(query string) bool {
+	for _, statement := range splitStatements(query) {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		parsed, err := sqlparser.Parse(placeholderRegexp.ReplaceAllString(statement, "?"))
+		if err != nil {
+			return true
+		}
+		switch parsed.(type) {
+		case *sqlparser.Select, *sqlparser.Union, *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete:
+			if callsFunctions(parsed) {
+				return true
+			}
+		case *sqlparser.Begin, *sqlparser.Commit, *sqlparser.Rollback, *sqlparser.DDL:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// callsFunctions returns true if statement calls functions other than aggregate functions
+func callsFunctions(statement sqlparser.SQLNode) bool {
+	found := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if function, ok := node.(*sqlparser.FuncExpr); ok && !function.IsAggregate() {
+			found = true
+			return false, nil
+		}
+		return !found, nil
+	}, statement)
+	return found
+}
+
+// splitStatements splits query by semicolons outside of quotes and removes comments
+func splitStatements(query string) []string {
+	var statements []string
+	var current strings.Builder
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			// content of literals and identifiers doesn't matter
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			current.WriteByte(c)
+			current.WriteByte(c)
+			i += end + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			current.WriteByte(' ')
+			i += end
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 2
+			}
+			current.WriteByte(' ')
+			i += end + 3
+		case c == ';':
+			statements = append(statements, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return append(statements, current.String())
+}
+
+// isReadOnlyQuery returns true if query is single SELECT statement without locking clause recognized by parser of
+// AcraCensor. Statements which call functions aren't read-only because functions like nextval may change data
+func isReadOnlyQuery(query string) bool {
+	_, _, statement, err := common.HandleRawSQLQuery(query)
+	if err != nil {
+		return false
+	}
+	switch statement := statement.(type) {
+	case *sqlparser.Select:
+		return statement.Lock == "" && !callsFunctions(statement)
+	case *sqlparser.Union:
+		return statement.Lock == "" && !callsFunctions(statement)
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"sync"
+
+	"github.com/cossacklabs/acra/decryptor/base"
+)
+
+// pendingResult is response which client expects from database on Execute or end of requests' batch
+type pendingResult struct {
+	// format codes of result columns of executed portal, nil if all columns use text format
+	formats []uint16
+	// isSync is true for Sync, Query and FunctionCall which responses end with ReadyForQuery
+	isSync bool
+}
+
+// resultFormatTracker matches results sent by database with portals executed by client to find out formats of result
+// columns. Formats are requested in Bind and RowDescription sent in response to Describe of prepared statement doesn't
+// contain them. Database responds in the same order as requests were sent, so goroutine that proxies client's requests
+// queues expected results and goroutine that processes database's responses takes them when results are finished
+type resultFormatTracker struct {
+	lock sync.Mutex
+	// format codes of result columns of bound portals
+	portals map[string][]uint16
+	pending []pendingResult
+}
+
+func newResultFormatTracker() *resultFormatTracker {
+	return &resultFormatTracker{portals: make(map[string][]uint16)}
+}
+
+// onBind remembers format codes of result columns of bound portal
+func (tracker *resultFormatTracker) onBind(portal string, formats []uint16) {
+	tracker.lock.Lock()
+	tracker.portals[portal] = formats
+	tracker.lock.Unlock()
+}
+
+// onClosePortal forgets closed portal
+func (tracker *resultFormatTracker) onClosePortal(portal string) {
+	tracker.lock.Lock()
+	delete(tracker.portals, portal)
+	tracker.lock.Unlock()
+}
+
+// onExecute queues result of executed portal
+func (tracker *resultFormatTracker) onExecute(portal string) {
+	tracker.lock.Lock()
+	tracker.pending = append(tracker.pending, pendingResult{formats: tracker.portals[portal]})
+	tracker.lock.Unlock()
+}
+
+// onSync queues end of requests' batch which database finishes with ReadyForQuery
+func (tracker *resultFormatTracker) onSync() {
+	tracker.lock.Lock()
+	tracker.pending = append(tracker.pending, pendingResult{isSync: true})
+	tracker.lock.Unlock()
+}
+
+// currentFormats returns format codes of result columns of currently executed portal and false if current result isn't
+// result of Execute (for example, result of simple query)
+func (tracker *resultFormatTracker) currentFormats() ([]uint16, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if len(tracker.pending) == 0 || tracker.pending[0].isSync {
+		return nil, false
+	}
+	return tracker.pending[0].formats, true
+}
+
+// onResultEnd takes result of Execute finished with CommandComplete, EmptyQueryResponse, PortalSuspended or
+// ErrorResponse
+func (tracker *resultFormatTracker) onResultEnd() {
+	tracker.lock.Lock()
+	if len(tracker.pending) > 0 && !tracker.pending[0].isSync {
+		tracker.pending = tracker.pending[1:]
+	}
+	tracker.lock.Unlock()
+}
+
+// onReadyForQuery takes all results till end of requests' batch including results of Execute which database skipped
+// after error
+func (tracker *resultFormatTracker) onReadyForQuery() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for i, result := range tracker.pending {
+		if result.isSync {
+			tracker.pending = tracker.pending[i+1:]
+			return
+		}
+	}
+}
+
+// trackResultFormats passes client's messages that create, execute and close portals to tracker
+func (proxy *PgProxy) trackResultFormats(packet *PacketHandler) error {
+	switch {
+	case packet.IsBind():
+		bindPacket, err := NewBindPacket(packet.GetPacketData())
+		if err != nil {
+			return err
+		}
+		proxy.resultFormats.onBind(bindPacket.PortalName(), bindPacket.ResultFormats())
+	case packet.IsExecute():
+		executePacket, err := NewExecutePacket(packet.GetPacketData())
+		if err != nil {
+			return err
+		}
+		proxy.resultFormats.onExecute(executePacket.PortalName())
+	case packet.IsClose():
+		closePacket, err := NewClosePacket(packet.GetPacketData())
+		if err != nil {
+			return err
+		}
+		if closePacket.IsPortal() {
+			proxy.resultFormats.onClosePortal(closePacket.Name())
+		}
+	case packet.IsSync(), packet.IsFunctionCall():
+		proxy.resultFormats.onSync()
+	}
+	return nil
+}
+
+// binaryFormatDecryptor is implemented by decryptors which can decrypt values of columns in binary format
+type binaryFormatDecryptor interface {
+	SetBinaryFormat(bool)
+}
+
+// setDecryptorFormat switches decryptor to decryption of values in format if decryptor supports binary format
+func setDecryptorFormat(decryptor base.Decryptor, format uint16) {
+	if formatDecryptor, ok := decryptor.(binaryFormatDecryptor); ok {
+		formatDecryptor.SetBinaryFormat(format == BinaryFormat)
+	}
+}
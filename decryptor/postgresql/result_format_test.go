@@ -0,0 +1,67 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResultFormatTracker(t *testing.T) {
+	tracker := newResultFormatTracker()
+	checkFormats := func(expected []uint16, expectedOk bool) {
+		t.Helper()
+		formats, ok := tracker.currentFormats()
+		if ok != expectedOk || !reflect.DeepEqual(formats, expected) {
+			t.Fatalf("Expected %v (%v), took %v (%v)", expected, expectedOk, formats, ok)
+		}
+	}
+	binaryFormats := []uint16{BinaryFormat}
+	mixedFormats := []uint16{TextFormat, BinaryFormat}
+
+	// Bind(a), Bind(b), Execute(a), Execute(b), Execute(b), Sync, simple Query
+	tracker.onBind("a", binaryFormats)
+	tracker.onBind("b", mixedFormats)
+	tracker.onExecute("a")
+	tracker.onExecute("b")
+	tracker.onExecute("b")
+	tracker.onSync()
+	tracker.onSync()
+
+	checkFormats(binaryFormats, true)
+	// CommandComplete of "a"
+	tracker.onResultEnd()
+	checkFormats(mixedFormats, true)
+	// ErrorResponse of first Execute of "b", second Execute is skipped by database
+	tracker.onResultEnd()
+	checkFormats(mixedFormats, true)
+	tracker.onReadyForQuery()
+	// result of simple query
+	checkFormats(nil, false)
+	tracker.onResultEnd()
+	checkFormats(nil, false)
+	tracker.onReadyForQuery()
+	checkFormats(nil, false)
+
+	// unknown portal uses text format
+	tracker.onClosePortal("a")
+	tracker.onExecute("a")
+	checkFormats(nil, true)
+	if formatCode(nil, 3) != TextFormat || formatCode(mixedFormats, 1) != BinaryFormat || formatCode(binaryFormats, 1) != BinaryFormat {
+		t.Fatal("Incorrect format codes of columns")
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/masking"
+)
+
+// ErrInvalidRowDescriptionPacket returned when RowDescription packet has incorrect structure
+var ErrInvalidRowDescriptionPacket = errors.New("invalid RowDescription packet")
+
+// rowDescriptionFieldSize size of field's description after its name: table OID (4) + attribute number (2) +
+// type OID (4) + type size (2) + type modifier (4) + format code (2)
+const rowDescriptionFieldSize = 18
+
+// RowDescriptionField describes one column of result set
+// https://www.postgresql.org/docs/current/static/protocol-message-formats.html
+type RowDescriptionField struct {
+	Name string
+	// TableOID is 0 if column isn't a column of table
+	TableOID uint32
+	// AttributeNumber is position of column in table starting from 1 or 0 if column isn't a column of table
+	AttributeNumber int16
+	TypeOID         uint32
+	Format          uint16
+}
+
+// ParseRowDescription returns descriptions of columns from payload of RowDescription packet (without message type and
+// length of packet)
+func ParseRowDescription(data []byte) ([]*RowDescriptionField, error) {
+	if len(data) < 2 {
+		return nil, ErrInvalidRowDescriptionPacket
+	}
+	fieldCount := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	fields := make([]*RowDescriptionField, fieldCount)
+	for i := 0; i < fieldCount; i++ {
+		name, rest, err := readCString(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < rowDescriptionFieldSize {
+			return nil, ErrInvalidRowDescriptionPacket
+		}
+		fields[i] = &RowDescriptionField{
+			Name:            string(name),
+			TableOID:        binary.BigEndian.Uint32(rest),
+			AttributeNumber: int16(binary.BigEndian.Uint16(rest[4:])),
+			TypeOID:         binary.BigEndian.Uint32(rest[6:]),
+			Format:          binary.BigEndian.Uint16(rest[16:]),
+		}
+		data = rest[rowDescriptionFieldSize:]
+	}
+	return fields, nil
+}
+
+// encryptedColumnResolver finds out which result columns contain AcraStructs using configured tables' schemas.
+// RowDescription doesn't contain table name, only its OID and attribute number of column, so columns are matched
+// exactly only with tables which OIDs are configured. Tables with the same name may be in several schemas and
+// attribute numbers of dropped columns aren't reused, so they can't be guessed by name and position. Columns which
+// can't be matched exactly (computed values, columns of tables with unknown OIDs) are unknown and checked on
+// AcraStructs like without schemas.
+type encryptedColumnResolver struct {
+	schemaStore encryptor.TableSchemaStore
+	tableOIDs   map[uint32]*encryptor.TableSchema
+}
+
+func newEncryptedColumnResolver(schemaStore encryptor.TableSchemaStore) *encryptedColumnResolver {
+	tableOIDs := make(map[uint32]*encryptor.TableSchema)
+	for _, schema := range schemaStore.GetTableSchemas() {
+		if schema.TableOID != 0 {
+			tableOIDs[schema.TableOID] = schema
+		}
+	}
+	return &encryptedColumnResolver{schemaStore: schemaStore, tableOIDs: tableOIDs}
+}
+
+// columnAtPosition returns name of table's column by attribute number or empty string
+func columnAtPosition(schema *encryptor.TableSchema, attributeNumber int16) string {
+	if attributeNumber < 1 || int(attributeNumber) > len(schema.Columns) {
+		return ""
+	}
+	return schema.Columns[attributeNumber-1]
+}
+
+// resolveField returns settings of configured columns which field may be and true if field matched column of
+// configured table exactly. In this case there is at most one setting. Otherwise field is unknown and settings of all
+// configured columns at the same position or with the same name in tables without configured OIDs are returned
+func (resolver *encryptedColumnResolver) resolveField(field *RowDescriptionField) ([]*encryptor.ColumnEncryptionSetting, bool) {
+	if field.TableOID == 0 || field.AttributeNumber < 1 {
+		// computed values can't be matched with table's columns
+		return nil, false
+	}
+	if schema, ok := resolver.tableOIDs[field.TableOID]; ok {
+		column := columnAtPosition(schema, field.AttributeNumber)
+		if column == "" {
+			// column which isn't listed in configuration of table is checked on AcraStructs
+			return nil, false
+		}
+		if setting := schema.GetColumnEncryptionSettings(column); setting != nil {
+			return []*encryptor.ColumnEncryptionSetting{setting}, true
+		}
+		return nil, true
+	}
+	var settings []*encryptor.ColumnEncryptionSetting
+	for _, schema := range resolver.schemaStore.GetTableSchemas() {
+		if schema.TableOID != 0 {
+			continue
+		}
+		if setting := schema.GetColumnEncryptionSettings(columnAtPosition(schema, field.AttributeNumber)); setting != nil {
+			settings = append(settings, setting)
+		} else if setting := schema.GetColumnEncryptionSettings(field.Name); setting != nil {
+			settings = append(settings, setting)
+		}
+	}
+	return settings, false
+}
+
+// isEncryptedField returns true if field is column of configured table that stores AcraStructs or unknown column
+// which values should be checked on AcraStructs
+func (resolver *encryptedColumnResolver) isEncryptedField(field *RowDescriptionField) bool {
+	settings, exact := resolver.resolveField(field)
+	if !exact {
+		return true
+	}
+	return len(settings) == 1 && !settings[0].IsTokenized()
+}
+
+// columnsToDecrypt returns flags for each field which are true if column should be decrypted
+func (resolver *encryptedColumnResolver) columnsToDecrypt(fields []*RowDescriptionField) []bool {
+	result := make([]bool, len(fields))
+	for i, field := range fields {
+		result[i] = resolver.isEncryptedField(field)
+	}
+	return result
+}
+
+// maskingPolicies returns masking policies of client for each field or nil if no field should be masked. If field
+// is unknown and may be one of several encrypted columns then first found policy is used to not show values that
+// should be masked
+func (resolver *encryptedColumnResolver) maskingPolicies(fields []*RowDescriptionField, clientID []byte) []*masking.Policy {
+	var policies []*masking.Policy
+	for i, field := range fields {
+		settings, _ := resolver.resolveField(field)
+		for _, setting := range settings {
+			if policy := setting.GetMaskingPolicy(clientID); policy != nil {
+				if policies == nil {
+					policies = make([]*masking.Policy, len(fields))
+				}
+				policies[i] = policy
+				break
+			}
+		}
+	}
+	return policies
+}
+
+// fieldsToDetokenize returns settings of tokenized columns which tokens client may see as original values or nil
+// if there are no such columns. Unknown fields are left as is because their token types are unknown
+func (resolver *encryptedColumnResolver) fieldsToDetokenize(fields []*RowDescriptionField, clientID []byte) []*encryptor.ColumnEncryptionSetting {
+	var result []*encryptor.ColumnEncryptionSetting
+	for i, field := range fields {
+		settings, exact := resolver.resolveField(field)
+		if !exact || len(settings) != 1 || !settings[0].IsTokenized() || !settings[0].CanDetokenize(clientID) {
+			continue
+		}
+		if result == nil {
+			result = make([]*encryptor.ColumnEncryptionSetting, len(fields))
+		}
+		result[i] = settings[0]
+	}
+	return result
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/cossacklabs/acra/encryptor"
+)
+
+func rowDescriptionField(name string, tableOID uint32, attributeNumber int16) []byte {
+	buf := make([]byte, rowDescriptionFieldSize)
+	binary.BigEndian.PutUint32(buf, tableOID)
+	binary.BigEndian.PutUint16(buf[4:], uint16(attributeNumber))
+	// bytea type
+	binary.BigEndian.PutUint32(buf[6:], 17)
+	return append(append([]byte(name), 0), buf...)
+}
+
+func TestParseRowDescription(t *testing.T) {
+	data := bytes.Join([][]byte{{0, 2}, rowDescriptionField("id", 100, 1), rowDescriptionField("data", 0, 0)}, nil)
+	fields, err := ParseRowDescription(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 2 || fields[0].Name != "id" || fields[0].TableOID != 100 || fields[0].AttributeNumber != 1 ||
+		fields[1].Name != "data" || fields[1].TableOID != 0 || fields[1].TypeOID != 17 {
+		t.Fatal("Incorrect parsed fields")
+	}
+	if _, err := ParseRowDescription(data[:len(data)-1]); err != ErrInvalidRowDescriptionPacket {
+		t.Fatalf("Expected ErrInvalidRowDescriptionPacket, took %v", err)
+	}
+}
+
+func TestEncryptedColumnResolver(t *testing.T) {
+	// column between id and email of users was dropped
+	config := `
+schemas:
+  - table: users
+    table_oid: 1
+    columns: ["id", "", "email", "data"]
+    encrypted:
+      - column: email
+  - table: orders
+    columns: ["id", "comment"]
+    encrypted:
+      - column: comment
+`
+	schemaStore, err := encryptor.MapTableSchemaStoreFromConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := newEncryptedColumnResolver(schemaStore)
+	testcases := []struct {
+		field    *RowDescriptionField
+		expected bool
+	}{
+		// computed value is unknown and checked on AcraStructs
+		{&RowDescriptionField{Name: "email", TableOID: 0, AttributeNumber: 0}, true},
+		// columns of users are matched by attribute numbers after dropped column
+		{&RowDescriptionField{Name: "email", TableOID: 1, AttributeNumber: 3}, true},
+		{&RowDescriptionField{Name: "data", TableOID: 1, AttributeNumber: 4}, false},
+		// aliases of table with known OID
+		{&RowDescriptionField{Name: "e", TableOID: 1, AttributeNumber: 3}, true},
+		{&RowDescriptionField{Name: "email", TableOID: 1, AttributeNumber: 1}, false},
+		// column added after configuration was written
+		{&RowDescriptionField{Name: "total", TableOID: 1, AttributeNumber: 5}, true},
+		// table users from other schema and tables without configured OIDs are unknown
+		{&RowDescriptionField{Name: "data", TableOID: 3, AttributeNumber: 4}, true},
+		{&RowDescriptionField{Name: "id", TableOID: 2, AttributeNumber: 1}, true},
+	}
+	for i, testcase := range testcases {
+		if result := resolver.isEncryptedField(testcase.field); result != testcase.expected {
+			t.Fatalf("%v. Expected %v, took %v", i, testcase.expected, result)
+		}
+	}
+	if settings, exact := resolver.resolveField(&RowDescriptionField{Name: "c", TableOID: 2, AttributeNumber: 2}); exact || len(settings) != 1 || settings[0].Name != "comment" {
+		t.Fatalf("Expected unknown field with settings of comment, took %v, %v", settings, exact)
+	}
+}
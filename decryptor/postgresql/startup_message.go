@@ -0,0 +1,68 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Parameters of StartupMessage used to find out client ID of connection
+const (
+	StartupUserParameter            = "user"
+	StartupApplicationNameParameter = "application_name"
+)
+
+// ErrInvalidStartupMessage if StartupMessage has incorrect format
+var ErrInvalidStartupMessage = errors.New("invalid StartupMessage packet")
+
+// IsStartupMessage returns true if packet is StartupMessage sent by client to start session
+func (packet *PacketHandler) IsStartupMessage() bool {
+	return packet.messageType[0] == WithoutMessageType && bytes.HasPrefix(packet.descriptionBuf.Bytes(), StartupRequest)
+}
+
+// parseStartupParameters returns parameters of StartupMessage which data starts with protocol version followed by
+// pairs of null-terminated names and values and ends with null byte
+// https://www.postgresql.org/docs/current/static/protocol-message-formats.html
+func parseStartupParameters(data []byte) (map[string]string, error) {
+	if !bytes.HasPrefix(data, StartupRequest) {
+		return nil, ErrInvalidStartupMessage
+	}
+	data = data[len(StartupRequest):]
+	parameters := make(map[string]string)
+	for len(data) > 0 && data[0] != 0 {
+		fields := bytes.SplitN(data, []byte{0}, 3)
+		if len(fields) != 3 {
+			return nil, ErrInvalidStartupMessage
+		}
+		parameters[string(fields[0])] = string(fields[1])
+		data = fields[2]
+	}
+	if len(data) != 1 {
+		return nil, ErrInvalidStartupMessage
+	}
+	return parameters, nil
+}
+
+// onStartupMessage passes user and application name of client to login callback
+func (proxy *PgProxy) onStartupMessage(packet *PacketHandler) error {
+	parameters, err := parseStartupParameters(packet.GetPacketData())
+	if err != nil {
+		return err
+	}
+	return proxy.onLogin(parameters[StartupUserParameter], parameters[StartupApplicationNameParameter])
+}
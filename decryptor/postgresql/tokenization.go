@@ -0,0 +1,92 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgresql
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/cossacklabs/acra/encryptor"
+	"github.com/cossacklabs/acra/tokenization"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidBinaryInteger returned when integer value in binary format has size different from size of token type
+var ErrInvalidBinaryInteger = errors.New("integer value in binary format has incorrect size")
+
+// binaryIntegerSize returns size of integer token in binary format or 0 if token isn't integer
+func binaryIntegerSize(tokenType string) int {
+	switch tokenType {
+	case tokenization.TypeInt32:
+		return 4
+	case tokenization.TypeInt64:
+		return 8
+	}
+	return 0
+}
+
+// processTokenValue passes value in text format to process function and returns result in the same format as value.
+// Integers in binary format are converted to decimal text and back, other values are passed as is
+func processTokenValue(value []byte, format uint16, tokenType string, process func([]byte) ([]byte, error)) ([]byte, error) {
+	size := binaryIntegerSize(tokenType)
+	if format != BinaryFormat || size == 0 {
+		return process(value)
+	}
+	if len(value) != size {
+		return nil, ErrInvalidBinaryInteger
+	}
+	var number int64
+	if size == 4 {
+		number = int64(int32(binary.BigEndian.Uint32(value)))
+	} else {
+		number = int64(binary.BigEndian.Uint64(value))
+	}
+	result, err := process([]byte(strconv.FormatInt(number, 10)))
+	if err != nil {
+		return nil, err
+	}
+	number, err = strconv.ParseInt(string(result), 10, size*8)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]byte, size)
+	if size == 4 {
+		binary.BigEndian.PutUint32(output, uint32(number))
+	} else {
+		binary.BigEndian.PutUint64(output, uint64(number))
+	}
+	return output, nil
+}
+
+// detokenizeColumns replaces tokens in columns with original values. Tokens that can't be detokenized are left as is.
+// formats are format codes of columns, nil if all columns use text format
+func (proxy *PgProxy) detokenizeColumns(columns []*ColumnData, settings []*encryptor.ColumnEncryptionSetting, formats []uint16, logger *log.Entry) {
+	for i, setting := range settings {
+		if setting == nil || i >= len(columns) || columns[i].IsNull() {
+			continue
+		}
+		value, err := processTokenValue(columns[i].Data, formatCode(formats, i), setting.TokenType, func(token []byte) ([]byte, error) {
+			return proxy.tokenizer.Detokenize(token, setting.TokenType, setting.TokenKeyID(proxy.getClientID()))
+		})
+		if err != nil {
+			logger.WithError(err).WithField("column_index", i).Warningln("Can't detokenize column's value")
+			continue
+		}
+		columns[i].SetData(value)
+	}
+}
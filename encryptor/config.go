@@ -0,0 +1,210 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cossacklabs/acra/masking"
+	"github.com/cossacklabs/acra/tokenization"
+	"gopkg.in/yaml.v2"
+)
+
+// Errors returned on loading encryptor configuration.
+var (
+	ErrEmptyTableName           = errors.New("table name is empty")
+	ErrEmptyColumnName          = errors.New("column name is empty")
+	ErrDuplicatedTableSchema    = errors.New("table schema defined several times")
+	ErrBothClientIDAndZoneIDSet = errors.New("client_id and zone_id can't be set for one column at the same time")
+	ErrHashColumnIsEncrypted    = errors.New("hash_column can't be encrypted column")
+	ErrHashColumnOfTokenized    = errors.New("hash_column can't be set for tokenized column")
+	ErrDuplicatedTableOID       = errors.New("table_oid set for several tables")
+)
+
+// ColumnEncryptionSetting describes how to encrypt values of one column. If ClientID and ZoneID are empty then
+// values will be encrypted with ClientID of current connection. If HashColumn is set then HMAC of plaintext value
+// will be stored in it as blind index and used to search by encrypted column. Masking policies are applied to
+// decrypted values returned to clients. If TokenType is set then values are replaced with tokens of this type instead
+// of AcraStructs and tokens are replaced back with values only for clients from DetokenizeClientIDs.
+type ColumnEncryptionSetting struct {
+	Name                string            `yaml:"column"`
+	ClientID            string            `yaml:"client_id"`
+	ZoneID              string            `yaml:"zone_id"`
+	HashColumn          string            `yaml:"hash_column"`
+	Masking             []*masking.Policy `yaml:"masking"`
+	TokenType           string            `yaml:"token_type"`
+	DetokenizeClientIDs []string          `yaml:"detokenize_client_ids"`
+}
+
+// IsTokenized returns true if values of column are replaced with tokens instead of AcraStructs.
+func (setting *ColumnEncryptionSetting) IsTokenized() bool {
+	return setting.TokenType != ""
+}
+
+// CanDetokenize returns true if client should receive original values of tokenized column.
+func (setting *ColumnEncryptionSetting) CanDetokenize(clientID []byte) bool {
+	for _, id := range setting.DetokenizeClientIDs {
+		if id == string(clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenKeyID returns id of key used to tokenize values of column: zone or client id specified in setting or clientID
+// of connection.
+func (setting *ColumnEncryptionSetting) TokenKeyID(clientID []byte) []byte {
+	if setting.ZoneID != "" {
+		return []byte(setting.ZoneID)
+	}
+	if setting.ClientID != "" {
+		return []byte(setting.ClientID)
+	}
+	return clientID
+}
+
+// GetMaskingPolicy returns masking policy for client or nil if client should see decrypted values as is.
+func (setting *ColumnEncryptionSetting) GetMaskingPolicy(clientID []byte) *masking.Policy {
+	return masking.FindPolicy(setting.Masking, clientID)
+}
+
+// TableSchema describes columns of table and settings of columns that should be encrypted.
+// Columns used to map values of INSERT queries without explicitly specified columns. TableOID is OID of PostgreSQL
+// table used to match result columns with Columns by their attribute numbers, empty names in Columns are positions
+// of dropped columns.
+type TableSchema struct {
+	TableName                string                     `yaml:"table"`
+	TableOID                 uint32                     `yaml:"table_oid"`
+	Columns                  []string                   `yaml:"columns"`
+	EncryptionColumnSettings []*ColumnEncryptionSetting `yaml:"encrypted"`
+}
+
+// InsertColumns returns columns which values INSERT without explicitly specified columns sets.
+func (schema *TableSchema) InsertColumns() []string {
+	columns := make([]string, 0, len(schema.Columns))
+	for _, column := range schema.Columns {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// GetColumnEncryptionSettings returns setting for column or nil if column shouldn't be encrypted.
+func (schema *TableSchema) GetColumnEncryptionSettings(columnName string) *ColumnEncryptionSetting {
+	for _, setting := range schema.EncryptionColumnSettings {
+		if strings.EqualFold(setting.Name, columnName) {
+			return setting
+		}
+	}
+	return nil
+}
+
+// IsEncryptedColumn returns true if column is configured to be encrypted with AcraStructs.
+func (schema *TableSchema) IsEncryptedColumn(columnName string) bool {
+	setting := schema.GetColumnEncryptionSettings(columnName)
+	return setting != nil && !setting.IsTokenized()
+}
+
+// TableSchemaStore fetches schema for encryptable tables.
+type TableSchemaStore interface {
+	GetTableSchema(tableName string) *TableSchema
+	GetTableSchemas() []*TableSchema
+}
+
+// IsEncryptedColumn returns true if column of table is configured to be encrypted and stores AcraStructs.
+func IsEncryptedColumn(store TableSchemaStore, tableName, columnName string) bool {
+	schema := store.GetTableSchema(tableName)
+	return schema != nil && schema.IsEncryptedColumn(columnName)
+}
+
+type storeConfig struct {
+	Schemas []*TableSchema `yaml:"schemas"`
+}
+
+// MapTableSchemaStore stores schemas of tables in map by lower-cased table name.
+type MapTableSchemaStore struct {
+	schemas map[string]*TableSchema
+}
+
+// NewMapTableSchemaStore returns new empty MapTableSchemaStore.
+func NewMapTableSchemaStore() *MapTableSchemaStore {
+	return &MapTableSchemaStore{schemas: make(map[string]*TableSchema)}
+}
+
+// MapTableSchemaStoreFromConfig parses YAML configuration and returns MapTableSchemaStore.
+func MapTableSchemaStoreFromConfig(config []byte) (*MapTableSchemaStore, error) {
+	storeConfig := &storeConfig{}
+	if err := yaml.Unmarshal(config, storeConfig); err != nil {
+		return nil, err
+	}
+	store := NewMapTableSchemaStore()
+	tableOIDs := make(map[uint32]bool)
+	for _, schema := range storeConfig.Schemas {
+		if schema.TableName == "" {
+			return nil, ErrEmptyTableName
+		}
+		for _, setting := range schema.EncryptionColumnSettings {
+			if setting.Name == "" {
+				return nil, ErrEmptyColumnName
+			}
+			if setting.ClientID != "" && setting.ZoneID != "" {
+				return nil, ErrBothClientIDAndZoneIDSet
+			}
+			if setting.HashColumn != "" && schema.GetColumnEncryptionSettings(setting.HashColumn) != nil {
+				return nil, ErrHashColumnIsEncrypted
+			}
+			if setting.IsTokenized() {
+				if err := tokenization.ValidateTokenType(setting.TokenType); err != nil {
+					return nil, err
+				}
+				if setting.HashColumn != "" {
+					return nil, ErrHashColumnOfTokenized
+				}
+			}
+			if err := masking.ValidatePolicies(setting.Masking); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := store.schemas[strings.ToLower(schema.TableName)]; ok {
+			return nil, ErrDuplicatedTableSchema
+		}
+		if schema.TableOID != 0 {
+			if tableOIDs[schema.TableOID] {
+				return nil, ErrDuplicatedTableOID
+			}
+			tableOIDs[schema.TableOID] = true
+		}
+		store.schemas[strings.ToLower(schema.TableName)] = schema
+	}
+	return store, nil
+}
+
+// GetTableSchema returns schema of table or nil if table isn't configured.
+func (store *MapTableSchemaStore) GetTableSchema(tableName string) *TableSchema {
+	return store.schemas[strings.ToLower(tableName)]
+}
+
+// GetTableSchemas returns schemas of all configured tables.
+func (store *MapTableSchemaStore) GetTableSchemas() []*TableSchema {
+	schemas := make([]*TableSchema, 0, len(store.schemas))
+	for _, schema := range store.schemas {
+		schemas = append(schemas, schema)
+	}
+	return schemas
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryptor contains logic of transparent encryption of data that sent from clients to database. AcraServer
+// finds values of configured tables' columns in queries and replaces them with AcraStructs created with client's or
+// zone's public key.
+package encryptor
+
+import (
+	"github.com/cossacklabs/acra/acra-writer"
+	"github.com/cossacklabs/acra/decryptor/base"
+	"github.com/cossacklabs/acra/keystore"
+)
+
+// DataEncryptor encrypts data with ClientID or ZoneID.
+type DataEncryptor interface {
+	EncryptWithZoneID(zoneID, data []byte) ([]byte, error)
+	EncryptWithClientID(clientID, data []byte) ([]byte, error)
+}
+
+// AcrawriterDataEncryptor creates AcraStructs with public keys from keystore.
+type AcrawriterDataEncryptor struct {
+	keystore keystore.PublicKeyStore
+}
+
+// NewAcrawriterDataEncryptor returns new AcrawriterDataEncryptor that uses keystore to fetch public keys.
+func NewAcrawriterDataEncryptor(keystore keystore.PublicKeyStore) (*AcrawriterDataEncryptor, error) {
+	return &AcrawriterDataEncryptor{keystore: keystore}, nil
+}
+
+// EncryptWithZoneID returns data encrypted with zone's public key or data as is if it's already AcraStruct.
+func (encryptor *AcrawriterDataEncryptor) EncryptWithZoneID(zoneID, data []byte) ([]byte, error) {
+	if err := base.ValidateAcraStruct(data); err == nil {
+		return data, nil
+	}
+	publicKey, err := encryptor.keystore.GetZonePublicKey(zoneID)
+	if err != nil {
+		return nil, err
+	}
+	return acrawriter.CreateAcrastruct(data, publicKey, zoneID)
+}
+
+// EncryptWithClientID returns data encrypted with client's public key or data as is if it's already AcraStruct.
+func (encryptor *AcrawriterDataEncryptor) EncryptWithClientID(clientID, data []byte) ([]byte, error) {
+	if err := base.ValidateAcraStruct(data); err == nil {
+		return data, nil
+	}
+	publicKey, err := encryptor.keystore.GetClientIDEncryptionPublicKey(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return acrawriter.CreateAcrastruct(data, publicKey, nil)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+// HMACCalculator calculates HMAC of data that stored as blind index of encrypted value and used to search by it.
+type HMACCalculator interface {
+	HMACWithZoneID(zoneID, data []byte) ([]byte, error)
+	HMACWithClientID(clientID, data []byte) ([]byte, error)
+}
+
+// KeystoreHMACCalculator calculates HMAC-SHA256 with keys from keystore.
+type KeystoreHMACCalculator struct {
+	keystore keystore.HmacKeyStore
+}
+
+// NewKeystoreHMACCalculator returns new KeystoreHMACCalculator that uses keystore to fetch HMAC keys.
+func NewKeystoreHMACCalculator(keystore keystore.HmacKeyStore) *KeystoreHMACCalculator {
+	return &KeystoreHMACCalculator{keystore: keystore}
+}
+
+func (calculator *KeystoreHMACCalculator) calculate(id, data []byte) ([]byte, error) {
+	key, err := calculator.keystore.GetHMACSecretKey(id)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// HMACWithZoneID returns HMAC of data with zone's HMAC key.
+func (calculator *KeystoreHMACCalculator) HMACWithZoneID(zoneID, data []byte) ([]byte, error) {
+	return calculator.calculate(zoneID, data)
+}
+
+// HMACWithClientID returns HMAC of data with client's HMAC key.
+func (calculator *KeystoreHMACCalculator) HMACWithClientID(clientID, data []byte) ([]byte, error) {
+	return calculator.calculate(clientID, data)
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"github.com/cossacklabs/acra/tokenization"
+	"github.com/xwb1989/sqlparser"
+)
+
+// NewMysqlQueryEncryptor returns QueryDataEncryptor that understands MySQL's ? placeholders and places AcraStructs
+// into queries as hex literals.
+func NewMysqlQueryEncryptor(schemaStore TableSchemaStore, clientID []byte, dataEncryptor DataEncryptor, hmacCalculator HMACCalculator, tokenizer tokenization.Tokenizer) *QueryDataEncryptor {
+	return newQueryDataEncryptor(schemaStore, clientID, dataEncryptor, hmacCalculator, tokenizer, mysqlNodeFormatter)
+}
+
+// mysqlNodeFormatter serializes placeholders back to ? because sqlparser replaces them with :vN bind variables
+func mysqlNodeFormatter(values encryptedValues) sqlparser.NodeFormatter {
+	return func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		if value, ok := node.(*sqlparser.SQLVal); ok && value.Type == sqlparser.ValArg {
+			if _, ok := placeholderIndex(value); ok {
+				buf.WriteString("?")
+				return
+			}
+		}
+		node.Format(buf)
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cossacklabs/acra/tokenization"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/xwb1989/sqlparser"
+)
+
+// NewPostgresqlQueryEncryptor returns QueryDataEncryptor that understands PostgreSQL's $N placeholders and places
+// AcraStructs into queries as bytea literals in hex format.
+func NewPostgresqlQueryEncryptor(schemaStore TableSchemaStore, clientID []byte, dataEncryptor DataEncryptor, hmacCalculator HMACCalculator, tokenizer tokenization.Tokenizer) *QueryDataEncryptor {
+	encryptor := newQueryDataEncryptor(schemaStore, clientID, dataEncryptor, hmacCalculator, tokenizer, postgresqlNodeFormatter)
+	encryptor.statementSplitter = splitPostgresqlStatements
+	encryptor.statementPreparer = preparePostgresqlStatement
+	encryptor.unsupportedConstruct = unsupportedPostgresqlConstruct
+	return encryptor
+}
+
+// isPostgresqlIdentifierChar returns true if c may be part of unquoted identifier or keyword
+func isPostgresqlIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// quotedLength returns length of token which starts with quote and ends with the same unescaped quote. Doubled quote
+// is escaped quote, backslash escapes next character if backslashEscapes is true
+func quotedLength(query string, backslashEscapes bool) int {
+	quote := query[0]
+	for i := 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// dollarQuotedLength returns length of dollar-quoted string constant or 0 if query doesn't start with its tag
+func dollarQuotedLength(query string) int {
+	end := 1
+	for end < len(query) && query[end] != '$' {
+		// tag has the same rules as unquoted identifier
+		if !isPostgresqlIdentifierChar(query[end]) || (end == 1 && query[end] >= '0' && query[end] <= '9') {
+			return 0
+		}
+		end++
+	}
+	if end == len(query) {
+		return 0
+	}
+	tag := query[:end+1]
+	closing := strings.Index(query[len(tag):], tag)
+	if closing == -1 {
+		return len(query)
+	}
+	return len(tag) + closing + len(tag)
+}
+
+// postgresqlTokenLength returns length of word, string literal, quoted identifier, comment or dollar-quoted string at
+// the beginning of query or 0 if query starts with other character. Unterminated tokens last till end of query
+// https://www.postgresql.org/docs/current/sql-syntax-lexical.html
+func postgresqlTokenLength(query string) int {
+	switch {
+	case query[0] == '\'' || query[0] == '"':
+		return quotedLength(query, false)
+	case strings.HasPrefix(query, "--"):
+		if end := strings.IndexByte(query, '\n'); end != -1 {
+			return end + 1
+		}
+		return len(query)
+	case strings.HasPrefix(query, "/*"):
+		// block comments may be nested
+		depth := 0
+		for i := 0; i+1 < len(query); i++ {
+			switch query[i : i+2] {
+			case "/*":
+				depth++
+				i++
+			case "*/":
+				depth--
+				i++
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(query)
+	case query[0] == '$':
+		return dollarQuotedLength(query)
+	case isPostgresqlIdentifierChar(query[0]):
+		end := 1
+		for end < len(query) && isPostgresqlIdentifierChar(query[end]) {
+			end++
+		}
+		// string constant with C-style escapes
+		if end == 1 && (query[0] == 'E' || query[0] == 'e') && end < len(query) && query[end] == '\'' {
+			return end + quotedLength(query[end:], true)
+		}
+		return end
+	}
+	return 0
+}
+
+// splitPostgresqlStatements splits query to statements separated by semicolons outside of literals, quoted
+// identifiers and comments
+func splitPostgresqlStatements(query string) ([]string, error) {
+	var pieces []string
+	start := 0
+	for i := 0; i < len(query); {
+		if n := postgresqlTokenLength(query[i:]); n > 0 {
+			i += n
+			continue
+		}
+		if query[i] == ';' {
+			pieces = append(pieces, query[start:i])
+			start = i + 1
+		}
+		i++
+	}
+	if strings.TrimSpace(query[start:]) != "" {
+		pieces = append(pieces, query[start:])
+	}
+	return pieces, nil
+}
+
+// lowerASCII returns identifier with ASCII letters folded to lower case like PostgreSQL folds unquoted identifiers
+func lowerASCII(identifier string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, identifier)
+}
+
+// backtickIdentifier converts identifier quoted with double quotes to identifier quoted with backticks which sqlparser
+// parses as identifier instead of string
+func backtickIdentifier(token string) string {
+	if len(token) < 2 || token[len(token)-1] != '"' {
+		// unterminated identifier
+		return token
+	}
+	name := strings.Replace(token[1:len(token)-1], `""`, `"`, -1)
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// preparePostgresqlStatement converts statement to syntax parsed by sqlparser and returns it with RETURNING clause
+// which sqlparser doesn't support and which should be appended to serialized statement as is. It replaces $N
+// placeholders with :vN bind variables, escapes backslashes in standard string literals, folds unquoted identifiers
+// to lower case and quotes quoted identifiers with backticks. sqlparser decodes backslash escapes like MySQL while
+// PostgreSQL with standard_conforming_strings (default since 9.1) takes backslashes literally
+func preparePostgresqlStatement(statement string) (string, string) {
+	output := make([]byte, 0, len(statement))
+	depth := 0
+	for i := 0; i < len(statement); {
+		if statement[i] == '$' && i+1 < len(statement) && statement[i+1] >= '0' && statement[i+1] <= '9' {
+			output = append(output, ':', 'v')
+			i++
+			continue
+		}
+		n := postgresqlTokenLength(statement[i:])
+		if n == 0 {
+			switch statement[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			output = append(output, statement[i])
+			i++
+			continue
+		}
+		token := statement[i : i+n]
+		switch {
+		case token[0] == '\'':
+			token = strings.Replace(token, `\`, `\\`, -1)
+		case token[0] == '"':
+			token = backtickIdentifier(token)
+		case isPostgresqlIdentifierChar(token[0]) && !strings.HasSuffix(token, "'"):
+			// RETURNING of INSERT, UPDATE and DELETE lists only returned values
+			if depth == 0 && strings.EqualFold(token, "returning") {
+				return string(output), statement[i:]
+			}
+			token = lowerASCII(token)
+		}
+		output = append(output, token...)
+		i += n
+	}
+	return string(output), ""
+}
+
+// unsupportedPostgresqlConstruct returns name of PostgreSQL syntax which sqlparser can't parse or empty string if
+// statement doesn't have known unsupported syntax
+func unsupportedPostgresqlConstruct(statement string) string {
+	previousWord := ""
+	for i := 0; i < len(statement); {
+		if strings.HasPrefix(statement[i:], "::") {
+			return "type cast"
+		}
+		n := postgresqlTokenLength(statement[i:])
+		if n == 0 {
+			i++
+			continue
+		}
+		token := statement[i : i+n]
+		i += n
+		switch {
+		case token[0] == '$':
+			return "dollar-quoted string"
+		case !isPostgresqlIdentifierChar(token[0]):
+			continue
+		case strings.HasSuffix(token, "'"):
+			return "escape string"
+		case strings.EqualFold(token, "with") && previousWord == "":
+			return "WITH"
+		case strings.EqualFold(token, "conflict") && strings.EqualFold(previousWord, "on"):
+			return "ON CONFLICT"
+		}
+		previousWord = token
+	}
+	return ""
+}
+
+// postgresqlNodeFormatter serializes encrypted values as bytea literals, placeholders as $N, string literals and
+// identifiers with PostgreSQL quoting instead of MySQL's escaping used by sqlparser by default
+func postgresqlNodeFormatter(values encryptedValues) sqlparser.NodeFormatter {
+	return func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		switch typedNode := node.(type) {
+		case *sqlparser.SQLVal:
+			if values[typedNode] {
+				buf.WriteString(`E'\\x`)
+				buf.Write(typedNode.Val)
+				buf.WriteString(`'`)
+				return
+			}
+			switch typedNode.Type {
+			case sqlparser.StrVal:
+				buf.WriteString(utils.QuoteValue(string(typedNode.Val)))
+				return
+			case sqlparser.ValArg:
+				if index, ok := placeholderIndex(typedNode); ok {
+					buf.WriteString("$" + strconv.Itoa(index+1))
+					return
+				}
+			}
+		case sqlparser.ColIdent:
+			buf.WriteString(postgresqlIdentifier(typedNode, typedNode.String()))
+			return
+		case sqlparser.TableIdent:
+			buf.WriteString(postgresqlIdentifier(typedNode, typedNode.String()))
+			return
+		}
+		node.Format(buf)
+	}
+}
+
+// postgresqlIdentifier returns identifier quoted with double quotes if sqlparser quotes it with backticks or it has
+// upper case letters which PostgreSQL folds in unquoted identifiers
+func postgresqlIdentifier(node sqlparser.SQLNode, name string) string {
+	if sqlparser.String(node) == name && lowerASCII(name) == name {
+		return name
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
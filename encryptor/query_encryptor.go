@@ -0,0 +1,779 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cossacklabs/acra/tokenization"
+	log "github.com/sirupsen/logrus"
+	"github.com/xwb1989/sqlparser"
+)
+
+// ErrHMACCalculatorNotSet returned when column has hash column but HMACCalculator wasn't passed to QueryDataEncryptor
+var ErrHMACCalculatorNotSet = errors.New("HMAC calculator isn't set to calculate values of hash columns")
+
+// ErrTokenizerNotSet returned when column is tokenized but Tokenizer wasn't passed to QueryDataEncryptor
+var ErrTokenizerNotSet = errors.New("tokenizer isn't set to tokenize values of columns")
+
+// ErrUnparsedQueryWithEncryptedTable returned when query which can't be parsed uses table with encrypted columns
+var ErrUnparsedQueryWithEncryptedTable = errors.New("can't parse query which uses table with encrypted columns")
+
+// ErrUnsupportedEncryptedValue returned when value of encrypted column isn't literal, placeholder or NULL and can't be
+// encrypted before it's stored
+var ErrUnsupportedEncryptedValue = errors.New("value of encrypted column isn't literal or placeholder")
+
+// ErrUnsupportedInsertWithEncryptedTable returned when values of INSERT can't be mapped to encrypted columns, e.g. if
+// they are selected by INSERT ... SELECT
+var ErrUnsupportedInsertWithEncryptedTable = errors.New("can't map values of INSERT to encrypted columns")
+
+// ErrUnsupportedUpdateWithEncryptedTable returned when UPDATE of several tables assigns value to encrypted column
+var ErrUnsupportedUpdateWithEncryptedTable = errors.New("can't map values of UPDATE of several tables to encrypted columns")
+
+// ErrConflictingPlaceholder returned when the same placeholder is used for values which should be processed differently
+var ErrConflictingPlaceholder = errors.New("placeholder is used for values of columns with different encryption settings")
+
+// PlaceholderSetting stores setting of column where placeholder's value stored or which it's compared with
+type PlaceholderSetting struct {
+	*ColumnEncryptionSetting
+	// IsHash is true if placeholder is compared with hash column and its value should be replaced with HMAC
+	IsHash bool
+}
+
+// PlaceholderSettings maps index of query's placeholder (starting from 0) to setting of column where its value stored
+type PlaceholderSettings map[int]*PlaceholderSetting
+
+// encryptedValues stores values that were replaced with AcraStructs in currently processed query
+type encryptedValues map[*sqlparser.SQLVal]bool
+
+// statementContext stores information collected while processing one statement
+type statementContext struct {
+	values       encryptedValues
+	placeholders PlaceholderSettings
+}
+
+func newStatementContext() *statementContext {
+	return &statementContext{values: encryptedValues{}, placeholders: PlaceholderSettings{}}
+}
+
+// addPlaceholder remembers setting of placeholder with index. Returns ErrConflictingPlaceholder if placeholder was
+// already used for other column or was used as value of column and compared with its hash column
+func (ctx *statementContext) addPlaceholder(index int, setting *ColumnEncryptionSetting, isHash bool) error {
+	if previous, ok := ctx.placeholders[index]; ok && (previous.ColumnEncryptionSetting != setting || previous.IsHash != isHash) {
+		return ErrConflictingPlaceholder
+	}
+	ctx.placeholders[index] = &PlaceholderSetting{ColumnEncryptionSetting: setting, IsHash: isHash}
+	return nil
+}
+
+// nodeFormatterFactory returns formatter used to serialize query with encrypted values for specific database
+type nodeFormatterFactory func(values encryptedValues) sqlparser.NodeFormatter
+
+// QueryEncryptor finds values of encryptable columns in queries and replaces them with AcraStructs.
+type QueryEncryptor interface {
+	OnQuery(query string) (string, bool, error)
+	OnPreparedQuery(query string) (string, bool, PlaceholderSettings, error)
+	EncryptWithColumnSettings(setting *ColumnEncryptionSetting, data []byte) ([]byte, error)
+	HMACWithColumnSettings(setting *ColumnEncryptionSetting, data []byte) ([]byte, error)
+	TokenizeWithColumnSettings(setting *ColumnEncryptionSetting, data []byte) ([]byte, error)
+}
+
+// QueryDataEncryptor parses INSERT/UPDATE queries and encrypts values that will be stored in columns
+// configured in TableSchemaStore. If columns have hash columns then it stores HMAC of values in them and rewrites
+// comparisons of encrypted columns with literals in WHERE clauses to comparisons of hash columns. Values of tokenized
+// columns are replaced with tokens in INSERT/UPDATE queries and in comparisons in WHERE clauses.
+type QueryDataEncryptor struct {
+	schemaStore TableSchemaStore
+	// clientIDLock guards clientID which may be changed by login mapping while queries are processed
+	clientIDLock   sync.RWMutex
+	clientID       []byte
+	encryptor      DataEncryptor
+	hmacCalculator HMACCalculator
+	tokenizer      tokenization.Tokenizer
+	nodeFormatter  nodeFormatterFactory
+	// statementSplitter splits query to statements which are encrypted separately
+	statementSplitter func(query string) ([]string, error)
+	// statementPreparer converts statement of database's dialect to syntax parsed by sqlparser and returns it with
+	// trailing clause which isn't parsed and appended to encrypted statement as is, nil if it isn't needed
+	statementPreparer func(statement string) (string, string)
+	// unsupportedConstruct returns name of syntax which sqlparser can't parse to log it, nil if it isn't known
+	unsupportedConstruct func(statement string) string
+}
+
+func newQueryDataEncryptor(schemaStore TableSchemaStore, clientID []byte, dataEncryptor DataEncryptor, hmacCalculator HMACCalculator, tokenizer tokenization.Tokenizer, nodeFormatter nodeFormatterFactory) *QueryDataEncryptor {
+	return &QueryDataEncryptor{schemaStore: schemaStore, clientID: clientID, encryptor: dataEncryptor, hmacCalculator: hmacCalculator, tokenizer: tokenizer, nodeFormatter: nodeFormatter, statementSplitter: sqlparser.SplitStatementToPieces}
+}
+
+// SetClientID sets client ID of connection used to encrypt values of columns without zone or client ID in settings
+func (encryptor *QueryDataEncryptor) SetClientID(clientID []byte) {
+	encryptor.clientIDLock.Lock()
+	encryptor.clientID = clientID
+	encryptor.clientIDLock.Unlock()
+}
+
+// getClientID returns current client ID of connection
+func (encryptor *QueryDataEncryptor) getClientID() []byte {
+	encryptor.clientIDLock.RLock()
+	defer encryptor.clientIDLock.RUnlock()
+	return encryptor.clientID
+}
+
+// EncryptWithColumnSettings encrypts data with zone or client id specified in setting, or with clientID of connection
+func (encryptor *QueryDataEncryptor) EncryptWithColumnSettings(setting *ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	if setting.ZoneID != "" {
+		return encryptor.encryptor.EncryptWithZoneID([]byte(setting.ZoneID), data)
+	}
+	return encryptor.encryptor.EncryptWithClientID(encryptor.columnClientID(setting), data)
+}
+
+// HMACWithColumnSettings calculates HMAC of data with key of zone or client specified in setting, or with key of
+// connection's clientID
+func (encryptor *QueryDataEncryptor) HMACWithColumnSettings(setting *ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	if encryptor.hmacCalculator == nil {
+		return nil, ErrHMACCalculatorNotSet
+	}
+	if setting.ZoneID != "" {
+		return encryptor.hmacCalculator.HMACWithZoneID([]byte(setting.ZoneID), data)
+	}
+	return encryptor.hmacCalculator.HMACWithClientID(encryptor.columnClientID(setting), data)
+}
+
+// TokenizeWithColumnSettings returns token of data with type and key of zone or client specified in setting, or with
+// key of connection's clientID
+func (encryptor *QueryDataEncryptor) TokenizeWithColumnSettings(setting *ColumnEncryptionSetting, data []byte) ([]byte, error) {
+	if encryptor.tokenizer == nil {
+		return nil, ErrTokenizerNotSet
+	}
+	return encryptor.tokenizer.Tokenize(data, setting.TokenType, setting.TokenKeyID(encryptor.getClientID()))
+}
+
+// columnClientID returns clientID specified in setting or clientID of connection
+func (encryptor *QueryDataEncryptor) columnClientID(setting *ColumnEncryptionSetting) []byte {
+	if setting.ClientID != "" {
+		return []byte(setting.ClientID)
+	}
+	return encryptor.getClientID()
+}
+
+// placeholderIndex returns index of placeholder from its value which has format ":v<number>" where number starts from 1
+func placeholderIndex(value *sqlparser.SQLVal) (int, bool) {
+	name := string(value.Val)
+	if !strings.HasPrefix(name, ":v") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(name[2:])
+	if err != nil || index < 1 {
+		return 0, false
+	}
+	return index - 1, true
+}
+
+// literalValue returns plaintext data of literal value and false if value isn't literal
+func literalValue(value *sqlparser.SQLVal) ([]byte, bool, error) {
+	switch value.Type {
+	case sqlparser.StrVal, sqlparser.IntVal, sqlparser.FloatVal:
+		return value.Val, true, nil
+	case sqlparser.HexVal:
+		data, err := value.HexDecode()
+		if err != nil {
+			return nil, false, err
+		}
+		return data, true, nil
+	}
+	return nil, false, nil
+}
+
+// replaceWithBinary replaces value with binary data that will be serialized as binary literal
+func replaceWithBinary(value *sqlparser.SQLVal, data []byte, ctx *statementContext) {
+	value.Type = sqlparser.HexVal
+	value.Val = []byte(hex.EncodeToString(data))
+	ctx.values[value] = true
+}
+
+// replaceWithToken replaces literal value with token of its data. Hex literals are replaced with string literals
+// because tokens are text values
+func (encryptor *QueryDataEncryptor) replaceWithToken(value *sqlparser.SQLVal, data []byte, setting *ColumnEncryptionSetting) error {
+	token, err := encryptor.TokenizeWithColumnSettings(setting, data)
+	if err != nil {
+		return err
+	}
+	if value.Type == sqlparser.HexVal {
+		value.Type = sqlparser.StrVal
+	}
+	value.Val = token
+	return nil
+}
+
+// encryptExpression replaces expr with AcraStruct or token if it's literal value of column that should be encrypted
+// or tokenized, or remembers setting of column if expr is placeholder. Returns expression that should be stored in column's hash
+// column or nil if column hasn't hash column or value is placeholder. Other values can't be encrypted and
+// ErrUnsupportedEncryptedValue returned to not store them as plaintext
+func (encryptor *QueryDataEncryptor) encryptExpression(expr sqlparser.Expr, schema *TableSchema, columnName string, ctx *statementContext) (bool, sqlparser.Expr, error) {
+	setting := schema.GetColumnEncryptionSettings(columnName)
+	if setting == nil {
+		return false, nil, nil
+	}
+	var value *sqlparser.SQLVal
+	switch typedExpr := expr.(type) {
+	case *sqlparser.NullVal:
+		if setting.HashColumn != "" {
+			return false, &sqlparser.NullVal{}, nil
+		}
+		return false, nil, nil
+	case *sqlparser.Default:
+		return false, nil, nil
+	case *sqlparser.ColName:
+		// assignment of column to itself doesn't change stored value
+		if typedExpr.Qualifier.IsEmpty() && typedExpr.Name.EqualString(columnName) {
+			return false, nil, nil
+		}
+	case *sqlparser.ValuesFuncExpr:
+		// ON DUPLICATE KEY UPDATE column=VALUES(column) stores value which was already encrypted in VALUES
+		if typedExpr.Name.Qualifier.IsEmpty() && typedExpr.Name.Name.EqualString(columnName) {
+			if setting.HashColumn != "" {
+				return false, &sqlparser.ValuesFuncExpr{Name: &sqlparser.ColName{Name: sqlparser.NewColIdent(setting.HashColumn)}}, nil
+			}
+			return false, nil, nil
+		}
+	case *sqlparser.SQLVal:
+		value = typedExpr
+	}
+	if value == nil {
+		log.WithField("column", columnName).Debugf("Can't encrypt value of type %T", expr)
+		return false, nil, ErrUnsupportedEncryptedValue
+	}
+	if value.Type == sqlparser.ValArg {
+		// value of placeholder will be encrypted when client binds it
+		index, ok := placeholderIndex(value)
+		if !ok {
+			log.WithField("column", columnName).Debugf("Can't encrypt value of named placeholder %s", value.Val)
+			return false, nil, ErrUnsupportedEncryptedValue
+		}
+		return false, nil, ctx.addPlaceholder(index, setting, false)
+	}
+	data, ok, err := literalValue(value)
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		log.WithField("column", columnName).Debugln("Can't encrypt literal of unsupported type")
+		return false, nil, ErrUnsupportedEncryptedValue
+	}
+	if setting.IsTokenized() {
+		if err := encryptor.replaceWithToken(value, data, setting); err != nil {
+			return false, nil, err
+		}
+		return true, nil, nil
+	}
+	var hashExpr sqlparser.Expr
+	if setting.HashColumn != "" {
+		hash, err := encryptor.HMACWithColumnSettings(setting, data)
+		if err != nil {
+			return false, nil, err
+		}
+		hashValue := &sqlparser.SQLVal{}
+		replaceWithBinary(hashValue, hash, ctx)
+		hashExpr = hashValue
+	}
+	encrypted, err := encryptor.EncryptWithColumnSettings(setting, data)
+	if err != nil {
+		return false, nil, err
+	}
+	replaceWithBinary(value, encrypted, ctx)
+	return true, hashExpr, nil
+}
+
+// encryptUpdateExpressions encrypts values assigned to encryptable columns in UPDATE ... SET and ON DUPLICATE KEY UPDATE
+// and sets values of their hash columns. Returns new list of expressions
+func (encryptor *QueryDataEncryptor) encryptUpdateExpressions(exprs sqlparser.UpdateExprs, schema *TableSchema, ctx *statementContext) (sqlparser.UpdateExprs, bool, error) {
+	changed := false
+	hashes := make(map[string]sqlparser.Expr)
+	for _, expr := range exprs {
+		encrypted, hashExpr, err := encryptor.encryptExpression(expr.Expr, schema, expr.Name.Name.String(), ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		if hashExpr != nil {
+			hashes[schema.GetColumnEncryptionSettings(expr.Name.Name.String()).HashColumn] = hashExpr
+		}
+		changed = changed || encrypted || hashExpr != nil
+	}
+	for hashColumn, hashExpr := range hashes {
+		found := false
+		for _, expr := range exprs {
+			if strings.EqualFold(expr.Name.Name.String(), hashColumn) {
+				expr.Expr = hashExpr
+				found = true
+			}
+		}
+		if !found {
+			exprs = append(exprs, &sqlparser.UpdateExpr{Name: &sqlparser.ColName{Name: sqlparser.NewColIdent(hashColumn)}, Expr: hashExpr})
+		}
+	}
+	return exprs, changed, nil
+}
+
+// columnIndex returns index of column in list or -1
+func columnIndex(columns []string, column string) int {
+	for i, name := range columns {
+		if strings.EqualFold(name, column) {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertsEncryptedColumns returns true if INSERT may store values in encrypted columns. INSERT without list of
+// columns into table which columns aren't configured may store values in any column
+func insertsEncryptedColumns(insert *sqlparser.Insert, schema *TableSchema, columns []string) bool {
+	if len(columns) == 0 {
+		return len(schema.EncryptionColumnSettings) > 0
+	}
+	for _, column := range columns {
+		if schema.GetColumnEncryptionSettings(column) != nil {
+			return true
+		}
+	}
+	for _, expr := range insert.OnDup {
+		if schema.GetColumnEncryptionSettings(expr.Name.Name.String()) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (encryptor *QueryDataEncryptor) encryptInsertQuery(insert *sqlparser.Insert, ctx *statementContext) (bool, error) {
+	schema := encryptor.schemaStore.GetTableSchema(insert.Table.Name.String())
+	if schema == nil {
+		return false, nil
+	}
+	var columns []string
+	if len(insert.Columns) > 0 {
+		for _, column := range insert.Columns {
+			columns = append(columns, column.String())
+		}
+	} else {
+		columns = schema.InsertColumns()
+	}
+	if !insertsEncryptedColumns(insert, schema, columns) {
+		return false, nil
+	}
+	changed := false
+	rows, ok := insert.Rows.(sqlparser.Values)
+	if !ok {
+		log.WithField("table", insert.Table.Name.String()).Debugf("Can't encrypt values of INSERT with rows of type %T", insert.Rows)
+		return false, ErrUnsupportedInsertWithEncryptedTable
+	}
+	// hashes of values for each row by hash column name
+	rowHashes := make([]map[string]sqlparser.Expr, len(rows))
+	// hash columns that should be added to list of columns
+	var newColumns []string
+	for rowIndex, tuple := range rows {
+		rowHashes[rowIndex] = make(map[string]sqlparser.Expr)
+		if len(tuple) > len(columns) {
+			log.WithField("table", insert.Table.Name.String()).Debugln("Can't map values of INSERT to columns")
+			return false, ErrUnsupportedInsertWithEncryptedTable
+		}
+		for i, expr := range tuple {
+			encrypted, hashExpr, err := encryptor.encryptExpression(expr, schema, columns[i], ctx)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || encrypted
+			if hashExpr == nil {
+				continue
+			}
+			hashColumn := schema.GetColumnEncryptionSettings(columns[i]).HashColumn
+			rowHashes[rowIndex][hashColumn] = hashExpr
+			if columnIndex(columns, hashColumn) == -1 && columnIndex(newColumns, hashColumn) == -1 {
+				newColumns = append(newColumns, hashColumn)
+			}
+		}
+	}
+	if len(newColumns) > 0 && len(insert.Columns) == 0 {
+		log.WithField("columns", newColumns).Debugln("Can't add hash columns to INSERT without explicitly specified columns")
+		newColumns = nil
+	}
+	for _, column := range newColumns {
+		insert.Columns = append(insert.Columns, sqlparser.NewColIdent(column))
+	}
+	for rowIndex, tuple := range rows {
+		for hashColumn, hashExpr := range rowHashes[rowIndex] {
+			if index := columnIndex(columns, hashColumn); index != -1 && index < len(tuple) {
+				tuple[index] = hashExpr
+				changed = true
+			}
+		}
+		for _, column := range newColumns {
+			hashExpr, ok := rowHashes[rowIndex][column]
+			if !ok {
+				hashExpr = &sqlparser.NullVal{}
+			}
+			tuple = append(tuple, hashExpr)
+			changed = true
+		}
+		rows[rowIndex] = tuple
+	}
+	if len(insert.OnDup) > 0 {
+		exprs, encrypted, err := encryptor.encryptUpdateExpressions(sqlparser.UpdateExprs(insert.OnDup), schema, ctx)
+		if err != nil {
+			return false, err
+		}
+		insert.OnDup = sqlparser.OnDup(exprs)
+		changed = changed || encrypted
+	}
+	return changed, nil
+}
+
+// collectTableSchemas fills tables with schemas of configured tables used in exprs by their aliases or names
+func (encryptor *QueryDataEncryptor) collectTableSchemas(exprs sqlparser.TableExprs, tables map[string]*TableSchema) {
+	for _, expr := range exprs {
+		switch typedExpr := expr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			tableName, ok := typedExpr.Expr.(sqlparser.TableName)
+			if !ok {
+				continue
+			}
+			schema := encryptor.schemaStore.GetTableSchema(tableName.Name.String())
+			if schema == nil {
+				continue
+			}
+			name := tableName.Name.String()
+			if !typedExpr.As.IsEmpty() {
+				name = typedExpr.As.String()
+			}
+			tables[strings.ToLower(name)] = schema
+		case *sqlparser.JoinTableExpr:
+			encryptor.collectTableSchemas(sqlparser.TableExprs{typedExpr.LeftExpr, typedExpr.RightExpr}, tables)
+		case *sqlparser.ParenTableExpr:
+			encryptor.collectTableSchemas(typedExpr.Exprs, tables)
+		}
+	}
+}
+
+// searchableColumnSetting returns setting of column that has hash column or is tokenized, or nil. Column without table qualifier
+// is resolved only if exactly one table has such column
+func searchableColumnSetting(column *sqlparser.ColName, tables map[string]*TableSchema) *ColumnEncryptionSetting {
+	var result *ColumnEncryptionSetting
+	if !column.Qualifier.IsEmpty() {
+		schema, ok := tables[strings.ToLower(column.Qualifier.Name.String())]
+		if !ok {
+			return nil
+		}
+		result = schema.GetColumnEncryptionSettings(column.Name.String())
+	} else {
+		for _, schema := range tables {
+			setting := schema.GetColumnEncryptionSettings(column.Name.String())
+			if setting == nil {
+				continue
+			}
+			if result != nil {
+				// ambiguous column
+				return nil
+			}
+			result = setting
+		}
+	}
+	if result == nil || (result.HashColumn == "" && !result.IsTokenized()) {
+		return nil
+	}
+	return result
+}
+
+// encryptComparison replaces comparison of searchable encrypted column with literals by comparison of its hash column
+// with HMACs of literals, and literals compared with tokenized column with their tokens. Placeholders are remembered
+// to replace their values with HMACs or tokens when client binds them
+func (encryptor *QueryDataEncryptor) encryptComparison(expr *sqlparser.ComparisonExpr, tables map[string]*TableSchema, ctx *statementContext) (bool, error) {
+	switch expr.Operator {
+	case sqlparser.EqualStr, sqlparser.NotEqualStr, sqlparser.NullSafeEqualStr, sqlparser.InStr, sqlparser.NotInStr:
+	default:
+		return false, nil
+	}
+	column, ok := expr.Left.(*sqlparser.ColName)
+	values := expr.Right
+	if !ok {
+		column, ok = expr.Right.(*sqlparser.ColName)
+		values = expr.Left
+	}
+	if !ok {
+		return false, nil
+	}
+	setting := searchableColumnSetting(column, tables)
+	if setting == nil {
+		return false, nil
+	}
+	var literals []*sqlparser.SQLVal
+	switch typedValues := values.(type) {
+	case *sqlparser.SQLVal:
+		literals = append(literals, typedValues)
+	case sqlparser.ValTuple:
+		for _, value := range typedValues {
+			literal, ok := value.(*sqlparser.SQLVal)
+			if !ok {
+				return false, nil
+			}
+			literals = append(literals, literal)
+		}
+	default:
+		return false, nil
+	}
+	literalsData := make([][]byte, len(literals))
+	isPlaceholder := make([]bool, len(literals))
+	var placeholders []int
+	for i, literal := range literals {
+		if literal.Type == sqlparser.ValArg {
+			index, ok := placeholderIndex(literal)
+			if !ok {
+				log.WithField("column", column.Name.String()).Debugf("Can't compare encrypted column with named placeholder %s", literal.Val)
+				return false, ErrUnsupportedEncryptedValue
+			}
+			placeholders = append(placeholders, index)
+			isPlaceholder[i] = true
+			continue
+		}
+		data, ok, err := literalValue(literal)
+		if err != nil || !ok {
+			// other values can't be replaced
+			return false, err
+		}
+		literalsData[i] = data
+	}
+	isHash := !setting.IsTokenized()
+	for _, index := range placeholders {
+		if err := ctx.addPlaceholder(index, setting, isHash); err != nil {
+			return false, err
+		}
+	}
+	if !isHash {
+		changed := false
+		for i, literal := range literals {
+			if isPlaceholder[i] {
+				continue
+			}
+			if err := encryptor.replaceWithToken(literal, literalsData[i], setting); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+		return changed, nil
+	}
+	hashes := make([][]byte, len(literals))
+	for i, data := range literalsData {
+		if isPlaceholder[i] {
+			continue
+		}
+		hash, err := encryptor.HMACWithColumnSettings(setting, data)
+		if err != nil {
+			return false, err
+		}
+		hashes[i] = hash
+	}
+	column.Name = sqlparser.NewColIdent(setting.HashColumn)
+	for i, literal := range literals {
+		if !isPlaceholder[i] {
+			replaceWithBinary(literal, hashes[i], ctx)
+		}
+	}
+	return true, nil
+}
+
+// encryptWhere rewrites comparisons of searchable encrypted columns in WHERE clause
+func (encryptor *QueryDataEncryptor) encryptWhere(where *sqlparser.Where, tables map[string]*TableSchema, ctx *statementContext) (bool, error) {
+	if where == nil || len(tables) == 0 {
+		return false, nil
+	}
+	changed := false
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch typedNode := node.(type) {
+		case *sqlparser.Subquery:
+			// columns of subqueries belong to other tables
+			return false, nil
+		case *sqlparser.ComparisonExpr:
+			encrypted, err := encryptor.encryptComparison(typedNode, tables, ctx)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || encrypted
+		}
+		return true, nil
+	}, where.Expr)
+	return changed, err
+}
+
+func (encryptor *QueryDataEncryptor) encryptSelectQuery(selectQuery *sqlparser.Select, ctx *statementContext) (bool, error) {
+	tables := make(map[string]*TableSchema)
+	encryptor.collectTableSchemas(selectQuery.From, tables)
+	return encryptor.encryptWhere(selectQuery.Where, tables, ctx)
+}
+
+func (encryptor *QueryDataEncryptor) encryptDeleteQuery(deleteQuery *sqlparser.Delete, ctx *statementContext) (bool, error) {
+	tables := make(map[string]*TableSchema)
+	encryptor.collectTableSchemas(deleteQuery.TableExprs, tables)
+	return encryptor.encryptWhere(deleteQuery.Where, tables, ctx)
+}
+
+// updatesEncryptedColumn returns true if any of exprs assigns value to column which is encrypted in any of tables
+func updatesEncryptedColumn(exprs sqlparser.UpdateExprs, tables map[string]*TableSchema) bool {
+	for _, expr := range exprs {
+		for name, schema := range tables {
+			if !expr.Name.Qualifier.IsEmpty() && !strings.EqualFold(expr.Name.Qualifier.Name.String(), name) {
+				continue
+			}
+			if schema.GetColumnEncryptionSettings(expr.Name.Name.String()) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (encryptor *QueryDataEncryptor) encryptUpdateQuery(update *sqlparser.Update, ctx *statementContext) (bool, error) {
+	tables := make(map[string]*TableSchema)
+	encryptor.collectTableSchemas(update.TableExprs, tables)
+	// support only updates of one table to map columns without ambiguity
+	if len(update.TableExprs) != 1 || len(tables) != 1 {
+		if updatesEncryptedColumn(update.Exprs, tables) {
+			log.Debugln("Can't encrypt values of UPDATE of several tables")
+			return false, ErrUnsupportedUpdateWithEncryptedTable
+		}
+		return false, nil
+	}
+	var schema *TableSchema
+	for _, tableSchema := range tables {
+		schema = tableSchema
+	}
+	exprs, changed, err := encryptor.encryptUpdateExpressions(update.Exprs, schema, ctx)
+	if err != nil {
+		return false, err
+	}
+	update.Exprs = exprs
+	whereChanged, err := encryptor.encryptWhere(update.Where, tables, ctx)
+	if err != nil {
+		return false, err
+	}
+	return changed || whereChanged, nil
+}
+
+// encryptStatement encrypts values of one statement and returns serialized statement if it was changed
+func (encryptor *QueryDataEncryptor) encryptStatement(statement sqlparser.Statement, ctx *statementContext) (string, bool, error) {
+	var changed bool
+	var err error
+	switch typedStatement := statement.(type) {
+	case *sqlparser.Insert:
+		changed, err = encryptor.encryptInsertQuery(typedStatement, ctx)
+	case *sqlparser.Update:
+		changed, err = encryptor.encryptUpdateQuery(typedStatement, ctx)
+	case *sqlparser.Select:
+		changed, err = encryptor.encryptSelectQuery(typedStatement, ctx)
+	case *sqlparser.Delete:
+		changed, err = encryptor.encryptDeleteQuery(typedStatement, ctx)
+	}
+	if err != nil || !changed {
+		return "", false, err
+	}
+	var formatter sqlparser.NodeFormatter
+	if encryptor.nodeFormatter != nil {
+		formatter = encryptor.nodeFormatter(ctx.values)
+	}
+	return sqlparser.NewTrackedBuffer(formatter).WriteNode(statement).String(), true, nil
+}
+
+// usesConfiguredTable returns true if any identifier of statement which can't be parsed matches name of configured
+// table. Quoted identifiers of PostgreSQL are scanned as strings so strings are checked too
+func (encryptor *QueryDataEncryptor) usesConfiguredTable(statement string) bool {
+	tokenizer := sqlparser.NewStringTokenizer(statement)
+	for {
+		tokenType, value := tokenizer.Scan()
+		switch tokenType {
+		case 0, sqlparser.LEX_ERROR:
+			return false
+		case sqlparser.ID, sqlparser.STRING:
+			if encryptor.schemaStore.GetTableSchema(string(value)) != nil {
+				return true
+			}
+		}
+	}
+}
+
+// OnQuery returns query with encrypted values and true if query was changed. Queries that can't be parsed
+// are returned as is if they don't use configured tables.
+func (encryptor *QueryDataEncryptor) OnQuery(query string) (string, bool, error) {
+	newQuery, changed, _, err := encryptor.OnPreparedQuery(query)
+	return newQuery, changed, err
+}
+
+// OnPreparedQuery returns query with encrypted values, true if query was changed and settings of placeholders
+// which values should be encrypted on binding. Queries that can't be parsed are returned as is if they don't use
+// configured tables, otherwise ErrUnparsedQueryWithEncryptedTable returned because their values can't be encrypted.
+func (encryptor *QueryDataEncryptor) OnPreparedQuery(query string) (string, bool, PlaceholderSettings, error) {
+	pieces, err := encryptor.statementSplitter(query)
+	if err != nil {
+		if encryptor.usesConfiguredTable(query) {
+			log.WithError(err).Debugln("Can't split query with configured table to statements")
+			return query, false, nil, ErrUnparsedQueryWithEncryptedTable
+		}
+		log.WithError(err).Debugln("Can't split query to statements, skip encryption")
+		return query, false, nil, nil
+	}
+	queryChanged := false
+	placeholders := PlaceholderSettings{}
+	for i, piece := range pieces {
+		// statements which weren't changed are returned as is, not prepared
+		parsedPiece, suffix := piece, ""
+		if encryptor.statementPreparer != nil {
+			parsedPiece, suffix = encryptor.statementPreparer(piece)
+		}
+		statement, err := sqlparser.Parse(parsedPiece)
+		if err != nil {
+			if encryptor.usesConfiguredTable(parsedPiece) {
+				logger := log.WithError(err)
+				if encryptor.unsupportedConstruct != nil {
+					if construct := encryptor.unsupportedConstruct(piece); construct != "" {
+						logger = logger.WithField("construct", construct)
+					}
+				}
+				logger.Warningln("Can't parse query statement with configured table, query rejected")
+				return query, false, nil, ErrUnparsedQueryWithEncryptedTable
+			}
+			log.WithError(err).Debugln("Can't parse query statement, skip encryption")
+			continue
+		}
+		ctx := newStatementContext()
+		newStatement, changed, err := encryptor.encryptStatement(statement, ctx)
+		if err != nil {
+			return query, false, nil, err
+		}
+		for index, setting := range ctx.placeholders {
+			placeholders[index] = setting
+		}
+		if changed {
+			pieces[i] = newStatement
+			if suffix != "" {
+				pieces[i] += " " + suffix
+			}
+			queryChanged = true
+		}
+	}
+	if !queryChanged {
+		return query, false, placeholders, nil
+	}
+	return strings.Join(pieces, ";"), true, placeholders, nil
+}
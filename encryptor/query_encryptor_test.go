@@ -0,0 +1,572 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cossacklabs/acra/tokenization"
+)
+
+// testDataEncryptor "encrypts" data by prefixing it with key id to check which key was chosen
+type testDataEncryptor struct {
+	err error
+}
+
+func (encryptor *testDataEncryptor) EncryptWithZoneID(zoneID, data []byte) ([]byte, error) {
+	return append([]byte("zone:"+string(zoneID)+":"), data...), encryptor.err
+}
+
+func (encryptor *testDataEncryptor) EncryptWithClientID(clientID, data []byte) ([]byte, error) {
+	return append([]byte("client:"+string(clientID)+":"), data...), encryptor.err
+}
+
+// testHMACCalculator "hashes" data by prefixing it with key id
+type testHMACCalculator struct{}
+
+func (*testHMACCalculator) HMACWithZoneID(zoneID, data []byte) ([]byte, error) {
+	return append([]byte("hmac:"+string(zoneID)+":"), data...), nil
+}
+
+func (*testHMACCalculator) HMACWithClientID(clientID, data []byte) ([]byte, error) {
+	return append([]byte("hmac:"+string(clientID)+":"), data...), nil
+}
+
+func encryptedHex(prefix, data string) string {
+	return fmt.Sprintf(`E'\\x%s'`, hex.EncodeToString([]byte(prefix+data)))
+}
+
+const testEncryptorConfig = `
+schemas:
+  - table: users
+    columns: ["id", "name", "email", "ssn"]
+    encrypted:
+      - column: email
+      - column: ssn
+        zone_id: DDDDDDDDHCzqZAZNbBvybWLR
+      - column: name
+        client_id: other_client
+`
+
+func TestPostgresqlQueryEncryptor(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	testcases := []struct {
+		query    string
+		expected string
+		changed  bool
+	}{
+		{
+			query:    "INSERT INTO users (id, email) VALUES (1, 'user@example.com')",
+			expected: fmt.Sprintf("insert into users(id, email) values (1, %s)", encryptedHex("client:client:", "user@example.com")),
+			changed:  true,
+		},
+		{
+			query: "INSERT INTO users VALUES (1, 'name', 'user@example.com', 123)",
+			expected: fmt.Sprintf("insert into users values (1, %s, %s, %s)",
+				encryptedHex("client:other_client:", "name"), encryptedHex("client:client:", "user@example.com"),
+				encryptedHex("zone:DDDDDDDDHCzqZAZNbBvybWLR:", "123")),
+			changed: true,
+		},
+		{
+			query:    "UPDATE users SET email='user@example.com', id=2 WHERE id=1",
+			expected: fmt.Sprintf("update users set email = %s, id = 2 where id = 1", encryptedHex("client:client:", "user@example.com")),
+			changed:  true,
+		},
+		{
+			query:    "UPDATE users SET id=2 WHERE email='it''s'",
+			expected: "UPDATE users SET id=2 WHERE email='it''s'",
+			changed:  false,
+		},
+		{
+			query:    "INSERT INTO other_table (email) VALUES ('user@example.com')",
+			expected: "INSERT INTO other_table (email) VALUES ('user@example.com')",
+			changed:  false,
+		},
+		{
+			query:    "SELECT email FROM users",
+			expected: "SELECT email FROM users",
+			changed:  false,
+		},
+		{
+			query: "INSERT INTO users (id, email) VALUES (1, 'a');INSERT INTO users (name, id) VALUES ('it''s', 2)",
+			expected: fmt.Sprintf("insert into users(id, email) values (1, %s);insert into users(name, id) values (%s, 2)",
+				encryptedHex("client:client:", "a"), encryptedHex("client:other_client:", "it's")),
+			changed: true,
+		},
+		{
+			query:    "INSERT INTO other_table (id, \"key\") VALUES (1, 'a') RETURNING id",
+			expected: "INSERT INTO other_table (id, \"key\") VALUES (1, 'a') RETURNING id",
+			changed:  false,
+		},
+		{
+			query:    "INSERT INTO users (id, email) VALUES (1, 'a') RETURNING id, (email), 'returning'",
+			expected: fmt.Sprintf("insert into users(id, email) values (1, %s) RETURNING id, (email), 'returning'", encryptedHex("client:client:", "a")),
+			changed:  true,
+		},
+		{
+			query:    "UPDATE Public.USERS SET \"email\" = 'a' WHERE \"Id\" = 1 RETURNING \"Id\"",
+			expected: fmt.Sprintf("update public.users set email = %s where \"Id\" = 1 RETURNING \"Id\"", encryptedHex("client:client:", "a")),
+			changed:  true,
+		},
+		{
+			query:    "INSERT INTO \"users\" (\"Key\", \"select\", email) VALUES (1, 2, 'a')",
+			expected: fmt.Sprintf("insert into users(\"Key\", \"select\", email) values (1, 2, %s)", encryptedHex("client:client:", "a")),
+			changed:  true,
+		},
+	}
+	for i, testcase := range testcases {
+		query, changed, err := encryptor.OnQuery(testcase.query)
+		if err != nil {
+			t.Fatalf("%v. Unexpected error: %v", i, err)
+		}
+		if changed != testcase.changed {
+			t.Fatalf("%v. Expected changed=%v, took %v", i, testcase.changed, changed)
+		}
+		if query != testcase.expected {
+			t.Fatalf("%v. Incorrect query.\nTook: %s\nExpected: %s", i, query, testcase.expected)
+		}
+	}
+}
+
+func TestQueryEncryptorUnparsedQuery(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	for i, query := range []string{
+		"WITH t AS (SELECT 1) INSERT INTO users (id, email) VALUES (1, 'user@example.com')",
+		"INSERT INTO users (id, email) VALUES (1, 'user@example.com'::text)",
+		"SELECT 1; INSERT INTO users (id, email) VALUES (1, 'a') ON CONFLICT (id) DO UPDATE SET email = 'b'",
+		"INSERT INTO users (id, email) VALUES (1, $$user@example.com$$)",
+	} {
+		newQuery, changed, placeholders, err := encryptor.OnPreparedQuery(query)
+		if err != ErrUnparsedQueryWithEncryptedTable {
+			t.Fatalf("%v. Expected ErrUnparsedQueryWithEncryptedTable, took %v", i, err)
+		}
+		if changed || newQuery != query || placeholders != nil {
+			t.Fatalf("%v. Query shouldn't be changed on error", i)
+		}
+	}
+}
+
+func TestUnsupportedPostgresqlConstruct(t *testing.T) {
+	for query, construct := range map[string]string{
+		"WITH t AS (SELECT 1) SELECT * FROM t":                     "WITH",
+		"SELECT 'with', \"with\" FROM t WHERE id = $1::int":        "type cast",
+		"INSERT INTO t VALUES (1) ON CONFLICT DO NOTHING":          "ON CONFLICT",
+		"INSERT INTO t VALUES (E'\\n')":                            "escape string",
+		"INSERT INTO t VALUES ($tag$a$tag$)":                       "dollar-quoted string",
+		"INSERT INTO t VALUES ('::', '$$', 'on conflict') -- with": "",
+	} {
+		if result := unsupportedPostgresqlConstruct(query); result != construct {
+			t.Fatalf("Expected %q for query %s, took %q", construct, query, result)
+		}
+	}
+}
+
+func TestQueryEncryptorUnsupportedValues(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewMysqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	testCases := []struct {
+		query string
+		err   error
+	}{
+		{"INSERT INTO users (id, email) VALUES (1, upper('secret'))", ErrUnsupportedEncryptedValue},
+		{"INSERT INTO users (id, email) VALUES (1, concat('a', 'b'))", ErrUnsupportedEncryptedValue},
+		{"INSERT INTO users (id, email) VALUES (1, name)", ErrUnsupportedEncryptedValue},
+		{"INSERT INTO users (id, email) VALUES (1, :email)", ErrUnsupportedEncryptedValue},
+		{"INSERT INTO users (id, email) VALUES (1, 0x736563726574)", ErrUnsupportedEncryptedValue},
+		{"UPDATE users SET email = lower('secret') WHERE id = 1", ErrUnsupportedEncryptedValue},
+		{"INSERT INTO users (id, email) VALUES (1, 'a') ON DUPLICATE KEY UPDATE email = upper('b')", ErrUnsupportedEncryptedValue},
+		{"INSERT INTO users (id, email) SELECT id, email FROM other_users", ErrUnsupportedInsertWithEncryptedTable},
+		{"INSERT INTO users SELECT * FROM other_users", ErrUnsupportedInsertWithEncryptedTable},
+		{"INSERT INTO users VALUES (1, 'name', 'email', 'ssn', 'extra')", ErrUnsupportedInsertWithEncryptedTable},
+		{"UPDATE users, orders SET users.email = 'secret' WHERE users.id = orders.user_id", ErrUnsupportedUpdateWithEncryptedTable},
+	}
+	for i, testCase := range testCases {
+		newQuery, changed, err := encryptor.OnQuery(testCase.query)
+		if err != testCase.err {
+			t.Fatalf("%v. Expected %v, took %v", i, testCase.err, err)
+		}
+		if changed || newQuery != testCase.query {
+			t.Fatalf("%v. Query shouldn't be changed on error", i)
+		}
+	}
+
+	for i, query := range []string{
+		"INSERT INTO users (id, email) VALUES (1, NULL)",
+		"INSERT INTO users (id, email) VALUES (1, DEFAULT)",
+		"INSERT INTO users (id) SELECT id FROM other_users",
+		"UPDATE users SET email = email, id = id + 1 WHERE id = 1",
+		"UPDATE users, orders SET orders.comment = 'comment' WHERE users.id = orders.user_id",
+	} {
+		newQuery, changed, err := encryptor.OnQuery(query)
+		if err != nil {
+			t.Fatalf("%v. Unexpected error: %v", i, err)
+		}
+		if changed || newQuery != query {
+			t.Fatalf("%v. Query shouldn't be changed", i)
+		}
+	}
+
+	query := "INSERT INTO users (id, email) VALUES (1, 'a') ON DUPLICATE KEY UPDATE email = VALUES(email)"
+	newQuery, _, err := encryptor.OnQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("insert into users(id, email) values (1, X'%s') on duplicate key update email = values(email)", hex.EncodeToString([]byte("client:client:a")))
+	if newQuery != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", newQuery, expected)
+	}
+}
+
+func TestQueryEncryptorEncryptionError(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testErr := errors.New("test error")
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{err: testErr}, &testHMACCalculator{}, nil)
+	query := "INSERT INTO users (id, email) VALUES (1, 'user@example.com')"
+	newQuery, changed, err := encryptor.OnQuery(query)
+	if err != testErr {
+		t.Fatalf("Expected test error, took %v", err)
+	}
+	if changed || newQuery != query {
+		t.Fatal("Query shouldn't be changed on error")
+	}
+}
+
+func TestMapTableSchemaStoreFromConfig(t *testing.T) {
+	invalidConfigs := []struct {
+		config string
+		err    error
+	}{
+		{"schemas:\n  - columns: [\"a\"]\n", ErrEmptyTableName},
+		{"schemas:\n  - table: t\n    encrypted:\n      - zone_id: zone\n", ErrEmptyColumnName},
+		{"schemas:\n  - table: t\n    encrypted:\n      - column: a\n        zone_id: zone\n        client_id: client\n", ErrBothClientIDAndZoneIDSet},
+		{"schemas:\n  - table: t\n  - table: T\n", ErrDuplicatedTableSchema},
+		{"schemas:\n  - table: t\n    encrypted:\n      - column: a\n        hash_column: b\n      - column: b\n", ErrHashColumnIsEncrypted},
+		{"schemas:\n  - table: t\n    table_oid: 1\n  - table: t2\n    table_oid: 1\n", ErrDuplicatedTableOID},
+	}
+	for i, testcase := range invalidConfigs {
+		if _, err := MapTableSchemaStoreFromConfig([]byte(testcase.config)); err != testcase.err {
+			t.Fatalf("%v. Expected %v, took %v", i, testcase.err, err)
+		}
+	}
+	store, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := store.GetTableSchema("USERS")
+	if schema == nil {
+		t.Fatal("Expected schema for table with case-insensitive name")
+	}
+	if schema.GetColumnEncryptionSettings("id") != nil {
+		t.Fatal("Unexpected encryption setting for not encrypted column")
+	}
+	if setting := schema.GetColumnEncryptionSettings("SSN"); setting == nil || setting.ZoneID != "DDDDDDDDHCzqZAZNbBvybWLR" {
+		t.Fatal("Incorrect encryption setting for ssn column")
+	}
+
+	// INSERT without columns skips dropped column
+	store, err = MapTableSchemaStoreFromConfig([]byte("schemas:\n  - table: t\n    table_oid: 10\n    columns: [\"id\", \"\", \"email\"]\n    encrypted:\n      - column: email\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.GetTableSchema("t").TableOID != 10 {
+		t.Fatal("Incorrect table OID")
+	}
+	encryptor := NewPostgresqlQueryEncryptor(store, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	query, _, err := encryptor.OnQuery("INSERT INTO t VALUES (1, 'a')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("insert into t values (1, %s)", encryptedHex("client:client:", "a")); query != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", query, expected)
+	}
+}
+
+func TestPostgresqlPreparedQueryPlaceholders(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	query := "INSERT INTO users (id, email, ssn) VALUES ($1, $2, $3)"
+	newQuery, changed, placeholders, err := encryptor.OnPreparedQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || newQuery != query {
+		t.Fatal("Query without literals shouldn't be changed")
+	}
+	if len(placeholders) != 2 || placeholders[1] == nil || placeholders[1].Name != "email" || placeholders[2] == nil || placeholders[2].ZoneID == "" {
+		t.Fatalf("Incorrect placeholder settings: %v", placeholders)
+	}
+
+	query = "UPDATE users SET name='$1 name', email=$1 WHERE id=$2"
+	newQuery, changed, placeholders, err = encryptor.OnPreparedQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("update users set name = %s, email = $1 where id = $2", encryptedHex("client:other_client:", "$1 name"))
+	if !changed || newQuery != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", newQuery, expected)
+	}
+	if len(placeholders) != 1 || placeholders[0] == nil || placeholders[0].Name != "email" {
+		t.Fatalf("Incorrect placeholder settings: %v", placeholders)
+	}
+}
+
+func TestPostgresqlBackslashInLiterals(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	// PostgreSQL doesn't treat backslashes in standard string literals as escape characters
+	query := `INSERT INTO users (id, name, email) VALUES (1, 'C:\dir', 'C:\new\path')`
+	newQuery, changed, _, err := encryptor.OnPreparedQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`insert into users(id, name, email) values (1, %s, %s)`, encryptedHex("client:other_client:", `C:\dir`), encryptedHex("client:client:", `C:\new\path`))
+	if !changed || newQuery != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", newQuery, expected)
+	}
+
+	query = `SELECT 'a\b;', E'c\'d', $1; INSERT INTO users (id, email) VALUES ($2, 'e\f'); SELECT $$g\h$$`
+	newQuery, changed, placeholders, err := encryptor.OnPreparedQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = fmt.Sprintf(`SELECT 'a\b;', E'c\'d', $1;insert into users(id, email) values ($2, %s); SELECT $$g\h$$`, encryptedHex("client:client:", `e\f`))
+	if !changed || newQuery != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", newQuery, expected)
+	}
+	if len(placeholders) != 0 {
+		t.Fatalf("Incorrect placeholder settings: %v", placeholders)
+	}
+}
+
+func TestMysqlPreparedQueryPlaceholders(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testEncryptorConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewMysqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	query := "INSERT INTO users (id, name, email) VALUES (?, 'name', ?)"
+	newQuery, changed, placeholders, err := encryptor.OnPreparedQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("insert into users(id, name, email) values (?, X'%s', ?)", hex.EncodeToString([]byte("client:other_client:name")))
+	if !changed || newQuery != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", newQuery, expected)
+	}
+	if len(placeholders) != 1 || placeholders[1] == nil || placeholders[1].Name != "email" {
+		t.Fatalf("Incorrect placeholder settings: %v", placeholders)
+	}
+
+	schemaStore, err = MapTableSchemaStoreFromConfig([]byte(testSearchableConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor = NewMysqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	newQuery, changed, placeholders, err = encryptor.OnPreparedQuery("SELECT id FROM users WHERE id > ? AND email = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "select id from users where id > ? and email_hash = ?"
+	if !changed || newQuery != expected {
+		t.Fatalf("Incorrect query.\nTook: %s\nExpected: %s", newQuery, expected)
+	}
+	if len(placeholders) != 1 || placeholders[1] == nil || !placeholders[1].IsHash {
+		t.Fatalf("Incorrect placeholder settings: %v", placeholders)
+	}
+}
+
+const testSearchableConfig = `
+schemas:
+  - table: users
+    columns: ["id", "email", "email_hash"]
+    encrypted:
+      - column: email
+        hash_column: email_hash
+  - table: orders
+    columns: ["id", "comment"]
+    encrypted:
+      - column: comment
+`
+
+func TestPostgresqlBlindIndex(t *testing.T) {
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(testSearchableConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, &testHMACCalculator{}, nil)
+	email := encryptedHex("client:client:", "a@b")
+	emailHash := encryptedHex("hmac:client:", "a@b")
+	otherHash := encryptedHex("hmac:client:", "c@d")
+	testcases := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "INSERT INTO users (id, email) VALUES (1, 'a@b'), (2, NULL)",
+			expected: fmt.Sprintf("insert into users(id, email, email_hash) values (1, %s, %s), (2, null, null)", email, emailHash),
+		},
+		{
+			query:    "INSERT INTO users VALUES (1, 'a@b', NULL)",
+			expected: fmt.Sprintf("insert into users values (1, %s, %s)", email, emailHash),
+		},
+		{
+			query:    "UPDATE users SET email='a@b' WHERE email='c@d'",
+			expected: fmt.Sprintf("update users set email = %s, email_hash = %s where email_hash = %s", email, emailHash, otherHash),
+		},
+		{
+			query:    "SELECT id FROM users WHERE 'a@b' = email AND id > 1",
+			expected: fmt.Sprintf("select id from users where %s = email_hash and id > 1", emailHash),
+		},
+		{
+			query:    "SELECT u.id FROM users AS u JOIN orders AS o ON u.id = o.id WHERE u.email IN ('a@b', 'c@d')",
+			expected: fmt.Sprintf("select u.id from users as u join orders as o on u.id = o.id where u.email_hash in (%s, %s)", emailHash, otherHash),
+		},
+		{
+			query:    "DELETE FROM users WHERE email != 'a@b'",
+			expected: fmt.Sprintf("delete from users where email_hash != %s", emailHash),
+		},
+		{
+			query:    "SELECT id FROM users WHERE email = $1",
+			expected: "select id from users where email_hash = $1",
+		},
+		{
+			query:    "SELECT id FROM users WHERE email IN ($1, 'a@b')",
+			expected: fmt.Sprintf("select id from users where email_hash in ($1, %s)", emailHash),
+		},
+		{
+			query:    "SELECT id FROM orders WHERE comment = 'a@b'",
+			expected: "SELECT id FROM orders WHERE comment = 'a@b'",
+		},
+	}
+	for i, testcase := range testcases {
+		query, _, err := encryptor.OnQuery(testcase.query)
+		if err != nil {
+			t.Fatalf("%v. Unexpected error: %v", i, err)
+		}
+		if query != testcase.expected {
+			t.Fatalf("%v. Incorrect query.\nTook: %s\nExpected: %s", i, query, testcase.expected)
+		}
+	}
+
+	_, _, placeholders, err := encryptor.OnPreparedQuery("SELECT id FROM users WHERE email = $2 OR email = $1 AND id = $3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(placeholders) != 2 || !placeholders[0].IsHash || !placeholders[1].IsHash || placeholders[0].Name != "email" {
+		t.Fatalf("Incorrect placeholder settings: %v", placeholders)
+	}
+	if _, _, _, err := encryptor.OnPreparedQuery("UPDATE users SET email = $1 WHERE email = $1"); err != ErrConflictingPlaceholder {
+		t.Fatalf("Expected ErrConflictingPlaceholder, took %v", err)
+	}
+
+	encryptor = NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, nil, nil)
+	if _, _, err := encryptor.OnQuery("SELECT id FROM users WHERE email = 'a@b'"); err != ErrHMACCalculatorNotSet {
+		t.Fatalf("Expected ErrHMACCalculatorNotSet, took %v", err)
+	}
+}
+
+// testTokenizer "tokenizes" data by prefixing it with key id
+type testTokenizer struct{}
+
+func (*testTokenizer) Tokenize(data []byte, tokenType string, id []byte) ([]byte, error) {
+	return append([]byte(tokenType+":"+string(id)+":"), data...), nil
+}
+
+func (*testTokenizer) Detokenize(token []byte, tokenType string, id []byte) ([]byte, error) {
+	return token[len(tokenType)+len(id)+2:], nil
+}
+
+func TestPostgresqlTokenization(t *testing.T) {
+	config := `
+schemas:
+  - table: users
+    columns: ["id", "age", "email"]
+    encrypted:
+      - column: age
+        token_type: int32
+      - column: email
+        token_type: email
+        zone_id: DDDDDDDDHCzqZAZNbBvybWLR
+`
+	schemaStore, err := MapTableSchemaStoreFromConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schemaStore.GetTableSchema("users").IsEncryptedColumn("age") {
+		t.Fatal("Tokenized column shouldn't be treated as column with AcraStructs")
+	}
+	encryptor := NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, nil, &testTokenizer{})
+	testcases := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "INSERT INTO users VALUES (1, 30, 'a@b.com')",
+			expected: "insert into users values (1, int32:client:30, 'email:DDDDDDDDHCzqZAZNbBvybWLR:a@b.com')",
+		},
+		{
+			query:    "UPDATE users SET age = 31 WHERE email IN ('a@b.com')",
+			expected: "update users set age = int32:client:31 where email in ('email:DDDDDDDDHCzqZAZNbBvybWLR:a@b.com')",
+		},
+	}
+	for i, testcase := range testcases {
+		query, _, err := encryptor.OnQuery(testcase.query)
+		if err != nil {
+			t.Fatalf("%v. Unexpected error: %v", i, err)
+		}
+		if query != testcase.expected {
+			t.Fatalf("%v. Incorrect query.\nTook: %s\nExpected: %s", i, query, testcase.expected)
+		}
+	}
+
+	if _, err := MapTableSchemaStoreFromConfig([]byte(`
+schemas:
+  - table: users
+    encrypted:
+      - column: age
+        token_type: unknown
+`)); err != tokenization.ErrUnknownTokenType {
+		t.Fatalf("Expected ErrUnknownTokenType, took %v", err)
+	}
+	encryptor = NewPostgresqlQueryEncryptor(schemaStore, []byte("client"), &testDataEncryptor{}, nil, nil)
+	if _, _, err := encryptor.OnQuery("SELECT id FROM users WHERE age = 1"); err != ErrTokenizerNotSet {
+		t.Fatalf("Expected ErrTokenizerNotSet, took %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackupVersion is version of keys backup archive format
+const BackupVersion = 1
+
+// Names of entries of keys backup archive. Files of private keys folder are stored with backupPrivatePrefix, files of
+// public keys folder, if it differs from private one, with backupPublicPrefix
+const (
+	backupManifestName  = "manifest.json"
+	backupPrivatePrefix = "private/"
+	backupPublicPrefix  = "public/"
+)
+
+// Errors returned on import of keys backup
+var (
+	ErrUnsupportedBackupVersion = errors.New("unsupported version of keys backup")
+	ErrBackupManifestNotFound   = errors.New("keys backup doesn't contain manifest")
+	ErrBackupIntegrity          = errors.New("keys backup is corrupted: files don't match manifest")
+	ErrInvalidBackupPath        = errors.New("keys backup contains invalid file path")
+	ErrBackupKeyExists          = errors.New("key file from backup already exists")
+)
+
+// BackupFile describes one file of keys backup
+type BackupFile struct {
+	Path   string      `json:"path"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+// BackupManifest lists all files of keys backup with their checksums
+type BackupManifest struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Files   []BackupFile `json:"files"`
+}
+
+// backupEntry is file of keys backup with its content
+type backupEntry struct {
+	BackupFile
+	data []byte
+}
+
+// isSameDirectory returns true if both paths point to the same folder
+func isSameDirectory(first, second string) (bool, error) {
+	firstAbs, err := filepath.Abs(first)
+	if err != nil {
+		return false, err
+	}
+	secondAbs, err := filepath.Abs(second)
+	if err != nil {
+		return false, err
+	}
+	return firstAbs == secondAbs, nil
+}
+
+// collectBackupFiles reads all regular files of directory and its subfolders, including previous key versions,
+// poison and audit log keys, and names them with prefix
+func collectBackupFiles(directory, prefix string) ([]*backupEntry, error) {
+	var entries []*backupEntry
+	err := filepath.Walk(directory, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(directory, filePath)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		checksum := sha256.Sum256(data)
+		entries = append(entries, &backupEntry{
+			BackupFile: BackupFile{
+				Path:   prefix + filepath.ToSlash(relativePath),
+				Mode:   info.Mode().Perm(),
+				Size:   int64(len(data)),
+				SHA256: hex.EncodeToString(checksum[:]),
+			},
+			data: data,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// ExportKeys packs all files of private and public keys folders into single tar archive with manifest which lists
+// files with their checksums. Private keys stay encrypted with master key, so archive should be protected separately
+// and master key is required to use restored keys
+func ExportKeys(privateKeysDirectory, publicKeysDirectory string) ([]byte, error) {
+	entries, err := collectBackupFiles(privateKeysDirectory, backupPrivatePrefix)
+	if err != nil {
+		return nil, err
+	}
+	sameDirectory, err := isSameDirectory(privateKeysDirectory, publicKeysDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if !sameDirectory {
+		publicEntries, err := collectBackupFiles(publicKeysDirectory, backupPublicPrefix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		entries = append(entries, publicEntries...)
+	}
+
+	manifest := BackupManifest{Version: BackupVersion, Created: time.Now().UTC(), Files: make([]BackupFile, 0, len(entries))}
+	for _, entry := range entries {
+		manifest.Files = append(manifest.Files, entry.BackupFile)
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	output := &bytes.Buffer{}
+	writer := tar.NewWriter(output)
+	writeEntry := func(name string, mode os.FileMode, data []byte) error {
+		header := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: manifest.Created, Typeflag: tar.TypeReg}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := writer.Write(data)
+		return err
+	}
+	if err := writeEntry(backupManifestName, 0600, manifestData); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := writeEntry(entry.Path, entry.Mode, entry.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	log.Debugf("Exported %v files of keys", len(entries))
+	return output.Bytes(), nil
+}
+
+// readBackup unpacks tar archive of keys backup and checks that it contains exactly the files listed in its manifest
+// with the same sizes and checksums
+func readBackup(archive []byte) (*BackupManifest, []*backupEntry, error) {
+	reader := tar.NewReader(bytes.NewReader(archive))
+	files := make(map[string][]byte)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, nil, ErrInvalidBackupPath
+		}
+		if _, ok := files[header.Name]; ok {
+			return nil, nil, ErrBackupIntegrity
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[header.Name] = data
+	}
+	manifestData, ok := files[backupManifestName]
+	if !ok {
+		return nil, nil, ErrBackupManifestNotFound
+	}
+	delete(files, backupManifestName)
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(manifestData, manifest); err != nil {
+		return nil, nil, err
+	}
+	if manifest.Version != BackupVersion {
+		return nil, nil, ErrUnsupportedBackupVersion
+	}
+	if len(manifest.Files) != len(files) {
+		return nil, nil, ErrBackupIntegrity
+	}
+	entries := make([]*backupEntry, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		data, ok := files[file.Path]
+		if !ok {
+			return nil, nil, ErrBackupIntegrity
+		}
+		// every file is listed once, so all files of archive are restored
+		delete(files, file.Path)
+		checksum := sha256.Sum256(data)
+		if int64(len(data)) != file.Size || hex.EncodeToString(checksum[:]) != file.SHA256 {
+			return nil, nil, ErrBackupIntegrity
+		}
+		entries = append(entries, &backupEntry{BackupFile: file, data: data})
+	}
+	return manifest, entries, nil
+}
+
+// getBackupFileDestination returns path where file of keys backup should be restored and rejects paths which point
+// outside of keys folders
+func getBackupFileDestination(backupPath, privateKeysDirectory, publicKeysDirectory string) (string, error) {
+	var directory, relativePath string
+	switch {
+	case strings.HasPrefix(backupPath, backupPrivatePrefix):
+		directory, relativePath = privateKeysDirectory, strings.TrimPrefix(backupPath, backupPrivatePrefix)
+	case strings.HasPrefix(backupPath, backupPublicPrefix):
+		directory, relativePath = publicKeysDirectory, strings.TrimPrefix(backupPath, backupPublicPrefix)
+	default:
+		return "", ErrInvalidBackupPath
+	}
+	if relativePath == "" || path.IsAbs(relativePath) || path.Clean(relativePath) != relativePath ||
+		relativePath == ".." || strings.HasPrefix(relativePath, "../") || strings.Contains(relativePath, "\\") {
+		return "", ErrInvalidBackupPath
+	}
+	return filepath.Join(directory, filepath.FromSlash(relativePath)), nil
+}
+
+// ImportKeys restores files of keys backup created by ExportKeys to private and public keys folders. Whole archive is
+// validated against its manifest and every destination is checked before any file is written, existing key files are
+// never overwritten. If some file can't be written, already restored files are removed, so keys folders are left as
+// they were. Returns paths of restored files.
+func ImportKeys(archive []byte, privateKeysDirectory, publicKeysDirectory string) ([]string, error) {
+	manifest, entries, err := readBackup(archive)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		destination, err := getBackupFileDestination(entry.Path, privateKeysDirectory, publicKeysDirectory)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(destination); err == nil {
+			log.Errorf("Can't restore %s, file already exists", destination)
+			return nil, ErrBackupKeyExists
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+	}
+
+	restored := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		err := os.MkdirAll(filepath.Dir(destinations[i]), 0700)
+		if err == nil {
+			err = writeFileAtomically(destinations[i], entry.data, entry.Mode.Perm())
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Can't restore %s, remove %v already restored files", destinations[i], len(restored))
+			for _, restoredPath := range restored {
+				if err := os.Remove(restoredPath); err != nil {
+					log.WithError(err).Errorf("Can't remove %s", restoredPath)
+				}
+			}
+			return nil, err
+		}
+		restored = append(restored, destinations[i])
+	}
+	log.Infof("Restored %v files of keys backup created at %v", len(restored), manifest.Created)
+	return restored, nil
+}
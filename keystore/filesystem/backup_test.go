@@ -0,0 +1,180 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestExportImportKeys(t *testing.T) {
+	directory, err := ioutil.TempDir("", "test_keys_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	privateDirectory := filepath.Join(directory, "private")
+	publicDirectory := filepath.Join(directory, "public")
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFilesystemKeyStoreTwoPath(privateDirectory, publicDirectory, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	zoneID, _, err := store.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPoisonKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	zoneKeys, err := store.GetZonePrivateKeys(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ExportKeys(privateDirectory, publicDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredPrivateDirectory := filepath.Join(directory, "restored_private")
+	restoredPublicDirectory := filepath.Join(directory, "restored_public")
+	restored, err := ImportKeys(archive, restoredPrivateDirectory, restoredPublicDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// storage key, 2 zone key versions and poison key with public keys of storage, zone and poison keys
+	if len(restored) != 7 {
+		t.Fatalf("Expected 7 restored files, took %v", restored)
+	}
+	restoredStore, err := NewFilesystemKeyStoreTwoPath(restoredPrivateDirectory, restoredPublicDirectory, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoredStore.VerifyMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	restoredZoneKeys, err := restoredStore.GetZonePrivateKeys(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restoredZoneKeys) != len(zoneKeys) {
+		t.Fatalf("Expected %v versions of zone key, took %v", len(zoneKeys), len(restoredZoneKeys))
+	}
+	for i := range zoneKeys {
+		if !bytes.Equal(zoneKeys[i].Value, restoredZoneKeys[i].Value) {
+			t.Fatal("Restored zone key doesn't match exported key")
+		}
+	}
+	if _, err := restoredStore.GetServerDecryptionPrivateKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(restoredPrivateDirectory, getServerDecryptionKeyFilename(clientID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected 0600 permissions of private key, took %v", info.Mode().Perm())
+	}
+
+	// existing keys are never overwritten and nothing is restored
+	otherPrivateDirectory := filepath.Join(directory, "other_private")
+	if err := os.MkdirAll(otherPrivateDirectory, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(otherPrivateDirectory, getServerDecryptionKeyFilename(clientID)), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportKeys(archive, otherPrivateDirectory, restoredPublicDirectory); err != ErrBackupKeyExists {
+		t.Fatalf("Expected ErrBackupKeyExists, took %v", err)
+	}
+	files, err := ioutil.ReadDir(otherPrivateDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("Keys were partially restored")
+	}
+
+	// changed file doesn't match manifest
+	corrupted := append([]byte{}, archive...)
+	index := bytes.Index(corrupted, []byte(PoisonKeyFilename))
+	if index < 0 {
+		t.Fatal("Can't find poison key in archive")
+	}
+	// header of tar entry is 512 bytes long and followed by content
+	corrupted[index-index%512+512] ^= 0xff
+	if _, err := ImportKeys(corrupted, filepath.Join(directory, "corrupted_private"), filepath.Join(directory, "corrupted_public")); err != ErrBackupIntegrity {
+		t.Fatalf("Expected ErrBackupIntegrity, took %v", err)
+	}
+}
+
+func TestImportKeysInvalidPath(t *testing.T) {
+	directory, err := ioutil.TempDir("", "test_keys_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	restoredDirectory := filepath.Join(directory, "restored")
+	for _, backupPath := range []string{"private/../../key", "public/../key", "private//key", "/key", "key"} {
+		data := []byte("key")
+		checksum := sha256.Sum256(data)
+		manifest, err := json.Marshal(BackupManifest{Version: BackupVersion, Files: []BackupFile{
+			{Path: backupPath, Mode: 0600, Size: int64(len(data)), SHA256: hex.EncodeToString(checksum[:])},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := &bytes.Buffer{}
+		writer := tar.NewWriter(output)
+		for name, content := range map[string][]byte{backupManifestName: manifest, backupPath: data} {
+			if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writer.Write(content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ImportKeys(output.Bytes(), restoredDirectory, restoredDirectory); err != ErrInvalidBackupPath {
+			t.Fatalf("Expected ErrInvalidBackupPath for %s, took %v", backupPath, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(directory, "key")); !os.IsNotExist(err) {
+		t.Fatal("File was restored outside of keys folder")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/cossacklabs/acra/cmd/acra-connector/connector-mode"
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/themis/gothemis/keys"
-	"io/ioutil"
 	"path/filepath"
 )
 
@@ -31,17 +30,27 @@ type ConnectorFileSystemKeyStore struct {
 	clientID      []byte
 	encryptor     keystore.KeyEncryptor
 	connectorMode connector_mode.ConnectorMode
+	storage       Storage
 }
 
 // NewConnectorFileSystemKeyStore creates new ConnectorFileSystemKeyStore
 func NewConnectorFileSystemKeyStore(directory string, clientID []byte, encryptor keystore.KeyEncryptor, mode connector_mode.ConnectorMode) (*ConnectorFileSystemKeyStore, error) {
-	return &ConnectorFileSystemKeyStore{directory: directory, clientID: clientID, encryptor: encryptor, connectorMode: mode}, nil
+	return NewConnectorKeyStoreWithStorage(directory, clientID, nil, encryptor, mode)
+}
+
+// NewConnectorKeyStoreWithStorage creates new ConnectorFileSystemKeyStore which reads files of keys from storage.
+// Local file system is used if storage is nil.
+func NewConnectorKeyStoreWithStorage(directory string, clientID []byte, storage Storage, encryptor keystore.KeyEncryptor, mode connector_mode.ConnectorMode) (*ConnectorFileSystemKeyStore, error) {
+	if storage == nil {
+		storage = fileStorage{}
+	}
+	return &ConnectorFileSystemKeyStore{directory: directory, clientID: clientID, encryptor: encryptor, connectorMode: mode, storage: storage}, nil
 }
 
 // CheckIfPrivateKeyExists checks if Keystore has Connector transport private key for establishing Secure Session connection,
 // returns true if key exists in fs.
 func (store *ConnectorFileSystemKeyStore) CheckIfPrivateKeyExists(id []byte) (bool, error) {
-	_, err := ioutil.ReadFile(filepath.Join(store.directory, getConnectorKeyFilename(id)))
+	_, err := store.storage.ReadFile(filepath.Join(store.directory, getConnectorKeyFilename(id)))
 	if err != nil {
 		return false, err
 	}
@@ -50,7 +59,7 @@ func (store *ConnectorFileSystemKeyStore) CheckIfPrivateKeyExists(id []byte) (bo
 
 // GetPrivateKey reads and decrypts Connector transport private key for establishing Secure Session connection.
 func (store *ConnectorFileSystemKeyStore) GetPrivateKey(id []byte) (*keys.PrivateKey, error) {
-	keyData, err := ioutil.ReadFile(filepath.Join(store.directory, getConnectorKeyFilename(id)))
+	keyData, err := store.storage.ReadFile(filepath.Join(store.directory, getConnectorKeyFilename(id)))
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +85,7 @@ func (store *ConnectorFileSystemKeyStore) GetPeerPublicKey(id []byte) (*keys.Pub
 		return nil, errors.New("unsupported ConnectorMode, can't find PeerPublicKey")
 	}
 
-	key, err := ioutil.ReadFile(filepath.Join(store.directory, getPublicKeyFilename([]byte(filename))))
+	key, err := store.storage.ReadFile(filepath.Join(store.directory, getPublicKeyFilename([]byte(filename))))
 	if err != nil {
 		return nil, err
 	}
@@ -27,8 +27,20 @@ var lock = sync.RWMutex{}
 const (
 	PoisonKeyFilename    = ".poison_key/poison_key"
 	BasicAuthKeyFilename = "auth_key"
+	AuditLogKeyFilename  = ".audit_log/audit_log_key"
 )
 
+// keyVersionTimeFormat is layout of names of previous key versions, their lexical order matches order of replacing
+const keyVersionTimeFormat = "20060102T150405.000000000Z"
+
+// keyHistorySuffix is suffix of folder with previous versions of private key
+const keyHistorySuffix = ".history"
+
+// getKeyHistoryDirectory returns folder with previous versions of private key stored in filename
+func getKeyHistoryDirectory(filename string) string {
+	return filename + keyHistorySuffix
+}
+
 // getZoneKeyFilename
 func getZoneKeyFilename(id []byte) string {
 	return fmt.Sprintf("%s_zone", string(id))
@@ -59,6 +71,16 @@ func getServerDecryptionKeyFilename(id []byte) string {
 	return fmt.Sprintf("%s_storage", string(id))
 }
 
+// getHmacKeyFilename
+func getHmacKeyFilename(id []byte) string {
+	return fmt.Sprintf("%s_hmac", string(id))
+}
+
+// getTokenKeyFilename
+func getTokenKeyFilename(id []byte) string {
+	return fmt.Sprintf("%s_token", string(id))
+}
+
 // getConnectorKeyFilename
 func getConnectorKeyFilename(id []byte) string {
 	return string(id)
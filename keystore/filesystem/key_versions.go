@@ -0,0 +1,205 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	"github.com/cossacklabs/themis/gothemis/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+// keyHistory is decrypted previous versions of private key cached together with current key they were loaded for.
+// History is loaded again when current key differs because key was rotated by other process
+type keyHistory struct {
+	current  []byte
+	versions [][]byte
+}
+
+// zero fills values of keys of history with zeros
+func (history *keyHistory) zero() {
+	utils.FillSlice(byte(0), history.current)
+	for _, version := range history.versions {
+		utils.FillSlice(byte(0), version)
+	}
+}
+
+// forgetKeyHistory removes cached history of private key stored in filename
+func (store *FilesystemKeyStore) forgetKeyHistory(filename string) {
+	store.historyLock.Lock()
+	defer store.historyLock.Unlock()
+	if history, ok := store.histories[filename]; ok {
+		history.zero()
+		delete(store.histories, filename)
+	}
+}
+
+// clearKeyHistories removes all cached histories of private keys
+func (store *FilesystemKeyStore) clearKeyHistories() {
+	store.historyLock.Lock()
+	defer store.historyLock.Unlock()
+	for filename, history := range store.histories {
+		history.zero()
+		delete(store.histories, filename)
+	}
+}
+
+// archivePrivateKey copies current private key stored in filename to history of its versions before it's replaced,
+// so AcraStructs encrypted with previous public key may be decrypted until the version is retired
+func (store *FilesystemKeyStore) archivePrivateKey(filename string) error {
+	path := store.getPrivateKeyFilePath(filename)
+	exists, err := store.storage.Exists(path)
+	if err != nil || !exists {
+		return err
+	}
+	encryptedKey, err := store.storage.ReadPrivateKeyFile(path)
+	if err != nil {
+		return err
+	}
+	historyDirectory := store.getPrivateKeyFilePath(getKeyHistoryDirectory(filename))
+	if err := store.storage.MkdirAll(historyDirectory, 0700); err != nil {
+		return err
+	}
+	version := time.Now().UTC().Format(keyVersionTimeFormat)
+	log.Debugf("Save previous version of %s as %s", filename, version)
+	store.forgetKeyHistory(filename)
+	return store.storage.WriteFile(filepath.Join(historyDirectory, version), encryptedKey, 0600)
+}
+
+// listKeyVersions returns names of previous versions of private key stored in filename, from newest to oldest
+func (store *FilesystemKeyStore) listKeyVersions(filename string) ([]string, error) {
+	versions, err := store.storage.ListFiles(store.getPrivateKeyFilePath(getKeyHistoryDirectory(filename)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// getPrivateKeysByFilename returns current private key stored in filename followed by its previous versions.
+// Decrypted previous versions are cached until current key is changed, keys are returned as copies which callers
+// may fill with zeros after use
+func (store *FilesystemKeyStore) getPrivateKeysByFilename(id []byte, filename string) ([]*keys.PrivateKey, error) {
+	currentKey, err := store.getPrivateKeyByFilename(id, filename)
+	if err != nil {
+		return nil, err
+	}
+	store.historyLock.Lock()
+	defer store.historyLock.Unlock()
+	history, ok := store.histories[filename]
+	if !ok || !bytes.Equal(history.current, currentKey.Value) {
+		if ok {
+			history.zero()
+			delete(store.histories, filename)
+		}
+		history, err = store.loadKeyHistory(id, filename, currentKey)
+		if err != nil {
+			return nil, err
+		}
+		// keystore without cache doesn't keep keys in memory
+		if _, noCache := store.cache.(keystore.NoCache); !noCache {
+			store.histories[filename] = history
+		} else {
+			defer history.zero()
+		}
+	}
+	privateKeys := make([]*keys.PrivateKey, 0, len(history.versions)+1)
+	privateKeys = append(privateKeys, currentKey)
+	for _, version := range history.versions {
+		privateKeys = append(privateKeys, &keys.PrivateKey{Value: append([]byte{}, version...)})
+	}
+	return privateKeys, nil
+}
+
+// loadKeyHistory reads and decrypts previous versions of private key stored in filename
+func (store *FilesystemKeyStore) loadKeyHistory(id []byte, filename string, currentKey *keys.PrivateKey) (*keyHistory, error) {
+	versions, err := store.listKeyVersions(filename)
+	if err != nil {
+		return nil, err
+	}
+	history := &keyHistory{current: append([]byte{}, currentKey.Value...), versions: make([][]byte, 0, len(versions))}
+	for _, version := range versions {
+		privateKey, err := store.getPrivateKeyByFilename(id, filepath.Join(getKeyHistoryDirectory(filename), version))
+		if err != nil {
+			history.zero()
+			return nil, err
+		}
+		history.versions = append(history.versions, privateKey.Value)
+	}
+	return history, nil
+}
+
+// retireKeyVersions removes previous versions of private key stored in filename and returns their count
+func (store *FilesystemKeyStore) retireKeyVersions(id []byte, filename string) (int, error) {
+	if !keystore.ValidateID(id) {
+		return 0, keystore.ErrInvalidClientID
+	}
+	versions, err := store.listKeyVersions(filename)
+	if err != nil {
+		return 0, err
+	}
+	historyDirectory := getKeyHistoryDirectory(filename)
+	// retired versions may be cached, history is removed after lock of files is released
+	defer store.forgetKeyHistory(filename)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for i, version := range versions {
+		if err := store.storage.Remove(store.getPrivateKeyFilePath(filepath.Join(historyDirectory, version))); err != nil {
+			return i, err
+		}
+	}
+	if len(versions) > 0 {
+		if err := store.storage.Remove(store.getPrivateKeyFilePath(historyDirectory)); err != nil && !os.IsNotExist(err) {
+			return len(versions), err
+		}
+	}
+	// retired versions may be cached
+	store.cache.Clear()
+	return len(versions), nil
+}
+
+// GetZonePrivateKeys returns current private key of zone followed by its previous versions from newest to oldest
+func (store *FilesystemKeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return store.getPrivateKeysByFilename(id, getZoneKeyFilename(id))
+}
+
+// GetServerDecryptionPrivateKeys returns current storage private key of clientID followed by its previous versions
+// from newest to oldest
+func (store *FilesystemKeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return store.getPrivateKeysByFilename(id, getServerDecryptionKeyFilename(id))
+}
+
+// RetireZoneKeyVersions removes previous versions of zone private key when all AcraStructs of zone are re-encrypted
+// with current key. Returns count of removed versions
+func (store *FilesystemKeyStore) RetireZoneKeyVersions(id []byte) (int, error) {
+	return store.retireKeyVersions(id, getZoneKeyFilename(id))
+}
+
+// RetireServerDecryptionKeyVersions removes previous versions of storage private key of clientID when all
+// AcraStructs of client are re-encrypted with current key. Returns count of removed versions
+func (store *FilesystemKeyStore) RetireServerDecryptionKeyVersions(id []byte) (int, error) {
+	return store.retireKeyVersions(id, getServerDecryptionKeyFilename(id))
+}
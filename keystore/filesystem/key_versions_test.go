@@ -0,0 +1,185 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestFilesystemKeyStore_KeyVersions(t *testing.T) {
+	keyDirectory, err := ioutil.TempDir("", "test_key_versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDirectory)
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("some key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFilesystemKeyStore(keyDirectory, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneID, _, err := store.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKey, err := store.GetZonePrivateKey(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privateKeys, err := store.GetZonePrivateKeys(zoneID); err != nil || len(privateKeys) != 1 {
+		t.Fatalf("Expected only current key, took %v keys, %v", len(privateKeys), err)
+	}
+	if _, err := store.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	secondKey, err := store.GetZonePrivateKey(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	thirdKey, err := store.GetZonePrivateKey(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeys, err := store.GetZonePrivateKeys(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKeys := [][]byte{thirdKey.Value, secondKey.Value, firstKey.Value}
+	if len(privateKeys) != len(expectedKeys) {
+		t.Fatalf("Expected %v versions of key, took %v", len(expectedKeys), len(privateKeys))
+	}
+	for i, expectedKey := range expectedKeys {
+		if !bytes.Equal(privateKeys[i].Value, expectedKey) {
+			t.Fatalf("Version %v of key doesn't match expected key", i)
+		}
+	}
+
+	// previous versions of keys are re-encrypted on master key rotation
+	newEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("new key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateMasterKey(keyDirectory, keyDirectory+"_backup", encryptor, newEncryptor); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDirectory + "_backup")
+	store, err = NewFilesystemKeyStore(keyDirectory, newEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privateKeys, err := store.GetZonePrivateKeys(zoneID); err != nil || len(privateKeys) != len(expectedKeys) {
+		t.Fatalf("Expected %v versions of key after master key rotation, took %v, %v", len(expectedKeys), len(privateKeys), err)
+	}
+
+	retired, err := store.RetireZoneKeyVersions(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retired != 2 {
+		t.Fatalf("Expected 2 retired versions, took %v", retired)
+	}
+	privateKeys, err = store.GetZonePrivateKeys(zoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(privateKeys) != 1 || !bytes.Equal(privateKeys[0].Value, thirdKey.Value) {
+		t.Fatal("Expected only current key after retirement")
+	}
+	if _, err := os.Stat(store.getPrivateKeyFilePath(getKeyHistoryDirectory(getZoneKeyFilename(zoneID)))); !os.IsNotExist(err) {
+		t.Fatalf("Expected removed folder of previous versions, took %v", err)
+	}
+
+	clientID := []byte("client")
+	if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if privateKeys, err := store.GetServerDecryptionPrivateKeys(clientID); err != nil || len(privateKeys) != 2 {
+		t.Fatalf("Expected 2 versions of storage key, took %v, %v", len(privateKeys), err)
+	}
+	if retired, err := store.RetireServerDecryptionKeyVersions(clientID); err != nil || retired != 1 {
+		t.Fatalf("Expected 1 retired version of storage key, took %v, %v", retired, err)
+	}
+}
+
+func TestFilesystemKeyStore_KeyHistoryCache(t *testing.T) {
+	keyDirectory, err := ioutil.TempDir("", "test_key_history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDirectory)
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("some key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFilesystemKeyStore(keyDirectory, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneID, _, err := store.GenerateZoneKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	privateKeys, err := store.GetZonePrivateKeys(zoneID)
+	if err != nil || len(privateKeys) != 2 {
+		t.Fatalf("Expected 2 versions of key, took %v, %v", len(privateKeys), err)
+	}
+	previousKey := append([]byte{}, privateKeys[1].Value...)
+	// callers fill returned keys with zeros after use
+	for _, privateKey := range privateKeys {
+		for i := range privateKey.Value {
+			privateKey.Value[i] = 0
+		}
+	}
+	// cached history isn't read from files again
+	if err := os.RemoveAll(store.getPrivateKeyFilePath(getKeyHistoryDirectory(getZoneKeyFilename(zoneID)))); err != nil {
+		t.Fatal(err)
+	}
+	privateKeys, err = store.GetZonePrivateKeys(zoneID)
+	if err != nil || len(privateKeys) != 2 {
+		t.Fatalf("Expected 2 cached versions of key, took %v, %v", len(privateKeys), err)
+	}
+	if !bytes.Equal(privateKeys[1].Value, previousKey) {
+		t.Fatal("Cached version of key was changed by caller")
+	}
+	// rotation invalidates cached history
+	if _, err := store.RotateZoneKey(zoneID); err != nil {
+		t.Fatal(err)
+	}
+	privateKeys, err = store.GetZonePrivateKeys(zoneID)
+	if err != nil || len(privateKeys) != 2 {
+		t.Fatalf("Expected 2 versions of key after rotation, took %v, %v", len(privateKeys), err)
+	}
+	if bytes.Equal(privateKeys[1].Value, previousKey) {
+		t.Fatal("History of key wasn't loaded again after rotation")
+	}
+}
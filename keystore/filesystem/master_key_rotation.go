@@ -0,0 +1,196 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Errors returned by RotateMasterKey
+var (
+	ErrBackupDirectoryExists = errors.New("backup directory already exists")
+	ErrRotatedKeyMismatch    = errors.New("key re-encrypted with new master key doesn't match original key")
+)
+
+// rotatedKey is key of key folder re-encrypted with new master key
+type rotatedKey struct {
+	filename     string
+	context      []byte
+	key          []byte
+	oldEncrypted []byte
+	newEncrypted []byte
+}
+
+// decryptKeyFile decrypts key stored in filename of directory with one of possible contexts
+func decryptKeyFile(directory, filename string, encryptor keystore.KeyEncryptor) (*rotatedKey, error) {
+	encrypted, err := ioutil.ReadFile(filepath.Join(directory, filename))
+	if err != nil {
+		return nil, err
+	}
+	for _, context := range keyFileContexts(filename) {
+		if key, err := encryptor.Decrypt(encrypted, context); err == nil {
+			return &rotatedKey{filename: filename, context: context, key: key, oldEncrypted: encrypted}, nil
+		}
+	}
+	return nil, fmt.Errorf("can't decrypt %s with old master key", filename)
+}
+
+// listEncryptedKeyFiles returns names of files with encrypted keys in directory, including previous versions of keys,
+// poison and audit log keys
+func listEncryptedKeyFiles(directory string) ([]string, error) {
+	files, err := fileStorage{}.ListFiles(directory)
+	if err != nil {
+		return nil, err
+	}
+	filenames := make([]string, 0, len(files)+2)
+	for _, filename := range files {
+		if !isEncryptedKeyFilename(filename) {
+			continue
+		}
+		filenames = append(filenames, filename)
+		historyDirectory := getKeyHistoryDirectory(filename)
+		versions, err := fileStorage{}.ListFiles(filepath.Join(directory, historyDirectory))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, version := range versions {
+			filenames = append(filenames, filepath.Join(historyDirectory, version))
+		}
+	}
+	for _, filename := range []string{PoisonKeyFilename, AuditLogKeyFilename} {
+		exists, err := utils.FileExists(filepath.Join(directory, filename))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames, nil
+}
+
+// writeFileAtomically writes data to temporary file in the same directory and renames it to path, so path contains
+// either old or new data
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// RotateMasterKey re-encrypts every key of key folder in directory, encrypted with oldEncryptor, with newEncryptor
+// and the same context. All keys are decrypted before any file is changed, so nothing is written if any key can't be
+// decrypted with old master key. Original files are copied to backupDirectory which shouldn't exist, then files are
+// replaced atomically one by one and verified with newEncryptor. Returns names of re-encrypted files.
+func RotateMasterKey(directory, backupDirectory string, oldEncryptor, newEncryptor keystore.KeyEncryptor) ([]string, error) {
+	if _, err := os.Stat(backupDirectory); err == nil {
+		return nil, ErrBackupDirectoryExists
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	filenames, err := listEncryptedKeyFiles(directory)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*rotatedKey, 0, len(filenames))
+	defer func() {
+		for _, key := range keys {
+			utils.FillSlice(0, key.key)
+		}
+	}()
+	for _, filename := range filenames {
+		key, err := decryptKeyFile(directory, filename, oldEncryptor)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		key.newEncrypted, err = newEncryptor.Encrypt(key.key, key.context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range keys {
+		backupPath := filepath.Join(backupDirectory, key.filename)
+		if err := os.MkdirAll(filepath.Dir(backupPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(backupPath, key.oldEncrypted, 0600); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Backup of %v keys encrypted with old master key saved to %s", len(keys), backupDirectory)
+
+	rotated := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if err := writeFileAtomically(filepath.Join(directory, key.filename), key.newEncrypted, 0600); err != nil {
+			log.WithError(err).Errorf("Can't write %s, restore keys from %s", key.filename, backupDirectory)
+			return rotated, err
+		}
+		rotated = append(rotated, key.filename)
+	}
+
+	for _, key := range keys {
+		encrypted, err := ioutil.ReadFile(filepath.Join(directory, key.filename))
+		if err != nil {
+			return rotated, err
+		}
+		decrypted, err := newEncryptor.Decrypt(encrypted, key.context)
+		if err != nil {
+			return rotated, fmt.Errorf("can't decrypt %s with new master key: %v", key.filename, err)
+		}
+		equal := bytes.Equal(decrypted, key.key)
+		utils.FillSlice(0, decrypted)
+		if !equal {
+			return rotated, ErrRotatedKeyMismatch
+		}
+	}
+	return rotated, nil
+}
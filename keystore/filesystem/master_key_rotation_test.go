@@ -0,0 +1,151 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+func TestRotateMasterKey(t *testing.T) {
+	keyDirectory, err := ioutil.TempDir("", "test_rotate_master_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDirectory)
+	backupDirectory := keyDirectory + "_backup"
+	defer os.RemoveAll(backupDirectory)
+	oldEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("old master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("new master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFilesystemKeyStore(keyDirectory, oldEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	// connector's key is stored without suffix and its id ends with suffix of other key
+	connectorID := []byte("connector_server")
+	if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GenerateConnectorKeys(connectorID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GenerateHMACSecretKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	hmacKey, err := store.GetHMACSecretKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poisonKeyPair, err := store.GetPoisonKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey, err := store.GetAuthKey(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetAuditLogKey(); err != nil {
+		t.Fatal(err)
+	}
+	storageKey, err := store.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageKeyValue := append([]byte{}, storageKey.Value...)
+
+	// nothing is changed if some key can't be decrypted with old master key
+	wrongEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("wrong master key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateMasterKey(keyDirectory, backupDirectory, wrongEncryptor, newEncryptor); err == nil {
+		t.Fatal("Expected error with incorrect old master key")
+	}
+	if _, err := os.Stat(backupDirectory); !os.IsNotExist(err) {
+		t.Fatal("Backup directory shouldn't be created on failure")
+	}
+
+	rotated, err := RotateMasterKey(keyDirectory, backupDirectory, oldEncryptor, newEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// storage, hmac, connector, poison and audit log keys
+	if len(rotated) != 5 {
+		t.Fatalf("Expected 5 rotated keys, took %v", rotated)
+	}
+	if _, err := RotateMasterKey(keyDirectory, backupDirectory, newEncryptor, oldEncryptor); err != ErrBackupDirectoryExists {
+		t.Fatalf("Expected ErrBackupDirectoryExists, took %v", err)
+	}
+
+	newStore, err := NewFilesystemKeyStore(keyDirectory, newEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newStore.VerifyMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	newStorageKey, err := newStore.GetServerDecryptionPrivateKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newStorageKey.Value, storageKeyValue) {
+		t.Fatal("Rotated storage key doesn't match original key")
+	}
+	newHMACKey, err := newStore.GetHMACSecretKey(clientID)
+	if err != nil || !bytes.Equal(newHMACKey, hmacKey) {
+		t.Fatalf("Rotated HMAC key doesn't match original key, %v", err)
+	}
+	newPoisonKeyPair, err := newStore.GetPoisonKeyPair()
+	if err != nil || !bytes.Equal(newPoisonKeyPair.Private.Value, poisonKeyPair.Private.Value) {
+		t.Fatalf("Rotated poison key doesn't match original key, %v", err)
+	}
+	if _, err := newStore.GetPrivateKey(connectorID); err == nil {
+		t.Fatal("Unexpected server key of connector id")
+	}
+	newAuthKey, err := newStore.GetAuthKey(false)
+	if err != nil || !bytes.Equal(newAuthKey, authKey) {
+		t.Fatalf("Auth key shouldn't be changed, %v", err)
+	}
+
+	// backup is decryptable with old master key
+	oldStore, err := NewFilesystemKeyStore(backupDirectory, oldEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oldStore.VerifyMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	backupKey, err := ioutil.ReadFile(filepath.Join(backupDirectory, string(connectorID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oldEncryptor.Decrypt(backupKey, connectorID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -34,10 +34,10 @@ import (
 	"github.com/cossacklabs/acra/zone"
 	"github.com/cossacklabs/themis/gothemis/keys"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 )
 
@@ -49,45 +49,66 @@ type FilesystemKeyStore struct {
 	directory           string
 	lock                *sync.RWMutex
 	encryptor           keystore.KeyEncryptor
+	storage             Storage
+	historyLock         sync.Mutex
+	histories           map[string]*keyHistory
 }
 
 // NewFileSystemKeyStoreWithCacheSize represents keystore that reads keys from key folders, and stores them in cache.
 func NewFileSystemKeyStoreWithCacheSize(directory string, encryptor keystore.KeyEncryptor, cacheSize int) (*FilesystemKeyStore, error) {
-	return newFilesystemKeyStore(directory, directory, encryptor, cacheSize)
+	return newFilesystemKeyStore(directory, directory, nil, encryptor, cacheSize)
 }
 
 // NewFilesystemKeyStore represents keystore that reads keys from key folders, and stores them in memory.
 func NewFilesystemKeyStore(directory string, encryptor keystore.KeyEncryptor) (*FilesystemKeyStore, error) {
-	return newFilesystemKeyStore(directory, directory, encryptor, keystore.InfiniteCacheSize)
+	return newFilesystemKeyStore(directory, directory, nil, encryptor, keystore.InfiniteCacheSize)
 }
 
 // NewFilesystemKeyStoreTwoPath creates new FilesystemKeyStore using separate folders for private and public keys.
 func NewFilesystemKeyStoreTwoPath(privateKeyFolder, publicKeyFolder string, encryptor keystore.KeyEncryptor) (*FilesystemKeyStore, error) {
-	return newFilesystemKeyStore(privateKeyFolder, publicKeyFolder, encryptor, keystore.InfiniteCacheSize)
+	return newFilesystemKeyStore(privateKeyFolder, publicKeyFolder, nil, encryptor, keystore.InfiniteCacheSize)
 }
 
-func newFilesystemKeyStore(privateKeyFolder, publicKeyFolder string, encryptor keystore.KeyEncryptor, cacheSize int) (*FilesystemKeyStore, error) {
+// NewFilesystemKeyStoreWithStorage creates new FilesystemKeyStore which reads and writes files of keys in storage
+// using separate folders for private and public keys. Local file system is used if storage is nil.
+func NewFilesystemKeyStoreWithStorage(privateKeyFolder, publicKeyFolder string, storage Storage, encryptor keystore.KeyEncryptor, cacheSize int) (*FilesystemKeyStore, error) {
+	return newFilesystemKeyStore(privateKeyFolder, publicKeyFolder, storage, encryptor, cacheSize)
+}
+
+// checkKeyFolders checks that folders of keys in local file system have correct permissions
+func checkKeyFolders(privateKeyFolder, publicKeyFolder string) error {
 	// check folder for private key
 	directory, err := filepath.Abs(privateKeyFolder)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	fi, err := os.Stat(directory)
 	if nil == err && runtime.GOOS == "linux" && fi.Mode().Perm().String() != "-rwx------" {
 		log.Errorln("Key store folder has an incorrect permissions")
-		return nil, errors.New("key store folder has an incorrect permissions")
+		return errors.New("key store folder has an incorrect permissions")
 	}
 	if privateKeyFolder != publicKeyFolder {
 		// check folder for public key
 		directory, err = filepath.Abs(privateKeyFolder)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		fi, err = os.Stat(directory)
 		if nil != err && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func newFilesystemKeyStore(privateKeyFolder, publicKeyFolder string, storage Storage, encryptor keystore.KeyEncryptor, cacheSize int) (*FilesystemKeyStore, error) {
+	if storage == nil {
+		if err := checkKeyFolders(privateKeyFolder, publicKeyFolder); err != nil {
 			return nil, err
 		}
+		storage = fileStorage{}
 	}
+	var err error
 	var cache keystore.Cache
 	if cacheSize == keystore.WithoutCache {
 		cache = keystore.NoCache{}
@@ -98,7 +119,7 @@ func newFilesystemKeyStore(privateKeyFolder, publicKeyFolder string, encryptor k
 		}
 	}
 	store := &FilesystemKeyStore{privateKeyDirectory: privateKeyFolder, publicKeyDirectory: publicKeyFolder,
-		cache: cache, lock: &sync.RWMutex{}, encryptor: encryptor}
+		cache: cache, lock: &sync.RWMutex{}, encryptor: encryptor, storage: storage, histories: make(map[string]*keyHistory)}
 	// set callback on cache value removing
 
 	return store, nil
@@ -117,13 +138,13 @@ func (store *FilesystemKeyStore) generateKeyPair(filename string, clientID []byt
 
 func (store *FilesystemKeyStore) saveKeyPairWithFilename(keypair *keys.Keypair, filename string, id []byte) error {
 	privateKeysFolder := filepath.Dir(store.getPrivateKeyFilePath(filename))
-	err := os.MkdirAll(privateKeysFolder, 0700)
+	err := store.storage.MkdirAll(privateKeysFolder, 0700)
 	if err != nil {
 		return err
 	}
 
 	publicKeysFolder := filepath.Dir(store.getPublicKeyFilePath(filename))
-	err = os.MkdirAll(publicKeysFolder, 0700)
+	err = store.storage.MkdirAll(publicKeysFolder, 0700)
 	if err != nil {
 		return err
 	}
@@ -132,11 +153,11 @@ func (store *FilesystemKeyStore) saveKeyPairWithFilename(keypair *keys.Keypair,
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(store.getPrivateKeyFilePath(filename), encryptedPrivate, 0600)
+	err = store.storage.WriteFile(store.getPrivateKeyFilePath(filename), encryptedPrivate, 0600)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(store.getPublicKeyFilePath(fmt.Sprintf("%s.pub", filename)), keypair.Public.Value, 0644)
+	err = store.storage.WriteFile(store.getPublicKeyFilePath(fmt.Sprintf("%s.pub", filename)), keypair.Public.Value, 0644)
 	if err != nil {
 		return err
 	}
@@ -153,12 +174,12 @@ func (store *FilesystemKeyStore) generateKey(filename string, length uint8) ([]b
 		return nil, err
 	}
 	dirpath := filepath.Dir(store.getPrivateKeyFilePath(filename))
-	err = os.MkdirAll(dirpath, 0700)
+	err = store.storage.MkdirAll(dirpath, 0700)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
-	err = ioutil.WriteFile(store.getPrivateKeyFilePath(filename), randomBytes, 0600)
+	err = store.storage.WriteFile(store.getPrivateKeyFilePath(filename), randomBytes, 0600)
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -216,11 +237,11 @@ func (store *FilesystemKeyStore) getPrivateKeyByFilename(id []byte, filename str
 	defer store.lock.Unlock()
 	encryptedKey, ok := store.cache.Get(filename)
 	if !ok {
-		encryptedPrivateKey, err := utils.LoadPrivateKey(store.getPrivateKeyFilePath(filename))
+		encryptedPrivateKey, err := store.storage.ReadPrivateKeyFile(store.getPrivateKeyFilePath(filename))
 		if err != nil {
 			return nil, err
 		}
-		encryptedKey = encryptedPrivateKey.Value
+		encryptedKey = encryptedPrivateKey
 	}
 
 	decryptedKey, err := store.encryptor.Decrypt(encryptedKey, id)
@@ -256,16 +277,31 @@ func (store *FilesystemKeyStore) HasZonePrivateKey(id []byte) bool {
 	if ok {
 		return true
 	}
-	exists, _ := utils.FileExists(store.getPrivateKeyFilePath(fname))
+	exists, _ := store.storage.Exists(store.getPrivateKeyFilePath(fname))
 	return exists
 }
 
 // GetPeerPublicKey returns public key for this clientID, gets it from cache or reads from fs.
 func (store *FilesystemKeyStore) GetPeerPublicKey(id []byte) (*keys.PublicKey, error) {
+	return store.getPublicKeyByFilename(id, getPublicKeyFilename(id))
+}
+
+// GetClientIDEncryptionPublicKey returns public key of AcraStorage keypair for this clientID that used to create
+// AcraStructs, gets it from cache or reads from fs.
+func (store *FilesystemKeyStore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error) {
+	return store.getPublicKeyByFilename(clientID, getPublicKeyFilename([]byte(getServerDecryptionKeyFilename(clientID))))
+}
+
+// GetZonePublicKey returns public key of zone keypair that used to create AcraStructs with zone,
+// gets it from cache or reads from fs.
+func (store *FilesystemKeyStore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	return store.getPublicKeyByFilename(zoneID, getZonePublicKeyFilename(zoneID))
+}
+
+func (store *FilesystemKeyStore) getPublicKeyByFilename(id []byte, fname string) (*keys.PublicKey, error) {
 	if !keystore.ValidateID(id) {
 		return nil, keystore.ErrInvalidClientID
 	}
-	fname := getPublicKeyFilename(id)
 	store.lock.Lock()
 	defer store.lock.Unlock()
 	key, ok := store.cache.Get(fname)
@@ -273,13 +309,13 @@ func (store *FilesystemKeyStore) GetPeerPublicKey(id []byte) (*keys.PublicKey, e
 		log.Debugf("Load cached key: %s", fname)
 		return &keys.PublicKey{Value: key}, nil
 	}
-	publicKey, err := utils.LoadPublicKey(store.getPublicKeyFilePath(fname))
+	publicKey, err := store.storage.ReadFile(store.getPublicKeyFilePath(fname))
 	if err != nil {
 		return nil, err
 	}
 	log.Debugf("Load key from fs: %s", fname)
-	store.cache.Add(fname, publicKey.Value)
-	return publicKey, nil
+	store.cache.Add(fname, publicKey)
+	return &keys.PublicKey{Value: publicKey}, nil
 }
 
 // GetPrivateKey reads encrypted client private key from fs, decrypts it with master key and clientID,
@@ -345,13 +381,17 @@ func (store *FilesystemKeyStore) GenerateTranslatorKeys(id []byte) error {
 
 // GenerateDataEncryptionKeys generates Storage EC keypair for encrypting/decrypting data
 // using clientID as part of key name.
-// Writes encrypted private key and plaintext public key to fs.
+// Writes encrypted private key and plaintext public key to fs, previous private key is kept as previous version.
 // Returns error if writing/encryption failed.
 func (store *FilesystemKeyStore) GenerateDataEncryptionKeys(id []byte) error {
 	if !keystore.ValidateID(id) {
 		return keystore.ErrInvalidClientID
 	}
-	_, err := store.generateKeyPair(getServerDecryptionKeyFilename(id), id)
+	filename := getServerDecryptionKeyFilename(id)
+	if err := store.archivePrivateKey(filename); err != nil {
+		return err
+	}
+	_, err := store.generateKeyPair(filename, id)
 	if err != nil {
 		return err
 	}
@@ -361,6 +401,76 @@ func (store *FilesystemKeyStore) GenerateDataEncryptionKeys(id []byte) error {
 // Reset clears all cached keys
 func (store *FilesystemKeyStore) Reset() {
 	store.cache.Clear()
+	store.clearKeyHistories()
+}
+
+// keyFilenameSuffixes are suffixes appended to ids in filenames of private keys
+var keyFilenameSuffixes = []string{"_server", "_storage", "_zone", "_translator", "_hmac", "_token"}
+
+// VerifyMasterKey reads one private key from fs and checks that master key decrypts it. Poison key is used if it
+// exists, otherwise the first private key of key folder. Returns nil if keystore has no private keys.
+func (store *FilesystemKeyStore) VerifyMasterKey() error {
+	poisonExists, err := store.storage.Exists(store.getPrivateKeyFilePath(PoisonKeyFilename))
+	if err != nil {
+		return err
+	}
+	if poisonExists {
+		return store.verifyPrivateKeyFile(PoisonKeyFilename, []byte(PoisonKeyFilename))
+	}
+	files, err := store.storage.ListFiles(store.privateKeyDirectory)
+	if err != nil {
+		return err
+	}
+	for _, filename := range files {
+		if !isEncryptedKeyFilename(filename) {
+			continue
+		}
+		var err error
+		for _, id := range keyFileContexts(filename) {
+			if err = store.verifyPrivateKeyFile(filename, id); err == nil {
+				break
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// isEncryptedKeyFilename returns true if file of key folder stores key encrypted with master key
+func isEncryptedKeyFilename(filename string) bool {
+	return filename != BasicAuthKeyFilename && !strings.HasSuffix(filename, ".pub")
+}
+
+// keyFileContexts returns ids which may be used as context to encrypt key stored in filename, most likely first
+func keyFileContexts(filename string) [][]byte {
+	// previous versions of key are encrypted with the same context as current key
+	if directory := filepath.Dir(filename); strings.HasSuffix(directory, keyHistorySuffix) {
+		filename = strings.TrimSuffix(directory, keyHistorySuffix)
+	}
+	if filename == PoisonKeyFilename || filename == AuditLogKeyFilename {
+		return [][]byte{[]byte(filename)}
+	}
+	for _, suffix := range keyFilenameSuffixes {
+		if strings.HasSuffix(filename, suffix) {
+			// AcraConnector's keys are stored without suffix so their id may end with one of suffixes
+			return [][]byte{[]byte(strings.TrimSuffix(filename, suffix)), []byte(filename)}
+		}
+	}
+	return [][]byte{[]byte(filename)}
+}
+
+// verifyPrivateKeyFile decrypts private key stored in filename with id as context
+func (store *FilesystemKeyStore) verifyPrivateKeyFile(filename string, id []byte) error {
+	encryptedKey, err := store.storage.ReadFile(store.getPrivateKeyFilePath(filename))
+	if err != nil {
+		return err
+	}
+	decryptedKey, err := store.encryptor.Decrypt(encryptedKey, id)
+	if err != nil {
+		return err
+	}
+	utils.FillSlice(0, decryptedKey)
+	return nil
 }
 
 // GetPoisonKeyPair generates EC keypair for encrypting/decrypting poison records, and writes it to fs
@@ -369,27 +479,27 @@ func (store *FilesystemKeyStore) Reset() {
 func (store *FilesystemKeyStore) GetPoisonKeyPair() (*keys.Keypair, error) {
 	privatePath := store.getPrivateKeyFilePath(PoisonKeyFilename)
 	publicPath := store.getPublicKeyFilePath(fmt.Sprintf("%s.pub", PoisonKeyFilename))
-	privateExists, err := utils.FileExists(privatePath)
+	privateExists, err := store.storage.Exists(privatePath)
 	if err != nil {
 		return nil, err
 	}
-	publicExists, err := utils.FileExists(publicPath)
+	publicExists, err := store.storage.Exists(publicPath)
 	if err != nil {
 		return nil, err
 	}
 	if privateExists && publicExists {
-		private, err := utils.LoadPrivateKey(privatePath)
+		private, err := store.storage.ReadPrivateKeyFile(privatePath)
 		if err != nil {
 			return nil, err
 		}
-		if private.Value, err = store.encryptor.Decrypt(private.Value, []byte(PoisonKeyFilename)); err != nil {
+		if private, err = store.encryptor.Decrypt(private, []byte(PoisonKeyFilename)); err != nil {
 			return nil, err
 		}
-		public, err := utils.LoadPublicKey(publicPath)
+		public, err := store.storage.ReadFile(publicPath)
 		if err != nil {
 			return nil, err
 		}
-		return &keys.Keypair{Public: public, Private: private}, nil
+		return &keys.Keypair{Public: &keys.PublicKey{Value: public}, Private: &keys.PrivateKey{Value: private}}, nil
 	}
 	log.Infoln("Generate poison key pair")
 	return store.generateKeyPair(PoisonKeyFilename, []byte(PoisonKeyFilename))
@@ -400,13 +510,13 @@ func (store *FilesystemKeyStore) GetPoisonKeyPair() (*keys.Keypair, error) {
 // Returns key or error of generation/decryption failed.
 func (store *FilesystemKeyStore) GetAuthKey(remove bool) ([]byte, error) {
 	keyPath := store.getPrivateKeyFilePath(BasicAuthKeyFilename)
-	keyExists, err := utils.FileExists(keyPath)
+	keyExists, err := store.storage.Exists(keyPath)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 	if keyExists && !remove {
-		key, err := utils.ReadFile(keyPath)
+		key, err := store.storage.ReadFile(keyPath)
 		if err != nil {
 			log.Error(err)
 			return nil, err
@@ -417,15 +527,127 @@ func (store *FilesystemKeyStore) GetAuthKey(remove bool) ([]byte, error) {
 	return store.generateKey(BasicAuthKeyFilename, keystore.BasicAuthKeyLength)
 }
 
-// RotateZoneKey generate new key pair for ZoneId, overwrite private key with new and return new public key
+// GetHMACSecretKey returns symmetric key for clientID or zoneID used to calculate HMAC of data for searchable
+// encryption. Returns keystore.ErrKeyNotFound if key wasn't generated with GenerateHMACSecretKey.
+func (store *FilesystemKeyStore) GetHMACSecretKey(id []byte) ([]byte, error) {
+	return store.getSymmetricKey(id, getHmacKeyFilename(id), "HMAC", false)
+}
+
+// GenerateHMACSecretKey generates symmetric key for clientID or zoneID used to calculate HMAC of data and writes it
+// to fs encrypted with master key and id. Existing key is kept because HMACs calculated with it would be lost.
+func (store *FilesystemKeyStore) GenerateHMACSecretKey(id []byte) error {
+	_, err := store.getSymmetricKey(id, getHmacKeyFilename(id), "HMAC", true)
+	return err
+}
+
+// GetTokenizationKey returns symmetric key for clientID or zoneID used to tokenize data. Returns
+// keystore.ErrKeyNotFound if key wasn't generated with GenerateTokenizationKey.
+func (store *FilesystemKeyStore) GetTokenizationKey(id []byte) ([]byte, error) {
+	return store.getSymmetricKey(id, getTokenKeyFilename(id), "tokenization", false)
+}
+
+// GenerateTokenizationKey generates symmetric key for clientID or zoneID used to tokenize data and writes it to fs
+// encrypted with master key and id. Existing key is kept because tokens calculated with it couldn't be detokenized.
+func (store *FilesystemKeyStore) GenerateTokenizationKey(id []byte) error {
+	_, err := store.getSymmetricKey(id, getTokenKeyFilename(id), "tokenization", true)
+	return err
+}
+
+// GetAuditLogKey returns symmetric key used to chain entries of audit log with HMAC. Key is generated and written
+// to fs encrypted with master key if it doesn't exist yet.
+func (store *FilesystemKeyStore) GetAuditLogKey() ([]byte, error) {
+	return store.readSymmetricKey([]byte(AuditLogKeyFilename), AuditLogKeyFilename, "audit log", true)
+}
+
+// ReadAuditLogKey returns existing symmetric key of audit log or keystore.ErrKeyNotFound if it wasn't generated,
+// so verification of log never creates new key
+func (store *FilesystemKeyStore) ReadAuditLogKey() ([]byte, error) {
+	return store.readSymmetricKey([]byte(AuditLogKeyFilename), AuditLogKeyFilename, "audit log", false)
+}
+
+// getSymmetricKey validates id and returns symmetric key of id, key is generated if it doesn't exist and generate is true
+func (store *FilesystemKeyStore) getSymmetricKey(id []byte, filename, keyName string, generate bool) ([]byte, error) {
+	if !keystore.ValidateID(id) {
+		return nil, keystore.ErrInvalidClientID
+	}
+	return store.readSymmetricKey(id, filename, keyName, generate)
+}
+
+// readSymmetricKey reads symmetric key from cache or fs and decrypts it. If key doesn't exist then new key is
+// generated if generate is true, otherwise keystore.ErrKeyNotFound returned
+func (store *FilesystemKeyStore) readSymmetricKey(id []byte, filename, keyName string, generate bool) ([]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	encryptedKey, ok := store.cache.Get(filename)
+	if !ok {
+		keyPath := store.getPrivateKeyFilePath(filename)
+		keyExists, err := store.storage.Exists(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if keyExists {
+			encryptedKey, err = store.storage.ReadFile(keyPath)
+			if err != nil {
+				return nil, err
+			}
+		} else if generate {
+			log.Infof("Generate %s key to %v", keyName, keyPath)
+			encryptedKey, err = store.generateEncryptedSymmetricKey(filename, id)
+			if os.IsExist(err) {
+				// other instance which shares storage created key after check, use its key
+				encryptedKey, err = store.storage.ReadFile(keyPath)
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, keystore.ErrKeyNotFound
+		}
+	}
+	key, err := store.encryptor.Decrypt(encryptedKey, id)
+	if err != nil {
+		return nil, err
+	}
+	store.cache.Add(filename, encryptedKey)
+	return key, nil
+}
+
+// generateEncryptedSymmetricKey generates new symmetric key, writes it to fs encrypted with master key and id
+// and returns encrypted key. Returns error for which os.IsExist returns true if key file already exists
+func (store *FilesystemKeyStore) generateEncryptedSymmetricKey(filename string, id []byte) ([]byte, error) {
+	key, err := keystore.GenerateSymmetricKey()
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := store.encryptor.Encrypt(key, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.storage.MkdirAll(filepath.Dir(store.getPrivateKeyFilePath(filename)), 0700); err != nil {
+		return nil, err
+	}
+	if err := store.storage.CreateFile(store.getPrivateKeyFilePath(filename), encryptedKey, 0600); err != nil {
+		return nil, err
+	}
+	return encryptedKey, nil
+}
+
+// RotateZoneKey generate new key pair for ZoneId, overwrite private key with new and return new public key.
+// Previous private key is kept as previous version until it's retired
 func (store *FilesystemKeyStore) RotateZoneKey(zoneID []byte) ([]byte, error) {
+	if err := store.archivePrivateKey(getZoneKeyFilename(zoneID)); err != nil {
+		return nil, err
+	}
 	_, public, err := store.generateZoneKey(zoneID)
 	return public, err
 }
 
-// SaveZoneKeypair save or overwrite zone keypair
+// SaveZoneKeypair save or overwrite zone keypair, overwritten private key is kept as previous version
 func (store *FilesystemKeyStore) SaveZoneKeypair(id []byte, keypair *keys.Keypair) error {
 	filename := getZoneKeyFilename(id)
+	if err := store.archivePrivateKey(filename); err != nil {
+		return err
+	}
 	return store.saveKeyPairWithFilename(keypair, filename, id)
 }
 
@@ -447,8 +669,12 @@ func (store *FilesystemKeyStore) SaveTranslatorKeypair(id []byte, keypair *keys.
 	return store.saveKeyPairWithFilename(keypair, filename, id)
 }
 
-// SaveZoneKeypair save or overwrite decryption keypair for client id
+// SaveDataEncryptionKeys save or overwrite decryption keypair for client id, overwritten private key is kept as
+// previous version
 func (store *FilesystemKeyStore) SaveDataEncryptionKeys(id []byte, keypair *keys.Keypair) error {
 	filename := getServerDecryptionKeyFilename(id)
+	if err := store.archivePrivateKey(filename); err != nil {
+		return err
+	}
 	return store.saveKeyPairWithFilename(keypair, filename, id)
 }
@@ -63,13 +63,20 @@ func testGeneral(store *FilesystemKeyStore, t *testing.T) {
 	if key != nil {
 		t.Fatal("Non-expected key")
 	}
-	id, _, err := store.GenerateZoneKey()
+	id, publicKey, err := store.GenerateZoneKey()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if !store.HasZonePrivateKey(id) {
 		t.Fatal("Expected true on existed id")
 	}
+	zonePublicKey, err := store.GetZonePublicKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(zonePublicKey.Value, publicKey) {
+		t.Fatal("Zone public key not equal to generated")
+	}
 	key, err = store.GetZonePrivateKey(id)
 	if err != nil {
 		t.Fatal(err)
@@ -104,6 +111,13 @@ func testGeneratingDataEncryptionKeys(store *FilesystemKeyStore, t *testing.T) {
 	if !exists {
 		t.Fatal("Public decryption key doesn't exists")
 	}
+	publicKey, err := store.GetClientIDEncryptionPublicKey(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKey == nil {
+		t.Fatal("Expected public encryption key")
+	}
 }
 
 func checkPath(path string, t *testing.T) {
@@ -183,6 +197,104 @@ func testReset(store *FilesystemKeyStore, t *testing.T) {
 	}
 }
 
+func testGetHMACSecretKey(store *FilesystemKeyStore, t *testing.T) {
+	testID := []byte("some test id")
+	if _, err := store.GetHMACSecretKey(testID); err != keystore.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound before generation, took %v", err)
+	}
+	if err := store.GenerateHMACSecretKey(testID); err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.GetHMACSecretKey(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keystore.SymmetricKeyLength {
+		t.Fatal("Incorrect length of generated HMAC key")
+	}
+	absPath := store.getPrivateKeyFilePath(getHmacKeyFilename(testID))
+	checkPath(absPath, t)
+	encryptedKey, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encryptedKey, key) {
+		t.Fatal("HMAC key stored unencrypted")
+	}
+	store.Reset()
+	sameKey, err := store.GetHMACSecretKey(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, sameKey) {
+		t.Fatal("HMAC key was regenerated instead of reading existing one")
+	}
+	if err := store.GenerateHMACSecretKey(testID); err != nil {
+		t.Fatal(err)
+	}
+	if sameKey, err = store.GetHMACSecretKey(testID); err != nil || !bytes.Equal(key, sameKey) {
+		t.Fatal("Existing HMAC key was overwritten by generation")
+	}
+	if _, err := store.GetHMACSecretKey([]byte("id")); err != keystore.ErrInvalidClientID {
+		t.Fatalf("Expected ErrInvalidClientID, took %v", err)
+	}
+}
+
+func testGetTokenizationKey(store *FilesystemKeyStore, t *testing.T) {
+	testID := []byte("some test id")
+	if _, err := store.GetTokenizationKey(testID); err != keystore.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound before generation, took %v", err)
+	}
+	if err := store.GenerateTokenizationKey(testID); err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.GetTokenizationKey(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keystore.SymmetricKeyLength {
+		t.Fatal("Incorrect length of generated tokenization key")
+	}
+	checkPath(store.getPrivateKeyFilePath(getTokenKeyFilename(testID)), t)
+	hmacKey, err := store.GetHMACSecretKey(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, hmacKey) {
+		t.Fatal("Tokenization key should differ from HMAC key")
+	}
+}
+
+func testGetAuditLogKey(store *FilesystemKeyStore, t *testing.T) {
+	if _, err := store.ReadAuditLogKey(); err != keystore.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound before generation, took %v", err)
+	}
+	key, err := store.GetAuditLogKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keystore.SymmetricKeyLength {
+		t.Fatal("Incorrect length of generated audit log key")
+	}
+	checkPath(store.getPrivateKeyFilePath(AuditLogKeyFilename), t)
+	store.Reset()
+	sameKey, err := store.GetAuditLogKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, sameKey) {
+		t.Fatal("Audit log key was regenerated instead of reading existing one")
+	}
+	store.Reset()
+	readKey, err := store.ReadAuditLogKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, readKey) {
+		t.Fatal("Read audit log key doesn't match generated key")
+	}
+}
+
 func TestFilesystemKeyStore(t *testing.T) {
 
 	privateKeyDirectory := fmt.Sprintf(".%s%s", string(filepath.Separator), "cache")
@@ -226,6 +338,9 @@ func TestFilesystemKeyStore(t *testing.T) {
 		testReset(store, t)
 		testGenerateKeyPair(store, t)
 		testSaveKeypairs(store, t)
+		testGetHMACSecretKey(store, t)
+		testGetTokenizationKey(store, t)
+		testGetAuditLogKey(store, t)
 		resetKeyFolders()
 	}
 }
@@ -384,3 +499,51 @@ func testSaveKeypairs(store *FilesystemKeyStore, t *testing.T) {
 		}
 	}
 }
+
+func TestFilesystemKeyStore_VerifyMasterKey(t *testing.T) {
+	keyDirectory, err := ioutil.TempDir("", "test_verify_master_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDirectory)
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("some key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFilesystemKeyStore(keyDirectory, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.VerifyMasterKey(); err != nil {
+		t.Fatalf("Expected nil for empty keystore, took %v", err)
+	}
+	if _, err := store.GetAuthKey(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GenerateServerKeys([]byte("client_server")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.VerifyMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	anotherEncryptor, err := keystore.NewSCellKeyEncryptor([]byte("another key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anotherStore, err := NewFilesystemKeyStore(keyDirectory, anotherEncryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := anotherStore.VerifyMasterKey(); err == nil {
+		t.Fatal("Expected error with incorrect master key")
+	}
+	if _, err := store.GetPoisonKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.VerifyMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := anotherStore.VerifyMasterKey(); err == nil {
+		t.Fatal("Expected error with incorrect master key of poison key")
+	}
+}
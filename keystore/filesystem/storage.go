@@ -0,0 +1,104 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/cossacklabs/acra/utils"
+)
+
+// Storage stores files with encrypted private keys, public keys and symmetric keys of keystores. Keystores use
+// local file system by default, remote storages allow to share keys between many instances. Storage should return
+// error for which os.IsNotExist returns true when file doesn't exist.
+type Storage interface {
+	// Exists returns true if file exists
+	Exists(path string) (bool, error)
+	// ReadFile returns content of file
+	ReadFile(path string) ([]byte, error)
+	// ReadPrivateKeyFile returns content of file with private key which should be accessible only by owner
+	ReadPrivateKeyFile(path string) ([]byte, error)
+	// WriteFile creates or overwrites file with data, perm is used only by storages which support permissions
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	// CreateFile creates file with data only if it doesn't exist, so concurrent writers can't overwrite each other.
+	// Returns error for which os.IsExist returns true if file already exists
+	CreateFile(path string, data []byte, perm os.FileMode) error
+	// MkdirAll creates directory with parents if storage requires directories to exist before writing files
+	MkdirAll(path string, perm os.FileMode) error
+	// ListFiles returns names of files in directory without subdirectories
+	ListFiles(directory string) ([]string, error)
+	// Remove deletes file or empty directory
+	Remove(path string) error
+}
+
+// fileStorage is Storage of files in local file system
+type fileStorage struct{}
+
+func (fileStorage) Exists(path string) (bool, error) {
+	return utils.FileExists(path)
+}
+
+func (fileStorage) ReadFile(path string) ([]byte, error) {
+	return utils.ReadFile(path)
+}
+
+func (fileStorage) ReadPrivateKeyFile(path string) ([]byte, error) {
+	key, err := utils.LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return key.Value, nil
+}
+
+func (fileStorage) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, data, perm)
+}
+
+func (fileStorage) CreateFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (fileStorage) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (fileStorage) ListFiles(directory string) ([]string, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func (fileStorage) Remove(path string) error {
+	return os.Remove(path)
+}
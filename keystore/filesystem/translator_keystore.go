@@ -19,7 +19,6 @@ package filesystem
 import (
 	"github.com/cossacklabs/acra/keystore"
 	"github.com/cossacklabs/themis/gothemis/keys"
-	"io/ioutil"
 	"path/filepath"
 )
 
@@ -32,7 +31,13 @@ type TranslatorFileSystemKeyStore struct {
 
 // NewTranslatorFileSystemKeyStore creates new TranslatorFileSystemKeyStore
 func NewTranslatorFileSystemKeyStore(directory string, encryptor keystore.KeyEncryptor, cacheSize int) (*TranslatorFileSystemKeyStore, error) {
-	fsKeystore, err := NewFileSystemKeyStoreWithCacheSize(directory, encryptor, cacheSize)
+	return NewTranslatorKeyStoreWithStorage(directory, nil, encryptor, cacheSize)
+}
+
+// NewTranslatorKeyStoreWithStorage creates new TranslatorFileSystemKeyStore which reads and writes files of keys in
+// storage. Local file system is used if storage is nil.
+func NewTranslatorKeyStoreWithStorage(directory string, storage Storage, encryptor keystore.KeyEncryptor, cacheSize int) (*TranslatorFileSystemKeyStore, error) {
+	fsKeystore, err := NewFilesystemKeyStoreWithStorage(directory, directory, storage, encryptor, cacheSize)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +47,7 @@ func NewTranslatorFileSystemKeyStore(directory string, encryptor keystore.KeyEnc
 // CheckIfPrivateKeyExists checks if Keystore has Translator transport private key for establishing Secure Session connection,
 // returns true if key exists in fs.
 func (store *TranslatorFileSystemKeyStore) CheckIfPrivateKeyExists(id []byte) (bool, error) {
-	_, err := ioutil.ReadFile(filepath.Join(store.directory, getTranslatorKeyFilename(id)))
+	_, err := store.storage.ReadFile(filepath.Join(store.directory, getTranslatorKeyFilename(id)))
 	if err != nil {
 		return false, err
 	}
@@ -51,7 +56,7 @@ func (store *TranslatorFileSystemKeyStore) CheckIfPrivateKeyExists(id []byte) (b
 
 // GetPrivateKey reads and decrypts Translator transport private key for establishing Secure Session connection.
 func (store *TranslatorFileSystemKeyStore) GetPrivateKey(id []byte) (*keys.PrivateKey, error) {
-	keyData, err := ioutil.ReadFile(filepath.Join(store.directory, getTranslatorKeyFilename(id)))
+	keyData, err := store.storage.ReadFile(filepath.Join(store.directory, getTranslatorKeyFilename(id)))
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +71,7 @@ func (store *TranslatorFileSystemKeyStore) GetPrivateKey(id []byte) (*keys.Priva
 // GetPeerPublicKey returns other party transport public key.
 func (store *TranslatorFileSystemKeyStore) GetPeerPublicKey(id []byte) (*keys.PublicKey, error) {
 	filename := getConnectorKeyFilename(id)
-	key, err := ioutil.ReadFile(filepath.Join(store.directory, getPublicKeyFilename([]byte(filename))))
+	key, err := store.storage.ReadFile(filepath.Join(store.directory, getPublicKeyFilename([]byte(filename))))
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +51,9 @@ var (
 	ErrMasterKeyIncorrectLength = fmt.Errorf("master key must have %v length in bytes", SymmetricKeyLength)
 )
 
+// ErrKeyNotFound returned by methods which only read keys when key wasn't generated
+var ErrKeyNotFound = errors.New("key doesn't exist")
+
 // GenerateSymmetricKey return new generated symmetric key that must used in keystore as master key and will comply
 // our requirements.
 func GenerateSymmetricKey() ([]byte, error) {
@@ -88,20 +91,41 @@ func ValidateMasterKey(key []byte) error {
 	return nil
 }
 
-// GetMasterKeyFromEnvironment return master key from environment variable with name AcraMasterKeyVarName
-func GetMasterKeyFromEnvironment() (key []byte, err error) {
-	b64value := os.Getenv(AcraMasterKeyVarName)
+// MasterKeyProvider returns master key used to encrypt keys of keystore. Master key may be passed to service in
+// different ways, e.g. in plain or encrypted with key of external key management service.
+type MasterKeyProvider interface {
+	GetMasterKey() ([]byte, error)
+}
+
+// EnvironmentMasterKeyProvider returns base64 encoded master key from environment variable
+type EnvironmentMasterKeyProvider struct {
+	envName string
+}
+
+// NewEnvironmentMasterKeyProvider returns provider which reads master key from envName variable
+func NewEnvironmentMasterKeyProvider(envName string) *EnvironmentMasterKeyProvider {
+	return &EnvironmentMasterKeyProvider{envName: envName}
+}
+
+// GetMasterKey returns master key decoded from environment variable and validates it
+func (provider *EnvironmentMasterKeyProvider) GetMasterKey() ([]byte, error) {
+	b64value := os.Getenv(provider.envName)
 	if len(b64value) == 0 {
 		return nil, ErrEmptyMasterKey
 	}
-	key, err = base64.StdEncoding.DecodeString(b64value)
+	key, err := base64.StdEncoding.DecodeString(b64value)
 	if err != nil {
-		return
+		return nil, err
 	}
 	if err = ValidateMasterKey(key); err != nil {
-		return
+		return nil, err
 	}
-	return
+	return key, nil
+}
+
+// GetMasterKeyFromEnvironment return master key from environment variable with name AcraMasterKeyVarName
+func GetMasterKeyFromEnvironment() (key []byte, err error) {
+	return NewEnvironmentMasterKeyProvider(AcraMasterKeyVarName).GetMasterKey()
 }
 
 // KeyEncryptor describes Encrypt and Decrypt interfaces.
@@ -137,6 +161,27 @@ type SecureSessionKeyStore interface {
 	GetPeerPublicKey(id []byte) (*keys.PublicKey, error)
 }
 
+// PublicKeyStore describes KeyStore that provides public keys used to create AcraStructs with and without Zones.
+type PublicKeyStore interface {
+	GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error)
+	GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error)
+}
+
+// HmacKeyStore describes KeyStore that provides symmetric keys used to calculate HMAC of data for searchable encryption.
+type HmacKeyStore interface {
+	GetHMACSecretKey(id []byte) ([]byte, error)
+}
+
+// TokenKeyStore describes KeyStore that provides symmetric keys used to tokenize data.
+type TokenKeyStore interface {
+	GetTokenizationKey(id []byte) ([]byte, error)
+}
+
+// AuditLogKeyStore describes KeyStore that provides symmetric key used to chain entries of audit log with HMAC.
+type AuditLogKeyStore interface {
+	GetAuditLogKey() ([]byte, error)
+}
+
 // KeyStore describes any KeyStore that reads keys to handle Themis Secure Session connection,
 // to encrypt and decrypt AcraStructs with and without Zones,
 // to find Poison records.
@@ -145,9 +190,17 @@ type SecureSessionKeyStore interface {
 // Genenerate*Keys - generate new keypair and save
 type KeyStore interface {
 	SecureSessionKeyStore
+	PublicKeyStore
+	HmacKeyStore
+	TokenKeyStore
+	AuditLogKeyStore
 	GetZonePrivateKey(id []byte) (*keys.PrivateKey, error)
 	HasZonePrivateKey(id []byte) bool
 	GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error)
+	// GetZonePrivateKeys and GetServerDecryptionPrivateKeys return current private key followed by its previous
+	// versions which decrypt AcraStructs not re-encrypted after key rotation
+	GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error)
+	GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error)
 
 	// return id, public key, error
 	GenerateZoneKey() ([]byte, []byte, error)
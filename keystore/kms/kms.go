@@ -0,0 +1,371 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kms encrypts keys of keystore with key stored in external key management service which supports JSON
+// protocol of AWS KMS, so the master key never leaves KMS. KeyEncryptor encrypts every key with KMS, and
+// MasterKeyProvider decrypts master key stored encrypted with KMS for services which decrypt keys often.
+//
+// https://docs.aws.amazon.com/kms/latest/APIReference/Welcome.html
+package kms
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/utils"
+)
+
+// Environment variables with credentials used to sign requests to KMS
+const (
+	AccessKeyIDEnvName     = "AWS_ACCESS_KEY_ID"
+	SecretAccessKeyEnvName = "AWS_SECRET_ACCESS_KEY"
+	SessionTokenEnvName    = "AWS_SESSION_TOKEN"
+)
+
+// DefaultTimeout is timeout of requests to KMS
+const DefaultTimeout = time.Second * 30
+
+// DefaultKeyCacheTTL is time during which keys decrypted with KMS are reused without requests to KMS
+const DefaultKeyCacheTTL = time.Minute * 5
+
+// maxCachedKeys limits count of keys decrypted with KMS which are kept in memory
+const maxCachedKeys = 1024
+
+// contextField is field of KMS encryption context which stores context of encrypted key
+const contextField = "acra_context"
+
+// MasterKeyContext is context used to encrypt master key with KMS
+var MasterKeyContext = []byte("acra_master_key")
+
+// Errors returned by KMS KeyEncryptor
+var (
+	ErrInvalidEndpoint    = errors.New("KMS endpoint should be http or https URL")
+	ErrEmptyKeyID         = errors.New("ID of KMS key is empty")
+	ErrEmptyRegion        = errors.New("region of KMS is empty")
+	ErrEmptyCredentials   = fmt.Errorf("credentials for KMS should be passed via %s and %s environment variables", AccessKeyIDEnvName, SecretAccessKeyEnvName)
+	ErrUnexpectedResponse = errors.New("unexpected response of KMS")
+)
+
+// Credentials used to sign requests to KMS
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// CredentialsFromEnvironment returns credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optional
+// AWS_SESSION_TOKEN environment variables
+func CredentialsFromEnvironment() (Credentials, error) {
+	credentials := Credentials{
+		AccessKeyID:     os.Getenv(AccessKeyIDEnvName),
+		SecretAccessKey: os.Getenv(SecretAccessKeyEnvName),
+		SessionToken:    os.Getenv(SessionTokenEnvName),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return Credentials{}, ErrEmptyCredentials
+	}
+	return credentials, nil
+}
+
+// DefaultEndpoint returns endpoint of AWS KMS in region
+func DefaultEndpoint(region string) string {
+	return fmt.Sprintf("https://kms.%s.amazonaws.com", region)
+}
+
+// cachedKey is key decrypted with KMS which is reused until it expires
+type cachedKey struct {
+	value   []byte
+	expires time.Time
+}
+
+// KeyEncryptor encrypts and decrypts keys with symmetric key stored in KMS. Decrypted keys are cached for
+// DefaultKeyCacheTTL so keystore doesn't call KMS on every use of key. Implements keystore.KeyEncryptor
+type KeyEncryptor struct {
+	client      *http.Client
+	endpoint    *url.URL
+	region      string
+	keyID       string
+	credentials Credentials
+	now         func() time.Time
+	cacheLock   sync.Mutex
+	cacheTTL    time.Duration
+	cache       map[string]*cachedKey
+}
+
+// NewKeyEncryptor returns KeyEncryptor which uses key with keyID of KMS with endpoint in region
+func NewKeyEncryptor(endpoint, region, keyID string, credentials Credentials) (*KeyEncryptor, error) {
+	parsedEndpoint, err := url.Parse(endpoint)
+	if err != nil || (parsedEndpoint.Scheme != "http" && parsedEndpoint.Scheme != "https") || parsedEndpoint.Host == "" {
+		return nil, ErrInvalidEndpoint
+	}
+	if region == "" {
+		return nil, ErrEmptyRegion
+	}
+	if keyID == "" {
+		return nil, ErrEmptyKeyID
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, ErrEmptyCredentials
+	}
+	return &KeyEncryptor{client: &http.Client{Timeout: DefaultTimeout}, endpoint: parsedEndpoint, region: region,
+		keyID: keyID, credentials: credentials, now: time.Now, cacheTTL: DefaultKeyCacheTTL, cache: make(map[string]*cachedKey)}, nil
+}
+
+// SetCacheTTL sets time during which decrypted keys are reused without requests to KMS. 0 turns off cache
+func (encryptor *KeyEncryptor) SetCacheTTL(ttl time.Duration) {
+	encryptor.cacheLock.Lock()
+	defer encryptor.cacheLock.Unlock()
+	encryptor.cacheTTL = ttl
+	if ttl == 0 {
+		for cacheKey, cached := range encryptor.cache {
+			utils.FillSlice(byte(0), cached.value)
+			delete(encryptor.cache, cacheKey)
+		}
+	}
+}
+
+// decryptionCacheKey returns key of cache for encrypted key with context
+func decryptionCacheKey(key, context []byte) string {
+	hash := sha256.Sum256(key)
+	return string(hash[:]) + string(context)
+}
+
+// getCachedKey returns copy of decrypted key if it's cached and not expired
+func (encryptor *KeyEncryptor) getCachedKey(cacheKey string) ([]byte, bool) {
+	encryptor.cacheLock.Lock()
+	defer encryptor.cacheLock.Unlock()
+	cached, ok := encryptor.cache[cacheKey]
+	if !ok || !encryptor.now().Before(cached.expires) {
+		return nil, false
+	}
+	return append([]byte{}, cached.value...), true
+}
+
+// cacheKey stores copy of decrypted key, removing expired keys and the oldest one if cache is full
+func (encryptor *KeyEncryptor) cacheKey(cacheKey string, value []byte) {
+	encryptor.cacheLock.Lock()
+	defer encryptor.cacheLock.Unlock()
+	if encryptor.cacheTTL == 0 {
+		return
+	}
+	now := encryptor.now()
+	var oldestKey string
+	var oldest *cachedKey
+	for key, cached := range encryptor.cache {
+		if !now.Before(cached.expires) {
+			utils.FillSlice(byte(0), cached.value)
+			delete(encryptor.cache, key)
+			continue
+		}
+		if oldest == nil || cached.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, cached
+		}
+	}
+	if oldest != nil && len(encryptor.cache) >= maxCachedKeys {
+		utils.FillSlice(byte(0), oldest.value)
+		delete(encryptor.cache, oldestKey)
+	}
+	encryptor.cache[cacheKey] = &cachedKey{value: append([]byte{}, value...), expires: now.Add(encryptor.cacheTTL)}
+}
+
+// encryptionContext returns KMS encryption context which binds ciphertext to context of key
+func encryptionContext(context []byte) map[string]string {
+	if len(context) == 0 {
+		return nil
+	}
+	return map[string]string{contextField: base64.StdEncoding.EncodeToString(context)}
+}
+
+// encryptRequest is body of TrentService.Encrypt request
+type encryptRequest struct {
+	KeyId             string
+	Plaintext         []byte
+	EncryptionContext map[string]string `json:",omitempty"`
+}
+
+// decryptRequest is body of TrentService.Decrypt request
+type decryptRequest struct {
+	KeyId             string
+	CiphertextBlob    []byte
+	EncryptionContext map[string]string `json:",omitempty"`
+}
+
+// Encrypt returns key encrypted with KMS key, context is authenticated by KMS and required to decrypt key
+func (encryptor *KeyEncryptor) Encrypt(key, context []byte) ([]byte, error) {
+	var response struct {
+		CiphertextBlob []byte
+	}
+	request := encryptRequest{KeyId: encryptor.keyID, Plaintext: key, EncryptionContext: encryptionContext(context)}
+	if err := encryptor.call("TrentService.Encrypt", request, &response); err != nil {
+		return nil, err
+	}
+	if len(response.CiphertextBlob) == 0 {
+		return nil, ErrUnexpectedResponse
+	}
+	return response.CiphertextBlob, nil
+}
+
+// Decrypt returns key decrypted with KMS key and the same context as used on encryption. Cached key is returned
+// without request to KMS if the same key was decrypted during cache TTL
+func (encryptor *KeyEncryptor) Decrypt(key, context []byte) ([]byte, error) {
+	cacheKey := decryptionCacheKey(key, context)
+	if decrypted, ok := encryptor.getCachedKey(cacheKey); ok {
+		return decrypted, nil
+	}
+	var response struct {
+		Plaintext []byte
+	}
+	request := decryptRequest{KeyId: encryptor.keyID, CiphertextBlob: key, EncryptionContext: encryptionContext(context)}
+	if err := encryptor.call("TrentService.Decrypt", request, &response); err != nil {
+		return nil, err
+	}
+	if response.Plaintext == nil {
+		return nil, ErrUnexpectedResponse
+	}
+	encryptor.cacheKey(cacheKey, response.Plaintext)
+	return response.Plaintext, nil
+}
+
+// call sends signed request with action to KMS and decodes response into output
+func (encryptor *KeyEncryptor) call(action string, input, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, encryptor.endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", action)
+	encryptor.sign(request, body)
+	response, err := encryptor.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		// KMS returns {"__type": "...Exception", "message": "..."} with description of error
+		var kmsError struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(response.Body, 4096)).Decode(&kmsError)
+		return fmt.Errorf("KMS returned %s on %s: %s %s", response.Status, action, kmsError.Type, kmsError.Message)
+	}
+	return json.NewDecoder(response.Body).Decode(output)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// sign adds headers of AWS Signature Version 4 to request with body
+func (encryptor *KeyEncryptor) sign(request *http.Request, body []byte) {
+	const service = "kms"
+	now := encryptor.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	if encryptor.credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", encryptor.credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(request.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	uri := request.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{request.Method, uri, request.URL.RawQuery, canonicalHeaders.String(),
+		signedHeaders, hexSHA256(body)}, "\n")
+
+	scope := strings.Join([]string{date, encryptor.region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+encryptor.credentials.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, encryptor.region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		encryptor.credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// MasterKeyProvider returns master key stored in environment variable encrypted with KMS key. Implements
+// keystore.MasterKeyProvider
+type MasterKeyProvider struct {
+	encryptor *KeyEncryptor
+	envName   string
+}
+
+// NewMasterKeyProvider returns provider which decrypts base64 encoded master key from envName variable with encryptor
+func NewMasterKeyProvider(encryptor *KeyEncryptor, envName string) *MasterKeyProvider {
+	return &MasterKeyProvider{encryptor: encryptor, envName: envName}
+}
+
+// GetMasterKey decrypts master key with KMS and validates it
+func (provider *MasterKeyProvider) GetMasterKey() ([]byte, error) {
+	b64value := os.Getenv(provider.envName)
+	if len(b64value) == 0 {
+		return nil, keystore.ErrEmptyMasterKey
+	}
+	encryptedKey, err := base64.StdEncoding.DecodeString(b64value)
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.encryptor.Decrypt(encryptedKey, MasterKeyContext)
+	if err != nil {
+		return nil, err
+	}
+	if err := keystore.ValidateMasterKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
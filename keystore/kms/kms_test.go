@@ -0,0 +1,241 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+const (
+	testKeyID  = "alias/acra"
+	testRegion = "eu-west-1"
+)
+
+var testCredentials = Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+
+// testKMSServer is in-memory stand-in of KMS which stores plaintexts and returns their indexes as ciphertexts
+type testKMSServer struct {
+	lock        sync.Mutex
+	plaintexts  [][]byte
+	contexts    []map[string]string
+	decryptions int
+}
+
+func (server *testKMSServer) fail(w http.ResponseWriter, errorType string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": errorType, "message": errorType})
+}
+
+func (server *testKMSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	authorization := r.Header.Get("Authorization")
+	expectedCredential := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s/%s/kms/aws4_request, ", testCredentials.AccessKeyID,
+		time.Now().UTC().Format("20060102"), testRegion)
+	if !strings.HasPrefix(authorization, expectedCredential) || !strings.Contains(authorization, "Signature=") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("Content-Type") != "application/x-amz-json-1.1" {
+		server.fail(w, "UnrecognizedClientException")
+		return
+	}
+	var request struct {
+		KeyId             string
+		Plaintext         []byte
+		CiphertextBlob    []byte
+		EncryptionContext map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.KeyId != testKeyID {
+		server.fail(w, "NotFoundException")
+		return
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.Encrypt":
+		server.plaintexts = append(server.plaintexts, request.Plaintext)
+		server.contexts = append(server.contexts, request.EncryptionContext)
+		json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": testKeyID, "CiphertextBlob": []byte(fmt.Sprint(len(server.plaintexts) - 1))})
+	case "TrentService.Decrypt":
+		server.decryptions++
+		var index int
+		if _, err := fmt.Sscan(string(request.CiphertextBlob), &index); err != nil || index < 0 || index >= len(server.plaintexts) ||
+			!reflect.DeepEqual(server.contexts[index], request.EncryptionContext) {
+			server.fail(w, "InvalidCiphertextException")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": testKeyID, "Plaintext": server.plaintexts[index]})
+	default:
+		server.fail(w, "UnknownOperationException")
+	}
+}
+
+func TestKeyEncryptor(t *testing.T) {
+	if _, err := NewKeyEncryptor("kms.local", testRegion, testKeyID, testCredentials); err != ErrInvalidEndpoint {
+		t.Fatalf("Expected ErrInvalidEndpoint, took %v", err)
+	}
+	if _, err := NewKeyEncryptor("http://kms.local", testRegion, "", testCredentials); err != ErrEmptyKeyID {
+		t.Fatalf("Expected ErrEmptyKeyID, took %v", err)
+	}
+	if _, err := NewKeyEncryptor("http://kms.local", testRegion, testKeyID, Credentials{}); err != ErrEmptyCredentials {
+		t.Fatalf("Expected ErrEmptyCredentials, took %v", err)
+	}
+	server := httptest.NewServer(&testKMSServer{})
+	defer server.Close()
+	encryptor, err := NewKeyEncryptor(server.URL, testRegion, testKeyID, testCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ keystore.KeyEncryptor = encryptor
+
+	key := []byte("private key")
+	context := []byte("client id")
+	encrypted, err := encryptor.Encrypt(key, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := encryptor.Decrypt(encrypted, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, key) {
+		t.Fatal("Decrypted key doesn't match encrypted key")
+	}
+	if _, err := encryptor.Decrypt(encrypted, []byte("other client id")); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Fatalf("Expected error on decryption with other context, took %v", err)
+	}
+
+	otherKeyEncryptor, err := NewKeyEncryptor(server.URL, testRegion, "other key", testCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherKeyEncryptor.Decrypt(encrypted, context); err == nil {
+		t.Fatal("Expected error on decryption with unknown key")
+	}
+}
+
+func TestKeyEncryptorCache(t *testing.T) {
+	kmsServer := &testKMSServer{}
+	server := httptest.NewServer(kmsServer)
+	defer server.Close()
+	encryptor, err := NewKeyEncryptor(server.URL, testRegion, testKeyID, testCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := time.Duration(0)
+	encryptor.now = func() time.Time { return time.Now().Add(offset) }
+	key := []byte("private key")
+	context := []byte("client id")
+	encrypted, err := encryptor.Encrypt(key, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decryptions := func() int {
+		kmsServer.lock.Lock()
+		defer kmsServer.lock.Unlock()
+		return kmsServer.decryptions
+	}
+	for i := 0; i < 2; i++ {
+		decrypted, err := encryptor.Decrypt(encrypted, context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, key) {
+			t.Fatal("Decrypted key doesn't match encrypted key")
+		}
+		// keystore fills used keys with zeros
+		for j := range decrypted {
+			decrypted[j] = 0
+		}
+	}
+	if count := decryptions(); count != 1 {
+		t.Fatalf("Expected 1 request to KMS for cached key, took %v", count)
+	}
+	if _, err := encryptor.Decrypt(encrypted, []byte("other client id")); err == nil {
+		t.Fatal("Cached key shouldn't be returned for other context")
+	}
+
+	offset = DefaultKeyCacheTTL
+	if _, err := encryptor.Decrypt(encrypted, context); err != nil {
+		t.Fatal(err)
+	}
+	if count := decryptions(); count != 3 {
+		t.Fatalf("Expected request to KMS for expired key, took %v", count)
+	}
+
+	encryptor.SetCacheTTL(0)
+	for i := 0; i < 2; i++ {
+		if _, err := encryptor.Decrypt(encrypted, context); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := decryptions(); count != 5 {
+		t.Fatalf("Expected requests to KMS without cache, took %v", count)
+	}
+}
+
+func TestMasterKeyProvider(t *testing.T) {
+	const envName = "TEST_KMS_MASTER_KEY"
+	server := httptest.NewServer(&testKMSServer{})
+	defer server.Close()
+	encryptor, err := NewKeyEncryptor(server.URL, testRegion, testKeyID, testCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewMasterKeyProvider(encryptor, envName)
+	os.Unsetenv(envName)
+	if _, err := provider.GetMasterKey(); err != keystore.ErrEmptyMasterKey {
+		t.Fatalf("Expected ErrEmptyMasterKey, took %v", err)
+	}
+
+	masterKey, err := keystore.GenerateSymmetricKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, err := encryptor.Encrypt(masterKey, MasterKeyContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(envName, base64.StdEncoding.EncodeToString(encryptedKey))
+	defer os.Unsetenv(envName)
+	decryptedKey, err := provider.GetMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decryptedKey, masterKey) {
+		t.Fatal("Decrypted master key doesn't match generated key")
+	}
+
+	// master key encrypted with other context isn't accepted
+	encryptedKey, err = encryptor.Encrypt(masterKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(envName, base64.StdEncoding.EncodeToString(encryptedKey))
+	if _, err := provider.GetMasterKey(); err == nil {
+		t.Fatal("Expected error on master key encrypted without context")
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kv implements storage of keystore files in remote key-value store with HTTP API compatible with
+// version 2 of HashiCorp Vault KV secrets engine. Files of keys are stored as secrets with the same paths as in
+// key folders, so many instances of Acra services may share keys without syncing key folders. Keys are written
+// encrypted with master key as in file system, KV store never receives plaintext keys.
+//
+// https://www.vaultproject.io/api/secret/kv/kv-v2.html
+package kv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TokenHeader is header of HTTP requests with token used to access KV store
+const TokenHeader = "X-Vault-Token"
+
+// valueField is field of secret where content of file is stored
+const valueField = "value"
+
+// DefaultTimeout is timeout of requests to KV store
+const DefaultTimeout = time.Second * 30
+
+// Errors returned by Storage
+var (
+	ErrInvalidAddress = errors.New("address of KV store should be http or https URL")
+	ErrEmptyMountPath = errors.New("mount path of KV secrets engine is empty")
+	ErrInvalidSecret  = errors.New("secret in KV store doesn't contain file of key")
+)
+
+// Storage stores files of keys in KV store. Implements filesystem.Storage
+type Storage struct {
+	client    *http.Client
+	address   string
+	mountPath string
+	token     string
+}
+
+// NewStorage returns Storage which uses KV secrets engine mounted to mountPath of KV store with address and
+// authenticates with token. tlsConfig is used for https address and may be nil to use default config
+func NewStorage(address, mountPath, token string, tlsConfig *tls.Config) (*Storage, error) {
+	parsedAddress, err := url.Parse(address)
+	if err != nil || (parsedAddress.Scheme != "http" && parsedAddress.Scheme != "https") || parsedAddress.Host == "" {
+		return nil, ErrInvalidAddress
+	}
+	mountPath = strings.Trim(mountPath, "/")
+	if mountPath == "" {
+		return nil, ErrEmptyMountPath
+	}
+	client := &http.Client{Timeout: DefaultTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+	return &Storage{client: client, address: strings.TrimRight(address, "/"), mountPath: mountPath, token: token}, nil
+}
+
+// secretPath converts path of file to path of secret relative to mount path
+func secretPath(filePath string) string {
+	return strings.Trim(path.Clean("/"+filepath.ToSlash(filePath)), "/")
+}
+
+// url returns URL of secret's endpoint, endpoint is "data" or "metadata"
+func (storage *Storage) url(endpoint, secret string) string {
+	segments := strings.Split(secret, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return fmt.Sprintf("%s/v1/%s/%s/%s", storage.address, storage.mountPath, endpoint, strings.Join(segments, "/"))
+}
+
+// request sends request to KV store and returns response with status 200 or nil if status is 404
+func (storage *Storage) request(method, url string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set(TokenHeader, storage.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := storage.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return response, nil
+	case http.StatusNotFound:
+		response.Body.Close()
+		return nil, nil
+	}
+	defer response.Body.Close()
+	// KV store returns {"errors": [...]} with description of error
+	var kvError struct {
+		Errors []string `json:"errors"`
+	}
+	json.NewDecoder(io.LimitReader(response.Body, 4096)).Decode(&kvError)
+	return nil, fmt.Errorf("KV store returned %s on %s %s: %s", response.Status, method, url, strings.Join(kvError.Errors, "; "))
+}
+
+// Exists returns true if secret with file exists
+func (storage *Storage) Exists(filePath string) (bool, error) {
+	_, err := storage.ReadFile(filePath)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ReadFile returns content of file stored in secret. Returns error for which os.IsNotExist returns true if secret
+// doesn't exist or its last version is deleted
+func (storage *Storage) ReadFile(filePath string) ([]byte, error) {
+	response, err := storage.request(http.MethodGet, storage.url("data", secretPath(filePath)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, &os.PathError{Op: "read", Path: filePath, Err: os.ErrNotExist}
+	}
+	defer response.Body.Close()
+	var secret struct {
+		Data struct {
+			Data map[string][]byte `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	if secret.Data.Data == nil {
+		return nil, &os.PathError{Op: "read", Path: filePath, Err: os.ErrNotExist}
+	}
+	value, ok := secret.Data.Data[valueField]
+	if !ok {
+		return nil, ErrInvalidSecret
+	}
+	return value, nil
+}
+
+// ReadPrivateKeyFile returns content of file with private key. Access to secrets is controlled by KV store
+func (storage *Storage) ReadPrivateKeyFile(filePath string) ([]byte, error) {
+	return storage.ReadFile(filePath)
+}
+
+// WriteFile creates new version of secret with content of file. perm is ignored
+func (storage *Storage) WriteFile(filePath string, data []byte, perm os.FileMode) error {
+	return storage.write(filePath, map[string]interface{}{"data": map[string][]byte{valueField: data}})
+}
+
+// CreateFile creates first version of secret with content of file using check-and-set with version 0, so KV store
+// rejects write if other instance created secret before. Returns error for which os.IsExist returns true in this case.
+// perm is ignored
+func (storage *Storage) CreateFile(filePath string, data []byte, perm os.FileMode) error {
+	body := map[string]interface{}{
+		"options": map[string]int{"cas": 0},
+		"data":    map[string][]byte{valueField: data},
+	}
+	err := storage.write(filePath, body)
+	if err == nil {
+		return nil
+	}
+	// KV store returns error on mismatch of check-and-set version, check that secret was created by other writer
+	if exists, existsErr := storage.Exists(filePath); existsErr == nil && exists {
+		return &os.PathError{Op: "create", Path: filePath, Err: os.ErrExist}
+	}
+	return err
+}
+
+// write sends body with data of secret and options of writing to KV store
+func (storage *Storage) write(filePath string, body map[string]interface{}) error {
+	response, err := storage.request(http.MethodPost, storage.url("data", secretPath(filePath)), body)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return fmt.Errorf("KV store doesn't have secrets engine mounted to %s", storage.mountPath)
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	return response.Body.Close()
+}
+
+// MkdirAll does nothing because KV store creates paths of secrets on writing
+func (storage *Storage) MkdirAll(filePath string, perm os.FileMode) error {
+	return nil
+}
+
+// ListFiles returns names of secrets stored in directory. Returns empty list if directory doesn't have secrets
+func (storage *Storage) ListFiles(directory string) ([]string, error) {
+	response, err := storage.request(http.MethodGet, storage.url("metadata", secretPath(directory))+"?list=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, nil
+	}
+	defer response.Body.Close()
+	var list struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(list.Data.Keys))
+	for _, key := range list.Data.Keys {
+		// keys of subdirectories end with slash
+		if !strings.HasSuffix(key, "/") {
+			files = append(files, key)
+		}
+	}
+	return files, nil
+}
+
+// Remove deletes all versions of secret with file. Directories don't exist in KV store so removing of directory
+// without secrets does nothing. Metadata is deleted deliberately: keystore removes only retired versions of keys
+// which should be destroyed, and secrets with soft deleted versions would be still listed by ListFiles
+func (storage *Storage) Remove(filePath string) error {
+	response, err := storage.request(http.MethodDelete, storage.url("metadata", secretPath(filePath)), nil)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	return response.Body.Close()
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cossacklabs/acra/keystore"
+	"github.com/cossacklabs/acra/keystore/filesystem"
+)
+
+const testToken = "test token"
+
+// testKVServer is in-memory stand-in of KV version 2 secrets engine mounted to "secret"
+type testKVServer struct {
+	lock    sync.Mutex
+	secrets map[string]map[string]interface{}
+}
+
+func (server *testKVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if r.Header.Get(TokenHeader) != testToken {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		secret := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := server.secrets[secret]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data, "metadata": map[string]interface{}{"version": 1}}})
+		case http.MethodPost, http.MethodPut:
+			var body struct {
+				Options map[string]int         `json:"options"`
+				Data    map[string]interface{} `json:"data"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if version, ok := body.Options["cas"]; ok && version == 0 && server.secrets[secret] != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+				return
+			}
+			server.secrets[secret] = body.Data
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/") && r.Method == http.MethodDelete:
+		secret := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		delete(server.secrets, secret)
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/") && r.URL.Query().Get("list") == "true":
+		directory := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		if directory != "" && !strings.HasSuffix(directory, "/") {
+			directory += "/"
+		}
+		keys := map[string]bool{}
+		for secret := range server.secrets {
+			if !strings.HasPrefix(secret, directory) {
+				continue
+			}
+			name := strings.TrimPrefix(secret, directory)
+			if index := strings.Index(name, "/"); index >= 0 {
+				name = name[:index+1]
+			}
+			keys[name] = true
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		list := []string{}
+		for key := range keys {
+			list = append(list, key)
+		}
+		sort.Strings(list)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": list}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestStorage(t *testing.T, token string) (*Storage, *httptest.Server) {
+	server := httptest.NewServer(&testKVServer{secrets: map[string]map[string]interface{}{}})
+	storage, err := NewStorage(server.URL, "/secret/", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, server
+}
+
+func TestStorage(t *testing.T) {
+	if _, err := NewStorage("127.0.0.1:8200", "secret", testToken, nil); err != ErrInvalidAddress {
+		t.Fatalf("Expected ErrInvalidAddress, took %v", err)
+	}
+	if _, err := NewStorage("http://127.0.0.1:8200", "/", testToken, nil); err != ErrEmptyMountPath {
+		t.Fatalf("Expected ErrEmptyMountPath, took %v", err)
+	}
+	storage, server := newTestStorage(t, testToken)
+	defer server.Close()
+
+	if _, err := storage.ReadFile("keys/client"); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error, took %v", err)
+	}
+	if exists, err := storage.Exists("keys/client"); err != nil || exists {
+		t.Fatalf("Expected not existing file, took %v, %v", exists, err)
+	}
+	data := []byte("encrypted key")
+	for _, filename := range []string{"./keys/client", "keys/client.pub", "keys/.poison_key/poison_key"} {
+		if err := storage.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exists, err := storage.Exists("/keys/client"); err != nil || !exists {
+		t.Fatalf("Expected existing file, took %v, %v", exists, err)
+	}
+	if err := storage.CreateFile("keys/client", []byte("other key"), 0600); !os.IsExist(err) {
+		t.Fatalf("Expected exist error on creation of existing file, took %v", err)
+	}
+	if err := storage.CreateFile("keys/new", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	readData, err := storage.ReadPrivateKeyFile("keys/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Fatal("Read data doesn't match written data")
+	}
+	files, err := storage.ListFiles("keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[0] != "client" || files[1] != "client.pub" || files[2] != "new" {
+		t.Fatalf("Incorrect list of files: %v", files)
+	}
+	if files, err := storage.ListFiles("other"); err != nil || len(files) != 0 {
+		t.Fatalf("Expected empty list of files, took %v, %v", files, err)
+	}
+	if err := storage.Remove("keys/client.pub"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := storage.Exists("keys/client.pub"); err != nil || exists {
+		t.Fatalf("Expected removed file, took %v, %v", exists, err)
+	}
+
+	invalidTokenStorage, err := NewStorage(server.URL, "secret", "invalid token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := invalidTokenStorage.ReadFile("keys/client"); err == nil || os.IsNotExist(err) {
+		t.Fatalf("Expected error on access with invalid token, took %v", err)
+	}
+}
+
+func TestFilesystemKeyStoreWithStorage(t *testing.T) {
+	storage, server := newTestStorage(t, testToken)
+	defer server.Close()
+	encryptor, err := keystore.NewSCellKeyEncryptor([]byte("some key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := filesystem.NewFilesystemKeyStoreWithStorage(".acrakeys", ".acrakeys", storage, encryptor, keystore.WithoutCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := []byte("client")
+	if err := store.GenerateDataEncryptionKeys(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetServerDecryptionPrivateKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetClientIDEncryptionPublicKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.GenerateHMACSecretKey(clientID); err != nil {
+		t.Fatal(err)
+	}
+	hmacKey, err := store.GetHMACSecretKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.VerifyMasterKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	// other instance shares keys through KV store
+	otherStore, err := filesystem.NewFilesystemKeyStoreWithStorage(".acrakeys", ".acrakeys", storage, encryptor, keystore.WithoutCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameHMACKey, err := otherStore.GetHMACSecretKey(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hmacKey, sameHMACKey) {
+		t.Fatal("Keystores with the same storage returned different keys")
+	}
+	if otherStore.HasZonePrivateKey([]byte("unknown zone")) {
+		t.Fatal("Unexpected zone key")
+	}
+}
@@ -55,8 +55,10 @@ const (
 	EventCodeErrorConnectionDroppedByTimeout = 539
 
 	// database
-	EventCodeErrorCantConnectToDB       = 540
-	EventCodeErrorCantCloseConnectionDB = 541
+	EventCodeErrorCantConnectToDB            = 540
+	EventCodeErrorCantCloseConnectionDB      = 541
+	EventCodeErrorUnknownDatabaseLogin       = 542
+	EventCodeErrorDatabaseBackendUnavailable = 543
 
 	// AcraWebconfig
 	EventCodeErrorCantReadTemplate        = 550
@@ -101,6 +103,12 @@ const (
 	// mysql processing
 	EventCodeErrorProtocolProcessing = 600
 
+	// limits of clients
+	EventCodeErrorClientLimitExceeded = 610
+
+	// audit log
+	EventCodeErrorCantWriteAuditLog = 620
+
 	// AcraTranslator
 	EventCodeErrorTranslatorCantHandleHTTPRequest       = 700
 	EventCodeErrorTranslatorMethodNotAllowed            = 701
@@ -116,6 +124,10 @@ const (
 	EventCodeErrorTranslatorCantWrapConnectionToSS      = 711
 	EventCodeErrorTranslatorCantAcceptNewHTTPConnection = 712
 	EventCodeErrorTranslatorCantHandleGRPCConnection    = 713
+	EventCodeErrorTranslatorCantTokenize                = 714
 
 	EventCodeErrorTracingCantSendTrace = 800
+
+	// encryptor
+	EventCodeErrorEncryptorCantEncryptQuery = 900
 )
@@ -0,0 +1,144 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package masking contains policies that hide decrypted values partially or fully from clients which shouldn't see
+// whole plaintext.
+package masking
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// Supported types of masking policies
+const (
+	// TypeShowLast shows last PlaintextLength characters and replaces other characters with Pattern
+	TypeShowLast = "show_last"
+	// TypeFixed replaces value with Pattern repeated Length times
+	TypeFixed = "fixed"
+	// TypeNull replaces value with NULL
+	TypeNull = "null"
+)
+
+// DefaultPattern used to replace hidden characters if Pattern isn't set
+const DefaultPattern = "*"
+
+// Errors returned on validation of masking policies
+var (
+	ErrUnknownMaskingType      = errors.New("unknown masking type")
+	ErrInvalidPlaintextLength  = errors.New("plaintext_length should be greater than 0")
+	ErrInvalidMaskLength       = errors.New("length should be greater than 0")
+	ErrDuplicatedMaskingPolicy = errors.New("masking policy defined several times for one client_id")
+)
+
+// Policy describes how decrypted value should be masked for client. Policy with empty ClientID applied to all
+// clients without own policy.
+type Policy struct {
+	ClientID        string `yaml:"client_id"`
+	Type            string `yaml:"type"`
+	PlaintextLength int    `yaml:"plaintext_length"`
+	Length          int    `yaml:"length"`
+	Pattern         string `yaml:"pattern"`
+}
+
+// Validate returns error if policy has unknown type or incorrect parameters for its type
+func (policy *Policy) Validate() error {
+	switch policy.Type {
+	case TypeShowLast:
+		if policy.PlaintextLength <= 0 {
+			return ErrInvalidPlaintextLength
+		}
+	case TypeFixed:
+		if policy.Length <= 0 {
+			return ErrInvalidMaskLength
+		}
+	case TypeNull:
+	default:
+		return ErrUnknownMaskingType
+	}
+	return nil
+}
+
+// IsNull returns true if value should be replaced with NULL instead of Mask
+func (policy *Policy) IsNull() bool {
+	return policy.Type == TypeNull
+}
+
+func (policy *Policy) pattern() []byte {
+	if policy.Pattern == "" {
+		return []byte(DefaultPattern)
+	}
+	return []byte(policy.Pattern)
+}
+
+// Mask returns masked value. Characters are counted as UTF-8 runes if value is valid UTF-8 string, otherwise as
+// bytes. Values not longer than PlaintextLength are hidden fully to not show them as is.
+func (policy *Policy) Mask(value []byte) []byte {
+	switch policy.Type {
+	case TypeShowLast:
+		length := len(value)
+		isText := utf8.Valid(value)
+		if isText {
+			length = utf8.RuneCount(value)
+		}
+		if length <= policy.PlaintextLength {
+			return bytes.Repeat(policy.pattern(), length)
+		}
+		hiddenCount := length - policy.PlaintextLength
+		plaintext := value[hiddenCount:]
+		if isText {
+			// skip bytes of hidden runes
+			plaintext = value
+			for i := 0; i < hiddenCount; i++ {
+				_, size := utf8.DecodeRune(plaintext)
+				plaintext = plaintext[size:]
+			}
+		}
+		return append(bytes.Repeat(policy.pattern(), hiddenCount), plaintext...)
+	case TypeFixed:
+		return bytes.Repeat(policy.pattern(), policy.Length)
+	}
+	return nil
+}
+
+// FindPolicy returns policy of client, policy for all clients or nil if value shouldn't be masked for client
+func FindPolicy(policies []*Policy, clientID []byte) *Policy {
+	var defaultPolicy *Policy
+	for _, policy := range policies {
+		if policy.ClientID == "" {
+			defaultPolicy = policy
+		} else if policy.ClientID == string(clientID) {
+			return policy
+		}
+	}
+	return defaultPolicy
+}
+
+// ValidatePolicies validates each policy and checks that client has only one policy
+func ValidatePolicies(policies []*Policy) error {
+	clientIDs := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		if clientIDs[policy.ClientID] {
+			return ErrDuplicatedMaskingPolicy
+		}
+		clientIDs[policy.ClientID] = true
+	}
+	return nil
+}
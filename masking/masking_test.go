@@ -0,0 +1,80 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package masking
+
+import (
+	"testing"
+)
+
+func TestPolicyMask(t *testing.T) {
+	testcases := []struct {
+		policy   *Policy
+		value    string
+		expected string
+	}{
+		{&Policy{Type: TypeShowLast, PlaintextLength: 4}, "4111111111111111", "************1111"},
+		{&Policy{Type: TypeShowLast, PlaintextLength: 2, Pattern: "#"}, "привет", "####ет"},
+		// short values are hidden fully
+		{&Policy{Type: TypeShowLast, PlaintextLength: 4}, "123", "***"},
+		{&Policy{Type: TypeFixed, Length: 5}, "secret value", "*****"},
+		{&Policy{Type: TypeFixed, Length: 2, Pattern: "xy"}, "secret value", "xyxy"},
+	}
+	for i, testcase := range testcases {
+		if err := testcase.policy.Validate(); err != nil {
+			t.Fatalf("%v. Unexpected validation error %v", i, err)
+		}
+		if result := testcase.policy.Mask([]byte(testcase.value)); string(result) != testcase.expected {
+			t.Fatalf("%v. Expected %v, took %v", i, testcase.expected, string(result))
+		}
+	}
+	if !(&Policy{Type: TypeNull}).IsNull() {
+		t.Fatal("Null policy should return true for IsNull")
+	}
+}
+
+func TestValidatePolicies(t *testing.T) {
+	testcases := []struct {
+		policies []*Policy
+		err      error
+	}{
+		{[]*Policy{{Type: "unknown"}}, ErrUnknownMaskingType},
+		{[]*Policy{{Type: TypeShowLast}}, ErrInvalidPlaintextLength},
+		{[]*Policy{{Type: TypeFixed}}, ErrInvalidMaskLength},
+		{[]*Policy{{Type: TypeNull, ClientID: "client"}, {Type: TypeNull, ClientID: "client"}}, ErrDuplicatedMaskingPolicy},
+		{[]*Policy{{Type: TypeNull, ClientID: "client"}, {Type: TypeNull}}, nil},
+	}
+	for i, testcase := range testcases {
+		if err := ValidatePolicies(testcase.policies); err != testcase.err {
+			t.Fatalf("%v. Expected %v, took %v", i, testcase.err, err)
+		}
+	}
+}
+
+func TestFindPolicy(t *testing.T) {
+	support := &Policy{ClientID: "support", Type: TypeShowLast, PlaintextLength: 4}
+	defaultPolicy := &Policy{Type: TypeNull}
+	if FindPolicy([]*Policy{support}, []byte("backend")) != nil {
+		t.Fatal("Client without policy should see values as is")
+	}
+	policies := []*Policy{defaultPolicy, support}
+	if FindPolicy(policies, []byte("support")) != support {
+		t.Fatal("Expected policy of client")
+	}
+	if FindPolicy(policies, []byte("backend")) != defaultPolicy {
+		t.Fatal("Expected default policy")
+	}
+}
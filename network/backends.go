@@ -0,0 +1,166 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossacklabs/acra/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Errors returned by BackendSet
+var (
+	ErrEmptyBackendSet = errors.New("list of database backends is empty")
+)
+
+// ParseBackendAddresses returns list of host:port addresses separated by commas
+func ParseBackendAddresses(value string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// BackendChecker verifies that database with host:port address accepts sessions and has role expected by backend set,
+// e.g. isn't read-only replica in list of primary databases
+type BackendChecker func(address string) error
+
+// BackendSet is ordered list of databases serving the same data. Connections are opened to the first healthy database
+// and next ones are used only if previous refuse connections
+type BackendSet struct {
+	lock      sync.RWMutex
+	addresses []string
+	healthy   []bool
+	checker   BackendChecker
+}
+
+// NewBackendSet returns set of databases with host:port addresses ordered by priority
+func NewBackendSet(addresses []string) (*BackendSet, error) {
+	if len(addresses) == 0 {
+		return nil, ErrEmptyBackendSet
+	}
+	healthy := make([]bool, len(addresses))
+	for i := range healthy {
+		healthy[i] = true
+	}
+	return &BackendSet{addresses: addresses, healthy: healthy}, nil
+}
+
+// Addresses returns addresses of all databases
+func (set *BackendSet) Addresses() []string {
+	return set.addresses
+}
+
+// SetChecker sets checker used by CheckHealth instead of opening tcp connections. Should be called before set is used
+func (set *BackendSet) SetChecker(checker BackendChecker) {
+	set.checker = checker
+}
+
+// setHealthy updates status of database and logs its changes
+func (set *BackendSet) setHealthy(index int, healthy bool, err error) {
+	set.lock.Lock()
+	changed := set.healthy[index] != healthy
+	set.healthy[index] = healthy
+	set.lock.Unlock()
+	if !changed {
+		return
+	}
+	logger := log.WithField("backend", set.addresses[index])
+	if healthy {
+		logger.Infoln("Database backend became available")
+	} else {
+		logger.WithError(err).WithField(logging.FieldKeyEventCode, logging.EventCodeErrorDatabaseBackendUnavailable).
+			Warningln("Database backend is unavailable")
+	}
+}
+
+// Dial connects to the first healthy database. Databases marked as unhealthy are tried last because they could become
+// available after last health check. Successful connection marks database as healthy only if set has no checker,
+// otherwise only checker may find out that database has expected role
+func (set *BackendSet) Dial() (net.Conn, error) {
+	set.lock.RLock()
+	order := make([]int, 0, len(set.addresses))
+	for i, healthy := range set.healthy {
+		if healthy {
+			order = append(order, i)
+		}
+	}
+	for i, healthy := range set.healthy {
+		if !healthy {
+			order = append(order, i)
+		}
+	}
+	set.lock.RUnlock()
+	var err error
+	for _, i := range order {
+		var connection net.Conn
+		connection, err = net.DialTimeout("tcp", set.addresses[i], DefaultNetworkTimeout)
+		if err != nil || set.checker == nil {
+			set.setHealthy(i, err == nil, err)
+		}
+		if err == nil {
+			return newSafeCloseConnection(connection), nil
+		}
+	}
+	return nil, err
+}
+
+// CheckHealth checks all databases with checker of set or connects to them if set has no checker and updates their
+// statuses
+func (set *BackendSet) CheckHealth() {
+	for i, address := range set.addresses {
+		var err error
+		if set.checker != nil {
+			err = set.checker(address)
+		} else {
+			var connection net.Conn
+			connection, err = net.DialTimeout("tcp", address, DefaultNetworkTimeout)
+			if err == nil {
+				connection.Close()
+			}
+		}
+		set.setHealthy(i, err == nil, err)
+	}
+}
+
+// RunHealthCheck checks health of databases with interval until context is done
+func (set *BackendSet) RunHealthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			set.CheckHealth()
+		}
+	}
+}
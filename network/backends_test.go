@@ -0,0 +1,122 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestBackendSetFailover(t *testing.T) {
+	stopped, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stoppedAddress := stopped.Addr().String()
+	stopped.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	addresses, err := ParseBackendAddresses(stoppedAddress + ", " + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends, err := NewBackendSet(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		connection, err := backends.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connection.RemoteAddr().String() != listener.Addr().String() {
+			t.Fatalf("Expected connection to available database, took %s", connection.RemoteAddr())
+		}
+		connection.Close()
+	}
+	if backends.healthy[0] || !backends.healthy[1] {
+		t.Fatalf("Incorrect health of backends %v", backends.healthy)
+	}
+
+	listener.Close()
+	backends.CheckHealth()
+	if backends.healthy[1] {
+		t.Fatal("Expected unhealthy backend after its listener was closed")
+	}
+	if _, err := backends.Dial(); err == nil {
+		t.Fatal("Expected error when all backends are unavailable")
+	}
+
+	if _, err := ParseBackendAddresses("host_without_port"); err == nil {
+		t.Fatal("Expected error for address without port")
+	}
+	if _, err := NewBackendSet(nil); err != ErrEmptyBackendSet {
+		t.Fatalf("Expected ErrEmptyBackendSet, took %v", err)
+	}
+}
+
+func TestBackendSetChecker(t *testing.T) {
+	var listeners []net.Listener
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		addresses = append(addresses, listener.Addr().String())
+	}
+	backends, err := NewBackendSet(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// first database accepts connections but is read-only replica
+	errReadOnly := errors.New("read-only database")
+	backends.SetChecker(func(address string) error {
+		if address == addresses[0] {
+			return errReadOnly
+		}
+		return nil
+	})
+	backends.CheckHealth()
+	if backends.healthy[0] || !backends.healthy[1] {
+		t.Fatalf("Incorrect health of backends %v", backends.healthy)
+	}
+	connection, err := backends.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	if connection.RemoteAddr().String() != addresses[1] {
+		t.Fatalf("Expected connection to database with expected role, took %s", connection.RemoteAddr())
+	}
+	listeners[1].Close()
+	other, err := backends.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if backends.healthy[0] {
+		t.Fatal("Database which failed check shouldn't become healthy after connection")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrConnectionListenerClosed returned by Accept of ConnectionListener after its connection was closed
+var ErrConnectionListenerClosed = errors.New("connection of listener closed")
+
+// ConnectionListener is listener that accepts only one already established connection. It allows to serve wrapped
+// connections with servers which work with listeners, for example with http.Server
+type ConnectionListener struct {
+	connection net.Conn
+	lock       sync.Mutex
+	accepted   bool
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewConnectionListener returns listener which Accept returns connection once and then blocks until connection or
+// listener is closed
+func NewConnectionListener(connection net.Conn) *ConnectionListener {
+	return &ConnectionListener{connection: connection, closed: make(chan struct{})}
+}
+
+// listenerConnection closes listener on closing of connection
+type listenerConnection struct {
+	net.Conn
+	listener *ConnectionListener
+}
+
+// Close connection and listener
+func (connection *listenerConnection) Close() error {
+	connection.listener.Close()
+	return connection.Conn.Close()
+}
+
+// Accept returns connection on first call and ErrConnectionListenerClosed after listener is closed
+func (listener *ConnectionListener) Accept() (net.Conn, error) {
+	listener.lock.Lock()
+	accepted := listener.accepted
+	listener.accepted = true
+	listener.lock.Unlock()
+	if !accepted {
+		return &listenerConnection{Conn: listener.connection, listener: listener}, nil
+	}
+	<-listener.closed
+	return nil, ErrConnectionListenerClosed
+}
+
+// Close stops accepting but doesn't close accepted connection
+func (listener *ConnectionListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+	return nil
+}
+
+// Addr returns local address of connection
+func (listener *ConnectionListener) Addr() net.Addr {
+	return listener.connection.LocalAddr()
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestConnectionListenerServesKeepAliveRequests(t *testing.T) {
+	clientConnection, serverConnection := net.Pipe()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})}
+	serveErr := make(chan error)
+	go func() {
+		serveErr <- server.Serve(NewConnectionListener(serverConnection))
+	}()
+
+	reader := bufio.NewReader(clientConnection)
+	for _, path := range []string{"/first", "/second"} {
+		request, err := http.NewRequest(http.MethodGet, "http://acra"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := request.Write(clientConnection); err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || string(body) != path {
+			t.Fatalf("Incorrect response %s, %v", body, err)
+		}
+	}
+	clientConnection.Close()
+	if err := <-serveErr; err != ErrConnectionListenerClosed {
+		t.Fatalf("Expected ErrConnectionListenerClosed, took %v", err)
+	}
+}
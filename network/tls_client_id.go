@@ -0,0 +1,157 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/cossacklabs/acra/keystore"
+	"gopkg.in/yaml.v2"
+)
+
+// Sources of client ID in peer's certificate
+const (
+	ClientIDFromCommonName  = "cn"
+	ClientIDFromSAN         = "san"
+	ClientIDFromFingerprint = "fingerprint"
+)
+
+// Errors returned by TLSClientIDExtractor
+var (
+	ErrUnknownClientIDSource       = errors.New("unknown source of client ID in certificate")
+	ErrEmptyFingerprintMapping     = errors.New("fingerprint to client ID mapping file not set")
+	ErrNoVerifiedClientCertificate = errors.New("client didn't provide verified certificate")
+	ErrClientIDNotFound            = errors.New("client ID not found in certificate")
+	ErrInvalidCertificateClientID  = errors.New("client ID from certificate is invalid")
+)
+
+// TLSClientIDExtractor returns client ID of peer that presented certificate
+type TLSClientIDExtractor interface {
+	ExtractClientID(certificate *x509.Certificate) ([]byte, error)
+}
+
+// NewTLSClientIDExtractor returns extractor of client ID from source: ClientIDFromCommonName, ClientIDFromSAN or
+// ClientIDFromFingerprint. mappingPath is path to yaml file with "<sha256 fingerprint>: <client ID>" pairs and used
+// only with ClientIDFromFingerprint
+func NewTLSClientIDExtractor(source, mappingPath string) (TLSClientIDExtractor, error) {
+	switch source {
+	case ClientIDFromCommonName:
+		return commonNameExtractor{}, nil
+	case ClientIDFromSAN:
+		return sanExtractor{}, nil
+	case ClientIDFromFingerprint:
+		if mappingPath == "" {
+			return nil, ErrEmptyFingerprintMapping
+		}
+		data, err := ioutil.ReadFile(mappingPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewFingerprintExtractor(data)
+	}
+	return nil, ErrUnknownClientIDSource
+}
+
+// commonNameExtractor uses subject's common name as client ID
+type commonNameExtractor struct{}
+
+// ExtractClientID returns subject's CN
+func (commonNameExtractor) ExtractClientID(certificate *x509.Certificate) ([]byte, error) {
+	return validateCertificateClientID(certificate.Subject.CommonName)
+}
+
+// sanExtractor uses first subject alternative name as client ID
+type sanExtractor struct{}
+
+// ExtractClientID returns first DNS name, email address or URI from SAN extension
+func (sanExtractor) ExtractClientID(certificate *x509.Certificate) ([]byte, error) {
+	switch {
+	case len(certificate.DNSNames) > 0:
+		return validateCertificateClientID(certificate.DNSNames[0])
+	case len(certificate.EmailAddresses) > 0:
+		return validateCertificateClientID(certificate.EmailAddresses[0])
+	case len(certificate.URIs) > 0:
+		return validateCertificateClientID(certificate.URIs[0].String())
+	}
+	return nil, ErrClientIDNotFound
+}
+
+// FingerprintExtractor maps SHA256 fingerprints of certificates to client IDs
+type FingerprintExtractor struct {
+	clientIDs map[string][]byte
+}
+
+// NewFingerprintExtractor returns extractor with mapping loaded from yaml config. Fingerprints are hex encoded and may
+// be separated by colons as openssl prints them
+func NewFingerprintExtractor(config []byte) (*FingerprintExtractor, error) {
+	mapping := make(map[string]string)
+	if err := yaml.Unmarshal(config, &mapping); err != nil {
+		return nil, err
+	}
+	extractor := &FingerprintExtractor{clientIDs: make(map[string][]byte, len(mapping))}
+	for fingerprint, clientID := range mapping {
+		if !keystore.ValidateID([]byte(clientID)) {
+			return nil, ErrInvalidCertificateClientID
+		}
+		extractor.clientIDs[normalizeFingerprint(fingerprint)] = []byte(clientID)
+	}
+	return extractor, nil
+}
+
+// ExtractClientID returns client ID mapped to certificate's fingerprint
+func (extractor *FingerprintExtractor) ExtractClientID(certificate *x509.Certificate) ([]byte, error) {
+	clientID, ok := extractor.clientIDs[CertificateFingerprint(certificate)]
+	if !ok {
+		return nil, ErrClientIDNotFound
+	}
+	return clientID, nil
+}
+
+// CertificateFingerprint returns hex encoded SHA256 hash of certificate
+func CertificateFingerprint(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+}
+
+func validateCertificateClientID(clientID string) ([]byte, error) {
+	if clientID == "" {
+		return nil, ErrClientIDNotFound
+	}
+	if !keystore.ValidateID([]byte(clientID)) {
+		return nil, ErrInvalidCertificateClientID
+	}
+	return []byte(clientID), nil
+}
+
+// clientIDFromConnection returns client ID of peer's certificate verified during handshake
+func clientIDFromConnection(connection *tls.Conn, extractor TLSClientIDExtractor) ([]byte, error) {
+	state := connection.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, ErrNoVerifiedClientCertificate
+	}
+	return extractor.ExtractClientID(state.VerifiedChains[0][0])
+}
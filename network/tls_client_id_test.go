@@ -0,0 +1,174 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns certificate signed by parent or self-signed certificate if parent is nil
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCertificate, parentKey := template, interface{}(key)
+	if parent != nil {
+		parentCertificate, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSClientIDExtractors(t *testing.T) {
+	certificate := newTestCertificate(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "cn_client"},
+		DNSNames:       []string{"san-client"},
+		EmailAddresses: []string{"client@example.com"},
+	}, nil).Leaf
+
+	for source, expected := range map[string]string{ClientIDFromCommonName: "cn_client", ClientIDFromSAN: "san-client"} {
+		extractor, err := NewTLSClientIDExtractor(source, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientID, err := extractor.ExtractClientID(certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(clientID) != expected {
+			t.Fatalf("Expected %s, took %s", expected, clientID)
+		}
+	}
+	// email isn't valid client ID
+	certificate.DNSNames = nil
+	if _, err := (sanExtractor{}).ExtractClientID(certificate); err != ErrInvalidCertificateClientID {
+		t.Fatalf("Expected ErrInvalidCertificateClientID, took %v", err)
+	}
+	if _, err := NewTLSClientIDExtractor(ClientIDFromFingerprint, ""); err != ErrEmptyFingerprintMapping {
+		t.Fatalf("Expected ErrEmptyFingerprintMapping, took %v", err)
+	}
+	if _, err := NewTLSClientIDExtractor("subject", ""); err != ErrUnknownClientIDSource {
+		t.Fatalf("Expected ErrUnknownClientIDSource, took %v", err)
+	}
+
+	// fingerprints printed by openssl are accepted
+	fingerprint := CertificateFingerprint(certificate)
+	opensslFingerprint := ""
+	for i := 0; i < len(fingerprint); i += 2 {
+		if i > 0 {
+			opensslFingerprint += ":"
+		}
+		opensslFingerprint += string(bytes.ToUpper([]byte(fingerprint[i : i+2])))
+	}
+	extractor, err := NewFingerprintExtractor([]byte(`"` + opensslFingerprint + `": fingerprint_client`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, err := extractor.ExtractClientID(certificate)
+	if err != nil || string(clientID) != "fingerprint_client" {
+		t.Fatalf("Incorrect client ID %s, %v", clientID, err)
+	}
+	otherCertificate := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}, nil).Leaf
+	if _, err := extractor.ExtractClientID(otherCertificate); err != ErrClientIDNotFound {
+		t.Fatalf("Expected ErrClientIDNotFound, took %v", err)
+	}
+	if _, err := NewFingerprintExtractor([]byte(fingerprint + ": invalid.client")); err != ErrInvalidCertificateClientID {
+		t.Fatalf("Expected ErrInvalidCertificateClientID, took %v", err)
+	}
+}
+
+func TestTLSWrapperClientIDFromCertificate(t *testing.T) {
+	ca := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		DNSNames:    []string{"server"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "service_client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	serverWrapper, err := NewTLSConnectionWrapperWithClientIDExtractor(commonNameExtractor{}, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    roots,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, certificates := range [][]tls.Certificate{{client}, nil} {
+		clientWrapper, err := NewTLSConnectionWrapper(nil, &tls.Config{
+			Certificates: certificates,
+			RootCAs:      roots,
+			ServerName:   "server",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConnection, serverConnection := net.Pipe()
+		go func() {
+			if connection, err := clientWrapper.WrapClient(context.TODO(), nil, clientConnection); err == nil {
+				connection.Close()
+			}
+		}()
+		_, clientID, err := serverWrapper.WrapServer(context.TODO(), serverConnection)
+		serverConnection.Close()
+		if certificates == nil {
+			if err != ErrNoVerifiedClientCertificate {
+				t.Fatalf("Expected ErrNoVerifiedClientCertificate, took %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(clientID) != "service_client" {
+			t.Fatalf("Expected client ID from certificate, took %s", clientID)
+		}
+	}
+}
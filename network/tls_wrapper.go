@@ -40,8 +40,9 @@ var allowedCipherSuits = []uint16{
 
 // TLSConnectionWrapper for wrapping connection into TLS encryption
 type TLSConnectionWrapper struct {
-	config   *tls.Config
-	clientID []byte
+	config            *tls.Config
+	clientID          []byte
+	clientIDExtractor TLSClientIDExtractor
 }
 
 // ErrEmptyTLSConfig if not TLS config found
@@ -52,6 +53,12 @@ func NewTLSConnectionWrapper(clientID []byte, config *tls.Config) (*TLSConnectio
 	return &TLSConnectionWrapper{config: config, clientID: clientID}, nil
 }
 
+// NewTLSConnectionWrapperWithClientIDExtractor returns new TLSConnectionWrapper which takes client ID from verified
+// certificate of client instead of static client ID
+func NewTLSConnectionWrapperWithClientIDExtractor(extractor TLSClientIDExtractor, config *tls.Config) (*TLSConnectionWrapper, error) {
+	return &TLSConnectionWrapper{config: config, clientIDExtractor: extractor}, nil
+}
+
 // WrapClient wraps client connection into TLS
 func (wrapper *TLSConnectionWrapper) WrapClient(ctx context.Context, id []byte, conn net.Conn) (net.Conn, error) {
 	conn.SetDeadline(time.Now().Add(DefaultNetworkTimeout))
@@ -75,6 +82,13 @@ func (wrapper *TLSConnectionWrapper) WrapServer(ctx context.Context, conn net.Co
 		return conn, nil, err
 	}
 	conn.SetDeadline(time.Time{})
+	if wrapper.clientIDExtractor != nil {
+		clientID, err := clientIDFromConnection(tlsConn, wrapper.clientIDExtractor)
+		if err != nil {
+			return conn, nil, err
+		}
+		return newSafeCloseConnection(tlsConn), clientID, nil
+	}
 	return newSafeCloseConnection(tlsConn), wrapper.clientID, nil
 }
 
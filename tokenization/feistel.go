@@ -0,0 +1,138 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tokenization
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+// feistelRounds count of rounds of Feistel network
+const feistelRounds = 10
+
+// minFeistelDomain is minimal count of values which may be permuted by cipher. Permutations of smaller domains may be
+// recovered by enumeration of all values, NIST SP 800-38G requires the same minimum for FF1 and FF3-1
+const minFeistelDomain = 1000000
+
+// feistelCipher is format-preserving cipher of strings of digits in some radix, so output has the same length and
+// radix as input. It's custom scheme: unbalanced Feistel network with modular addition of halves like in FF1 but with
+// HMAC-SHA256 of key, tweak, round number and half as round function. It isn't compatible with FF1 and isn't
+// validated against its test vectors.
+type feistelCipher struct {
+	key   []byte
+	radix int
+	// tweak separates permutations of different token types that use the same key
+	tweak []byte
+}
+
+func newFeistelCipher(key []byte, radix int, tweak string) *feistelCipher {
+	return &feistelCipher{key: key, radix: radix, tweak: []byte(tweak)}
+}
+
+// digitsToNumber returns number represented by digits with most significant digit first
+func (cipher *feistelCipher) digitsToNumber(digits []int) *big.Int {
+	number := new(big.Int)
+	radix := big.NewInt(int64(cipher.radix))
+	for _, digit := range digits {
+		number.Mul(number, radix)
+		number.Add(number, big.NewInt(int64(digit)))
+	}
+	return number
+}
+
+// numberToDigits returns length digits of number with most significant digit first
+func (cipher *feistelCipher) numberToDigits(number *big.Int, length int) []int {
+	digits := make([]int, length)
+	number = new(big.Int).Set(number)
+	radix := big.NewInt(int64(cipher.radix))
+	digit := new(big.Int)
+	for i := length - 1; i >= 0; i-- {
+		number.DivMod(number, radix, digit)
+		digits[i] = int(digit.Int64())
+	}
+	return digits
+}
+
+// validDomain returns true if count of strings with length digits isn't less than minFeistelDomain
+func (cipher *feistelCipher) validDomain(length int) bool {
+	return cipher.modulus(length).Cmp(big.NewInt(minFeistelDomain)) >= 0
+}
+
+// modulus returns radix^length
+func (cipher *feistelCipher) modulus(length int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(int64(cipher.radix)), big.NewInt(int64(length)), nil)
+}
+
+// roundValue returns pseudorandom number calculated from round number, total length and half of data
+func (cipher *feistelCipher) roundValue(round, length int, half []int) *big.Int {
+	mac := hmac.New(sha256.New, cipher.key)
+	mac.Write(cipher.tweak)
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header, uint32(round))
+	binary.BigEndian.PutUint32(header[4:], uint32(cipher.radix))
+	binary.BigEndian.PutUint32(header[8:], uint32(length))
+	mac.Write(header)
+	digitBuf := make([]byte, 4)
+	for _, digit := range half {
+		binary.BigEndian.PutUint32(digitBuf, uint32(digit))
+		mac.Write(digitBuf)
+	}
+	return new(big.Int).SetBytes(mac.Sum(nil))
+}
+
+// roundLength returns length of half that changed in round
+func roundLength(round, leftLength, rightLength int) int {
+	if round%2 == 0 {
+		return leftLength
+	}
+	return rightLength
+}
+
+// Encrypt returns permutation of digits with the same length
+func (cipher *feistelCipher) Encrypt(digits []int) []int {
+	length := len(digits)
+	leftLength := length / 2
+	rightLength := length - leftLength
+	left, right := digits[:leftLength], digits[leftLength:]
+	for round := 0; round < feistelRounds; round++ {
+		changedLength := roundLength(round, leftLength, rightLength)
+		number := cipher.digitsToNumber(left)
+		number.Add(number, cipher.roundValue(round, length, right))
+		number.Mod(number, cipher.modulus(changedLength))
+		left, right = right, cipher.numberToDigits(number, changedLength)
+	}
+	return append(append([]int{}, left...), right...)
+}
+
+// Decrypt returns digits which permutation is passed digits
+func (cipher *feistelCipher) Decrypt(digits []int) []int {
+	length := len(digits)
+	leftLength := length / 2
+	rightLength := length - leftLength
+	// after even count of rounds halves have the same lengths as at start
+	left, right := digits[:leftLength], digits[leftLength:]
+	for round := feistelRounds - 1; round >= 0; round-- {
+		changedLength := roundLength(round, leftLength, rightLength)
+		number := cipher.digitsToNumber(right)
+		number.Sub(number, cipher.roundValue(round, length, left))
+		number.Mod(number, cipher.modulus(changedLength))
+		left, right = cipher.numberToDigits(number, changedLength), left
+	}
+	return append(append([]int{}, left...), right...)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tokenization replaces values with tokens that have the same type and format as original values, so they
+// can be stored in columns which types can't hold binary AcraStructs. Tokens are calculated deterministically with
+// format-preserving encryption using keys from keystore, so equal values have equal tokens and original values
+// can be restored from tokens without any storage of tokens.
+package tokenization
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/cossacklabs/acra/keystore"
+)
+
+// Supported types of tokens
+const (
+	// TypeInt32 token is 32-bit signed integer in decimal text format
+	TypeInt32 = "int32"
+	// TypeInt64 token is 64-bit signed integer in decimal text format
+	TypeInt64 = "int64"
+	// TypeString token has the same length as value, only latin letters and digits are replaced. Value should contain
+	// at least 4 latin letters or digits
+	TypeString = "string"
+	// TypeEmail token has the same format as email, top level domain isn't changed. Local part and domain without
+	// top level domain should contain at least 4 latin letters or digits
+	TypeEmail = "email"
+)
+
+// Errors returned by tokenization
+var (
+	ErrUnknownTokenType    = errors.New("unknown token type")
+	ErrInvalidIntegerValue = errors.New("value isn't integer of token type size")
+	ErrInvalidEmailValue   = errors.New("value isn't email")
+	ErrTooShortValue       = errors.New("value has too few characters to be tokenized securely")
+)
+
+// stringAlphabet contains characters replaced in string and email tokens, other characters are left as is
+const stringAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ValidateTokenType returns ErrUnknownTokenType if tokenType isn't supported
+func ValidateTokenType(tokenType string) error {
+	switch tokenType {
+	case TypeInt32, TypeInt64, TypeString, TypeEmail:
+		return nil
+	}
+	return ErrUnknownTokenType
+}
+
+// Tokenizer replaces values with tokens and restores values from tokens with keys of clientID or zoneID.
+type Tokenizer interface {
+	Tokenize(data []byte, tokenType string, id []byte) ([]byte, error)
+	Detokenize(token []byte, tokenType string, id []byte) ([]byte, error)
+}
+
+// KeystoreTokenizer tokenizes values with keys from keystore.
+type KeystoreTokenizer struct {
+	keystore keystore.TokenKeyStore
+}
+
+// NewKeystoreTokenizer returns new KeystoreTokenizer that uses keystore to fetch tokenization keys.
+func NewKeystoreTokenizer(keystore keystore.TokenKeyStore) *KeystoreTokenizer {
+	return &KeystoreTokenizer{keystore: keystore}
+}
+
+// Tokenize returns token of data with type tokenType
+func (tokenizer *KeystoreTokenizer) Tokenize(data []byte, tokenType string, id []byte) ([]byte, error) {
+	return tokenizer.process(data, tokenType, id, true)
+}
+
+// Detokenize returns original value of token with type tokenType
+func (tokenizer *KeystoreTokenizer) Detokenize(token []byte, tokenType string, id []byte) ([]byte, error) {
+	return tokenizer.process(token, tokenType, id, false)
+}
+
+func (tokenizer *KeystoreTokenizer) process(data []byte, tokenType string, id []byte, tokenize bool) ([]byte, error) {
+	if err := ValidateTokenType(tokenType); err != nil {
+		return nil, err
+	}
+	key, err := tokenizer.keystore.GetTokenizationKey(id)
+	if err != nil {
+		return nil, err
+	}
+	switch tokenType {
+	case TypeInt32:
+		return processInteger(newFeistelCipher(key, 2, tokenType), data, 32, tokenize)
+	case TypeInt64:
+		return processInteger(newFeistelCipher(key, 2, tokenType), data, 64, tokenize)
+	case TypeString:
+		return processString(newFeistelCipher(key, len(stringAlphabet), tokenType), data, tokenize)
+	default:
+		return processEmail(newFeistelCipher(key, len(stringAlphabet), tokenType), data, tokenize)
+	}
+}
+
+// applyCipher encrypts or decrypts digits
+func applyCipher(cipher *feistelCipher, digits []int, encrypt bool) []int {
+	if encrypt {
+		return cipher.Encrypt(digits)
+	}
+	return cipher.Decrypt(digits)
+}
+
+// processInteger permutes bits of integer in two's complement form so result stays in range of integer type
+func processInteger(cipher *feistelCipher, data []byte, bitSize int, encrypt bool) ([]byte, error) {
+	value, err := strconv.ParseInt(string(data), 10, bitSize)
+	if err != nil {
+		return nil, ErrInvalidIntegerValue
+	}
+	bits := make([]int, bitSize)
+	unsignedValue := uint64(value)
+	for i := range bits {
+		bits[bitSize-1-i] = int(unsignedValue >> uint(i) & 1)
+	}
+	bits = applyCipher(cipher, bits, encrypt)
+	unsignedValue = 0
+	for _, bit := range bits {
+		unsignedValue = unsignedValue<<1 | uint64(bit)
+	}
+	if bitSize == 32 {
+		return []byte(strconv.FormatInt(int64(int32(uint32(unsignedValue))), 10)), nil
+	}
+	return []byte(strconv.FormatInt(int64(unsignedValue), 10)), nil
+}
+
+// processString permutes latin letters and digits of data and leaves other bytes on their places. Returns
+// ErrTooShortValue if data has too few letters and digits for secure permutation
+func processString(cipher *feistelCipher, data []byte, encrypt bool) ([]byte, error) {
+	var positions []int
+	var digits []int
+	for i, c := range data {
+		if digit := bytes.IndexByte([]byte(stringAlphabet), c); digit != -1 {
+			positions = append(positions, i)
+			digits = append(digits, digit)
+		}
+	}
+	if !cipher.validDomain(len(digits)) {
+		return nil, ErrTooShortValue
+	}
+	output := append([]byte{}, data...)
+	for i, digit := range applyCipher(cipher, digits, encrypt) {
+		output[positions[i]] = stringAlphabet[digit]
+	}
+	return output, nil
+}
+
+// processEmail permutes characters of local part and domain without top level domain together, so short parts
+// don't make small domain of permutation
+func processEmail(cipher *feistelCipher, data []byte, encrypt bool) ([]byte, error) {
+	at := bytes.LastIndexByte(data, '@')
+	if at < 1 || at == len(data)-1 {
+		return nil, ErrInvalidEmailValue
+	}
+	domain := data[at+1:]
+	domainEnd := bytes.LastIndexByte(domain, '.')
+	if domainEnd < 1 {
+		domainEnd = len(domain)
+	}
+	// '@' isn't in alphabet and stays on its place
+	output, err := processString(cipher, data[:at+1+domainEnd], encrypt)
+	if err != nil {
+		return nil, err
+	}
+	return append(output, domain[domainEnd:]...), nil
+}
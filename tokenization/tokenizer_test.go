@@ -0,0 +1,99 @@
+/*
+Copyright 2018, Cossack Labs Limited
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tokenization
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+type testKeystore struct{}
+
+func (*testKeystore) GetTokenizationKey(id []byte) ([]byte, error) {
+	return append([]byte("tokenization key of "), id...), nil
+}
+
+func TestKeystoreTokenizer(t *testing.T) {
+	tokenizer := NewKeystoreTokenizer(&testKeystore{})
+	testcases := []struct {
+		tokenType string
+		value     string
+		format    *regexp.Regexp
+	}{
+		{TypeInt32, "-2147483648", regexp.MustCompile(`^-?\d+$`)},
+		{TypeInt32, "12345", regexp.MustCompile(`^-?\d+$`)},
+		{TypeInt64, "9223372036854775807", regexp.MustCompile(`^-?\d+$`)},
+		{TypeString, "card 4111-1111-1111-1111", regexp.MustCompile(`^[0-9a-zA-Z]{4} [0-9a-zA-Z]{4}-[0-9a-zA-Z]{4}-[0-9a-zA-Z]{4}-[0-9a-zA-Z]{4}$`)},
+		{TypeString, "a-b-c-d", regexp.MustCompile(`^[0-9a-zA-Z]-[0-9a-zA-Z]-[0-9a-zA-Z]-[0-9a-zA-Z]$`)},
+		{TypeEmail, "jo@ex.io", regexp.MustCompile(`^[0-9a-zA-Z]{2}@[0-9a-zA-Z]{2}\.io$`)},
+		{TypeEmail, "john.doe@example.com", regexp.MustCompile(`^[0-9a-zA-Z]{4}\.[0-9a-zA-Z]{3}@[0-9a-zA-Z]{7}\.com$`)},
+	}
+	for i, testcase := range testcases {
+		token, err := tokenizer.Tokenize([]byte(testcase.value), testcase.tokenType, []byte("client"))
+		if err != nil {
+			t.Fatalf("%v. Unexpected error %v", i, err)
+		}
+		if !testcase.format.Match(token) {
+			t.Fatalf("%v. Token %s has incorrect format", i, token)
+		}
+		if bytes.Equal(token, []byte(testcase.value)) {
+			t.Fatalf("%v. Token equal to value", i)
+		}
+		sameToken, err := tokenizer.Tokenize([]byte(testcase.value), testcase.tokenType, []byte("client"))
+		if err != nil || !bytes.Equal(token, sameToken) {
+			t.Fatalf("%v. Tokenization isn't deterministic", i)
+		}
+		anotherToken, err := tokenizer.Tokenize([]byte(testcase.value), testcase.tokenType, []byte("another client"))
+		if err != nil || bytes.Equal(token, anotherToken) {
+			t.Fatalf("%v. Tokens of different clients should differ", i)
+		}
+		value, err := tokenizer.Detokenize(token, testcase.tokenType, []byte("client"))
+		if err != nil {
+			t.Fatalf("%v. Unexpected error %v", i, err)
+		}
+		if string(value) != testcase.value {
+			t.Fatalf("%v. Expected %v, took %s", i, testcase.value, value)
+		}
+	}
+	token, err := tokenizer.Tokenize([]byte("1"), TypeInt32, []byte("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strconv.ParseInt(string(token), 10, 32); err != nil {
+		t.Fatal("Token of int32 out of range")
+	}
+
+	if _, err := tokenizer.Tokenize([]byte("2147483648"), TypeInt32, []byte("client")); err != ErrInvalidIntegerValue {
+		t.Fatalf("Expected ErrInvalidIntegerValue, took %v", err)
+	}
+	if _, err := tokenizer.Tokenize([]byte("example.com"), TypeEmail, []byte("client")); err != ErrInvalidEmailValue {
+		t.Fatalf("Expected ErrInvalidEmailValue, took %v", err)
+	}
+	for _, value := range []string{"x", "abc", "a-b-c", "---"} {
+		if _, err := tokenizer.Tokenize([]byte(value), TypeString, []byte("client")); err != ErrTooShortValue {
+			t.Fatalf("Expected ErrTooShortValue for %s, took %v", value, err)
+		}
+	}
+	if _, err := tokenizer.Tokenize([]byte("a@b.com"), TypeEmail, []byte("client")); err != ErrTooShortValue {
+		t.Fatalf("Expected ErrTooShortValue for short email, took %v", err)
+	}
+	if _, err := tokenizer.Tokenize([]byte("value"), "unknown", []byte("client")); err != ErrUnknownTokenType {
+		t.Fatalf("Expected ErrUnknownTokenType, took %v", err)
+	}
+}
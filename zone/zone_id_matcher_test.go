@@ -53,6 +53,21 @@ func (storage *TestKeyStore) HasZonePrivateKey(id []byte) bool { return true }
 func (storage *TestKeyStore) GetPeerPublicKey(id []byte) (*keys.PublicKey, error) {
 	return &keys.PublicKey{Value: []byte{}}, nil
 }
+func (storage *TestKeyStore) GetClientIDEncryptionPublicKey(clientID []byte) (*keys.PublicKey, error) {
+	return &keys.PublicKey{Value: []byte{}}, nil
+}
+func (storage *TestKeyStore) GetZonePublicKey(zoneID []byte) (*keys.PublicKey, error) {
+	return &keys.PublicKey{Value: []byte{}}, nil
+}
+func (storage *TestKeyStore) GetHMACSecretKey(id []byte) ([]byte, error) {
+	return nil, nil
+}
+func (storage *TestKeyStore) GetTokenizationKey(id []byte) ([]byte, error) {
+	return nil, nil
+}
+func (storage *TestKeyStore) GetAuditLogKey() ([]byte, error) {
+	return nil, nil
+}
 func (storage *TestKeyStore) GetPrivateKey(id []byte) (*keys.PrivateKey, error) {
 	return &keys.PrivateKey{Value: []byte{}}, nil
 }
@@ -66,6 +81,12 @@ func (storage *TestKeyStore) GenerateDataEncryptionKeys(id []byte) error { retur
 func (storage *TestKeyStore) GetServerDecryptionPrivateKey(id []byte) (*keys.PrivateKey, error) {
 	return nil, nil
 }
+func (storage *TestKeyStore) GetZonePrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return []*keys.PrivateKey{{Value: []byte{}}}, nil
+}
+func (storage *TestKeyStore) GetServerDecryptionPrivateKeys(id []byte) ([]*keys.PrivateKey, error) {
+	return nil, nil
+}
 func (keystore *TestKeyStore) GetAuthKey(remove bool) ([]byte, error) {
 	return nil, nil
 }